@@ -0,0 +1,125 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+)
+
+const (
+	budgetInitialBackoff = 500 * time.Millisecond
+	budgetMaxBackoff     = 30 * time.Second
+)
+
+const (
+	errBudgetExhausted  = "startup retry budget of %s exhausted, last failing step: %s"
+	errRetriesExhausted = "%s failed %d times: %s"
+)
+
+// retryBudget is a time budget shared by all retried startup operations, so
+// that the total time spent retrying during startup is bounded regardless of
+// how many operations fail.
+type retryBudget struct {
+	log      logging.Logger
+	total    time.Duration
+	deadline time.Time
+
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// newRetryBudget returns a retryBudget of the given total duration, starting
+// now. Operations are not retried with a zero budget.
+func newRetryBudget(total time.Duration, log logging.Logger) *retryBudget {
+	return &retryBudget{
+		log:            log,
+		total:          total,
+		deadline:       time.Now().Add(total),
+		initialBackoff: budgetInitialBackoff,
+		maxBackoff:     budgetMaxBackoff,
+		now:            time.Now,
+		sleep:          time.Sleep,
+	}
+}
+
+// Do calls fn until it succeeds, backing off exponentially between attempts
+// and drawing the waits from the remaining budget. It returns the last error
+// of fn, naming the given step, once the budget is exhausted.
+func (b *retryBudget) Do(step string, fn func() error) error {
+	wait := b.initialBackoff
+	for {
+		err := fn()
+		if err == nil || b.total == 0 {
+			return err
+		}
+		remaining := b.deadline.Sub(b.now())
+		if remaining <= 0 {
+			return errors.Wrapf(err, errBudgetExhausted, b.total, step)
+		}
+		if wait > remaining {
+			wait = remaining
+		}
+		b.log.Info("startup step failed, retrying", "step", step, "error", err, "retry-in", wait.String(), "budget-remaining", remaining.String())
+		b.sleep(wait)
+		wait *= 2
+		if wait > b.maxBackoff {
+			wait = b.maxBackoff
+		}
+	}
+}
+
+// DoRetries calls fn like Do, but only retries it up to the given number of
+// times, regardless of whether there is a budget. Once the retries or the
+// budget are used up, it returns the errors of all attempts.
+func (b *retryBudget) DoRetries(step string, retries int, fn func() error) error {
+	wait := b.initialBackoff
+	var errs []string
+	failed := func() error {
+		return errors.Errorf(errRetriesExhausted, step, len(errs), strings.Join(errs, "; "))
+	}
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err.Error())
+		if len(errs) > retries {
+			return failed()
+		}
+		if b.total > 0 {
+			remaining := b.deadline.Sub(b.now())
+			if remaining <= 0 {
+				return errors.Wrapf(failed(), errBudgetExhausted, b.total, step)
+			}
+			if wait > remaining {
+				wait = remaining
+			}
+		}
+		b.log.Info("startup step failed, retrying", "step", step, "error", err, "attempt", len(errs), "retry-in", wait.String())
+		b.sleep(wait)
+		wait *= 2
+		if wait > b.maxBackoff {
+			wait = b.maxBackoff
+		}
+	}
+}
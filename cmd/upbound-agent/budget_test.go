@@ -0,0 +1,174 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	"github.com/crossplane/crossplane-runtime/pkg/test"
+)
+
+// fakeClockBudget returns a retryBudget whose clock only advances when it
+// sleeps.
+func fakeClockBudget(total time.Duration) *retryBudget {
+	now := time.Unix(0, 0)
+	b := newRetryBudget(total, logging.NewNopLogger())
+	b.deadline = now.Add(total)
+	b.now = func() time.Time { return now }
+	b.sleep = func(d time.Duration) { now = now.Add(d) }
+	return b
+}
+
+// failing returns a step that fails the given number of times before
+// succeeding, counting its calls.
+func failing(times int, err error, calls *int) func() error {
+	return func() error {
+		*calls++
+		if *calls <= times {
+			return err
+		}
+		return nil
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	errBoom := errors.New("boom")
+
+	type step struct {
+		name     string
+		failures int
+	}
+	type want struct {
+		err   error
+		calls []int
+	}
+	cases := map[string]struct {
+		reason string
+		budget time.Duration
+		steps  []step
+		want
+	}{
+		"NoBudget": {
+			reason: "Steps should not be retried without a budget.",
+			steps:  []step{{name: "certs", failures: 1}},
+			want: want{
+				err:   errBoom,
+				calls: []int{1},
+			},
+		},
+		"AllStepsRecover": {
+			reason: "Steps that recover within the budget should succeed.",
+			budget: time.Minute,
+			steps:  []step{{name: "certs", failures: 2}, {name: "kube", failures: 1}, {name: "nats", failures: 0}},
+			want: want{
+				calls: []int{3, 2, 1},
+			},
+		},
+		"ExhaustedAcrossSteps": {
+			reason: "Retries of earlier steps should draw from the budget available to later steps.",
+			// certs waits 0.5s+1s+2s+4s = 7.5s before succeeding, leaving 2.5s
+			// for kube that waits 0.5s+1s+1s (capped by remaining budget).
+			budget: 10 * time.Second,
+			steps:  []step{{name: "certs", failures: 4}, {name: "kube", failures: 100}, {name: "nats"}},
+			want: want{
+				err:   errors.Wrapf(errBoom, errBudgetExhausted, 10*time.Second, "kube"),
+				calls: []int{5, 4, 0},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			b := fakeClockBudget(tc.budget)
+			calls := make([]int, len(tc.steps))
+			var err error
+			for i, s := range tc.steps {
+				if err = b.Do(s.name, failing(s.failures, errBoom, &calls[i])); err != nil {
+					break
+				}
+			}
+			if diff := cmp.Diff(tc.want.err, err, test.EquateErrors()); diff != "" {
+				t.Errorf("\n%s\nDo(...): -want error, +got error:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.calls, calls); diff != "" {
+				t.Errorf("\n%s\nDo(...): -want calls, +got calls:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRetryBudgetDoRetries(t *testing.T) {
+	errBoom := errors.New("boom")
+
+	type want struct {
+		err   error
+		calls int
+	}
+	cases := map[string]struct {
+		reason   string
+		budget   time.Duration
+		retries  int
+		failures int
+		want
+	}{
+		"Recovers": {
+			reason:   "A step that recovers within its retries should succeed, even without a budget.",
+			retries:  3,
+			failures: 2,
+			want: want{
+				calls: 3,
+			},
+		},
+		"RetriesExhausted": {
+			reason:   "A step that keeps failing should return the errors of all attempts once its retries are used up.",
+			retries:  2,
+			failures: 100,
+			want: want{
+				err:   errors.Errorf(errRetriesExhausted, "certs", 3, "boom; boom; boom"),
+				calls: 3,
+			},
+		},
+		"BudgetExhausted": {
+			reason: "A step should stop retrying once the budget is used up, even with retries left.",
+			// Waits 0.5s and then the remaining 0.5s of the budget.
+			budget:   time.Second,
+			retries:  10,
+			failures: 100,
+			want: want{
+				err:   errors.Wrapf(errors.Errorf(errRetriesExhausted, "certs", 3, "boom; boom; boom"), errBudgetExhausted, time.Second, "certs"),
+				calls: 3,
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			b := fakeClockBudget(tc.budget)
+			calls := 0
+			err := b.DoRetries("certs", tc.retries, failing(tc.failures, errBoom, &calls))
+			if diff := cmp.Diff(tc.want.err, err, test.EquateErrors()); diff != "" {
+				t.Errorf("\n%s\nDoRetries(...): -want error, +got error:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.calls, calls); diff != "" {
+				t.Errorf("\n%s\nDoRetries(...): -want calls, +got calls:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,414 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	"github.com/upbound/universal-crossplane/internal/clients/upbound"
+	"github.com/upbound/universal-crossplane/internal/upboundagent"
+	"github.com/upbound/universal-crossplane/internal/version"
+)
+
+// Names of checks.
+const (
+	checkDNSUpboundAPI = "dns-upbound-api"
+	checkDNSNATS       = "dns-nats"
+	checkTCPUpboundAPI = "tcp-upbound-api"
+	checkTCPNATS       = "tcp-nats"
+	checkTLSUpboundAPI = "tls-upbound-api"
+	checkToken         = "token"
+	checkGatewayCerts  = "gateway-certs"
+	checkAPIServer     = "api-server"
+	checkNATSAuth      = "nats-auth"
+)
+
+// Ports the probes connect to if the endpoint has neither a port nor a scheme
+// that implies one.
+const (
+	defaultUpboundAPIPort = "443"
+	defaultNATSPort       = "4222"
+)
+
+const (
+	errChecksFailed   = "one or more checks failed"
+	errCheckTimeout   = "timed out after %s"
+	errCheckSkipped   = "skipped since %s did not pass"
+	errEmptyTokenFile = "control plane token file is empty"
+)
+
+// CheckCmd represents the "check" command
+type CheckCmd struct {
+	UpboundFlags
+
+	Timeout time.Duration `default:"10s" help:"Timeout of each check."`
+	Report  bool          `help:"Print a structured JSON report of all checks with their timing to stdout, e.g. to share as a diagnostic artifact when run as a Job. Otherwise, the result of each check is logged."`
+}
+
+// check is a single diagnostic step. It returns a human readable detail of
+// what it found.
+type check struct {
+	name   string
+	target string
+	// requires are the checks that must pass for this check to be run.
+	requires []string
+	run      func(ctx context.Context) (string, error)
+}
+
+// checkResult is the result of a check in a report.
+type checkResult struct {
+	Name            string  `json:"name"`
+	Target          string  `json:"target,omitempty"`
+	Passed          bool    `json:"passed"`
+	Skipped         bool    `json:"skipped,omitempty"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	Detail          string  `json:"detail,omitempty"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// checkReport is a structured diagnostic report of all checks.
+type checkReport struct {
+	Version string        `json:"version"`
+	Time    time.Time     `json:"time"`
+	Passed  bool          `json:"passed"`
+	Checks  []checkResult `json:"checks"`
+}
+
+// run runs all checks and either logs their results or prints a report. It
+// returns an error if any check failed.
+func (c CheckCmd) run(log logging.Logger, out io.Writer) error {
+	upTLS, err := c.upboundAPITLSConfig()
+	if err != nil {
+		return err
+	}
+	r := runChecks(context.Background(), c.Timeout, c.checks(log, upTLS))
+	if c.Report {
+		e := json.NewEncoder(out)
+		e.SetIndent("", "  ")
+		if err := e.Encode(r); err != nil {
+			return errors.Wrap(err, "cannot write report")
+		}
+	} else {
+		for _, cr := range r.Checks {
+			switch {
+			case cr.Skipped:
+				log.Info("check skipped", "check", cr.Name, "target", cr.Target, "reason", cr.Error)
+			case cr.Passed:
+				log.Info("check passed", "check", cr.Name, "target", cr.Target, "duration", cr.DurationSeconds, "detail", cr.Detail)
+			default:
+				log.Info("check failed", "check", cr.Name, "target", cr.Target, "duration", cr.DurationSeconds, "error", cr.Error)
+			}
+		}
+	}
+	if !r.Passed {
+		return errors.New(errChecksFailed)
+	}
+	return nil
+}
+
+// runChecks runs the given checks in order, each bounded by the timeout.
+// Checks whose requirements did not pass are skipped.
+func runChecks(ctx context.Context, timeout time.Duration, checks []check) checkReport {
+	r := checkReport{Version: version.Version, Time: time.Now().UTC(), Passed: true}
+	passed := map[string]bool{}
+	for _, ch := range checks {
+		cr := checkResult{Name: ch.name, Target: ch.target}
+		for _, req := range ch.requires {
+			if !passed[req] {
+				cr.Skipped = true
+				cr.Error = fmt.Sprintf(errCheckSkipped, req)
+				break
+			}
+		}
+		if !cr.Skipped {
+			start := time.Now()
+			detail, err := runCheck(ctx, timeout, ch.run)
+			cr.DurationSeconds = time.Since(start).Seconds()
+			cr.Passed = err == nil
+			if err != nil {
+				cr.Error = err.Error()
+			} else {
+				cr.Detail = detail
+			}
+		}
+		passed[ch.name] = cr.Passed
+		r.Passed = r.Passed && cr.Passed
+		r.Checks = append(r.Checks, cr)
+	}
+	return r
+}
+
+// runCheck runs the given check function, failing it once the timeout passed.
+// The check is then cancelled through its context but not waited for, since
+// it may not stop, e.g. while blocked in a client without a context. Checks
+// therefore only change the state later checks read through a checkState.
+func runCheck(ctx context.Context, timeout time.Duration, fn func(ctx context.Context) (string, error)) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	type result struct {
+		detail string
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		d, err := fn(ctx)
+		done <- result{detail: d, err: err}
+	}()
+	select {
+	case res := <-done:
+		return res.detail, res.err
+	case <-ctx.Done():
+		return "", errors.Errorf(errCheckTimeout, timeout)
+	}
+}
+
+// checkValues are the values that checks pass on to later checks.
+type checkValues struct {
+	token     string
+	pubCerts  upbound.PublicCerts
+	clusterID string
+}
+
+// checkState guards the values that checks pass on to later checks, since a
+// check that timed out may still be running.
+type checkState struct {
+	mu sync.Mutex
+	v  checkValues
+}
+
+func (s *checkState) get() checkValues {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.v
+}
+
+// update applies fn to the values unless the context of the check is done,
+// i.e. unless the check was given up on.
+func (s *checkState) update(ctx context.Context, fn func(v *checkValues)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ctx.Err() == nil {
+		fn(&s.v)
+	}
+}
+
+// checks returns the checks to diagnose the connectivity of the agent, which
+// reuse the clients and steps the agent starts with. Checks stop once their
+// context is done, or else once their client times out after the timeout.
+func (c CheckCmd) checks(log logging.Logger, upTLS *tls.Config) []check { // nolint:gocyclo
+	st := &checkState{}
+	upClient := upbound.NewClient(c.UpboundAPIEndpoint, log, false, upbound.WithQPS(c.UpboundAPIQPS), upbound.WithTLSConfig(upTLS), upbound.WithTimeout(c.Timeout))
+	return []check{
+		{
+			name:   checkDNSUpboundAPI,
+			target: c.UpboundAPIEndpoint,
+			run:    resolveCheck(c.UpboundAPIEndpoint),
+		},
+		{
+			name:   checkDNSNATS,
+			target: strings.Join(c.NATSEndpoint, ","),
+			run:    eachEndpoint(c.NATSEndpoint, resolveCheck),
+		},
+		{
+			name:     checkTCPUpboundAPI,
+			target:   c.UpboundAPIEndpoint,
+			requires: []string{checkDNSUpboundAPI},
+			run:      dialCheck(c.UpboundAPIEndpoint, defaultUpboundAPIPort),
+		},
+		{
+			name:     checkTCPNATS,
+			target:   strings.Join(c.NATSEndpoint, ","),
+			requires: []string{checkDNSNATS},
+			run: eachEndpoint(c.NATSEndpoint, func(e string) func(ctx context.Context) (string, error) {
+				return dialCheck(e, defaultNATSPort)
+			}),
+		},
+		{
+			name:     checkTLSUpboundAPI,
+			target:   c.UpboundAPIEndpoint,
+			requires: []string{checkTCPUpboundAPI},
+			run:      tlsCheck(c.UpboundAPIEndpoint, defaultUpboundAPIPort, upTLS),
+		},
+		{
+			name:   checkToken,
+			target: c.ControlPlaneTokenPath,
+			run: func(ctx context.Context) (string, error) {
+				var token string
+				if t := os.Getenv(c.ControlPlaneTokenEnv); c.ControlPlaneTokenPath == "" && t != "" {
+					token = t
+				} else {
+					b, err := os.ReadFile(filepath.Clean(c.ControlPlaneTokenPath))
+					if err != nil {
+						return "", errors.Wrap(err, "cannot read control plane token file")
+					}
+					if len(b) == 0 {
+						return "", errors.New(errEmptyTokenFile)
+					}
+					token = string(b)
+				}
+				st.update(ctx, func(v *checkValues) { v.token = token })
+				cpID, err := readCPIDFromToken(token, withExpiry(c.TokenClockSkew, time.Now), withMaxLifetime(c.MaxTokenLifetime, c.TokenClockSkew), withNotBefore(c.TokenClockSkew, time.Now))
+				return fmt.Sprintf("control plane id %s", cpID), err
+			},
+		},
+		{
+			name:     checkGatewayCerts,
+			target:   c.UpboundAPIEndpoint,
+			requires: []string{checkTLSUpboundAPI, checkToken},
+			run: func(ctx context.Context) (string, error) {
+				pubCerts, err := upClient.GetGatewayCerts(st.get().token)
+				if err != nil {
+					return "", err
+				}
+				st.update(ctx, func(v *checkValues) { v.pubCerts = pubCerts })
+				_, err = upboundagent.ParseTokenPublicKeys(pubCerts.JWTPublicKey)
+				return "fetched gateway certs", err
+			},
+		},
+		{
+			name: checkAPIServer,
+			run: func(ctx context.Context) (string, error) {
+				restConfig, err := config.GetConfig()
+				if err != nil {
+					return "", errors.Wrap(err, "failed to get rest config")
+				}
+				restConfig.Timeout = c.Timeout
+				kube, err := client.New(restConfig, client.Options{})
+				if err != nil {
+					return "", errors.Wrap(err, "failed to initialize kubernetes client")
+				}
+				clusterID, err := c.clusterID(kube)
+				st.update(ctx, func(v *checkValues) { v.clusterID = clusterID })
+				return fmt.Sprintf("%s with cluster id %s", restConfig.Host, clusterID), err
+			},
+		},
+		{
+			name:     checkNATSAuth,
+			target:   strings.Join(c.NATSEndpoint, ","),
+			requires: []string{checkTCPNATS, checkGatewayCerts, checkAPIServer},
+			run: func(context.Context) (string, error) {
+				v := st.get()
+				cpID, err := readCPIDFromToken(v.token)
+				if err != nil {
+					return "", err
+				}
+				nc, err := upboundagent.ConnectNATS(&upboundagent.Config{
+					ControlPlaneID: cpID,
+					NATS: &upboundagent.NATSClientConfig{
+						Name:              "check",
+						Endpoints:         c.NATSEndpoint,
+						JWTEndpoint:       c.UpboundAPIEndpoint,
+						ControlPlaneToken: v.token,
+						CABundle:          v.pubCerts.NATSCA,
+					},
+				}, upClient, log, v.clusterID)
+				if err != nil {
+					return "", err
+				}
+				defer nc.Close()
+				return fmt.Sprintf("connected to %s", nc.ConnectedUrl()), nil
+			},
+		},
+	}
+}
+
+// eachEndpoint returns a check that runs the given check for each of the given
+// endpoints, so that an endpoint the agent would fail over to is diagnosed
+// too. It fails if the check fails for any of them.
+func eachEndpoint(endpoints []string, check func(endpoint string) func(ctx context.Context) (string, error)) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		details := make([]string, 0, len(endpoints))
+		for _, e := range endpoints {
+			if err := ctx.Err(); err != nil {
+				return strings.Join(details, "; "), err
+			}
+			d, err := check(e)(ctx)
+			if err != nil {
+				return strings.Join(details, "; "), errors.Wrapf(err, "check of %s failed", e)
+			}
+			details = append(details, d)
+		}
+		return strings.Join(details, "; "), nil
+	}
+}
+
+func resolveCheck(endpoint string) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		h, addrs, err := resolveEndpoint(ctx, net.DefaultResolver, endpoint)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s resolves to %s", h, strings.Join(addrs, ", ")), nil
+	}
+}
+
+// dialCheck connects to the given endpoint, at its port or else the one its
+// scheme implies or the given default.
+func dialCheck(endpoint, defaultPort string) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		hp, err := hostPortFromEndpoint(endpoint, defaultPort)
+		if err != nil {
+			return "", err
+		}
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", hp)
+		if err != nil {
+			return "", errors.Wrapf(err, "cannot connect to %s", hp)
+		}
+		defer conn.Close() // nolint:errcheck
+		return fmt.Sprintf("connected to %s", conn.RemoteAddr()), nil
+	}
+}
+
+// tlsCheck completes a TLS handshake with the given endpoint, at the same port
+// as dialCheck, using the given config, or the system roots if it is nil.
+func tlsCheck(endpoint, defaultPort string, cfg *tls.Config) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		hp, err := hostPortFromEndpoint(endpoint, defaultPort)
+		if err != nil {
+			return "", err
+		}
+		h, _, _ := net.SplitHostPort(hp)
+		c := &tls.Config{MinVersion: tls.VersionTLS12}
+		if cfg != nil {
+			c = cfg.Clone()
+		}
+		c.ServerName = h
+		d := &tls.Dialer{Config: c}
+		conn, err := d.DialContext(ctx, "tcp", hp)
+		if err != nil {
+			return "", errors.Wrapf(err, "cannot complete tls handshake with %s", hp)
+		}
+		defer conn.Close() // nolint:errcheck
+		cs := conn.(*tls.Conn).ConnectionState()
+		leaf := cs.PeerCertificates[0]
+		return fmt.Sprintf("certificate for %s valid until %s", leaf.Subject.CommonName, leaf.NotAfter.UTC().Format(time.RFC3339)), nil
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/pkg/errors"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	"github.com/crossplane/crossplane-runtime/pkg/test"
+)
+
+func Test_runChecks(t *testing.T) {
+	pass := func(detail string) func(context.Context) (string, error) {
+		return func(context.Context) (string, error) { return detail, nil }
+	}
+	fail := func(context.Context) (string, error) { return "", errors.New("boom") }
+	hang := func(ctx context.Context) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+
+	cases := map[string]struct {
+		reason string
+		checks []check
+		want   checkReport
+	}{
+		"AllPassed": {
+			reason: "The report should pass if all checks passed.",
+			checks: []check{
+				{name: "a", target: "https://api.upbound.io", run: pass("resolved")},
+				{name: "b", requires: []string{"a"}, run: pass("connected")},
+			},
+			want: checkReport{Passed: true, Checks: []checkResult{
+				{Name: "a", Target: "https://api.upbound.io", Passed: true, Detail: "resolved"},
+				{Name: "b", Passed: true, Detail: "connected"},
+			}},
+		},
+		"FailedSkipsDependents": {
+			reason: "Checks that require a failed check should be skipped, while others still run.",
+			checks: []check{
+				{name: "a", run: fail},
+				{name: "b", requires: []string{"a"}, run: pass("connected")},
+				{name: "c", requires: []string{"b"}, run: pass("authenticated")},
+				{name: "d", run: pass("reachable")},
+			},
+			want: checkReport{Checks: []checkResult{
+				{Name: "a", Error: "boom"},
+				{Name: "b", Skipped: true, Error: "skipped since a did not pass"},
+				{Name: "c", Skipped: true, Error: "skipped since b did not pass"},
+				{Name: "d", Passed: true, Detail: "reachable"},
+			}},
+		},
+		"TimedOut": {
+			reason: "Checks that do not complete in time should fail.",
+			checks: []check{{name: "a", run: hang}},
+			want: checkReport{Checks: []checkResult{
+				{Name: "a", Error: "timed out after 10ms"},
+			}},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := runChecks(context.Background(), 10*time.Millisecond, tc.checks)
+			for _, c := range got.Checks {
+				if c.DurationSeconds < 0 {
+					t.Errorf("runChecks(...): want non-negative duration of check %s, got %v", c.Name, c.DurationSeconds)
+				}
+			}
+			ignore := cmpopts.IgnoreFields(checkReport{}, "Version", "Time")
+			if diff := cmp.Diff(tc.want, got, ignore, cmpopts.IgnoreFields(checkResult{}, "DurationSeconds")); diff != "" {
+				t.Errorf("\n%s\nrunChecks(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func Test_runCheckDoesNotWaitForCheck(t *testing.T) {
+	// The check ignores its context, like one blocked in a client without one.
+	release := make(chan struct{})
+	defer close(release)
+	_, err := runCheck(context.Background(), 10*time.Millisecond, func(context.Context) (string, error) {
+		<-release
+		return "", nil
+	})
+	if diff := cmp.Diff(errors.Errorf(errCheckTimeout, 10*time.Millisecond), err, test.EquateErrors()); diff != "" {
+		t.Errorf("runCheck(...): -want error, +got error:\n%s", diff)
+	}
+}
+
+func Test_checkStateUpdate(t *testing.T) {
+	st := &checkState{}
+	ctx, cancel := context.WithCancel(context.Background())
+	st.update(ctx, func(v *checkValues) { v.token = "token" })
+	cancel()
+	st.update(ctx, func(v *checkValues) { v.clusterID = "late" })
+	if diff := cmp.Diff(checkValues{token: "token"}, st.get(), cmp.AllowUnexported(checkValues{})); diff != "" {
+		t.Errorf("update(...): want updates of a check that was given up on discarded, -want, +got:\n%s", diff)
+	}
+}
+
+func TestCheckCmd_checkToken(t *testing.T) {
+	now := time.Now()
+	path := filepath.Join(t.TempDir(), "token")
+	tok := signedToken(t, jwt.MapClaims{"sub": prefixPlatformTokenSubject + "b0075060-a0d0-4948-80a3-ffdb0c28ef71", "iat": now.Unix(), "exp": now.Add(48 * time.Hour).Unix()})
+	if err := os.WriteFile(path, []byte(tok), 0600); err != nil {
+		t.Fatalf("cannot write token: %v", err)
+	}
+	c := CheckCmd{UpboundFlags: UpboundFlags{ControlPlaneTokenPath: path, TokenClockSkew: 2 * time.Minute, MaxTokenLifetime: 24 * time.Hour}}
+	for _, ch := range c.checks(logging.NewNopLogger(), nil) {
+		if ch.name != checkToken {
+			continue
+		}
+		_, err := ch.run(context.Background())
+		if diff := cmp.Diff(errors.Errorf(errCPTokenLifetimeTooLong, 48*time.Hour, 24*time.Hour), err, test.EquateErrors()); diff != "" {
+			t.Errorf("checks(...): -want error of token check, +got error:\n%s", diff)
+		}
+		return
+	}
+	t.Fatal("checks(...): want a token check")
+}
+
+func TestCheckCmd_checkNATSAuthInvalidToken(t *testing.T) {
+	c := CheckCmd{}
+	for _, ch := range c.checks(logging.NewNopLogger(), nil) {
+		if ch.name != checkNATSAuth {
+			continue
+		}
+		_, err := ch.run(context.Background())
+		if err == nil || !strings.HasPrefix(err.Error(), errMalformedCPToken) {
+			t.Errorf("checks(...): want error %q of nats auth check, got %v", errMalformedCPToken, err)
+		}
+		return
+	}
+	t.Fatal("checks(...): want a nats auth check")
+}
+
+func Test_probesUseEndpointPort(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	// The server listens on a random port, so the probes only reach it if
+	// they use the port of its URL rather than the default.
+	if _, err := dialCheck(srv.URL, defaultUpboundAPIPort)(context.Background()); err != nil {
+		t.Errorf("dialCheck(...): %v", err)
+	}
+	if _, err := tlsCheck(srv.URL, defaultUpboundAPIPort, &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12})(context.Background()); err != nil {
+		t.Errorf("tlsCheck(...): %v", err)
+	}
+}
+
+func Test_eachEndpoint(t *testing.T) {
+	check := func(e string) func(context.Context) (string, error) {
+		return func(context.Context) (string, error) {
+			if e == "nats://down:4222" {
+				return "", errors.New("boom")
+			}
+			return "reached " + e, nil
+		}
+	}
+
+	cases := map[string]struct {
+		reason    string
+		endpoints []string
+		detail    string
+		err       error
+	}{
+		"AllPassed": {
+			reason:    "The check should pass with the details of all endpoints if it passed for each of them.",
+			endpoints: []string{"nats://a:4222", "nats://b:4222"},
+			detail:    "reached nats://a:4222; reached nats://b:4222",
+		},
+		"OneFailed": {
+			reason:    "The check should fail if it failed for any of the endpoints.",
+			endpoints: []string{"nats://a:4222", "nats://down:4222", "nats://b:4222"},
+			detail:    "reached nats://a:4222",
+			err:       errors.Wrap(errors.New("boom"), "check of nats://down:4222 failed"),
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			detail, err := eachEndpoint(tc.endpoints, check)(context.Background())
+			if diff := cmp.Diff(tc.detail, detail); diff != "" {
+				t.Errorf("\n%s\neachEndpoint(...): -want detail, +got detail:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.err, err, test.EquateErrors()); diff != "" {
+				t.Errorf("\n%s\neachEndpoint(...): -want error, +got error:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
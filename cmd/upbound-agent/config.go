@@ -0,0 +1,103 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/kong"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	errReadConfigFile     = "cannot read config file"
+	errParseConfigFile    = "cannot parse config file"
+	errUnknownConfigFlags = "config file sets unknown flags: %s"
+)
+
+// configFile is the path of a YAML file that flags are read from unless they
+// are set on the command line. It maps the names of flags to their values,
+// e.g. tls-cert-file: /etc/certs/upbound-agent/tls.crt.
+type configFile string
+
+// BeforeResolve loads the config file, so that its values are resolved for
+// flags that are not set on the command line.
+func (f configFile) BeforeResolve(ctx *kong.Context, trace *kong.Path) error {
+	path, _ := ctx.FlagValue(trace.Flag).(configFile)
+	r, err := loadConfigFile(string(path))
+	if err != nil {
+		return err
+	}
+	ctx.AddResolver(r)
+	return nil
+}
+
+// configResolver resolves flags from the values of a config file by their
+// name.
+type configResolver map[string]interface{}
+
+func loadConfigFile(path string) (configResolver, error) {
+	b, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, errors.Wrap(err, errReadConfigFile)
+	}
+	r := configResolver{}
+	if err := yaml.Unmarshal(b, &r); err != nil {
+		return nil, errors.Wrap(err, errParseConfigFile)
+	}
+	return r, nil
+}
+
+// Validate rejects config files that set flags which do not exist, e.g.
+// because of a typo, rather than ignoring them.
+func (r configResolver) Validate(app *kong.Application) error {
+	known := map[string]bool{}
+	_ = kong.Visit(app, func(n kong.Visitable, next kong.Next) error {
+		if f, ok := n.(*kong.Flag); ok {
+			known[f.Name] = true
+		}
+		return next(nil)
+	})
+	var unknown []string
+	for name := range r {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return errors.Errorf(errUnknownConfigFlags, strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// Resolve returns the value of the given flag in the config file, if any.
+// Scalars are passed as strings, which all flag types are parsed from, while
+// lists and maps are decoded into the type of the flag.
+func (r configResolver) Resolve(_ *kong.Context, _ *kong.Path, flag *kong.Flag) (interface{}, error) {
+	switch v := r[flag.Name].(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		return v, nil
+	}
+}
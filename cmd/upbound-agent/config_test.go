@@ -0,0 +1,105 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestConfigFile(t *testing.T) {
+	const config = `
+tls-cert-file: /etc/certs/upbound-agent/tls.crt
+tls-key-file: /etc/certs/upbound-agent/tls.key
+server-port: 7443
+nats-endpoint:
+- nats://nats-0:4222
+- nats://nats-1:4222
+token-check-period: 5s
+shutdown-reject-new: true
+`
+	type want struct {
+		ServerPort       string
+		TLSCertFile      string
+		NATSEndpoint     []string
+		TokenCheckPeriod time.Duration
+		RejectNew        bool
+		err              bool
+	}
+	cases := map[string]struct {
+		reason string
+		config string
+		args   []string
+		want   want
+	}{
+		"FromFile": {
+			reason: "Flags that are not set on the command line should be read from the config file.",
+			config: config,
+			want: want{
+				ServerPort:       "7443",
+				TLSCertFile:      "/etc/certs/upbound-agent/tls.crt",
+				NATSEndpoint:     []string{"nats://nats-0:4222", "nats://nats-1:4222"},
+				TokenCheckPeriod: 5 * time.Second,
+				RejectNew:        true,
+			},
+		},
+		"CommandLinePrecedence": {
+			reason: "Flags set on the command line should take precedence over the config file.",
+			config: config,
+			args:   []string{"--server-port=9443", "--nats-endpoint=nats://nats:4222"},
+			want: want{
+				ServerPort:       "9443",
+				TLSCertFile:      "/etc/certs/upbound-agent/tls.crt",
+				NATSEndpoint:     []string{"nats://nats:4222"},
+				TokenCheckPeriod: 5 * time.Second,
+				RejectNew:        true,
+			},
+		},
+		"UnknownFlag": {
+			reason: "Config files that set unknown flags, e.g. because of a typo, should be rejected.",
+			config: config + "tls-cert-fle: /etc/certs/upbound-agent/tls.crt\n",
+			want:   want{err: true},
+		},
+		"Invalid": {
+			reason: "Config files that are not valid YAML should be rejected.",
+			config: "tls-cert-file: [",
+			want:   want{err: true},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := writeFile(t, "config.yaml", tc.config, 0600)
+			var c struct {
+				Agent AgentCmd `cmd:""`
+			}
+			p, err := kong.New(&c)
+			if err != nil {
+				t.Fatalf("kong.New(...): %v", err)
+			}
+			_, err = p.Parse(append([]string{"agent", "--config=" + path}, tc.args...))
+			a := c.Agent
+			got := want{err: err != nil}
+			if err == nil {
+				got = want{ServerPort: a.ServerPort, TLSCertFile: a.TLSCertFile, NATSEndpoint: a.NATSEndpoint, TokenCheckPeriod: a.TokenCheckPeriod, RejectNew: a.ShutdownRejectNew}
+			}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(want{})); diff != "" {
+				t.Errorf("\n%s\nParse(...): -want, +got:\n%s\n%v", tc.reason, diff, err)
+			}
+		})
+	}
+}
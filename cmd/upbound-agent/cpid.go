@@ -0,0 +1,71 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var cpIDCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "upbound_agent",
+	Name:      "control_plane_id_cache_hits_total",
+	Help:      "Number of times the control plane ID was not derived again from an unchanged control plane token.",
+})
+
+func init() {
+	prometheus.MustRegister(cpIDCacheHits)
+}
+
+// cpIDCache caches the claims and control plane ID of the last control plane
+// token, keyed by the hash of the token, so that validating an unchanged token
+// again, e.g. on spurious reload events or on every readiness probe, does not
+// parse it again. The checks are still run on every call, since time based
+// ones may fail for a token that passed them before. Tokens that cannot be
+// parsed are not cached.
+type cpIDCache struct {
+	parse  func(token string) (jwt.MapClaims, error)
+	checks []tokenCheck
+	hits   prometheus.Counter
+
+	mu     sync.Mutex
+	hash   [sha256.Size]byte
+	claims jwt.MapClaims
+}
+
+func newCPIDCache(checks ...tokenCheck) *cpIDCache {
+	return &cpIDCache{parse: parseTokenClaims, checks: checks, hits: cpIDCacheHits}
+}
+
+// Get returns the control plane ID in the given token once it passed the
+// checks of the cache.
+func (c *cpIDCache) Get(token string) (string, error) {
+	h := sha256.Sum256([]byte(token))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.claims != nil && h == c.hash {
+		c.hits.Inc()
+		return cpIDFromClaims(c.claims, c.checks...)
+	}
+	cl, err := c.parse(token)
+	if err != nil {
+		return "", err
+	}
+	c.hash, c.claims = h, cl
+	return cpIDFromClaims(cl, c.checks...)
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCPIDCache_Get(t *testing.T) {
+	now := time.Now()
+	first := signedToken(t, jwt.MapClaims{"sub": prefixPlatformTokenSubject + "2aeb5b0a-6b1b-4b8e-9a58-0d4d3ed3a6b0", "exp": now.Add(time.Hour).Unix()})
+	second := signedToken(t, jwt.MapClaims{"sub": prefixPlatformTokenSubject + "b7d9c1e4-1c1b-4a1e-8d0a-5f6f2e7a9c3d", "exp": now.Add(time.Hour).Unix()})
+
+	type want struct {
+		ids    []string
+		parsed int
+		hits   float64
+	}
+	cases := map[string]struct {
+		reason string
+		tokens []string
+		// advance is how much time passes after each token.
+		advance time.Duration
+		want    want
+	}{
+		"IdenticalToken": {
+			reason: "An identical token should not be parsed again.",
+			tokens: []string{first, first, first},
+			want: want{
+				ids:    []string{"2aeb5b0a-6b1b-4b8e-9a58-0d4d3ed3a6b0", "2aeb5b0a-6b1b-4b8e-9a58-0d4d3ed3a6b0", "2aeb5b0a-6b1b-4b8e-9a58-0d4d3ed3a6b0"},
+				parsed: 1,
+				hits:   2,
+			},
+		},
+		"ChangedToken": {
+			reason: "A changed token should be parsed again.",
+			tokens: []string{first, second, first},
+			want: want{
+				ids:    []string{"2aeb5b0a-6b1b-4b8e-9a58-0d4d3ed3a6b0", "b7d9c1e4-1c1b-4a1e-8d0a-5f6f2e7a9c3d", "2aeb5b0a-6b1b-4b8e-9a58-0d4d3ed3a6b0"},
+				parsed: 3,
+			},
+		},
+		"ExpiredToken": {
+			reason:  "The checks should still be run for an identical token, so that it fails once it expired.",
+			tokens:  []string{first, first},
+			advance: 2 * time.Hour,
+			want: want{
+				ids:    []string{"2aeb5b0a-6b1b-4b8e-9a58-0d4d3ed3a6b0", ""},
+				parsed: 1,
+				hits:   1,
+			},
+		},
+		"InvalidToken": {
+			reason: "Tokens that cannot be parsed should not be cached.",
+			tokens: []string{"invalid", "invalid"},
+			want: want{
+				ids:    []string{"", ""},
+				parsed: 2,
+			},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := want{}
+			clock := now
+			c := newCPIDCache(withExpiry(0, func() time.Time { return clock }))
+			c.hits = prometheus.NewCounter(prometheus.CounterOpts{Name: "hits"})
+			c.parse = func(token string) (jwt.MapClaims, error) {
+				got.parsed++
+				return parseTokenClaims(token)
+			}
+			for _, tk := range tc.tokens {
+				id, err := c.Get(tk)
+				if err != nil {
+					id = ""
+				}
+				got.ids = append(got.ids, id)
+				clock = clock.Add(tc.advance)
+			}
+			got.hits = testutil.ToFloat64(c.hits)
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(want{})); diff != "" {
+				t.Errorf("\n%s\nGet(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	errEndpointMissing   = "%s must be set"
+	errEndpointNoScheme  = "%s %q has no scheme, e.g. %s"
+	errEndpointMalformed = "%s %q is not a valid URL"
+	errEndpointScheme    = "%s %q has scheme %s but must be %s"
+	errEndpointHost      = "%s %q has no host"
+	errEndpointPath      = "%s %q must not have a path, query or fragment"
+)
+
+// normalizeEndpoint returns the given endpoint of the given flag without
+// surrounding whitespace and trailing slashes, or an error if it is not a URL
+// with a host and one of the given schemes. Endpoints must not have a query or
+// fragment, and must not have a path unless allowPath is set.
+func normalizeEndpoint(flag, e string, allowPath bool, schemes ...string) (string, error) {
+	s := strings.TrimSpace(e)
+	if s == "" {
+		return "", errors.Errorf(errEndpointMissing, flag)
+	}
+	if !strings.Contains(s, "://") {
+		return "", errors.Errorf(errEndpointNoScheme, flag, s, schemes[0]+"://"+strings.TrimLeft(s, "/"))
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", errors.Wrapf(err, errEndpointMalformed, flag, s)
+	}
+	valid := false
+	for _, sc := range schemes {
+		valid = valid || u.Scheme == sc
+	}
+	if !valid {
+		return "", errors.Errorf(errEndpointScheme, flag, s, u.Scheme, strings.Join(schemes, " or "))
+	}
+	if u.Hostname() == "" {
+		return "", errors.Errorf(errEndpointHost, flag, s)
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	if (u.Path != "" && !allowPath) || u.RawQuery != "" || u.Fragment != "" || u.ForceQuery {
+		return "", errors.Errorf(errEndpointPath, flag, s)
+	}
+	return u.String(), nil
+}
+
+// normalizeEndpoints normalizes the endpoints of Upbound API and, unless nats
+// is false, NATS, so that common copy-paste errors, like a missing or wrong
+// scheme, fail right away rather than confusingly once they are used.
+func (f *UpboundFlags) normalizeEndpoints(nats bool) error {
+	e, err := normalizeEndpoint("--upbound-api-endpoint", f.UpboundAPIEndpoint, true, "https")
+	if err != nil {
+		return err
+	}
+	f.UpboundAPIEndpoint = e
+	if !nats {
+		return nil
+	}
+	if len(f.NATSEndpoint) == 0 {
+		return errors.Errorf(errEndpointMissing, "--nats-endpoint")
+	}
+	for i, ne := range f.NATSEndpoint {
+		e, err := normalizeEndpoint("--nats-endpoint", ne, false, "nats", "tls")
+		if err != nil {
+			return err
+		}
+		f.NATSEndpoint[i] = e
+	}
+	return nil
+}
+
+// normalizeEndpoints normalizes the endpoints the agent connects to. NATS
+// endpoints are not needed, and thus not checked, if NATS is disabled.
+func (a *AgentCmd) normalizeEndpoints() error {
+	return a.UpboundFlags.normalizeEndpoints(!a.DisableNATS)
+}
@@ -0,0 +1,153 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+
+	"github.com/crossplane/crossplane-runtime/pkg/test"
+)
+
+func Test_normalizeEndpoint(t *testing.T) {
+	_, errParse := url.Parse("https://api.upbound.io:port")
+
+	type args struct {
+		endpoint  string
+		allowPath bool
+		schemes   []string
+	}
+	type want struct {
+		endpoint string
+		err      error
+	}
+	cases := map[string]struct {
+		reason string
+		args
+		want
+	}{
+		"Valid": {
+			reason: "A URL with one of the schemes and a host should be valid.",
+			args:   args{endpoint: "https://api.upbound.io", schemes: []string{"https"}},
+			want:   want{endpoint: "https://api.upbound.io"},
+		},
+		"TrailingSlash": {
+			reason: "Trailing slashes and surrounding whitespace should be removed.",
+			args:   args{endpoint: " https://api.upbound.io/ \n", allowPath: true, schemes: []string{"https"}},
+			want:   want{endpoint: "https://api.upbound.io"},
+		},
+		"Path": {
+			reason: "A path should be kept without its trailing slash if allowed.",
+			args:   args{endpoint: "https://upbound.example.com/api/", allowPath: true, schemes: []string{"https"}},
+			want:   want{endpoint: "https://upbound.example.com/api"},
+		},
+		"PathNotAllowed": {
+			reason: "A path should be invalid if not allowed.",
+			args:   args{endpoint: "nats://connect.upbound.io:443/nats", schemes: []string{"nats", "tls"}},
+			want:   want{err: errors.Errorf(errEndpointPath, "--flag", "nats://connect.upbound.io:443/nats")},
+		},
+		"UppercaseScheme": {
+			reason: "Schemes should be matched case insensitively.",
+			args:   args{endpoint: "TLS://connect.upbound.io:443", schemes: []string{"nats", "tls"}},
+			want:   want{endpoint: "tls://connect.upbound.io:443"},
+		},
+		"Empty": {
+			reason: "An empty endpoint should be invalid.",
+			args:   args{endpoint: " ", schemes: []string{"https"}},
+			want:   want{err: errors.Errorf(errEndpointMissing, "--flag")},
+		},
+		"MissingScheme": {
+			reason: "An endpoint without a scheme should be invalid, suggesting the expected one.",
+			args:   args{endpoint: "connect.upbound.io:443", schemes: []string{"nats", "tls"}},
+			want:   want{err: errors.Errorf(errEndpointNoScheme, "--flag", "connect.upbound.io:443", "nats://connect.upbound.io:443")},
+		},
+		"WrongScheme": {
+			reason: "An endpoint with another scheme should be invalid.",
+			args:   args{endpoint: "http://api.upbound.io", schemes: []string{"https"}},
+			want:   want{err: errors.Errorf(errEndpointScheme, "--flag", "http://api.upbound.io", "http", "https")},
+		},
+		"Malformed": {
+			reason: "An endpoint that cannot be parsed should be invalid.",
+			args:   args{endpoint: "https://api.upbound.io:port", schemes: []string{"https"}},
+			want:   want{err: errors.Wrapf(errParse, errEndpointMalformed, "--flag", "https://api.upbound.io:port")},
+		},
+		"NoHost": {
+			reason: "An endpoint without a host should be invalid.",
+			args:   args{endpoint: "https:///v1", allowPath: true, schemes: []string{"https"}},
+			want:   want{err: errors.Errorf(errEndpointHost, "--flag", "https:///v1")},
+		},
+		"Query": {
+			reason: "An endpoint with a query should be invalid.",
+			args:   args{endpoint: "https://api.upbound.io?x=1", allowPath: true, schemes: []string{"https"}},
+			want:   want{err: errors.Errorf(errEndpointPath, "--flag", "https://api.upbound.io?x=1")},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := normalizeEndpoint("--flag", tc.args.endpoint, tc.args.allowPath, tc.args.schemes...)
+			if diff := cmp.Diff(tc.want.err, err, test.EquateErrors()); diff != "" {
+				t.Errorf("\n%s\nnormalizeEndpoint(...): -want error, +got error:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.endpoint, got); diff != "" {
+				t.Errorf("\n%s\nnormalizeEndpoint(...): -want endpoint, +got endpoint:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestUpboundFlags_normalizeEndpoints(t *testing.T) {
+	f := &UpboundFlags{UpboundAPIEndpoint: "https://api.upbound.io/", NATSEndpoint: []string{"nats://nats-0:4222/", " tls://nats-1:4222"}}
+	if err := f.normalizeEndpoints(true); err != nil {
+		t.Fatalf("normalizeEndpoints(): %v", err)
+	}
+	want := &UpboundFlags{UpboundAPIEndpoint: "https://api.upbound.io", NATSEndpoint: []string{"nats://nats-0:4222", "tls://nats-1:4222"}}
+	if diff := cmp.Diff(want, f); diff != "" {
+		t.Errorf("normalizeEndpoints(): -want, +got:\n%s", diff)
+	}
+
+	f = &UpboundFlags{UpboundAPIEndpoint: "https://api.upbound.io", NATSEndpoint: []string{"nats://nats-0:4222", "https://nats-1:4222"}}
+	want2 := errors.Errorf(errEndpointScheme, "--nats-endpoint", "https://nats-1:4222", "https", "nats or tls")
+	if diff := cmp.Diff(want2, f.normalizeEndpoints(true), test.EquateErrors()); diff != "" {
+		t.Errorf("normalizeEndpoints(): -want error, +got error:\n%s", diff)
+	}
+}
+
+func TestAgentCmd_normalizeEndpoints(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		cmd    AgentCmd
+		want   error
+	}{
+		"NATSDisabled": {
+			reason: "NATS endpoints should not be required if NATS is disabled.",
+			cmd:    AgentCmd{UpboundFlags: UpboundFlags{UpboundAPIEndpoint: "https://api.upbound.io"}, DisableNATS: true},
+		},
+		"NATSEnabled": {
+			reason: "NATS endpoints should be required if NATS is enabled.",
+			cmd:    AgentCmd{UpboundFlags: UpboundFlags{UpboundAPIEndpoint: "https://api.upbound.io"}},
+			want:   errors.Errorf(errEndpointMissing, "--nats-endpoint"),
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, tc.cmd.normalizeEndpoints(), test.EquateErrors()); diff != "" {
+				t.Errorf("\n%s\nnormalizeEndpoints(): -want error, +got error:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
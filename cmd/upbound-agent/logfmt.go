@@ -0,0 +1,156 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap/buffer"
+	"go.uber.org/zap/zapcore"
+)
+
+var logfmtBuffers = buffer.NewPool()
+
+// logfmtEncoder is a zapcore.Encoder that encodes entries as logfmt, i.e.
+// space separated key=value pairs. Entries have the same keys and values as
+// with a JSON encoder of the same config. Accumulated context is kept in the
+// embedded map encoder and thus written in the order of its keys.
+type logfmtEncoder struct {
+	*zapcore.MapObjectEncoder
+	cfg zapcore.EncoderConfig
+}
+
+func newLogfmtEncoder(cfg zapcore.EncoderConfig) zapcore.Encoder {
+	return &logfmtEncoder{MapObjectEncoder: zapcore.NewMapObjectEncoder(), cfg: cfg}
+}
+
+func (e *logfmtEncoder) Clone() zapcore.Encoder {
+	c := &logfmtEncoder{MapObjectEncoder: zapcore.NewMapObjectEncoder(), cfg: e.cfg}
+	for k, v := range e.Fields {
+		c.Fields[k] = v
+	}
+	return c
+}
+
+func (e *logfmtEncoder) EncodeEntry(ent zapcore.Entry, fields []zapcore.Field) (*buffer.Buffer, error) {
+	b := logfmtBuffers.Get()
+	if e.cfg.TimeKey != "" && e.cfg.EncodeTime != nil {
+		e.appendEncoded(b, e.cfg.TimeKey, func(ae zapcore.PrimitiveArrayEncoder) { e.cfg.EncodeTime(ent.Time, ae) })
+	}
+	if e.cfg.LevelKey != "" && e.cfg.EncodeLevel != nil {
+		e.appendEncoded(b, e.cfg.LevelKey, func(ae zapcore.PrimitiveArrayEncoder) { e.cfg.EncodeLevel(ent.Level, ae) })
+	}
+	if e.cfg.NameKey != "" && ent.LoggerName != "" {
+		appendPair(b, e.cfg.NameKey, ent.LoggerName)
+	}
+	if e.cfg.CallerKey != "" && ent.Caller.Defined && e.cfg.EncodeCaller != nil {
+		e.appendEncoded(b, e.cfg.CallerKey, func(ae zapcore.PrimitiveArrayEncoder) { e.cfg.EncodeCaller(ent.Caller, ae) })
+	}
+	if e.cfg.MessageKey != "" {
+		appendPair(b, e.cfg.MessageKey, ent.Message)
+	}
+
+	keys := make([]string, 0, len(e.Fields))
+	for k := range e.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		appendPair(b, k, e.Fields[k])
+	}
+	for _, f := range fields {
+		// Fields are added one at a time so that they keep their order.
+		m := zapcore.NewMapObjectEncoder()
+		f.AddTo(m)
+		for k, v := range m.Fields {
+			appendPair(b, k, v)
+		}
+	}
+
+	if e.cfg.StacktraceKey != "" && ent.Stack != "" {
+		appendPair(b, e.cfg.StacktraceKey, ent.Stack)
+	}
+	le := e.cfg.LineEnding
+	if le == "" {
+		le = zapcore.DefaultLineEnding
+	}
+	b.AppendString(le)
+	return b, nil
+}
+
+// appendEncoded appends the value encoded by the given function of the
+// encoder config.
+func (e *logfmtEncoder) appendEncoded(b *buffer.Buffer, key string, encode func(zapcore.PrimitiveArrayEncoder)) {
+	m := zapcore.NewMapObjectEncoder()
+	_ = m.AddArray(key, zapcore.ArrayMarshalerFunc(func(ae zapcore.ArrayEncoder) error {
+		encode(ae)
+		return nil
+	}))
+	if vs, ok := m.Fields[key].([]interface{}); ok && len(vs) == 1 {
+		appendPair(b, key, vs[0])
+	}
+}
+
+func appendPair(b *buffer.Buffer, key string, v interface{}) {
+	if b.Len() > 0 {
+		b.AppendByte(' ')
+	}
+	b.AppendString(logfmtKey(key))
+	b.AppendByte('=')
+	b.AppendString(logfmtValue(v))
+}
+
+// logfmtKey replaces the characters that are not allowed in logfmt keys.
+func logfmtKey(k string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' {
+			return '_'
+		}
+		return r
+	}, k)
+}
+
+func logfmtValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case time.Time:
+		s = v.Format(time.RFC3339Nano)
+	case time.Duration:
+		s = v.String()
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	case fmt.Stringer:
+		s = v.String()
+	case []interface{}, map[string]interface{}:
+		j, err := json.Marshal(v)
+		if err != nil {
+			return strconv.Quote(fmt.Sprint(v))
+		}
+		s = string(j)
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\\") || strings.IndexFunc(s, func(r rune) bool { return r < ' ' }) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
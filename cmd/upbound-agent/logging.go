@@ -0,0 +1,318 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/zapr"
+	"github.com/pkg/errors"
+	uzap "go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+)
+
+// Log formats.
+const (
+	logFormatAuto    = "auto"
+	logFormatConsole = "console"
+	logFormatJSON    = "json"
+	logFormatLogfmt  = "logfmt"
+)
+
+// Log levels.
+const (
+	logLevelAuto  = "auto"
+	logLevelDebug = "debug"
+	logLevelInfo  = "info"
+	logLevelWarn  = "warn"
+)
+
+// warningPrefix is the prefix of messages that are logged as warnings.
+const warningPrefix = "warning: "
+
+const redacted = "REDACTED"
+
+const (
+	errUnknownLogFormat   = "unknown log format %q"
+	errUnknownLogLevel    = "unknown log level %q"
+	errInvalidLogSampling = "invalid log sampling of initial %d and thereafter %d entries, initial must not be negative and thereafter must be positive"
+)
+
+var (
+	// sensitiveKeys are the substrings of keys whose values are redacted.
+	sensitiveKeys = []string{"token", "secret", "password", "authorization"}
+
+	// sensitiveValue matches bearer credentials and JWTs in logged values,
+	// e.g. in errors that embed a request or a token.
+	sensitiveValue = regexp.MustCompile(`(?i)bearer\s+[\w\-.~+/]{16,}=*|eyJ[\w-]*\.[\w-]+\.[\w-]*`)
+)
+
+// logSampling configures the sampling of repeated log entries. The first
+// Initial entries with the same level and message are logged every second,
+// and every Thereafter-th entry after that. Sampling is disabled if Initial is
+// zero.
+type logSampling struct {
+	Initial    int
+	Thereafter int
+}
+
+// newLogger returns a logger named upbound-agent that writes in the given
+// format and at the given level. The auto format writes console output in
+// debug mode and JSON otherwise, and the auto level is debug in debug mode and
+// info otherwise. Entries are sampled unless in debug mode, but the first
+// entry of every message and error is always logged. Sensitive values are redacted
+// regardless of the format.
+func newLogger(format, level string, debug bool, s logSampling, w io.Writer) (logging.Logger, error) { // nolint:gocyclo
+	if s.Initial < 0 || (s.Initial > 0 && s.Thereafter < 1) {
+		return nil, errors.Errorf(errInvalidLogSampling, s.Initial, s.Thereafter)
+	}
+	var enc zapcore.Encoder
+	switch format {
+	case logFormatAuto, "":
+		enc = zapcore.NewJSONEncoder(uzap.NewProductionEncoderConfig())
+		if debug {
+			enc = zapcore.NewConsoleEncoder(uzap.NewDevelopmentEncoderConfig())
+		}
+	case logFormatConsole:
+		enc = zapcore.NewConsoleEncoder(uzap.NewDevelopmentEncoderConfig())
+	case logFormatJSON:
+		enc = zapcore.NewJSONEncoder(uzap.NewProductionEncoderConfig())
+	case logFormatLogfmt:
+		enc = newLogfmtEncoder(uzap.NewProductionEncoderConfig())
+	default:
+		return nil, errors.Errorf(errUnknownLogFormat, format)
+	}
+	lvl := uzap.InfoLevel
+	switch level {
+	case logLevelAuto, "":
+		if debug {
+			lvl = uzap.DebugLevel
+		}
+	case logLevelDebug:
+		lvl = uzap.DebugLevel
+	case logLevelInfo:
+	case logLevelWarn:
+		lvl = uzap.WarnLevel
+	default:
+		return nil, errors.Errorf(errUnknownLogLevel, level)
+	}
+
+	// This mirrors the production and development configs of the
+	// controller-runtime zap logger, whose fixed sampling cannot be changed.
+	sink := zapcore.AddSync(w)
+	stack := uzap.ErrorLevel
+	opts := []uzap.Option{uzap.AddCallerSkip(1), uzap.ErrorOutput(sink)}
+	if debug {
+		stack = uzap.WarnLevel
+		opts = append(opts, uzap.Development())
+	}
+	opts = append(opts, uzap.AddStacktrace(stack))
+	var core zapcore.Core = zapcore.NewCore(&zap.KubeAwareEncoder{Encoder: enc, Verbose: debug}, sink, lvl)
+	if !debug && s.Initial > 0 {
+		core = newFirstOccurrenceCore(core, zapcore.NewSampler(core, time.Second, s.Initial, s.Thereafter))
+	}
+	core = &warningCore{Core: core}
+	zl := zapr.NewLogger(uzap.New(core, opts...))
+	return &redactingLogger{log: logging.NewLogrLogger(zl.WithName("upbound-agent"))}, nil
+}
+
+// maxSeenMessages bounds the number of messages that a firstOccurrenceCore
+// remembers. Once exceeded, it starts over.
+const maxSeenMessages = 4096
+
+// maxSeenErrorLength bounds the length of the error that is remembered with a
+// message, so that long errors do not inflate the set of seen messages.
+const maxSeenErrorLength = 256
+
+// seenMessage is a message that was logged at the given level with the given
+// error, if any.
+type seenMessage struct {
+	lvl zapcore.Level
+	msg string
+	err string
+}
+
+// seenMessages is the set of messages that were logged at least once.
+type seenMessages struct {
+	mu   sync.Mutex
+	seen map[seenMessage]struct{}
+}
+
+// add returns true if the message was not seen yet at the given level with the
+// given error. Errors are truncated to maxSeenErrorLength.
+func (s *seenMessages) add(lvl zapcore.Level, msg, err string) bool {
+	if len(err) > maxSeenErrorLength {
+		err = err[:maxSeenErrorLength]
+	}
+	k := seenMessage{lvl: lvl, msg: msg, err: err}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.seen[k]; ok {
+		return false
+	}
+	if s.seen == nil || len(s.seen) >= maxSeenMessages {
+		s.seen = map[seenMessage]struct{}{}
+	}
+	s.seen[k] = struct{}{}
+	return true
+}
+
+// errorField returns the value of the error field, if any.
+func errorField(fields []zapcore.Field) string {
+	for _, f := range fields {
+		if f.Key != "error" {
+			continue
+		}
+		switch v := f.Interface.(type) {
+		case error:
+			return v.Error()
+		case fmt.Stringer:
+			return v.String()
+		}
+		return f.String
+	}
+	return ""
+}
+
+// firstOccurrenceCore passes the first entry of every message and error to the
+// wrapped core, and all subsequent ones to the sampled core. The zap sampler counts
+// entries in a fixed number of buckets of hashed messages, so that the first
+// entry of a new message, e.g. of a new error during a storm of other errors,
+// could otherwise be dropped.
+type firstOccurrenceCore struct {
+	zapcore.Core
+	sampled zapcore.Core
+	seen    *seenMessages
+}
+
+func newFirstOccurrenceCore(core, sampled zapcore.Core) zapcore.Core {
+	return &firstOccurrenceCore{Core: core, sampled: sampled, seen: &seenMessages{}}
+}
+
+func (c *firstOccurrenceCore) With(fields []zapcore.Field) zapcore.Core {
+	return &firstOccurrenceCore{Core: c.Core.With(fields), sampled: c.sampled.With(fields), seen: c.seen}
+}
+
+func (c *firstOccurrenceCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.Enabled(ent.Level) {
+		return ce
+	}
+	// Fields, and thus the error, are only known when the entry is written.
+	return ce.AddCore(ent, c)
+}
+
+func (c *firstOccurrenceCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	if c.seen.add(ent.Level, ent.Message, errorField(fields)) {
+		return c.Core.Write(ent, fields)
+	}
+	if ce := c.sampled.Check(ent, nil); ce != nil {
+		ce.Write(fields...)
+	}
+	return nil
+}
+
+// warningCore raises warnings, i.e. entries whose message has the warning
+// prefix, as well as startup failures to warn level, so that they are still
+// logged at warn level. logging.Logger only logs at info and debug level.
+type warningCore struct {
+	zapcore.Core
+}
+
+func (c *warningCore) With(fields []zapcore.Field) zapcore.Core {
+	return &warningCore{Core: c.Core.With(fields)}
+}
+
+// Enabled returns true for info level if warn level is enabled, since info
+// entries may be warnings.
+func (c *warningCore) Enabled(lvl zapcore.Level) bool {
+	return c.Core.Enabled(lvl) || (lvl == zapcore.InfoLevel && c.Core.Enabled(zapcore.WarnLevel))
+}
+
+func (c *warningCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if ent.Level == zapcore.InfoLevel && (strings.HasPrefix(ent.Message, warningPrefix) || ent.Message == msgStartupFailed) {
+		ent.Level = zapcore.WarnLevel
+	}
+	return c.Core.Check(ent, ce)
+}
+
+// redactingLogger redacts the values of sensitive keys, as well as bearer
+// credentials and JWTs in any value, before passing them to the wrapped
+// logger.
+type redactingLogger struct {
+	log logging.Logger
+}
+
+func (l *redactingLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.log.Info(redactValue(msg), redact(keysAndValues)...)
+}
+
+func (l *redactingLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.log.Debug(redactValue(msg), redact(keysAndValues)...)
+}
+
+func (l *redactingLogger) WithValues(keysAndValues ...interface{}) logging.Logger {
+	return &redactingLogger{log: l.log.WithValues(redact(keysAndValues)...)}
+}
+
+func redact(keysAndValues []interface{}) []interface{} {
+	out := make([]interface{}, len(keysAndValues))
+	for i, v := range keysAndValues {
+		if i%2 == 0 {
+			out[i] = v
+			continue
+		}
+		if k, ok := keysAndValues[i-1].(string); ok && isSensitiveKey(k) {
+			out[i] = redacted
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			out[i] = redactValue(v)
+		case error:
+			// Errors are only flattened if they need to be redacted, so that
+			// they are otherwise logged as usual.
+			if s := v.Error(); sensitiveValue.MatchString(s) {
+				out[i] = redactValue(s)
+				continue
+			}
+			out[i] = v
+		default:
+			out[i] = v
+		}
+	}
+	return out
+}
+
+func isSensitiveKey(k string) bool {
+	k = strings.ToLower(k)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(k, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactValue(v string) string {
+	return sensitiveValue.ReplaceAllString(v, redacted)
+}
@@ -16,35 +16,47 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"crypto/x509"
-	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/alecthomas/kong"
-	"github.com/dgrijalva/jwt-go"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
-	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	"github.com/crossplane/crossplane-runtime/pkg/logging"
 	"github.com/crossplane/crossplane-runtime/pkg/resource"
 
 	"github.com/upbound/universal-crossplane/internal/clients/upbound"
+	"github.com/upbound/universal-crossplane/internal/tracing"
 	"github.com/upbound/universal-crossplane/internal/upboundagent"
 	"github.com/upbound/universal-crossplane/internal/version"
 )
 
 const (
-	prefixPlatformTokenSubject   = "controlPlane|"
-	controlPlaneTokenCheckPeriod = time.Second * 3
+	prefixPlatformTokenSubject = "controlPlane|"
+
+	// Checking whether the control plane token file was mounted more often
+	// than minTokenCheckPeriod would hammer the file system, while checking
+	// less often than maxTokenCheckPeriod delays startup noticeably.
+	defaultTokenCheckPeriod = time.Second * 3
+	minTokenCheckPeriod     = 100 * time.Millisecond
+	maxTokenCheckPeriod     = time.Minute
 )
 
 const (
@@ -54,117 +66,827 @@ const (
 	errCPIDInTokenNotValidUUID   = "control plane id in token is not a valid UUID: %s"
 	errFailedToGetKubeSystemNS   = "failed to get kube-system namespace"
 	errKubeSystemUIDEmpty        = "metadata.uid of kube-system namespace is empty"
+	errFailedToGetClusterIDCM    = "failed to get config map %s"
+	errClusterIDCMKeyEmpty       = "config map %s has no cluster id under key %s"
+	errCPTokenClaimNotNumeric    = "failed to parse value for key %q as a numeric date"
+	errCPTokenNoExpiry           = "control plane token has no expiry but a maximum lifetime is enforced"
+	errCPTokenLifetimeTooLong    = "control plane token is valid for %s which exceeds the maximum allowed lifetime of %s"
+	errCPTokenNotYetValid        = "control plane token is not yet valid until %s"
+	errCPTokenExpired            = "control plane token expired at %s"
+	errMetricsSecureNoAuth       = "secure metrics require a bearer token file or a client ca bundle file"
+	errMetricsBearerTokenEmpty   = "metrics bearer token file is empty"
+	errTLSFilesMissing           = "--tls-cert-file and --tls-key-file are required"
+	errTLSCertFileMissing        = "--tls-cert-file is required when --tls-key-file is set"
+	errTLSKeyFileMissing         = "--tls-key-file is required when --tls-cert-file is set"
+	errClientCABundleMissing     = "--client-ca-bundle-file is required when --client-auth-mode is not none"
+	errNoMetricsExporter         = "--otel-metrics-endpoint is required when --disable-prometheus-metrics is set"
+	errOTelMetricsInterval       = "--otel-metrics-interval must be positive"
+	errShutdownGracePeriod       = "--shutdown-grace-period must be positive"
+	errTokenWaitTimeout          = "--token-wait-timeout must not be negative"
+	errTokenCheckPeriod          = "--token-check-period must be at least 100ms"
+	errTokenWaitStopped          = "stopped waiting for control plane token file to be mounted"
+	errWatchShutdownGrace        = "--watch-shutdown-grace must be shorter than --shutdown-grace-period"
+	errServerTimeouts            = "--read-header-timeout, --read-timeout, --write-timeout and --idle-timeout must not be negative"
+	errAdvertiseConflict         = "--advertised-address and --advertise-pod-ip are mutually exclusive"
+	errDisableNATSConflict       = "--disable-nats and --lazy-nats-connect are mutually exclusive"
+	errStateDirConflict          = "--state-dir and --cert-cache-dir are mutually exclusive, the state directory caches gateway certs already"
+	errNATSReconnectPolicy       = "--nats-max-reconnects and --nats-reconnect-wait must not be negative, --nats-max-reconnect-wait must not be shorter than --nats-reconnect-wait, and --nats-reconnect-jitter must be between 0 and 1"
+	errRouteConcurrencyLimits    = "--route-concurrency-limits must map routes, one of %s, to positive limits"
+	errMetricsPortDisabled       = "--metrics-port cannot be set along with --disable-prometheus-metrics"
+	errMetricsPortNoBearer       = "secure metrics on --metrics-port require a bearer token file, since client certificates cannot be presented over plain HTTP"
+	errCertFetch                 = "--cert-fetch-retries and --cert-fetch-timeout must not be negative"
+	errCertCacheMaxAge           = "--cert-cache-max-age must not be negative"
+	errCertRefreshBackoff        = "--cert-refresh-initial-backoff must be positive and must not exceed --cert-refresh-max-backoff"
+	errMinMemory                 = "--min-memory must be a positive quantity of bytes, e.g. 128Mi"
+	errClusterIDConflict         = "--cluster-id and --cluster-id-config-map are mutually exclusive"
+	errClusterIDConfigMap        = "--cluster-id-config-map must be in namespace/name form"
+	errPathPatterns              = "--allowed-paths and --denied-paths must be valid regular expressions"
+	errReadCPIDOfToken           = "cannot read control plane id from token in %s"
+	errConflictingCPTokens       = "control plane tokens are for different control planes, %s is for %s but %s is for %s"
+	errNoControlPlaneToken       = "neither --control-plane-token-path nor the environment variable %q is set"
+	errControlPlaneHeader        = "--forward-control-plane-header %q is not a valid header name or would override a header set by the agent"
+	errUpboundAPIClientCert      = "--upbound-api-client-cert and --upbound-api-client-key must be set together"
+	errTrustedProxies            = "--trusted-proxies must be CIDRs, e.g. 10.0.0.0/8"
 )
 
+// UpboundFlags are the flags to connect to Upbound Cloud, shared by commands.
+type UpboundFlags struct {
+	NATSEndpoint          []string      `help:"Endpoints for nats, separated by commas. The agent connects to one of them at random and fails over to the others if it goes down."`
+	UpboundAPIEndpoint    string        `help:"Endpoint for Upbound API"`
+	ControlPlaneTokenPath string        `help:"File path of the platform token to access Upbound Cloud connect endpoint"`
+	ControlPlaneTokenEnv  string        `default:"CONTROL_PLANE_TOKEN" help:"Environment variable that the platform token is read from if --control-plane-token-path is not set, e.g. when secrets are injected as environment variables."`
+	TokenClockSkew        time.Duration `default:"2m" help:"Clock skew tolerated when validating time based claims of the control plane token."`
+	MaxTokenLifetime      time.Duration `help:"Maximum validity window (exp - iat) accepted for the control plane token. Not enforced if zero."`
+	UpboundAPIQPS         float64       `name:"upbound-api-qps" default:"5" help:"Maximum rate of requests per second to Upbound API, which are spaced out evenly. Requests are also held off for as long as Upbound API asks to with a Retry-After header. Not limited if zero."`
+	UpboundAPICABundle    string        `name:"upbound-api-ca-bundle" help:"CA bundle file used to verify the certificate of Upbound API, e.g. in environments with a custom PKI. The system roots are used if not set."`
+	UpboundAPIClientCert  string        `name:"upbound-api-client-cert" help:"Certificate file presented to Upbound API for mutual TLS, along with --upbound-api-client-key."`
+	UpboundAPIClientKey   string        `name:"upbound-api-client-key" help:"Private key file of --upbound-api-client-cert."`
+	ClusterID             string        `help:"ID of the cluster the agent runs in, e.g. a stable human assigned identity. Defaults to the UID of the kube-system namespace unless --cluster-id-config-map is set."`
+	ClusterIDConfigMap    string        `name:"cluster-id-config-map" help:"Config map in namespace/name form that the ID of the cluster is read from, e.g. if the agent is not allowed to read the kube-system namespace."`
+	ClusterIDConfigMapKey string        `name:"cluster-id-config-map-key" default:"cluster-id" help:"Key of --cluster-id-config-map that the ID of the cluster is read from."`
+}
+
+// clusterID returns the ID of the cluster, which is either set explicitly,
+// read from the configured config map or, if neither, the UID of the
+// kube-system namespace.
+func (f UpboundFlags) clusterID(kube client.Client) (string, error) {
+	switch {
+	case f.ClusterID != "":
+		return f.ClusterID, nil
+	case f.ClusterIDConfigMap != "":
+		return readClusterIDFromConfigMap(kube, f.ClusterIDConfigMap, f.ClusterIDConfigMapKey)
+	}
+	return readKubeClusterID(kube)
+}
+
+// upboundAPITLSConfig returns the TLS config of connections to Upbound API, or
+// nil if the defaults are used.
+func (f UpboundFlags) upboundAPITLSConfig() (*tls.Config, error) {
+	if (f.UpboundAPIClientCert == "") != (f.UpboundAPIClientKey == "") {
+		return nil, errors.New(errUpboundAPIClientCert)
+	}
+	if f.UpboundAPICABundle == "" && f.UpboundAPIClientCert == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if f.UpboundAPICABundle != "" {
+		b, err := os.ReadFile(filepath.Clean(f.UpboundAPICABundle))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read upbound api ca bundle file")
+		}
+		if cfg.RootCAs, err = generateTrustedCertPool(b); err != nil {
+			return nil, errors.Wrap(err, "failed to generate upbound api ca cert pool")
+		}
+		upboundagent.ObserveCertExpiry(upboundagent.CertRoleUpboundAPICA, b)
+	}
+	if f.UpboundAPIClientCert != "" {
+		c, err := tls.LoadX509KeyPair(f.UpboundAPIClientCert, f.UpboundAPIClientKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load upbound api client certificate")
+		}
+		cfg.Certificates = []tls.Certificate{c}
+	}
+	return cfg, nil
+}
+
+// controlPlaneChangeSwitch switches to a different control plane that a
+// reloaded control plane token is for, rather than rejecting the token.
+const controlPlaneChangeSwitch = "switch"
+
+// Client authentication modes.
+const (
+	clientAuthNone             = "none"
+	clientAuthVerifyIfGiven    = "verify-if-given"
+	clientAuthRequireAndVerify = "require-and-verify"
+)
+
+var clientAuthModes = map[string]tls.ClientAuthType{
+	clientAuthNone:             tls.NoClientCert,
+	clientAuthVerifyIfGiven:    tls.VerifyClientCertIfGiven,
+	clientAuthRequireAndVerify: tls.RequireAndVerifyClientCert,
+}
+
 // AgentCmd represents the "upbound-agent" command
 type AgentCmd struct {
-	PodName               string `help:"Name of the agent pod."`
-	ServerPort            string `default:"6443" help:"Port to serve agent service."`
-	TLSCertFile           string `help:"File containing the default x509 Certificate for HTTPS."`
-	TLSKeyFile            string `help:"File containing the default x509 private key matching provided cert"`
-	XgqlCABundleFile      string `help:"CA bundle file for xgql server"`
-	NATSEndpoint          string `help:"Endpoint for nats"`
-	UpboundAPIEndpoint    string `help:"Endpoint for Upbound API"`
-	ControlPlaneTokenPath string `help:"File path of the platform token to access Upbound Cloud connect endpoint"`
+	UpboundFlags
+
+	Config configFile `help:"YAML file that maps the names of flags to their values, e.g. tls-cert-file: /etc/certs/upbound-agent/tls.crt, so that the configuration can be version controlled. Flags set on the command line take precedence. Unknown flags in the file are rejected."`
+
+	PodName           string        `help:"Name of the agent pod."`
+	ServerPort        string        `default:"6443" help:"Port to serve agent service."`
+	TLSCertFile       string        `help:"File containing the default x509 Certificate for HTTPS."`
+	TLSKeyFile        string        `help:"File containing the default x509 private key matching provided cert"`
+	TLSCertDir        string        `help:"Directory containing additional x509 certificates in .crt files, each with its private key in the .key file of the same name. They are served to clients asking for one of their names via SNI, and the default certificate to all others. Only loaded at startup."`
+	TLSReloadInterval time.Duration `default:"1m" help:"Interval on which the TLS certificate and key files are reloaded if they changed, e.g. when cert-manager rotates them. The current certificate keeps being served if they cannot be loaded. Not reloaded if zero."`
+	XgqlCABundleFile  string        `help:"CA bundle file for xgql server"`
+
+	ProbePort    string `help:"Port that /healthz, /livez and /readyz are additionally served on over plain HTTP, so that Kubernetes probes do not need TLS or client certificates, along with /info, which is only served there. Not served separately if empty."`
+	DebugAddress string `default:"127.0.0.1:6060" help:"Localhost address that diagnostic endpoints, like /debug/stacks, are served on in debug mode. They are never served on the serving port."`
+
+	LogResolvedEndpoints   bool          `help:"Log the IP addresses that Upbound API and NATS endpoints resolve to at startup. Always enabled in debug mode."`
+	EndpointResolveTimeout time.Duration `default:"5s" help:"Timeout for resolving each endpoint when logging resolved endpoints."`
+
+	ControlPlaneTokenReloadInterval time.Duration `default:"1m" help:"Interval on which the control plane token file is reloaded if it changed, e.g. when the mounted secret is rotated. A rotated token is validated like at startup and the current one is kept if it is invalid. Not reloaded if zero."`
+	ControlPlaneChange              string        `default:"reject" enum:"reject,switch" help:"What to do when a reloaded control plane token is for a different control plane, one of reject or switch. reject keeps the current token, switch logs a warning and restarts the agent gracefully to run for the new control plane."`
+	TokenWaitTimeout                time.Duration `default:"5m" help:"Maximum time to wait for the control plane token file to be mounted at startup, after which the agent exits. Waits indefinitely if zero."`
+	TokenCheckPeriod                time.Duration `default:"3s" help:"Period on which the agent checks whether the control plane token file was mounted while waiting for it at startup. Must be at least 100ms. The default is used if zero."`
+
+	MetricsSecure             bool   `help:"Require scrapers of the metrics endpoint to authenticate with a bearer token or a client certificate."`
+	MetricsBearerTokenFile    string `help:"File containing the bearer token accepted by the metrics endpoint in secure mode."`
+	MetricsClientCABundleFile string `help:"CA bundle file used to verify client certificates presented to the metrics endpoint in secure mode."`
+
+	OTelMetricsEndpoint      string        `name:"otel-metrics-endpoint" help:"Endpoint of an OpenTelemetry collector, e.g. http://otel-collector:4318, that the metrics are pushed to via OTLP over HTTP. /v1/metrics is appended if it has no path. Not pushed if empty."`
+	OTelMetricsInterval      time.Duration `name:"otel-metrics-interval" default:"30s" help:"Interval on which the metrics are pushed to --otel-metrics-endpoint."`
+	DisablePrometheusMetrics bool          `help:"Disable the Prometheus metrics endpoint. Requires --otel-metrics-endpoint."`
+	MetricsPort              string        `help:"Port that /metrics is additionally served on over plain HTTP, e.g. for a ServiceMonitor. Not served separately if empty."`
+
+	ReadHeaderTimeout time.Duration `default:"5s" help:"How long the server reads the headers of a request, so that slow clients cannot exhaust connections. The default is used if zero."`
+	ReadTimeout       time.Duration `default:"10s" help:"How long the server reads a whole request, including its body. Not bounded if zero."`
+	WriteTimeout      time.Duration `default:"0s" help:"How long the server writes a response. Not bounded if zero, which is required for watches since they stream their response for as long as they are open."`
+	IdleTimeout       time.Duration `default:"2m" help:"How long idle keep-alive connections of clients are kept open. --read-timeout is used if zero."`
+
+	ShutdownGracePeriod time.Duration `default:"20s" help:"How long the server waits on shutdown for in-flight requests to complete before it closes their connections forcibly. Should fit into the termination grace period of the pod, together with draining the NATS connection."`
+	ShutdownRejectNew   bool          `help:"Reject new requests with 503 once the agent shuts down, so that load balancers route them to another replica, while in-flight requests complete within --shutdown-grace-period. New requests are accepted and completed otherwise."`
+	WatchShutdownGrace  time.Duration `default:"0s" help:"How long in-flight watches are kept open on shutdown before they are ended cleanly, signaling clients to re-establish them. They are ended immediately if zero. Must be shorter than --shutdown-grace-period, after which they would be closed forcibly."`
+
+	XgqlEndpoints           []string      `default:"https://xgql" help:"Endpoints of xgql backends. Requests are balanced across healthy backends in a round-robin fashion."`
+	XgqlHealthCheckInterval time.Duration `default:"10s" help:"Interval on which xgql backends are health checked. Backends are not health checked if zero."`
+	XgqlHealthCheck         bool          `help:"Report ready on /readyz only if any xgql backend responds to a request for --xgql-health-check-path with --xgql-health-check-status."`
+	XgqlHealthCheckPath     string        `default:"/" help:"Path of the xgql backends that is requested by --xgql-health-check."`
+	XgqlHealthCheckStatus   int           `default:"200" help:"Status that xgql backends must respond with to --xgql-health-check."`
+
+	XgqlCAReloadInterval time.Duration `default:"1m" help:"Interval on which the xgql CA bundle file is reloaded if it changed. Not reloaded if zero."`
+
+	NATSStatsInterval time.Duration `default:"15s" help:"Interval on which the statistics of the NATS connection are exported as metrics. Not exported if zero."`
+
+	NATSMaxReconnects    int           `default:"0" help:"Number of attempts to re-establish a lost NATS connection before giving up, after which the agent is not ready anymore. Unlimited if zero."`
+	NATSReconnectWait    time.Duration `default:"1s" help:"Wait before the first attempt to re-establish a lost NATS connection, doubled with every attempt up to --nats-max-reconnect-wait."`
+	NATSMaxReconnectWait time.Duration `default:"30s" help:"Maximum wait between attempts to re-establish a lost NATS connection."`
+	NATSReconnectJitter  float64       `default:"0.2" help:"Fraction of the wait between attempts to re-establish a lost NATS connection that is randomly added to it, so that agents do not reconnect all at once."`
+
+	DisableNATS            bool          `name:"disable-nats" help:"Do not connect to NATS, so that the agent only serves its local endpoint, e.g. for testing or on-cluster only setups. Requests from Upbound Cloud are not received, while tokens are still validated with the gateway certs."`
+	LazyNATSConnect        bool          `help:"Defer connecting to NATS until the first request to the agent, which waits for the connection up to --lazy-nats-connect-timeout. Requests from Upbound Cloud are only received once connected."`
+	LazyNATSConnectTimeout time.Duration `default:"5s" help:"How long the first request waits for the NATS connection with --lazy-nats-connect. The connection is still established in the background after the timeout."`
+
+	NATSSubscribeFlushTimeout time.Duration `default:"10s" help:"How long the agent waits for the NATS server to acknowledge its subscription at startup before it reports ready. Startup fails if it is not acknowledged in time. Not waited for if zero."`
+
+	RejectOversizedNATSRequests bool `name:"reject-oversized-nats-requests" help:"Reject requests relayed over NATS whose body exceeds the max payload of the NATS connection with 413 Payload Too Large and a message naming the limit."`
+
+	MaxConcurrentRequests int           `help:"Maximum number of proxied requests handled at the same time. Not limited if zero."`
+	QueueTimeout          time.Duration `help:"How long a request waits for a free slot when the maximum number of concurrent requests is reached before it is rejected with 503. This only bounds the wait, not the handling of the request. Waits as long as the client if zero."`
+
+	RouteConcurrencyLimits map[string]int `mapsep:"," help:"Maximum number of proxied requests handled at the same time per route, e.g. k8s=100,k8s-watch=50,xgql=20, in addition to --max-concurrent-requests. Routes are k8s, k8s-watch for watches, and xgql. Requests wait for a free slot of their route up to --queue-timeout. Routes that are not listed are not limited."`
+
+	ClientRateLimitQPS   float64 `help:"Maximum rate of proxied requests per second of each client, identified by its verified certificate or the Upbound ID in its token. Requests exceeding it are rejected with 429. Not limited if zero."`
+	ClientRateLimitBurst int     `help:"Number of requests a client may exceed --client-rate-limit-qps by in a burst. Defaults to the rate rounded up if zero."`
+	MaxRequestsPerSecond float64 `help:"Maximum rate of proxied requests per second of all clients together, so that a flood of requests does not overwhelm the API server. Requests exceeding it are rejected with 429 and a Retry-After header. Not limited if zero."`
+	Burst                int     `help:"Number of requests that may exceed --max-requests-per-second in a burst. Defaults to the rate rounded up if zero."`
+
+	OTelEndpoint    string `name:"otel-endpoint" help:"Endpoint of an OpenTelemetry collector, e.g. http://otel-collector:4318, that spans of proxied requests, their requests to the Kubernetes API server and xgql, and requests to Upbound API are exported to via OTLP over HTTP. /v1/traces is appended if it has no path. Not traced if empty."`
+	TraceDownstream bool   `help:"Measure the DNS lookup, connect, TLS handshake and time to first byte of proxied requests to the Kubernetes API server and xgql, exported as histograms and logged in debug mode. Adds some overhead to every request."`
+
+	DeadlineHeader     string        `help:"Header carrying the deadline of proxied requests, either as an RFC 3339 timestamp or as a duration like 30s. Requests whose deadline has passed or is closer than --min-request-deadline are rejected with 504 without being proxied. Deadlines are not checked if empty."`
+	MinRequestDeadline time.Duration `help:"Minimum time left until the deadline of a request for it to be proxied. Only requests whose deadline has passed are rejected if zero."`
+
+	AllowedPaths []string `sep:"none" help:"Regular expression of the paths of the Kubernetes API server that can be proxied, matching the whole path, e.g. /apis/pkg\\.crossplane\\.io/.*. Repeat to allow more paths. Other paths are rejected with 403. Any path is allowed if not set."`
+	DeniedPaths  []string `sep:"none" help:"Regular expression of the paths of the Kubernetes API server that cannot be proxied, even if allowed, matching the whole path, e.g. /api/v1/(namespaces/[^/]+/)?secrets(/.*)?. Repeat to deny more paths. Denied paths are rejected with 403."`
+
+	IdleHeartbeatInterval time.Duration `help:"Interval on which the agent logs that it is alive, whether it is connected to NATS and the number of requests handled since start, if it did not handle any requests in the meantime. Not logged if zero."`
+
+	AccessLogErrorsOnly bool `help:"Log only requests that resulted in an error response, i.e. server errors, timeouts and authentication failures. By default, every request is logged in debug mode and none otherwise."`
+
+	AuditLog        bool   `help:"Write an audit entry with the time, method, path, response status and token subject of every proxied request as a line of JSON to stdout. Request and response bodies are never recorded."`
+	AuditLogPath    string `help:"File that audit entries are appended to in addition to stdout. Implies --audit-log."`
+	AuditLogHeaders bool   `help:"Capture the request headers in audit entries, with the values of credential headers like Authorization redacted."`
+
+	AdvertisedAddress string `help:"Address that replaces the server address in Kubernetes discovery responses, for clients that construct subsequent URLs from it. Not rewritten if empty."`
+	AdvertisePodIP    bool   `help:"Advertise the IP of the agent pod with --server-port as the server address in Kubernetes discovery responses. The IP is read from the POD_IP environment variable, which must be set from status.podIP via the downward API."`
+
+	ForwardClientIP           bool     `help:"Set X-Forwarded-For and X-Real-IP headers on proxied requests based on the remote client address, e.g. for audit logging on the API server."`
+	TrustedProxies            []string `help:"CIDRs of proxies in front of the agent, e.g. a load balancer, whose X-Forwarded-For entries are kept with --forward-client-ip. Entries sent by other clients are dropped."`
+	ForwardControlPlaneHeader string   `help:"Name of a header, e.g. X-Upbound-Control-Plane-ID, that is set to the control plane ID on requests proxied to the API server, to attribute them in audit logs. Values sent by clients are removed. Not set if empty."`
+
+	RequireNonRoot bool `help:"Refuse to start if running as root. A warning is logged otherwise."`
+
+	StrictServingCertChain bool `help:"Refuse to start if the certificate in --tls-cert-file does not include the intermediates needed to chain up to a trusted root. A warning is logged otherwise."`
+
+	MinMemory       string `help:"Minimum memory limit of the agent container, e.g. 128Mi, that the cgroup memory limit is checked against at startup. A warning is logged if it is lower. Not checked if empty."`
+	StrictMinMemory bool   `help:"Refuse to start if the memory limit of the agent container is lower than --min-memory."`
+
+	StrictFilePermissions bool `help:"Fail at startup if the control plane token file or the TLS key file is accessible by other users."`
+
+	StrictTokenEnvironment bool `help:"Fail at startup if the issuer or audience of the control plane token is in a different domain than --upbound-api-endpoint, which indicates a token for a different environment. A warning is logged otherwise."`
+
+	ClientCABundleFile string `help:"CA bundle file used to verify the certificates of clients of the agent according to --client-auth-mode."`
+	ClientAuthMode     string `default:"none" enum:"none,verify-if-given,require-and-verify" help:"Whether clients of the agent must present a certificate signed by a CA in --client-ca-bundle-file. One of none, verify-if-given or require-and-verify. Applies to /k8s and /xgql, but not the probe and metrics endpoints."`
+
+	APIServerCertPin string `help:"Hex encoded SHA-256 fingerprint of the certificate that the Kubernetes API server must serve to proxied requests, in addition to being trusted. Connections are rejected if it does not match. The pin must be updated whenever the API server certificate is rotated. Not pinned if empty."`
+
+	CertRefreshInterval       time.Duration `default:"1h" help:"Interval on which the gateway certs are refreshed from Upbound API. Not refreshed if zero."`
+	CertRefreshInitialBackoff time.Duration `default:"10s" help:"Wait after the first failed gateway certs refresh, doubled for each consecutive failure."`
+	CertRefreshMaxBackoff     time.Duration `default:"10m" help:"Maximum wait between failed gateway certs refreshes."`
+	CertCacheDir              string        `help:"Directory where the gateway certs fetched from Upbound API are cached. The agent starts with the cached certs if Upbound API is unreachable at startup. Not cached if empty."`
+	CertCacheMaxAge           time.Duration `help:"Maximum age of cached gateway certs that the agent starts with if Upbound API is unreachable at startup. Older certs are not used, so that startup fails instead. Not limited if zero."`
+	StateDir                  string        `help:"Directory where the last known good configuration and gateway certs are persisted. The agent starts serving from them right away on restart and re-validates them against Upbound API in the background. Must only be writable by the agent. Not persisted if empty."`
+
+	CopyBufferSize int `default:"32768" help:"Size in bytes of the pooled buffers that proxied response bodies are copied with. Request bodies are streamed by the transport and do not use them. Larger buffers may increase throughput for large payloads at the cost of memory per in-flight request. Buffers are allocated per request if zero."`
+
+	EnableCompression bool `help:"Compress proxied responses with gzip as they are streamed, if the request accepts it with its Accept-Encoding header. Responses that are already encoded, e.g. by the Kubernetes API server, or have a compressed content type are passed through."`
+
+	StartupRetryBudget time.Duration `help:"Total time shared by retries of startup network operations, i.e. fetching gateway certs, reading kube cluster ID and connecting to NATS. Startup fails once exhausted. Operations are not retried if zero."`
+	CertFetchRetries   int           `default:"5" help:"Number of times fetching the gateway certs is retried with backoff at startup before giving up, within the bounds of --startup-retry-budget if set."`
+	CertFetchTimeout   time.Duration `default:"30s" help:"Timeout of each request to Upbound API, i.e. fetching gateway certs and NATS JWTs. The default of 30s is used if zero."`
+}
+
+// Validate validates the flags of the command.
+func (a AgentCmd) Validate() error {
+	switch {
+	case a.TLSCertFile == "" && a.TLSKeyFile == "":
+		return errors.New(errTLSFilesMissing)
+	case a.TLSCertFile == "":
+		return errors.New(errTLSCertFileMissing)
+	case a.TLSKeyFile == "":
+		return errors.New(errTLSKeyFileMissing)
+	case clientAuthModes[a.ClientAuthMode] != tls.NoClientCert && a.ClientCABundleFile == "":
+		return errors.New(errClientCABundleMissing)
+	case a.DisablePrometheusMetrics && a.OTelMetricsEndpoint == "":
+		return errors.New(errNoMetricsExporter)
+	case a.OTelMetricsEndpoint != "" && a.OTelMetricsInterval <= 0:
+		return errors.New(errOTelMetricsInterval)
+	case a.MetricsPort != "" && a.DisablePrometheusMetrics:
+		return errors.New(errMetricsPortDisabled)
+	case a.MetricsPort != "" && a.MetricsSecure && a.MetricsBearerTokenFile == "":
+		return errors.New(errMetricsPortNoBearer)
+	case a.ShutdownGracePeriod <= 0:
+		return errors.New(errShutdownGracePeriod)
+	case a.ReadHeaderTimeout < 0 || a.ReadTimeout < 0 || a.WriteTimeout < 0 || a.IdleTimeout < 0:
+		return errors.New(errServerTimeouts)
+	case a.NATSMaxReconnects < 0 || a.NATSReconnectWait < 0 || a.NATSMaxReconnectWait < a.NATSReconnectWait || a.NATSReconnectJitter < 0 || a.NATSReconnectJitter > 1:
+		return errors.New(errNATSReconnectPolicy)
+	case a.TokenWaitTimeout < 0:
+		return errors.New(errTokenWaitTimeout)
+	case a.TokenCheckPeriod != 0 && a.TokenCheckPeriod < minTokenCheckPeriod:
+		return errors.New(errTokenCheckPeriod)
+	case a.CertFetchRetries < 0 || a.CertFetchTimeout < 0:
+		return errors.New(errCertFetch)
+	case a.CertCacheMaxAge < 0:
+		return errors.New(errCertCacheMaxAge)
+	case a.MinMemory != "" && memoryBytes(a.MinMemory) <= 0:
+		return errors.New(errMinMemory)
+	case a.WatchShutdownGrace < 0 || a.WatchShutdownGrace >= a.ShutdownGracePeriod:
+		return errors.New(errWatchShutdownGrace)
+	case a.AdvertisedAddress != "" && a.AdvertisePodIP:
+		return errors.New(errAdvertiseConflict)
+	case a.DisableNATS && a.LazyNATSConnect:
+		return errors.New(errDisableNATSConflict)
+	case a.StateDir != "" && a.CertCacheDir != "":
+		return errors.New(errStateDirConflict)
+	case a.certRefreshEnabled() && (a.CertRefreshInitialBackoff <= 0 || a.CertRefreshMaxBackoff < a.CertRefreshInitialBackoff):
+		// Failed refreshes would otherwise be retried right away.
+		return errors.New(errCertRefreshBackoff)
+	case !validRegexps(a.AllowedPaths) || !validRegexps(a.DeniedPaths):
+		return errors.New(errPathPatterns)
+	case a.ClusterID != "" && a.ClusterIDConfigMap != "":
+		return errors.New(errClusterIDConflict)
+	case a.ClusterIDConfigMap != "" && !validNamespacedName(a.ClusterIDConfigMap):
+		return errors.New(errClusterIDConfigMap)
+	case !validRouteLimits(a.RouteConcurrencyLimits):
+		return errors.Errorf(errRouteConcurrencyLimits, strings.Join(upboundagent.Routes, ", "))
+	case a.ForwardControlPlaneHeader != "" && !validControlPlaneHeader(a.ForwardControlPlaneHeader):
+		return errors.Errorf(errControlPlaneHeader, a.ForwardControlPlaneHeader)
+	}
+	if _, err := parseCIDRs(a.TrustedProxies); err != nil {
+		return errors.Wrap(err, errTrustedProxies)
+	}
+	return nil
+}
+
+// probeAddress returns the address to serve probes on separately, if any.
+func (a AgentCmd) probeAddress() string {
+	if a.ProbePort == "" {
+		return ""
+	}
+	return ":" + a.ProbePort
+}
+
+// tokenCheckPeriod returns the period on which the control plane token file is
+// checked while waiting for it to be mounted.
+func (a AgentCmd) tokenCheckPeriod() time.Duration {
+	if a.TokenCheckPeriod == 0 {
+		return defaultTokenCheckPeriod
+	}
+	return a.TokenCheckPeriod
+}
+
+// certRefreshEnabled returns true if the gateway certs are refreshed, i.e. on
+// an interval or once after they were restored from the state directory.
+func (a AgentCmd) certRefreshEnabled() bool {
+	return a.CertRefreshInterval > 0 || a.StateDir != ""
+}
+
+// certCacheDir returns the directory that refreshed gateway certs are cached
+// in, if any. Certs restored from the state directory are kept up to date
+// there.
+func (a AgentCmd) certCacheDir() string {
+	if a.StateDir != "" {
+		return a.StateDir
+	}
+	return a.CertCacheDir
+}
+
+// advertisedAddress returns the address to advertise in Kubernetes discovery
+// responses, if any.
+func (a AgentCmd) advertisedAddress() string {
+	if a.AdvertisePodIP {
+		return net.JoinHostPort(os.Getenv(envPodIP), a.ServerPort)
+	}
+	return a.AdvertisedAddress
+}
+
+// reHeaderName matches valid header names, i.e. RFC 7230 tokens.
+var reHeaderName = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// validControlPlaneHeader returns true if the given name is a valid header
+// name that does not override the authentication or impersonation headers the
+// agent sets, or the headers that frame the request.
+func validControlPlaneHeader(name string) bool {
+	if !reHeaderName.MatchString(name) {
+		return false
+	}
+	switch c := http.CanonicalHeaderKey(name); {
+	case c == "Authorization", c == "Host", c == "Content-Length", c == "Transfer-Encoding", strings.HasPrefix(c, "Impersonate-"):
+		return false
+	}
+	return true
+}
+
+// validRouteLimits returns true if the given limits are positive and keyed by
+// known routes.
+func validRouteLimits(limits map[string]int) bool {
+	for route, max := range limits {
+		known := false
+		for _, r := range upboundagent.Routes {
+			known = known || r == route
+		}
+		if !known || max <= 0 {
+			return false
+		}
+	}
+	return true
 }
 
 var cli struct {
-	Debug bool `help:"Enable debug mode"`
+	Debug                 bool   `help:"Enable debug mode"`
+	LogFormat             string `default:"auto" enum:"auto,console,json,logfmt" help:"Format of the logs, one of auto, console, json or logfmt. auto writes console logs in debug mode and JSON otherwise."`
+	LogLevel              string `default:"auto" enum:"auto,debug,info,warn" help:"Minimum level of the logs, one of auto, debug, info or warn. auto logs at debug level in debug mode and at info level otherwise. Warnings and startup failures are logged at warn level."`
+	LogSamplingInitial    int    `default:"100" help:"Number of log entries with the same level and message that are logged each second before sampling starts. The first entry of a message with a given error is always logged. Sampling is disabled if zero, or in debug mode."`
+	LogSamplingThereafter int    `default:"100" help:"Log every Nth entry with the same level and message each second once --log-sampling-initial is exceeded."`
 
-	Agent AgentCmd `cmd:"" help:"Runs Upbound Agent"`
+	Agent    AgentCmd    `cmd:"" help:"Runs Upbound Agent"`
+	Check    CheckCmd    `cmd:"" help:"Checks connectivity to Upbound Cloud and the Kubernetes API server"`
+	Validate ValidateCmd `cmd:"" help:"Runs the startup steps of Upbound Agent with the same flags, prints a report of them and exits without serving requests"`
+	Version  VersionCmd  `cmd:"" help:"Prints the version, git commit and build date of Upbound Agent"`
 }
 
 func main() { // nolint:gocyclo
 	ctx := kong.Parse(&cli)
-	zl := zap.New(zap.UseDevMode(cli.Debug))
-	log := logging.NewLogrLogger(zl.WithName("upbound-agent"))
-	a := cli.Agent
+	if ctx.Command() == "version" {
+		ctx.FatalIfErrorf(cli.Version.run(os.Stdout))
+		return
+	}
+	log, err := newLogger(cli.LogFormat, cli.LogLevel, cli.Debug, logSampling{Initial: cli.LogSamplingInitial, Thereafter: cli.LogSamplingThereafter}, os.Stderr)
+	ctx.FatalIfErrorf(err)
+	if ctx.Command() == "check" {
+		ctx.FatalIfErrorf(cli.Check.normalizeEndpoints(true))
+		ctx.FatalIfErrorf(cli.Check.run(log, os.Stdout))
+		return
+	}
+	// Validating runs the same steps as the agent, but reports them rather
+	// than serving requests.
+	a, v := cli.Agent, (*validation)(nil)
+	if ctx.Command() == "validate" {
+		a, v = cli.Validate.AgentCmd, newValidation(os.Stdout)
+	}
+	if err := a.normalizeEndpoints(); err != nil {
+		failStartup(ctx, log, v, failureConfig, errors.Wrap(err, "invalid endpoint"))
+	}
+
+	if err := checkRequiredEnv(a.requiredEnv(), os.LookupEnv); err != nil {
+		failStartup(ctx, log, v, failureConfig, errors.Wrap(err, "failed to validate environment"))
+	}
+
+	if err := checkNonRoot(os.Geteuid(), a.RequireNonRoot, log); err != nil {
+		failStartup(ctx, log, v, failureConfig, err)
+	}
+
+	if err := checkServingKeyPair(a.TLSCertFile, a.TLSKeyFile, time.Now(), log); err != nil {
+		failStartup(ctx, log, v, failureCert, errors.Wrap(err, "failed to load serving certificate"))
+	}
 
-	token, err := waitForControlPlaneToken(a.ControlPlaneTokenPath, controlPlaneTokenCheckPeriod, log)
+	if err := checkServingCertChain(a.TLSCertFile, a.StrictServingCertChain, log); err != nil {
+		failStartup(ctx, log, v, failureCert, errors.Wrap(err, "failed to validate serving certificate"))
+	}
+	v.pass(failureCert, "serving certificate and key are valid")
+
+	if a.MinMemory != "" {
+		if err := checkMinMemory(cgroupRoot, memoryBytes(a.MinMemory), a.StrictMinMemory, log); err != nil {
+			failStartup(ctx, log, v, failureConfig, err)
+		}
+	}
+	v.pass(failureConfig, "flags and environment are valid")
+
+	if cli.Debug || a.LogResolvedEndpoints {
+		// Resolution is best effort and must not delay startup.
+		endpoints := map[string]string{"upbound-api": a.UpboundAPIEndpoint}
+		for i, e := range a.NATSEndpoint {
+			endpoints[fmt.Sprintf("nats-%d", i)] = e
+		}
+		go logResolvedEndpoints(net.DefaultResolver, endpoints, a.EndpointResolveTimeout, log)
+	}
+
+	// The wait for the token is cancelled on shutdown signals, which the
+	// proxy only handles once it runs.
+	waitCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	if a.tokenCheckPeriod() > maxTokenCheckPeriod {
+		log.Info("warning: --token-check-period is long, startup may be delayed by up to that long after the control plane token file was mounted", "token-check-period", a.tokenCheckPeriod().String())
+	}
+	token, err := readControlPlaneToken(waitCtx, a.ControlPlaneTokenPath, a.ControlPlaneTokenEnv, a.TokenWaitTimeout, a.tokenCheckPeriod(), os.LookupEnv, log)
+	stop()
 	if err != nil {
-		ctx.FatalIfErrorf(errors.Wrap(err, "failed to wait for control plane token"))
+		failStartup(ctx, log, v, failureToken, errors.Wrap(err, "failed to read control plane token"))
+	}
+
+	// The NATS CA is written to a temporary file.
+	writable := map[string]string{"nats ca": os.TempDir()}
+	if a.CertCacheDir != "" {
+		writable["gateway certs cache"] = a.CertCacheDir
+	}
+	if a.StateDir != "" {
+		writable["state"] = a.StateDir
+	}
+	if a.AuditLogPath != "" {
+		writable["audit log"] = filepath.Dir(a.AuditLogPath)
+	}
+	if err := checkWritable(writable); err != nil {
+		failStartup(ctx, log, v, failureConfig, errors.Wrap(err, "failed to validate writable paths"))
 	}
 
-	cpID, err := readCPIDFromToken(token)
+	if err := checkSensitiveFiles(a.StrictFilePermissions, log, a.ControlPlaneTokenPath, a.TLSKeyFile); err != nil {
+		failStartup(ctx, log, v, failureConfig, errors.Wrap(err, "failed to validate file permissions"))
+	}
+	v.pass(failureConfig, "paths are writable and file permissions are valid")
+
+	tokenChecks := []tokenCheck{withExpiry(a.TokenClockSkew, time.Now), withMaxLifetime(a.MaxTokenLifetime, a.TokenClockSkew), withNotBefore(a.TokenClockSkew, time.Now)}
+	cpIDs := newCPIDCache(tokenChecks...)
+	cpID, err := cpIDs.Get(token)
 	if err != nil {
-		ctx.FatalIfErrorf(errors.Wrap(err, "failed to read control plane id from token"))
+		failStartup(ctx, log, v, failureToken, errors.Wrap(err, "failed to read control plane id from token"))
 	}
+	if err := checkTokenEnvironment(token, a.UpboundAPIEndpoint, a.StrictTokenEnvironment, log); err != nil {
+		failStartup(ctx, log, v, failureToken, errors.Wrap(err, "failed to validate control plane token environment"))
+	}
+
+	budget := newRetryBudget(a.StartupRetryBudget, log)
 
-	upClient := upbound.NewClient(a.UpboundAPIEndpoint, log, cli.Debug)
-	pubCerts, err := upClient.GetGatewayCerts(token)
+	tracer, err := tracing.New(a.OTelEndpoint, cpID, log)
 	if err != nil {
-		ctx.FatalIfErrorf(errors.Wrap(err, "failed to fetch public certs"))
+		failStartup(ctx, log, v, failureConfig, err)
 	}
-	pem, err := base64.StdEncoding.DecodeString(pubCerts.JWTPublicKey)
+	upTLS, err := a.upboundAPITLSConfig()
 	if err != nil {
-		ctx.FatalIfErrorf(errors.Wrap(err, "failed to base64 decode provided jwt public key"))
+		failStartup(ctx, log, v, failureCert, err)
 	}
-
-	pk, err := jwt.ParseRSAPublicKeyFromPEM(pem)
+	upClient := upbound.NewClient(a.UpboundAPIEndpoint, log, cli.Debug, upbound.WithQPS(a.UpboundAPIQPS), upbound.WithTimeout(a.CertFetchTimeout), upbound.WithTLSConfig(upTLS), upbound.WithTracer(tracer))
+	var pubCerts upbound.PublicCerts
+	restored, certSource := false, "fetched from upbound api"
+	if a.StateDir != "" {
+		cached, err := upboundagent.RestoreState(a.StateDir, cpID, a.UpboundAPIEndpoint)
+		if err == nil {
+			log.Info("restored persisted state, re-validating gateway certs against Upbound API in the background", "state-dir", a.StateDir, "fetched-at", cached.FetchedAt.String())
+			pubCerts = cached.PublicCerts
+			restored, certSource = true, "restored from state"
+			upboundagent.UseCachedCerts()
+		} else {
+			log.Info("cannot restore persisted state, fetching gateway certs", "error", err)
+		}
+	}
+	if !restored {
+		err = budget.DoRetries("fetch gateway certs", a.CertFetchRetries, func() error {
+			var err error
+			pubCerts, err = upClient.GetGatewayCerts(token)
+			return err
+		})
+	}
+	switch {
+	case restored:
+		// Re-validated by the cert refresher once the agent runs.
+	case err == nil && v != nil:
+		// Validating does not persist anything.
+	case err == nil && a.StateDir != "":
+		s := upboundagent.State{ControlPlaneID: cpID, UpboundAPIEndpoint: a.UpboundAPIEndpoint, SavedAt: time.Now().UTC()}
+		if err := upboundagent.WriteState(a.StateDir, s, upboundagent.CachedCerts{PublicCerts: pubCerts, FetchedAt: s.SavedAt}); err != nil {
+			log.Info("cannot persist state", "error", err)
+		}
+	case err == nil && a.CertCacheDir != "":
+		if err := upboundagent.WriteCertCache(a.CertCacheDir, pubCerts, time.Now()); err != nil {
+			log.Info("cannot cache gateway certs", "error", err)
+		}
+	case err != nil && a.CertCacheDir != "":
+		now := time.Now()
+		cached, cerr := upboundagent.ReadFreshCertCache(a.CertCacheDir, a.CertCacheMaxAge, now)
+		if cerr != nil {
+			failStartup(ctx, log, v, failureCert, errors.Wrapf(err, "failed to fetch public certs and no usable cached certs are available: %s", cerr))
+		}
+		log.Info("warning: failed to fetch public certs, running off cached gateway certs until they are refreshed", "error", err, "fetched-at", cached.FetchedAt.String(), "age", now.Sub(cached.FetchedAt).Round(time.Second).String())
+		pubCerts, certSource = cached.PublicCerts, "read from cache"
+		upboundagent.UseCachedCerts()
+	case err != nil:
+		failStartup(ctx, log, v, failureCert, errors.Wrap(err, "failed to fetch public certs"))
+	}
+	pk, err := upboundagent.ParseTokenPublicKeys(pubCerts.JWTPublicKey)
 	if err != nil {
-		ctx.FatalIfErrorf(errors.Wrap(err, "failed to parse public key"))
+		failStartup(ctx, log, v, failureCert, err)
+	}
+	// The control plane ID was read from the token before its signature could
+	// be verified, since the public keys are fetched with it.
+	if err := upboundagent.VerifyTokenSignature(token, pk); err != nil {
+		failStartup(ctx, log, v, failureToken, errors.Wrap(err, "failed to verify control plane token"))
 	}
+	v.pass(failureToken, fmt.Sprintf("control plane id %s", cpID))
+	v.pass(failureCert, "gateway certs are valid, "+certSource)
 
 	var xgqlCertPool *x509.CertPool
 	if a.XgqlCABundleFile != "" {
 		b, err := os.ReadFile(filepath.Clean(a.XgqlCABundleFile))
 		if err != nil {
-			ctx.FatalIfErrorf(errors.Wrap(err, "failed to read xgql ca bundle file"))
+			failStartup(ctx, log, v, failureCert, errors.Wrap(err, "failed to read xgql ca bundle file"))
 		}
 		xgqlCertPool, err = generateTrustedCertPool(b)
 		if err != nil {
-			ctx.FatalIfErrorf(errors.Wrap(err, "failed to generate xgql ca cert pool"))
+			failStartup(ctx, log, v, failureCert, errors.Wrap(err, "failed to generate xgql ca cert pool"))
+		}
+		upboundagent.ObserveCertExpiry(upboundagent.CertRoleXGQLCA, b)
+	}
+
+	metricsConfig, err := a.metricsConfig()
+	if err != nil {
+		failStartup(ctx, log, v, failureConfig, errors.Wrap(err, "failed to build metrics config"))
+	}
+
+	var clientCertPool *x509.CertPool
+	if a.ClientCABundleFile != "" {
+		b, err := os.ReadFile(filepath.Clean(a.ClientCABundleFile))
+		if err != nil {
+			failStartup(ctx, log, v, failureCert, errors.Wrap(err, "failed to read client ca bundle file"))
+		}
+		clientCertPool, err = generateTrustedCertPool(b)
+		if err != nil {
+			failStartup(ctx, log, v, failureCert, errors.Wrap(err, "failed to generate client ca cert pool"))
 		}
+		upboundagent.ObserveCertExpiry(upboundagent.CertRoleClientCA, b)
+	}
+	v.pass(failureConfig, "ca bundles and metrics config are valid")
+
+	trustedProxies, err := parseCIDRs(a.TrustedProxies)
+	if err != nil {
+		failStartup(ctx, log, v, failureConfig, errors.Wrap(err, errTrustedProxies))
 	}
 
 	tgConfig := &upboundagent.Config{
-		DebugMode:         cli.Debug,
-		ControlPlaneID:    cpID,
-		TokenRSAPublicKey: pk,
-		XGQLCACertPool:    xgqlCertPool,
+		DebugMode:               cli.Debug,
+		DebugAddress:            a.DebugAddress,
+		ProbeAddress:            a.probeAddress(),
+		AccessLogErrorsOnly:     a.AccessLogErrorsOnly,
+		ControlPlaneID:          cpID,
+		TokenPublicKeys:         pk,
+		XGQLCACertPool:          xgqlCertPool,
+		XGQLCABundleFile:        a.XgqlCABundleFile,
+		XGQLCAReloadInterval:    a.XgqlCAReloadInterval,
+		XGQLEndpoints:           a.XgqlEndpoints,
+		XGQLHealthCheckInterval: a.XgqlHealthCheckInterval,
+		XGQLHealthCheck:         a.XgqlHealthCheck,
+		XGQLHealthCheckPath:     a.XgqlHealthCheckPath,
+		XGQLHealthCheckStatus:   a.XgqlHealthCheckStatus,
 		NATS: &upboundagent.NATSClientConfig{
 			Name:              a.PodName,
-			Endpoint:          a.NATSEndpoint,
+			Endpoints:         a.NATSEndpoint,
 			JWTEndpoint:       a.UpboundAPIEndpoint,
 			ControlPlaneToken: token,
 			CABundle:          pubCerts.NATSCA,
+			MaxReconnects:     a.NATSMaxReconnects,
+			ReconnectWait:     a.NATSReconnectWait,
+			MaxReconnectWait:  a.NATSMaxReconnectWait,
+			ReconnectJitter:   a.NATSReconnectJitter,
+		},
+		Metrics: metricsConfig,
+		Audit: upboundagent.AuditConfig{
+			Enabled: a.AuditLog || a.AuditLogPath != "",
+			Path:    a.AuditLogPath,
+			Headers: a.AuditLogHeaders,
+		},
+		CertRefresh: upboundagent.CertRefreshConfig{
+			Interval:       a.CertRefreshInterval,
+			InitialBackoff: a.CertRefreshInitialBackoff,
+			MaxBackoff:     a.CertRefreshMaxBackoff,
+			OnStart:        restored,
+		},
+		ServingCertReloadInterval:       a.TLSReloadInterval,
+		ServingCertDir:                  a.TLSCertDir,
+		CertCacheDir:                    a.certCacheDir(),
+		ControlPlaneTokenFile:           a.ControlPlaneTokenPath,
+		ControlPlaneTokenReloadInterval: a.ControlPlaneTokenReloadInterval,
+		// Cached, since an unchanged token is validated again on spurious
+		// reload events and on every readiness probe.
+		ValidateControlPlaneToken: func(t string) (string, error) {
+			return cpIDs.Get(t)
 		},
+		SwitchControlPlane:        a.ControlPlaneChange == controlPlaneChangeSwitch,
+		ReadHeaderTimeout:         a.ReadHeaderTimeout,
+		ReadTimeout:               a.ReadTimeout,
+		WriteTimeout:              a.WriteTimeout,
+		IdleTimeout:               a.IdleTimeout,
+		ShutdownGracePeriod:       a.ShutdownGracePeriod,
+		WatchShutdownGrace:        a.WatchShutdownGrace,
+		ShutdownRejectNew:         a.ShutdownRejectNew,
+		AllowedPaths:              a.AllowedPaths,
+		DeniedPaths:               a.DeniedPaths,
+		ForwardClientIP:           a.ForwardClientIP,
+		TrustedProxies:            trustedProxies,
+		ControlPlaneHeader:        a.ForwardControlPlaneHeader,
+		NATSStatsInterval:         a.NATSStatsInterval,
+		MaxConcurrentRequests:     a.MaxConcurrentRequests,
+		QueueTimeout:              a.QueueTimeout,
+		RouteConcurrencyLimits:    a.RouteConcurrencyLimits,
+		DeadlineHeader:            a.DeadlineHeader,
+		MinRequestDeadline:        a.MinRequestDeadline,
+		AdvertisedAddress:         a.advertisedAddress(),
+		CopyBufferSize:            a.CopyBufferSize,
+		EnableCompression:         a.EnableCompression,
+		IdleHeartbeatInterval:     a.IdleHeartbeatInterval,
+		APIServerCertPin:          a.APIServerCertPin,
+		ClientAuth:                clientAuthModes[a.ClientAuthMode],
+		ClientCACertPool:          clientCertPool,
+		DisableNATS:               a.DisableNATS,
+		LazyNATSConnect:           a.LazyNATSConnect,
+		LazyNATSConnectTimeout:    a.LazyNATSConnectTimeout,
+		NATSSubscribeFlushTimeout: a.NATSSubscribeFlushTimeout,
+		ClientRateLimitQPS:        a.ClientRateLimitQPS,
+		ClientRateLimitBurst:      a.ClientRateLimitBurst,
+		MaxRequestsPerSecond:      a.MaxRequestsPerSecond,
+		RequestBurst:              a.Burst,
+		TraceDownstream:           a.TraceDownstream,
+		Tracer:                    tracer,
+
+		RejectOversizedNATSRequests: a.RejectOversizedNATSRequests,
 	}
 
 	restConfig, err := config.GetConfig()
 	if err != nil {
-		ctx.FatalIfErrorf(errors.Wrap(err, "failed to get rest config"))
+		failStartup(ctx, log, v, failureKube, errors.Wrap(err, "failed to get rest config"))
 	}
-	kube, err := client.New(restConfig, client.Options{})
-	if err != nil {
-		ctx.FatalIfErrorf(errors.Wrap(err, "failed to initialize kubernetes client"))
+	// An explicit cluster ID does not need the API server.
+	kubeClusterID := a.ClusterID
+	if kubeClusterID == "" {
+		err = budget.Do("read kube cluster id", func() error {
+			kube, err := client.New(restConfig, client.Options{})
+			if err != nil {
+				return errors.Wrap(err, "failed to initialize kubernetes client")
+			}
+			kubeClusterID, err = a.clusterID(kube)
+			return err
+		})
 	}
-	kubeClusterID, err := readKubeClusterID(kube)
 	if err != nil {
-		ctx.FatalIfErrorf(errors.Wrap(err, "failed to read kube cluster ID"))
+		failStartup(ctx, log, v, failureKube, errors.Wrap(err, "failed to read kube cluster ID"))
 	}
+	v.pass(failureKube, fmt.Sprintf("%s with cluster id %s", restConfig.Host, kubeClusterID))
 
-	pxy, err := upboundagent.NewProxy(tgConfig, restConfig, upClient, log, kubeClusterID)
+	var pxy *upboundagent.Proxy
+	err = budget.Do("connect to nats", func() error {
+		var err error
+		pxy, err = upboundagent.NewProxy(tgConfig, restConfig, upClient, log, kubeClusterID)
+		return err
+	})
 	if err != nil {
-		ctx.FatalIfErrorf(errors.Wrap(err, "failed to create new agent proxy"))
+		failStartup(ctx, log, v, failureNATS, errors.Wrap(err, "failed to create new agent proxy"))
+	}
+	if v != nil {
+		pxy.Close()
+		nats := "connected and subscribed"
+		switch {
+		case a.DisableNATS:
+			nats = "not connected since --disable-nats is set"
+		case a.LazyNATSConnect:
+			nats = "not connected since --lazy-nats-connect is set"
+		}
+		v.pass(failureNATS, nats)
+		ctx.FatalIfErrorf(v.write())
+		return
 	}
 
 	log.Info("Starting Upbound Agent ", "version", version.Version,
+		"git-commit", version.GitCommit,
 		"control-plane-id", cpID,
 		"debug", cli.Debug,
 		"pod-name", a.PodName,
 		"server-port", a.ServerPort,
 		"tls-cert-file", a.TLSCertFile,
 		"tls-private-key-file", a.TLSKeyFile,
+		"tls-cert-dir", a.TLSCertDir,
 		"xgql-ca-bundle-file", a.XgqlCABundleFile,
-		"nats-endpoint", a.NATSEndpoint,
+		"nats-endpoint", strings.Join(a.NATSEndpoint, ","),
 		"upbound-api-endpoint", a.UpboundAPIEndpoint)
 
+	// The proxy shuts down gracefully once a shutdown signal cancels the
+	// context it runs with.
+	runCtx, stopRun := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopRun()
 	addr := fmt.Sprintf(":%s", a.ServerPort)
-	ctx.FatalIfErrorf(errors.Wrap(pxy.Run(addr, a.TLSCertFile, a.TLSKeyFile), "cannot run upbound agent proxy"))
+	ctx.FatalIfErrorf(errors.Wrap(pxy.Run(runCtx, addr, a.TLSCertFile, a.TLSKeyFile), "cannot run upbound agent proxy"))
+}
+
+// readControlPlaneToken reads the control plane token from the file at the
+// given path once it is mounted, waiting up to the given timeout unless it is
+// zero, or else from the given environment variable. The file is used if both
+// are set.
+func readControlPlaneToken(ctx context.Context, path, env string, timeout, checkPeriod time.Duration, lookup func(string) (string, bool), log logging.Logger) (string, error) {
+	t, ok := lookup(env)
+	fromEnv := env != "" && ok && t != ""
+	switch {
+	case path != "" && fromEnv:
+		log.Info("warning: control plane token is set in both the token file and the environment, using the token file", "path", path, "env", env)
+	case fromEnv:
+		log.Info("control plane token has been read from environment", "env", env)
+		return t, nil
+	case path == "":
+		return "", errors.Errorf(errNoControlPlaneToken, env)
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ft, err := waitForControlPlaneToken(ctx, path, checkPeriod, log)
+	if err != nil || !fromEnv {
+		return ft, err
+	}
+	if err := checkTokenConsistency(tokenSource{name: path, token: ft}, tokenSource{name: "$" + env, token: t}); err != nil {
+		return "", err
+	}
+	return ft, nil
+}
+
+// tokenSource is a control plane token along with where it was read from.
+type tokenSource struct {
+	name  string
+	token string
+}
+
+// checkTokenConsistency returns an error if the given control plane tokens
+// are for different control planes. The agent serves exactly one control
+// plane, so such a misconfiguration must not be resolved by picking either.
+func checkTokenConsistency(tokens ...tokenSource) error {
+	var first, firstID string
+	for _, s := range tokens {
+		id, err := readCPIDFromToken(s.token)
+		if err != nil {
+			return errors.Wrapf(err, errReadCPIDOfToken, s.name)
+		}
+		if first == "" {
+			first, firstID = s.name, id
+			continue
+		}
+		if id != firstID {
+			return errors.Errorf(errConflictingCPTokens, first, firstID, s.name, id)
+		}
+	}
+	return nil
 }
 
-func waitForControlPlaneToken(path string, d time.Duration, log logging.Logger) (string, error) {
+// waitForControlPlaneToken reads the control plane token file right away and
+// then on the given period until it exists and has content, or the context is
+// done.
+func waitForControlPlaneToken(ctx context.Context, path string, d time.Duration, log logging.Logger) (string, error) {
 	ticker := time.NewTicker(d)
 	log.Info("waiting for control plane token to be mounted", "path", path, "check-period", d.String())
 	defer ticker.Stop()
@@ -179,12 +901,52 @@ func waitForControlPlaneToken(path string, d time.Duration, log logging.Logger)
 			return string(f), nil
 		}
 		log.Debug("control plane token file is empty")
-		// TODO(muvaf): We can probably replace this with an implementation
-		// that uses time.Ticker but I couldn't figure out to have a simple
-		// implementation with no timeout and single select case without wasting
-		// the initial period.
-		time.Sleep(d)
+		select {
+		case <-ctx.Done():
+			return "", errors.Wrap(ctx.Err(), errTokenWaitStopped)
+		case <-ticker.C:
+		}
+	}
+}
+
+// metricsConfig builds the metrics configuration from the flags.
+func (a AgentCmd) metricsConfig() (upboundagent.MetricsConfig, error) {
+	m := upboundagent.MetricsConfig{
+		Secure:            a.MetricsSecure,
+		OTLPEndpoint:      a.OTelMetricsEndpoint,
+		OTLPInterval:      a.OTelMetricsInterval,
+		DisablePrometheus: a.DisablePrometheusMetrics,
+	}
+	if a.MetricsPort != "" {
+		m.Address = ":" + a.MetricsPort
+	}
+	if !m.Secure {
+		return m, nil
+	}
+	if a.MetricsBearerTokenFile == "" && a.MetricsClientCABundleFile == "" {
+		return m, errors.New(errMetricsSecureNoAuth)
+	}
+	if a.MetricsBearerTokenFile != "" {
+		b, err := os.ReadFile(filepath.Clean(a.MetricsBearerTokenFile))
+		if err != nil {
+			return m, errors.Wrap(err, "failed to read metrics bearer token file")
+		}
+		m.BearerToken = strings.TrimSpace(string(b))
+		if m.BearerToken == "" {
+			return m, errors.New(errMetricsBearerTokenEmpty)
+		}
 	}
+	if a.MetricsClientCABundleFile != "" {
+		b, err := os.ReadFile(filepath.Clean(a.MetricsClientCABundleFile))
+		if err != nil {
+			return m, errors.Wrap(err, "failed to read metrics client ca bundle file")
+		}
+		if m.ClientCACertPool, err = generateTrustedCertPool(b); err != nil {
+			return m, errors.Wrap(err, "failed to generate metrics client ca cert pool")
+		}
+		upboundagent.ObserveCertExpiry(upboundagent.CertRoleMetricsClientCA, b)
+	}
+	return m, nil
 }
 
 func generateTrustedCertPool(b []byte) (*x509.CertPool, error) {
@@ -197,14 +959,118 @@ func generateTrustedCertPool(b []byte) (*x509.CertPool, error) {
 	return rootCAs, nil
 }
 
-func readCPIDFromToken(t string) (string, error) {
-	// Read control-plane id from the token
-	token, err := jwt.Parse(t, nil)
-	if err.(*jwt.ValidationError).Errors == jwt.ValidationErrorMalformed {
-		return "", errors.Wrap(err, errMalformedCPToken)
+// tokenCheck validates the claims of a control plane token.
+type tokenCheck func(cl jwt.MapClaims) error
+
+// withMaxLifetime rejects tokens whose validity window, i.e. the time between
+// their "iat" and "exp" claims, exceeds the given maximum plus the clock skew
+// leeway. Tokens without an "iat" claim are tolerated. A zero maximum disables
+// the check.
+func withMaxLifetime(max, leeway time.Duration) tokenCheck {
+	return func(cl jwt.MapClaims) error {
+		if max == 0 {
+			return nil
+		}
+		iat, ok, err := timeClaim(cl, "iat")
+		if err != nil || !ok {
+			return err
+		}
+		exp, ok, err := timeClaim(cl, "exp")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New(errCPTokenNoExpiry)
+		}
+		if l := exp.Sub(iat); l > max+leeway {
+			return errors.Errorf(errCPTokenLifetimeTooLong, l, max)
+		}
+		return nil
+	}
+}
+
+// withNotBefore rejects tokens whose "nbf" claim is later than the current time
+// plus the clock skew leeway. Tokens without an "nbf" claim are tolerated.
+func withNotBefore(leeway time.Duration, now func() time.Time) tokenCheck {
+	return func(cl jwt.MapClaims) error {
+		nbf, ok, err := timeClaim(cl, "nbf")
+		if err != nil || !ok {
+			return err
+		}
+		if nbf.After(now().Add(leeway)) {
+			return errors.Errorf(errCPTokenNotYetValid, nbf.UTC().Format(time.RFC3339))
+		}
+		return nil
+	}
+}
+
+// withExpiry rejects tokens whose "exp" claim is earlier than the current time
+// minus the clock skew leeway, e.g. from a stale secret, before they fail to
+// authenticate against Upbound API. Tokens without an "exp" claim are
+// tolerated as non-expiring.
+func withExpiry(leeway time.Duration, now func() time.Time) tokenCheck {
+	return func(cl jwt.MapClaims) error {
+		exp, ok, err := timeClaim(cl, "exp")
+		if err != nil || !ok {
+			return err
+		}
+		if exp.Before(now().Add(-leeway)) {
+			return errors.Errorf(errCPTokenExpired, exp.UTC().Format(time.RFC3339))
+		}
+		return nil
+	}
+}
+
+// timeClaim returns the value of the given NumericDate claim, and whether it
+// was set.
+func timeClaim(cl jwt.MapClaims, key string) (time.Time, bool, error) {
+	v, ok := cl[key]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	var sec float64
+	switch n := v.(type) {
+	case float64:
+		sec = n
+	case json.Number:
+		f, err := n.Float64()
+		if err != nil {
+			return time.Time{}, false, errors.Wrapf(err, errCPTokenClaimNotNumeric, key)
+		}
+		sec = f
+	default:
+		return time.Time{}, false, errors.Errorf(errCPTokenClaimNotNumeric, key)
+	}
+	return time.Unix(int64(sec), 0), true, nil
+}
+
+func readCPIDFromToken(t string, checks ...tokenCheck) (string, error) {
+	cl, err := parseTokenClaims(t)
+	if err != nil {
+		return "", err
+	}
+	return cpIDFromClaims(cl, checks...)
+}
+
+// parseTokenClaims parses the claims of the given control plane token. Its
+// signature is verified once the public keys are fetched, which requires the
+// control-plane id.
+func parseTokenClaims(t string) (jwt.MapClaims, error) {
+	token, _, err := new(jwt.Parser).ParseUnverified(t, jwt.MapClaims{})
+	if err != nil {
+		return nil, errors.Wrap(err, errMalformedCPToken)
 	}
+	return token.Claims.(jwt.MapClaims), nil
+}
 
-	cl := token.Claims.(jwt.MapClaims)
+// cpIDFromClaims returns the control plane ID in the given claims of a
+// control plane token, once they passed the given checks.
+func cpIDFromClaims(cl jwt.MapClaims, checks ...tokenCheck) (string, error) {
+	for _, check := range checks {
+		if err := check(cl); err != nil {
+			return "", err
+		}
+	}
 	v, ok := cl["sub"]
 	if !ok {
 		return "", errors.New(errCPTokenNoSubjectKey)
@@ -215,7 +1081,7 @@ func readCPIDFromToken(t string) (string, error) {
 	}
 
 	envID := strings.TrimPrefix(s, prefixPlatformTokenSubject)
-	_, err = uuid.Parse(envID)
+	_, err := uuid.Parse(envID)
 	return envID, errors.Wrapf(err, errCPIDInTokenNotValidUUID, envID)
 }
 
@@ -229,3 +1095,48 @@ func readKubeClusterID(kube client.Client) (string, error) {
 	}
 	return string(ns.GetUID()), nil
 }
+
+// readClusterIDFromConfigMap reads the cluster ID from the given key of the
+// config map with the given namespace/name.
+func readClusterIDFromConfigMap(kube client.Client, nsName, key string) (string, error) {
+	parts := strings.SplitN(nsName, "/", 2)
+	cm := &corev1.ConfigMap{}
+	if err := kube.Get(context.Background(), types.NamespacedName{Namespace: parts[0], Name: parts[1]}, cm); err != nil {
+		return "", errors.Wrapf(err, errFailedToGetClusterIDCM, nsName)
+	}
+	if cm.Data[key] == "" {
+		return "", errors.Errorf(errClusterIDCMKeyEmpty, nsName, key)
+	}
+	return cm.Data[key], nil
+}
+
+// parseCIDRs parses the given CIDRs.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// validRegexps returns true if the given strings are valid regular
+// expressions.
+func validRegexps(res []string) bool {
+	for _, re := range res {
+		if _, err := regexp.Compile(re); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// validNamespacedName returns true if the given string is in namespace/name
+// form.
+func validNamespacedName(s string) bool {
+	parts := strings.Split(s, "/")
+	return len(parts) == 2 && parts[0] != "" && parts[1] != ""
+}
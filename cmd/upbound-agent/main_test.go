@@ -17,8 +17,13 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -28,6 +33,7 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"github.com/pkg/errors"
 
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
 	"github.com/crossplane/crossplane-runtime/pkg/test"
 )
 
@@ -186,3 +192,693 @@ func Test_readKubeClusterID(t *testing.T) {
 		})
 	}
 }
+
+func TestUpboundFlags_clusterID(t *testing.T) {
+	errBoom := errors.New("boom")
+	uid := uuid.New().String()
+	kube := &test.MockClient{
+		MockGet: func(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+			switch o := obj.(type) {
+			case *corev1.Namespace:
+				if key.Name == "kube-system" {
+					o.SetUID(types.UID(uid))
+				}
+			case *corev1.ConfigMap:
+				if key.Namespace != "upbound-system" || key.Name != "cluster-identity" {
+					return errBoom
+				}
+				o.Data = map[string]string{"cluster-id": "edge-site-42"}
+			}
+			return nil
+		},
+	}
+
+	type want struct {
+		id  string
+		err error
+	}
+	cases := map[string]struct {
+		reason string
+		flags  UpboundFlags
+		want
+	}{
+		"Explicit": {
+			reason: "An explicit cluster ID should be used as is.",
+			flags:  UpboundFlags{ClusterID: "edge-site-1"},
+			want:   want{id: "edge-site-1"},
+		},
+		"ConfigMap": {
+			reason: "The cluster ID should be read from the configured config map.",
+			flags:  UpboundFlags{ClusterIDConfigMap: "upbound-system/cluster-identity", ClusterIDConfigMapKey: "cluster-id"},
+			want:   want{id: "edge-site-42"},
+		},
+		"ConfigMapNotFound": {
+			reason: "Failing to get the config map should return an error.",
+			flags:  UpboundFlags{ClusterIDConfigMap: "upbound-system/missing", ClusterIDConfigMapKey: "cluster-id"},
+			want:   want{err: errors.Wrapf(errBoom, errFailedToGetClusterIDCM, "upbound-system/missing")},
+		},
+		"ConfigMapKeyMissing": {
+			reason: "A config map without the cluster ID under the configured key should return an error.",
+			flags:  UpboundFlags{ClusterIDConfigMap: "upbound-system/cluster-identity", ClusterIDConfigMapKey: "id"},
+			want:   want{err: errors.Errorf(errClusterIDCMKeyEmpty, "upbound-system/cluster-identity", "id")},
+		},
+		"KubeSystemFallback": {
+			reason: "The UID of the kube-system namespace should be used if nothing is configured.",
+			want:   want{id: uid},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := tc.flags.clusterID(kube)
+			if diff := cmp.Diff(tc.want.err, err, test.EquateErrors()); diff != "" {
+				t.Errorf("\n%s\nclusterID(...): -want error, +got error:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.id, got); diff != "" {
+				t.Errorf("\n%s\nclusterID(...): -want id, +got id:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+// signedToken returns an HS256 signed JWT with the given claims. Control plane
+// tokens are not verified when reading the control plane id, hence the key does
+// not matter.
+func signedToken(t *testing.T, cl jwt.MapClaims) string {
+	t.Helper()
+	s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, cl).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatalf("cannot sign token: %v", err)
+	}
+	return s
+}
+
+func Test_readCPIDFromTokenWithMaxLifetime(t *testing.T) {
+	cpID := "b0075060-a0d0-4948-80a3-ffdb0c28ef71"
+	now := time.Now()
+
+	type args struct {
+		claims jwt.MapClaims
+		max    time.Duration
+		leeway time.Duration
+	}
+	type want struct {
+		id  string
+		err error
+	}
+	cases := map[string]struct {
+		args
+		want
+	}{
+		"Disabled": {
+			args: args{
+				claims: jwt.MapClaims{"sub": prefixPlatformTokenSubject + cpID, "iat": now.Unix(), "exp": now.Add(365 * 24 * time.Hour).Unix()},
+			},
+			want: want{
+				id: cpID,
+			},
+		},
+		"WithinLifetime": {
+			args: args{
+				claims: jwt.MapClaims{"sub": prefixPlatformTokenSubject + cpID, "iat": now.Unix(), "exp": now.Add(12 * time.Hour).Unix()},
+				max:    24 * time.Hour,
+			},
+			want: want{
+				id: cpID,
+			},
+		},
+		"WithinLifetimeWithLeeway": {
+			args: args{
+				claims: jwt.MapClaims{"sub": prefixPlatformTokenSubject + cpID, "iat": now.Unix(), "exp": now.Add(24*time.Hour + time.Minute).Unix()},
+				max:    24 * time.Hour,
+				leeway: 2 * time.Minute,
+			},
+			want: want{
+				id: cpID,
+			},
+		},
+		"ExceedsLifetime": {
+			args: args{
+				claims: jwt.MapClaims{"sub": prefixPlatformTokenSubject + cpID, "iat": now.Unix(), "exp": now.Add(48 * time.Hour).Unix()},
+				max:    24 * time.Hour,
+				leeway: 2 * time.Minute,
+			},
+			want: want{
+				err: errors.Errorf(errCPTokenLifetimeTooLong, 48*time.Hour, 24*time.Hour),
+			},
+		},
+		"NoIssuedAt": {
+			args: args{
+				claims: jwt.MapClaims{"sub": prefixPlatformTokenSubject + cpID, "exp": now.Add(48 * time.Hour).Unix()},
+				max:    24 * time.Hour,
+			},
+			want: want{
+				id: cpID,
+			},
+		},
+		"NoExpiry": {
+			args: args{
+				claims: jwt.MapClaims{"sub": prefixPlatformTokenSubject + cpID, "iat": now.Unix()},
+				max:    24 * time.Hour,
+			},
+			want: want{
+				err: errors.New(errCPTokenNoExpiry),
+			},
+		},
+		"ExpiryNotNumeric": {
+			args: args{
+				claims: jwt.MapClaims{"sub": prefixPlatformTokenSubject + cpID, "iat": now.Unix(), "exp": "tomorrow"},
+				max:    24 * time.Hour,
+			},
+			want: want{
+				err: errors.Errorf(errCPTokenClaimNotNumeric, "exp"),
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, gotErr := readCPIDFromToken(signedToken(t, tc.args.claims), withMaxLifetime(tc.args.max, tc.args.leeway))
+			if diff := cmp.Diff(tc.want.err, gotErr, test.EquateErrors()); diff != "" {
+				t.Fatalf("readCPIDFromToken(...): -want error, +got error: %s", diff)
+			}
+			if diff := cmp.Diff(tc.want.id, got); diff != "" {
+				t.Errorf("readCPIDFromToken(...): -want result, +got result: %s", diff)
+			}
+		})
+	}
+}
+
+func Test_readCPIDFromTokenWithNotBefore(t *testing.T) {
+	cpID := "b0075060-a0d0-4948-80a3-ffdb0c28ef71"
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	type args struct {
+		claims jwt.MapClaims
+		leeway time.Duration
+	}
+	type want struct {
+		id  string
+		err error
+	}
+	cases := map[string]struct {
+		args
+		want
+	}{
+		"FutureDated": {
+			args: args{
+				claims: jwt.MapClaims{"sub": prefixPlatformTokenSubject + cpID, "nbf": now.Add(time.Hour).Unix()},
+				leeway: 2 * time.Minute,
+			},
+			want: want{
+				err: errors.Errorf(errCPTokenNotYetValid, "2021-05-01T13:00:00Z"),
+			},
+		},
+		"FutureDatedWithinLeeway": {
+			args: args{
+				claims: jwt.MapClaims{"sub": prefixPlatformTokenSubject + cpID, "nbf": now.Add(time.Minute).Unix()},
+				leeway: 2 * time.Minute,
+			},
+			want: want{
+				id: cpID,
+			},
+		},
+		"CurrentlyValid": {
+			args: args{
+				claims: jwt.MapClaims{"sub": prefixPlatformTokenSubject + cpID, "nbf": now.Add(-time.Hour).Unix()},
+			},
+			want: want{
+				id: cpID,
+			},
+		},
+		"NoNotBefore": {
+			args: args{
+				claims: jwt.MapClaims{"sub": prefixPlatformTokenSubject + cpID},
+			},
+			want: want{
+				id: cpID,
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, gotErr := readCPIDFromToken(signedToken(t, tc.args.claims), withNotBefore(tc.args.leeway, func() time.Time { return now }))
+			if diff := cmp.Diff(tc.want.err, gotErr, test.EquateErrors()); diff != "" {
+				t.Fatalf("readCPIDFromToken(...): -want error, +got error: %s", diff)
+			}
+			if diff := cmp.Diff(tc.want.id, got); diff != "" {
+				t.Errorf("readCPIDFromToken(...): -want result, +got result: %s", diff)
+			}
+		})
+	}
+}
+
+func Test_readCPIDFromTokenWithExpiry(t *testing.T) {
+	cpID := "b0075060-a0d0-4948-80a3-ffdb0c28ef71"
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	type args struct {
+		claims jwt.MapClaims
+		leeway time.Duration
+	}
+	type want struct {
+		id  string
+		err error
+	}
+	cases := map[string]struct {
+		args
+		want
+	}{
+		"Expired": {
+			args: args{
+				claims: jwt.MapClaims{"sub": prefixPlatformTokenSubject + cpID, "exp": now.Add(-time.Hour).Unix()},
+				leeway: 2 * time.Minute,
+			},
+			want: want{
+				err: errors.Errorf(errCPTokenExpired, "2021-05-01T11:00:00Z"),
+			},
+		},
+		"ExpiredWithinLeeway": {
+			args: args{
+				claims: jwt.MapClaims{"sub": prefixPlatformTokenSubject + cpID, "exp": now.Add(-time.Minute).Unix()},
+				leeway: 2 * time.Minute,
+			},
+			want: want{
+				id: cpID,
+			},
+		},
+		"NotExpired": {
+			args: args{
+				claims: jwt.MapClaims{"sub": prefixPlatformTokenSubject + cpID, "exp": now.Add(time.Hour).Unix()},
+			},
+			want: want{
+				id: cpID,
+			},
+		},
+		"NoExpiry": {
+			args: args{
+				claims: jwt.MapClaims{"sub": prefixPlatformTokenSubject + cpID},
+			},
+			want: want{
+				id: cpID,
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, gotErr := readCPIDFromToken(signedToken(t, tc.args.claims), withExpiry(tc.args.leeway, func() time.Time { return now }))
+			if diff := cmp.Diff(tc.want.err, gotErr, test.EquateErrors()); diff != "" {
+				t.Fatalf("readCPIDFromToken(...): -want error, +got error: %s", diff)
+			}
+			if diff := cmp.Diff(tc.want.id, got); diff != "" {
+				t.Errorf("readCPIDFromToken(...): -want result, +got result: %s", diff)
+			}
+		})
+	}
+}
+
+func Test_readControlPlaneToken(t *testing.T) {
+	cpID, otherID := "b0075060-a0d0-4948-80a3-ffdb0c28ef71", "c21561da-087b-4efc-af6b-718e99bfd85f"
+	fileToken := signedToken(t, jwt.MapClaims{"sub": prefixPlatformTokenSubject + cpID, "iat": 1})
+	envToken := signedToken(t, jwt.MapClaims{"sub": prefixPlatformTokenSubject + cpID, "iat": 2})
+	otherToken := signedToken(t, jwt.MapClaims{"sub": prefixPlatformTokenSubject + otherID})
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte(fileToken), 0600); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"CONTROL_PLANE_TOKEN": envToken, "OTHER_TOKEN": otherToken, "EMPTY_TOKEN": ""}
+	lookup := func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}
+
+	type args struct {
+		path string
+		env  string
+	}
+	type want struct {
+		token string
+		err   error
+	}
+	cases := map[string]struct {
+		args
+		want
+	}{
+		"FromFile": {
+			args: args{path: path, env: "UNSET_TOKEN"},
+			want: want{token: fileToken},
+		},
+		"FromEnv": {
+			args: args{env: "CONTROL_PLANE_TOKEN"},
+			want: want{token: envToken},
+		},
+		"FileWins": {
+			args: args{path: path, env: "CONTROL_PLANE_TOKEN"},
+			want: want{token: fileToken},
+		},
+		"ConflictingTokens": {
+			args: args{path: path, env: "OTHER_TOKEN"},
+			want: want{err: errors.Errorf(errConflictingCPTokens, path, cpID, "$OTHER_TOKEN", otherID)},
+		},
+		"EmptyEnv": {
+			args: args{env: "EMPTY_TOKEN"},
+			want: want{err: errors.Errorf(errNoControlPlaneToken, "EMPTY_TOKEN")},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := readControlPlaneToken(context.Background(), tc.args.path, tc.args.env, 0, time.Hour, lookup, logging.NewNopLogger())
+			if diff := cmp.Diff(tc.want.err, err, test.EquateErrors()); diff != "" {
+				t.Fatalf("readControlPlaneToken(...): -want error, +got error: %s", diff)
+			}
+			if diff := cmp.Diff(tc.want.token, got); diff != "" {
+				t.Errorf("readControlPlaneToken(...): -want token, +got token: %s", diff)
+			}
+		})
+	}
+}
+
+func Test_waitForControlPlaneToken(t *testing.T) {
+	dir := t.TempDir()
+	mounted, empty := filepath.Join(dir, "mounted"), filepath.Join(dir, "empty")
+	if err := os.WriteFile(mounted, []byte("file-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	type want struct {
+		token string
+		err   error
+	}
+	cases := map[string]struct {
+		reason string
+		path   string
+		want
+	}{
+		"Mounted": {
+			reason: "A mounted token should be read right away rather than after the first period.",
+			path:   mounted,
+			want:   want{token: "file-token"},
+		},
+		"Cancelled": {
+			reason: "Waiting for a token that is not mounted should stop once the context is done.",
+			path:   empty,
+			want:   want{err: errors.Wrap(context.DeadlineExceeded, errTokenWaitStopped)},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			got, err := waitForControlPlaneToken(ctx, tc.path, time.Hour, logging.NewNopLogger())
+			if diff := cmp.Diff(tc.want.err, err, test.EquateErrors()); diff != "" {
+				t.Fatalf("\n%s\nwaitForControlPlaneToken(...): -want error, +got error:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.token, got); diff != "" {
+				t.Errorf("\n%s\nwaitForControlPlaneToken(...): -want token, +got token:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestAgentCmd_Validate(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		cmd    AgentCmd
+		want   error
+	}{
+		"CertAndKey": {
+			reason: "Providing both the cert and the key should be valid.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second},
+		},
+		"CertRefreshBackoff": {
+			reason: "Valid backoffs should be accepted while the gateway certs are refreshed.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, CertRefreshInterval: time.Hour, CertRefreshInitialBackoff: 10 * time.Second, CertRefreshMaxBackoff: 10 * time.Minute},
+		},
+		"CertRefreshZeroInitialBackoff": {
+			reason: "A zero initial backoff should be rejected since failed refreshes would be retried in a hot loop.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, CertRefreshInterval: time.Hour, CertRefreshMaxBackoff: 10 * time.Minute},
+			want:   errors.New(errCertRefreshBackoff),
+		},
+		"CertRefreshNegativeInitialBackoff": {
+			reason: "A negative initial backoff should be rejected.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, CertRefreshInterval: time.Hour, CertRefreshInitialBackoff: -time.Second, CertRefreshMaxBackoff: 10 * time.Minute},
+			want:   errors.New(errCertRefreshBackoff),
+		},
+		"CertRefreshMaxBelowInitialBackoff": {
+			reason: "A maximum backoff below the initial backoff should be rejected.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, CertRefreshInterval: time.Hour, CertRefreshInitialBackoff: 10 * time.Second, CertRefreshMaxBackoff: time.Second},
+			want:   errors.New(errCertRefreshBackoff),
+		},
+		"CertRefreshZeroMaxBackoff": {
+			reason: "A zero maximum backoff should be rejected.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, CertRefreshInterval: time.Hour, CertRefreshInitialBackoff: 10 * time.Second},
+			want:   errors.New(errCertRefreshBackoff),
+		},
+		"CertRefreshBackoffAfterRestore": {
+			reason: "Backoffs should be validated when the certs are only refreshed once after restoring them from the state directory.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, StateDir: "/var/lib/upbound-agent"},
+			want:   errors.New(errCertRefreshBackoff),
+		},
+		"InvalidTrustedProxy": {
+			reason: "Trusted proxies should be CIDRs.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, TrustedProxies: []string{"10.0.0.1"}},
+			want:   errors.Wrap(&net.ParseError{Type: "CIDR address", Text: "10.0.0.1"}, errTrustedProxies),
+		},
+		"OnlyCert": {
+			reason: "Providing only the cert should name the missing key.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt"},
+			want:   errors.New(errTLSKeyFileMissing),
+		},
+		"OnlyKey": {
+			reason: "Providing only the key should name the missing cert.",
+			cmd:    AgentCmd{TLSKeyFile: "/etc/certs/upbound-agent/tls.key"},
+			want:   errors.New(errTLSCertFileMissing),
+		},
+		"Neither": {
+			reason: "Providing neither should be invalid since the agent always serves TLS.",
+			cmd:    AgentCmd{},
+			want:   errors.New(errTLSFilesMissing),
+		},
+		"ClientAuthWithoutCA": {
+			reason: "Verifying client certificates should require a client CA bundle.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, ClientAuthMode: clientAuthVerifyIfGiven},
+			want:   errors.New(errClientCABundleMissing),
+		},
+		"PrometheusDisabledWithoutOTLP": {
+			reason: "Disabling the Prometheus endpoint should require pushing metrics via OTLP instead.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, DisablePrometheusMetrics: true},
+			want:   errors.New(errNoMetricsExporter),
+		},
+		"PrometheusDisabledWithOTLP": {
+			reason: "Disabling the Prometheus endpoint should be valid when pushing metrics via OTLP.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, DisablePrometheusMetrics: true, OTelMetricsEndpoint: "http://otel-collector:4318", OTelMetricsInterval: 30 * time.Second},
+		},
+		"NoShutdownGracePeriod": {
+			reason: "A shutdown grace period should be required since connections would be closed right away otherwise.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key"},
+			want:   errors.New(errShutdownGracePeriod),
+		},
+		"NegativeTokenWaitTimeout": {
+			reason: "A negative token wait timeout should be invalid.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, TokenWaitTimeout: -time.Second},
+			want:   errors.New(errTokenWaitTimeout),
+		},
+		"NATSReconnectPolicy": {
+			reason: "A reconnect wait that doubles up to a longer max wait with a jitter fraction should be valid.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, NATSReconnectWait: time.Second, NATSMaxReconnectWait: 30 * time.Second, NATSReconnectJitter: 0.2},
+		},
+		"NATSMaxReconnectWaitTooShort": {
+			reason: "A max reconnect wait shorter than the reconnect wait should be invalid.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, NATSReconnectWait: 10 * time.Second, NATSMaxReconnectWait: time.Second},
+			want:   errors.New(errNATSReconnectPolicy),
+		},
+		"NATSReconnectJitterTooLarge": {
+			reason: "A jitter of more than the whole wait should be invalid.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, NATSReconnectWait: time.Second, NATSMaxReconnectWait: 30 * time.Second, NATSReconnectJitter: 1.5},
+			want:   errors.New(errNATSReconnectPolicy),
+		},
+		"NegativeCertFetchRetries": {
+			reason: "A negative number of cert fetch retries should be invalid.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, CertFetchRetries: -1},
+			want:   errors.New(errCertFetch),
+		},
+		"MinMemory": {
+			reason: "A minimum memory quantity should be valid.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, MinMemory: "128Mi"},
+		},
+		"InvalidMinMemory": {
+			reason: "A minimum memory that is not a positive quantity should be invalid.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, MinMemory: "lots"},
+			want:   errors.New(errMinMemory),
+		},
+		"InvalidDeniedPaths": {
+			reason: "A denied path that is not a regular expression should be invalid.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, DeniedPaths: []string{"/api/v1/(secrets"}},
+			want:   errors.New(errPathPatterns),
+		},
+		"ClusterIDConflict": {
+			reason: "An explicit cluster ID along with a config map to read it from should be invalid.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, UpboundFlags: UpboundFlags{ClusterID: "edge-site-1", ClusterIDConfigMap: "upbound-system/cluster-identity"}},
+			want:   errors.New(errClusterIDConflict),
+		},
+		"ClusterIDConfigMapNotNamespaced": {
+			reason: "A cluster ID config map without a namespace should be invalid.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, UpboundFlags: UpboundFlags{ClusterIDConfigMap: "cluster-identity"}},
+			want:   errors.New(errClusterIDConfigMap),
+		},
+		"RouteConcurrencyLimits": {
+			reason: "Positive limits of known routes should be valid.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, RouteConcurrencyLimits: map[string]int{"k8s": 100, "k8s-watch": 50, "xgql": 20}},
+		},
+		"RouteConcurrencyLimitsUnknownRoute": {
+			reason: "A limit of an unknown route should be invalid.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, RouteConcurrencyLimits: map[string]int{"graphql": 20}},
+			want:   errors.Errorf(errRouteConcurrencyLimits, "k8s, k8s-watch, xgql"),
+		},
+		"RouteConcurrencyLimitsNotPositive": {
+			reason: "A limit that is not positive should be invalid.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, RouteConcurrencyLimits: map[string]int{"k8s": 0}},
+			want:   errors.Errorf(errRouteConcurrencyLimits, "k8s, k8s-watch, xgql"),
+		},
+		"MetricsPortDisabled": {
+			reason: "A metrics port along with disabled Prometheus metrics should be invalid since there is nothing to serve.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, MetricsPort: "8080", DisablePrometheusMetrics: true, OTelMetricsEndpoint: "http://otel-collector:4318", OTelMetricsInterval: 30 * time.Second},
+			want:   errors.New(errMetricsPortDisabled),
+		},
+		"MetricsPortSecureNoBearer": {
+			reason: "Secure metrics on the metrics port without a bearer token should be invalid since scrapers could not authenticate over plain HTTP.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, MetricsPort: "8080", MetricsSecure: true, MetricsClientCABundleFile: "/etc/certs/metrics/ca.crt"},
+			want:   errors.New(errMetricsPortNoBearer),
+		},
+		"MetricsPortSecure": {
+			reason: "Secure metrics on the metrics port with a bearer token should be valid.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, MetricsPort: "8080", MetricsSecure: true, MetricsBearerTokenFile: "/etc/metrics/token"},
+		},
+		"StateDirConflict": {
+			reason: "A state directory along with a gateway certs cache should be invalid since the state directory caches gateway certs already.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, StateDir: "/var/lib/upbound-agent", CertCacheDir: "/var/cache/upbound-agent"},
+			want:   errors.New(errStateDirConflict),
+		},
+		"WatchShutdownGrace": {
+			reason: "A watch shutdown grace shorter than the shutdown grace period should be valid.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, WatchShutdownGrace: 10 * time.Second},
+		},
+		"WatchShutdownGraceTooLong": {
+			reason: "A watch shutdown grace that is not shorter than the shutdown grace period should be invalid since watches would be cut short.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, WatchShutdownGrace: 20 * time.Second},
+			want:   errors.New(errWatchShutdownGrace),
+		},
+		"ServerTimeouts": {
+			reason: "Negative server timeouts should be invalid.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, IdleTimeout: -time.Second},
+			want:   errors.New(errServerTimeouts),
+		},
+		"TokenCheckPeriodTooShort": {
+			reason: "A token check period below 100ms should be invalid since it would hammer the file system.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, TokenCheckPeriod: 10 * time.Millisecond},
+			want:   errors.New(errTokenCheckPeriod),
+		},
+		"TokenCheckPeriod": {
+			reason: "A token check period of at least 100ms should be valid.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, TokenCheckPeriod: 100 * time.Millisecond},
+		},
+		"CertCacheMaxAge": {
+			reason: "A negative maximum age of cached gateway certs should be invalid.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, CertCacheMaxAge: -time.Hour},
+			want:   errors.New(errCertCacheMaxAge),
+		},
+		"DisableNATSConflict": {
+			reason: "Disabling NATS and connecting to it lazily should be invalid.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, DisableNATS: true, LazyNATSConnect: true},
+			want:   errors.New(errDisableNATSConflict),
+		},
+		"AdvertiseConflict": {
+			reason: "Advertising both a fixed address and the pod IP should be invalid.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, AdvertisedAddress: "10.0.0.1:6443", AdvertisePodIP: true},
+			want:   errors.New(errAdvertiseConflict),
+		},
+		"ControlPlaneHeader": {
+			reason: "A custom header name should be valid.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, ForwardControlPlaneHeader: "X-Upbound-Control-Plane-ID"},
+		},
+		"ControlPlaneHeaderInvalid": {
+			reason: "A header name with invalid characters should be rejected.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, ForwardControlPlaneHeader: "Control Plane"},
+			want:   errors.Errorf(errControlPlaneHeader, "Control Plane"),
+		},
+		"ControlPlaneHeaderImpersonation": {
+			reason: "A header name that would override the impersonation of the agent should be rejected.",
+			cmd:    AgentCmd{TLSCertFile: "/etc/certs/upbound-agent/tls.crt", TLSKeyFile: "/etc/certs/upbound-agent/tls.key", ShutdownGracePeriod: 20 * time.Second, ForwardControlPlaneHeader: "impersonate-user"},
+			want:   errors.Errorf(errControlPlaneHeader, "impersonate-user"),
+		},
+		"ClientAuthWithCA": {
+			reason: "Verifying client certificates with a client CA bundle should be valid.",
+			cmd: AgentCmd{
+				TLSCertFile:         "/etc/certs/upbound-agent/tls.crt",
+				TLSKeyFile:          "/etc/certs/upbound-agent/tls.key",
+				ClientAuthMode:      clientAuthRequireAndVerify,
+				ClientCABundleFile:  "/etc/certs/upbound-agent/client-ca.crt",
+				ShutdownGracePeriod: 20 * time.Second,
+			},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := tc.cmd.Validate()
+			if diff := cmp.Diff(tc.want, err, test.EquateErrors()); diff != "" {
+				t.Errorf("\n%s\nValidate(): -want error, +got error:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestUpboundFlags_upboundAPITLSConfig(t *testing.T) {
+	crt, key := writeKeyPair(t, "upbound-agent", time.Now().Add(time.Hour))
+	type want struct {
+		roots bool
+		certs int
+		err   error
+	}
+	cases := map[string]struct {
+		reason string
+		flags  UpboundFlags
+		want   want
+	}{
+		"Defaults": {
+			reason: "The defaults of the upbound client should be used if nothing is configured.",
+		},
+		"CABundle": {
+			reason: "The CA bundle should be trusted to verify Upbound API.",
+			flags:  UpboundFlags{UpboundAPICABundle: crt},
+			want:   want{roots: true},
+		},
+		"ClientCert": {
+			reason: "The client certificate should be presented to Upbound API.",
+			flags:  UpboundFlags{UpboundAPIClientCert: crt, UpboundAPIClientKey: key},
+			want:   want{certs: 1},
+		},
+		"ClientCertWithoutKey": {
+			reason: "A client certificate without its key should be rejected.",
+			flags:  UpboundFlags{UpboundAPIClientCert: crt},
+			want:   want{err: errors.New(errUpboundAPIClientCert)},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := tc.flags.upboundAPITLSConfig()
+			got := want{err: err}
+			if cfg != nil {
+				got.roots, got.certs = cfg.RootCAs != nil, len(cfg.Certificates)
+			}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(want{}), test.EquateErrors()); diff != "" {
+				t.Errorf("\n%s\nupboundAPITLSConfig(): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
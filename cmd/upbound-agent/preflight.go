@@ -0,0 +1,365 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	"github.com/upbound/universal-crossplane/internal/upboundagent"
+)
+
+const (
+	// permOther are the permission bits granting access to other users.
+	permOther os.FileMode = 0o007
+)
+
+// envPodIP is the environment variable that the IP of the agent pod is
+// expected in, set from status.podIP via the downward API.
+const envPodIP = "POD_IP"
+
+const (
+	errStatFile          = "cannot stat file %s"
+	errFileTooPermissive = "file %s is accessible by other users, permissions: %s"
+	errRunningAsRoot     = "agent is running as root (effective uid 0) but does not need root privileges"
+	errPathNotWritable   = "directory %s for %s is not writable"
+	errMissingEnv        = "environment variable %s is required by %s but is not set"
+	errInvalidEnv        = "environment variable %s required by %s is invalid: %s"
+	errReadServingCert   = "cannot read serving certificate file %s"
+	errReadServingKey    = "cannot read serving key file %s"
+	errServingKeyPair    = "serving certificate file %s and key file %s are not a valid key pair"
+	errParseServingCert  = "cannot parse serving certificate file %s"
+	errServingCertExpiry = "serving certificate in file %s expired at %s"
+	errTokenEnvMismatch  = "control plane token %s claim %q is for domain %s but upbound api endpoint %s is in domain %s, the token may be for a different environment"
+	errReadMemoryLimit   = "cannot read cgroup memory limit"
+	errParseMemoryLimit  = "cannot parse cgroup memory limit %q"
+	errMemoryTooLow      = "memory limit of %d bytes is lower than the minimum of %d bytes, the agent is likely to run out of memory under load"
+)
+
+const (
+	// cgroupRoot is where the cgroup filesystem of the container is mounted.
+	cgroupRoot = "/sys/fs/cgroup"
+
+	// memoryMaxFile is the memory limit in cgroup v2, which is "max" if
+	// unlimited.
+	memoryMaxFile = "memory.max"
+	// memoryLimitFile is the memory limit in cgroup v1, which is a very large
+	// number if unlimited.
+	memoryLimitFile = "memory/memory.limit_in_bytes"
+
+	// unlimitedMemory is the limit from which on cgroup v1 memory limits are
+	// considered unlimited, i.e. the page aligned maximum int64 it reports.
+	unlimitedMemory = int64(1) << 62
+)
+
+// checkFilePermissions returns an error if the file at the given path can be
+// accessed by users other than its owner and group.
+func checkFilePermissions(path string) error {
+	fi, err := os.Stat(filepath.Clean(path))
+	if err != nil {
+		return errors.Wrapf(err, errStatFile, path)
+	}
+	if perm := fi.Mode().Perm(); perm&permOther != 0 {
+		return errors.Errorf(errFileTooPermissive, path, perm)
+	}
+	return nil
+}
+
+// checkSensitiveFiles checks the permissions of the given sensitive files. It
+// returns an error for a file that is too permissive only in strict mode and
+// otherwise logs it.
+func checkSensitiveFiles(strict bool, log logging.Logger, paths ...string) error {
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		err := checkFilePermissions(p)
+		if err == nil {
+			continue
+		}
+		if strict {
+			return err
+		}
+		log.Info("warning: sensitive file has permissive permissions", "error", err)
+	}
+	return nil
+}
+
+// checkNonRoot returns an error if the given effective UID is root and non root
+// is required, and otherwise only logs it.
+func checkNonRoot(euid int, require bool, log logging.Logger) error {
+	if euid != 0 {
+		return nil
+	}
+	if require {
+		return errors.New(errRunningAsRoot)
+	}
+	log.Info("warning: " + errRunningAsRoot)
+	return nil
+}
+
+// checkServingKeyPair returns an error naming the bad file if the serving
+// certificate and key in the given files cannot be loaded as a key pair, or if
+// the certificate is expired at the given time. It logs the subject and expiry
+// of the certificate otherwise.
+func checkServingKeyPair(certFile, keyFile string, now time.Time, log logging.Logger) error {
+	cb, err := os.ReadFile(filepath.Clean(certFile))
+	if err != nil {
+		return errors.Wrapf(err, errReadServingCert, certFile)
+	}
+	kb, err := os.ReadFile(filepath.Clean(keyFile))
+	if err != nil {
+		return errors.Wrapf(err, errReadServingKey, keyFile)
+	}
+	// This is what tls.LoadX509KeyPair does, but reading the files separately
+	// tells which of them is missing.
+	kp, err := tls.X509KeyPair(cb, kb)
+	if err != nil {
+		return errors.Wrapf(err, errServingKeyPair, certFile, keyFile)
+	}
+	leaf, err := x509.ParseCertificate(kp.Certificate[0])
+	if err != nil {
+		return errors.Wrapf(err, errParseServingCert, certFile)
+	}
+	if now.After(leaf.NotAfter) {
+		return errors.Errorf(errServingCertExpiry, certFile, leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+	log.Info("loaded serving certificate", "subject", leaf.Subject.String(), "not-after", leaf.NotAfter.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// checkServingCertChain returns an error if the serving certificate in the
+// given file does not include the intermediates needed to chain up to a
+// trusted root and strict is set, and otherwise only logs it.
+func checkServingCertChain(certFile string, strict bool, log logging.Logger) error {
+	b, err := os.ReadFile(filepath.Clean(certFile))
+	if err != nil {
+		return errors.Wrapf(err, errReadServingCert, certFile)
+	}
+	err = upboundagent.VerifyServingCertChain(b, nil)
+	if err == nil || strict {
+		return err
+	}
+	log.Info("warning: " + err.Error() + ", clients that do not have the missing intermediates will fail to verify it")
+	return nil
+}
+
+// cgroupMemoryLimit returns the memory limit of the cgroup mounted at the given
+// root, trying cgroup v2 before v1, and whether there is a limit at all.
+func cgroupMemoryLimit(root string) (int64, bool, error) {
+	b, err := os.ReadFile(filepath.Join(root, memoryMaxFile))
+	if os.IsNotExist(err) {
+		b, err = os.ReadFile(filepath.Join(root, memoryLimitFile))
+	}
+	if err != nil {
+		return 0, false, errors.Wrap(err, errReadMemoryLimit)
+	}
+	v := strings.TrimSpace(string(b))
+	if v == "max" {
+		return 0, false, nil
+	}
+	limit, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, false, errors.Wrapf(err, errParseMemoryLimit, v)
+	}
+	return limit, limit < unlimitedMemory, nil
+}
+
+// memoryBytes returns the number of bytes of the given quantity, e.g. 128Mi,
+// or zero if it is not a valid quantity.
+func memoryBytes(s string) int64 {
+	q, err := resource.ParseQuantity(s)
+	if err != nil {
+		return 0
+	}
+	return q.Value()
+}
+
+// checkMinMemory returns an error if the memory limit of the cgroup mounted at
+// the given root is lower than the given minimum and strict is set, and
+// otherwise only logs it. Without a limit, or if it cannot be read, e.g. when
+// not running in a container, nothing is checked.
+func checkMinMemory(root string, min int64, strict bool, log logging.Logger) error {
+	limit, ok, err := cgroupMemoryLimit(root)
+	if err != nil {
+		log.Debug("cannot check memory limit", "error", err)
+		return nil
+	}
+	if !ok || limit >= min {
+		return nil
+	}
+	err = errors.Errorf(errMemoryTooLow, limit, min)
+	if strict {
+		return err
+	}
+	log.Info("warning: " + err.Error())
+	return nil
+}
+
+// checkWritable returns an error naming the first of the given directories,
+// keyed by what they are used for, that the agent cannot write to.
+func checkWritable(dirs map[string]string) error {
+	for use, dir := range dirs {
+		f, err := ioutil.TempFile(dir, ".write-check-")
+		if err != nil {
+			return errors.Wrapf(err, errPathNotWritable, dir, use)
+		}
+		_ = f.Close()
+		if err := os.Remove(f.Name()); err != nil {
+			return errors.Wrapf(err, errPathNotWritable, dir, use)
+		}
+	}
+	return nil
+}
+
+// envRequirement is an environment variable that an enabled feature requires,
+// along with a check of its value.
+type envRequirement struct {
+	env     string
+	feature string
+	valid   func(string) error
+}
+
+// requiredEnv returns the environment variables that the enabled features
+// require.
+func (a AgentCmd) requiredEnv() []envRequirement {
+	var r []envRequirement
+	if a.AdvertisePodIP {
+		r = append(r, envRequirement{env: envPodIP, feature: "--advertise-pod-ip", valid: validIP})
+	}
+	return r
+}
+
+// checkRequiredEnv returns an error naming the first of the given environment
+// variables that is not set or invalid, and the feature requiring it.
+func checkRequiredEnv(reqs []envRequirement, lookup func(string) (string, bool)) error {
+	for _, r := range reqs {
+		v, ok := lookup(r.env)
+		if !ok || v == "" {
+			return errors.Errorf(errMissingEnv, r.env, r.feature)
+		}
+		if r.valid == nil {
+			continue
+		}
+		if err := r.valid(v); err != nil {
+			return errors.Errorf(errInvalidEnv, r.env, r.feature, err)
+		}
+	}
+	return nil
+}
+
+func validIP(v string) error {
+	if net.ParseIP(v) == nil {
+		return errors.Errorf("%q is not an IP address", v)
+	}
+	return nil
+}
+
+var reHostLabel = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// checkTokenEnvironment returns an error if the issuer or audience of the
+// given token is a host in a different domain than the given Upbound API
+// endpoint, e.g. a production token used with a staging endpoint, only in
+// strict mode and otherwise logs it. The domain of a host is its last two
+// labels. Claims that are not hosts or URLs, as well as endpoints that are IP
+// addresses or single labels, are not compared.
+func checkTokenEnvironment(token, endpoint string, strict bool, log logging.Logger) error {
+	d := hostDomain(endpoint)
+	if d == "" {
+		return nil
+	}
+	cl := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, cl); err != nil {
+		// Malformed tokens are reported when reading the control plane ID.
+		return nil
+	}
+	for _, c := range []string{"iss", "aud"} {
+		for _, v := range claimStrings(cl[c]) {
+			td := hostDomain(v)
+			if td == "" || td == d {
+				continue
+			}
+			err := errors.Errorf(errTokenEnvMismatch, c, v, td, endpoint, d)
+			if strict {
+				return err
+			}
+			log.Info("warning: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// claimStrings returns the string values of a claim, which may be a single
+// string or a list, like the audience.
+func claimStrings(v interface{}) []string {
+	switch t := v.(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		s := make([]string, 0, len(t))
+		for _, e := range t {
+			if es, ok := e.(string); ok {
+				s = append(s, es)
+			}
+		}
+		return s
+	}
+	return nil
+}
+
+// hostDomain returns the last two labels of the host of the given URL or
+// bare host, or an empty string if it is not a host name with at least two
+// labels.
+func hostDomain(s string) string {
+	h := s
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return ""
+		}
+		h = u.Hostname()
+	} else if hh, _, err := net.SplitHostPort(s); err == nil {
+		h = hh
+	}
+	h = strings.TrimSuffix(strings.ToLower(h), ".")
+	if net.ParseIP(h) != nil {
+		return ""
+	}
+	labels := strings.Split(h, ".")
+	if len(labels) < 2 {
+		return ""
+	}
+	for _, l := range labels {
+		if !reHostLabel.MatchString(l) {
+			return ""
+		}
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
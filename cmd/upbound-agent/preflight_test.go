@@ -0,0 +1,454 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	"github.com/crossplane/crossplane-runtime/pkg/test"
+)
+
+// writeFile writes the given content to a file with the given permissions in
+// a temporary directory and returns its path.
+func writeFile(t *testing.T, name, content string, perm os.FileMode) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, []byte(content), perm); err != nil {
+		t.Fatalf("cannot write file: %v", err)
+	}
+	// Do not depend on the umask.
+	if err := os.Chmod(p, perm); err != nil {
+		t.Fatalf("cannot chmod file: %v", err)
+	}
+	return p
+}
+
+func Test_checkSensitiveFiles(t *testing.T) {
+	restrictive := writeFile(t, "token", "t", 0o600)
+	groupReadable := writeFile(t, "tls.key", "k", 0o640)
+	permissive := writeFile(t, "tls.key", "k", 0o644)
+
+	cases := map[string]struct {
+		reason string
+		strict bool
+		paths  []string
+		want   error
+		warned bool
+	}{
+		"Restrictive": {
+			reason: "Files only accessible by their owner should pass.",
+			strict: true,
+			paths:  []string{restrictive},
+		},
+		"GroupReadable": {
+			reason: "Files accessible by their group should pass.",
+			strict: true,
+			paths:  []string{groupReadable},
+		},
+		"TooPermissiveStrict": {
+			reason: "Files readable by other users should fail in strict mode.",
+			strict: true,
+			paths:  []string{restrictive, permissive},
+			want:   errors.Errorf(errFileTooPermissive, permissive, os.FileMode(0o644)),
+		},
+		"TooPermissiveNotStrict": {
+			reason: "Files readable by other users should only be logged as a warning if not in strict mode.",
+			paths:  []string{permissive},
+			warned: true,
+		},
+		"NotConfigured": {
+			reason: "Files that are not configured should be skipped.",
+			strict: true,
+			paths:  []string{""},
+		},
+		"Missing": {
+			reason: "Missing files should fail.",
+			strict: true,
+			paths:  []string{"/does/not/exist"},
+			want:   errors.Wrapf(errors.New("stat /does/not/exist: no such file or directory"), errStatFile, "/does/not/exist"),
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			rl := &recordingLogger{}
+			err := checkSensitiveFiles(tc.strict, rl, tc.paths...)
+			if diff := cmp.Diff(tc.want, err, test.EquateErrors()); diff != "" {
+				t.Errorf("\n%s\ncheckSensitiveFiles(...): -want error, +got error:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.warned, len(rl.entries) > 0); diff != "" {
+				t.Errorf("\n%s\ncheckSensitiveFiles(...): -want warning, +got warning:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func Test_checkNonRoot(t *testing.T) {
+	cases := map[string]struct {
+		reason  string
+		euid    int
+		require bool
+		want    error
+	}{
+		"NonRoot": {
+			reason:  "Running as a non root user should pass.",
+			euid:    65532,
+			require: true,
+		},
+		"RootRequired": {
+			reason:  "Running as root should fail if non root is required.",
+			euid:    0,
+			require: true,
+			want:    errors.New(errRunningAsRoot),
+		},
+		"RootNotRequired": {
+			reason: "Running as root should only be logged if non root is not required.",
+			euid:   0,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := checkNonRoot(tc.euid, tc.require, logging.NewNopLogger())
+			if diff := cmp.Diff(tc.want, err, test.EquateErrors()); diff != "" {
+				t.Errorf("\n%s\ncheckNonRoot(...): -want error, +got error:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func Test_checkRequiredEnv(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		cmd    AgentCmd
+		env    map[string]string
+		want   error
+	}{
+		"FeatureDisabled": {
+			reason: "No environment variables should be required if no feature requiring them is enabled.",
+			cmd:    AgentCmd{},
+		},
+		"Missing": {
+			reason: "A missing environment variable should be named along with the feature requiring it.",
+			cmd:    AgentCmd{AdvertisePodIP: true},
+			want:   errors.Errorf(errMissingEnv, envPodIP, "--advertise-pod-ip"),
+		},
+		"Empty": {
+			reason: "An empty environment variable should be treated as missing.",
+			cmd:    AgentCmd{AdvertisePodIP: true},
+			env:    map[string]string{envPodIP: ""},
+			want:   errors.Errorf(errMissingEnv, envPodIP, "--advertise-pod-ip"),
+		},
+		"Invalid": {
+			reason: "An environment variable with an invalid value should be rejected.",
+			cmd:    AgentCmd{AdvertisePodIP: true},
+			env:    map[string]string{envPodIP: "status.podIP"},
+			want:   errors.Errorf(errInvalidEnv, envPodIP, "--advertise-pod-ip", errors.New(`"status.podIP" is not an IP address`)),
+		},
+		"Set": {
+			reason: "A valid environment variable should pass.",
+			cmd:    AgentCmd{AdvertisePodIP: true},
+			env:    map[string]string{envPodIP: "10.0.0.12"},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			lookup := func(k string) (string, bool) {
+				v, ok := tc.env[k]
+				return v, ok
+			}
+			err := checkRequiredEnv(tc.cmd.requiredEnv(), lookup)
+			if diff := cmp.Diff(tc.want, err, test.EquateErrors()); diff != "" {
+				t.Errorf("\n%s\ncheckRequiredEnv(...): -want error, +got error:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func Test_checkWritable(t *testing.T) {
+	writable := t.TempDir()
+	readOnly := t.TempDir()
+	if err := os.Chmod(readOnly, 0o500); err != nil {
+		t.Fatalf("cannot chmod dir: %v", err)
+	}
+	file := writeFile(t, "file", "", 0o600)
+
+	cases := map[string]struct {
+		reason    string
+		dirs      map[string]string
+		wantError bool
+		skip      bool
+	}{
+		"Writable": {
+			reason: "Writable directories should pass.",
+			dirs:   map[string]string{"nats ca": writable},
+		},
+		"ReadOnly": {
+			reason:    "Read only directories should fail.",
+			dirs:      map[string]string{"nats ca": readOnly},
+			wantError: true,
+			// Root can write to read only directories.
+			skip: os.Geteuid() == 0,
+		},
+		"NotADirectory": {
+			reason:    "Paths that are not directories should fail.",
+			dirs:      map[string]string{"nats ca": file},
+			wantError: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if tc.skip {
+				t.Skip("cannot test as root")
+			}
+			err := checkWritable(tc.dirs)
+			if tc.wantError != (err != nil) {
+				t.Fatalf("\n%s\ncheckWritable(...): want error %t, got: %v", tc.reason, tc.wantError, err)
+			}
+			for use, dir := range tc.dirs {
+				if err != nil && !strings.HasPrefix(err.Error(), fmt.Sprintf(errPathNotWritable, dir, use)) {
+					t.Errorf("\n%s\ncheckWritable(...): error should name the directory and its use, got: %v", tc.reason, err)
+				}
+			}
+		})
+	}
+}
+
+func Test_checkTokenEnvironment(t *testing.T) {
+	cases := map[string]struct {
+		reason   string
+		claims   jwt.MapClaims
+		endpoint string
+		strict   bool
+		want     error
+	}{
+		"SameDomain": {
+			reason:   "A token issued in the domain of the endpoint should pass.",
+			claims:   jwt.MapClaims{"iss": "https://api.upbound.io/v1", "aud": "upbound.io"},
+			endpoint: "https://api.upbound.io",
+			strict:   true,
+		},
+		"IssuerMismatch": {
+			reason:   "A token issued in a different domain than the endpoint should fail in strict mode.",
+			claims:   jwt.MapClaims{"iss": "https://api.upbound.io"},
+			endpoint: "https://api.upbound-staging.io",
+			strict:   true,
+			want:     errors.Errorf(errTokenEnvMismatch, "iss", "https://api.upbound.io", "upbound.io", "https://api.upbound-staging.io", "upbound-staging.io"),
+		},
+		"AudienceMismatch": {
+			reason:   "A token for an audience in a different domain than the endpoint should fail in strict mode.",
+			claims:   jwt.MapClaims{"aud": []interface{}{"c21561da-087b-4efc-af6b-718e99bfd85f", "api.upbound-staging.io"}},
+			endpoint: "api.upbound.io:443",
+			strict:   true,
+			want:     errors.Errorf(errTokenEnvMismatch, "aud", "api.upbound-staging.io", "upbound-staging.io", "api.upbound.io:443", "upbound.io"),
+		},
+		"MismatchNotStrict": {
+			reason:   "A mismatch should only be logged if not strict.",
+			claims:   jwt.MapClaims{"iss": "https://api.upbound.io"},
+			endpoint: "https://api.upbound-staging.io",
+		},
+		"NotHosts": {
+			reason:   "Claims that are not hosts should not be compared.",
+			claims:   jwt.MapClaims{"iss": "upbound", "aud": "controlPlane|c21561da-087b-4efc-af6b-718e99bfd85f"},
+			endpoint: "https://api.upbound.io",
+			strict:   true,
+		},
+		"EndpointIP": {
+			reason:   "Endpoints that are IP addresses should not be compared.",
+			claims:   jwt.MapClaims{"iss": "https://api.upbound.io"},
+			endpoint: "https://10.0.0.1:8443",
+			strict:   true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := checkTokenEnvironment(signedToken(t, tc.claims), tc.endpoint, tc.strict, logging.NewNopLogger())
+			if diff := cmp.Diff(tc.want, err, test.EquateErrors()); diff != "" {
+				t.Errorf("\n%s\ncheckTokenEnvironment(...): -want error, +got error:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func Test_checkMinMemory(t *testing.T) {
+	const min = 128 << 20
+
+	cases := map[string]struct {
+		reason string
+		files  map[string]string
+		strict bool
+		want   error
+		warned bool
+	}{
+		"EnoughV2": {
+			reason: "A cgroup v2 limit above the minimum should pass.",
+			files:  map[string]string{memoryMaxFile: "268435456\n"},
+		},
+		"UnlimitedV2": {
+			reason: "An unlimited cgroup v2 limit should pass.",
+			files:  map[string]string{memoryMaxFile: "max\n"},
+		},
+		"TooLowV2": {
+			reason: "A cgroup v2 limit below the minimum should only be logged if not strict.",
+			files:  map[string]string{memoryMaxFile: "67108864\n"},
+			warned: true,
+		},
+		"TooLowV2Strict": {
+			reason: "A cgroup v2 limit below the minimum should fail if strict.",
+			files:  map[string]string{memoryMaxFile: "67108864\n"},
+			strict: true,
+			want:   errors.Errorf(errMemoryTooLow, 67108864, min),
+		},
+		"TooLowV1Strict": {
+			reason: "A cgroup v1 limit below the minimum should fail if strict.",
+			files:  map[string]string{memoryLimitFile: "67108864\n"},
+			strict: true,
+			want:   errors.Errorf(errMemoryTooLow, 67108864, min),
+		},
+		"UnlimitedV1": {
+			reason: "The very large limit cgroup v1 reports if unlimited should pass.",
+			files:  map[string]string{memoryLimitFile: "9223372036854771712\n"},
+			strict: true,
+		},
+		"NoCgroup": {
+			reason: "Nothing should be checked if there is no cgroup memory limit to read.",
+			strict: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			root := t.TempDir()
+			for f, content := range tc.files {
+				p := filepath.Join(root, f)
+				if err := os.MkdirAll(filepath.Dir(p), 0o750); err != nil {
+					t.Fatalf("cannot create cgroup directory: %v", err)
+				}
+				if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+					t.Fatalf("cannot write cgroup file: %v", err)
+				}
+			}
+			rl := &recordingLogger{}
+			err := checkMinMemory(root, min, tc.strict, rl)
+			if diff := cmp.Diff(tc.want, err, test.EquateErrors()); diff != "" {
+				t.Errorf("\n%s\ncheckMinMemory(...): -want error, +got error:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.warned, len(rl.entries) > 0); diff != "" {
+				t.Errorf("\n%s\ncheckMinMemory(...): -want warning, +got warning:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+// writeKeyPair writes a self-signed serving certificate for the given common
+// name that expires at the given time and its key to a temporary directory and
+// returns their paths.
+func writeKeyPair(t *testing.T, cn string, notAfter time.Time) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    notAfter.Add(-24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %v", err)
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("cannot marshal key: %v", err)
+	}
+	c := writeFile(t, "tls.crt", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), 0o600)
+	k := writeFile(t, "tls.key", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})), 0o600)
+	return c, k
+}
+
+func Test_checkServingKeyPair(t *testing.T) {
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := now.Add(time.Hour)
+	cert, key := writeKeyPair(t, "agent", notAfter)
+	_, otherKey := writeKeyPair(t, "other", notAfter)
+	expiredCert, expiredKey := writeKeyPair(t, "agent", now.Add(-time.Hour))
+
+	cases := map[string]struct {
+		reason string
+		cert   string
+		key    string
+		want   error
+		logged []map[string]interface{}
+	}{
+		"Valid": {
+			reason: "A matching and unexpired key pair should pass and be logged.",
+			cert:   cert,
+			key:    key,
+			logged: []map[string]interface{}{{"subject": "CN=agent", "not-after": notAfter.Format(time.RFC3339)}},
+		},
+		"MissingCert": {
+			reason: "A missing certificate file should be named in the error.",
+			cert:   "/does/not/exist",
+			key:    key,
+			want:   errors.Wrapf(errors.New("open /does/not/exist: no such file or directory"), errReadServingCert, "/does/not/exist"),
+		},
+		"MissingKey": {
+			reason: "A missing key file should be named in the error.",
+			cert:   cert,
+			key:    "/does/not/exist",
+			want:   errors.Wrapf(errors.New("open /does/not/exist: no such file or directory"), errReadServingKey, "/does/not/exist"),
+		},
+		"Mismatch": {
+			reason: "A key that does not match the certificate should fail naming both files.",
+			cert:   cert,
+			key:    otherKey,
+			want:   errors.Wrapf(errors.New("tls: private key does not match public key"), errServingKeyPair, cert, otherKey),
+		},
+		"Expired": {
+			reason: "An expired certificate should fail.",
+			cert:   expiredCert,
+			key:    expiredKey,
+			want:   errors.Errorf(errServingCertExpiry, expiredCert, now.Add(-time.Hour).Format(time.RFC3339)),
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			rl := &recordingLogger{}
+			err := checkServingKeyPair(tc.cert, tc.key, now, rl)
+			if diff := cmp.Diff(tc.want, err, test.EquateErrors()); diff != "" {
+				t.Errorf("\n%s\ncheckServingKeyPair(...): -want error, +got error:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.logged, rl.entries); diff != "" {
+				t.Errorf("\n%s\ncheckServingKeyPair(...): -want log, +got log:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+)
+
+const (
+	errEndpointNoHost = "cannot determine host of endpoint %q"
+)
+
+// resolver resolves host names to IP addresses. It is satisfied by
+// net.Resolver.
+type resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// hostFromEndpoint returns the host name of the given endpoint, which may or
+// may not contain a scheme and a port.
+func hostFromEndpoint(e string) (string, error) {
+	u, err := url.Parse(e)
+	if err != nil || u.Host == "" {
+		// Endpoint without a scheme, e.g. "api.upbound.io:443".
+		u, err = url.Parse("//" + e)
+	}
+	if err != nil || u.Hostname() == "" {
+		return "", errors.Errorf(errEndpointNoHost, e)
+	}
+	return u.Hostname(), nil
+}
+
+// hostPortFromEndpoint returns the host and port of the given endpoint. The
+// port defaults to the one of its scheme, if known, or the given one.
+func hostPortFromEndpoint(e, defaultPort string) (string, error) {
+	h, err := hostFromEndpoint(e)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(e)
+	if err != nil || u.Host == "" {
+		u, _ = url.Parse("//" + e)
+	}
+	port := u.Port()
+	switch {
+	case port != "":
+	case u.Scheme == "https":
+		port = "443"
+	case u.Scheme == "http":
+		port = "80"
+	default:
+		port = defaultPort
+	}
+	return net.JoinHostPort(h, port), nil
+}
+
+// resolveEndpoint resolves the host of the given endpoint to IP addresses.
+func resolveEndpoint(ctx context.Context, r resolver, e string) (string, []string, error) {
+	h, err := hostFromEndpoint(e)
+	if err != nil {
+		return "", nil, err
+	}
+	ips, err := r.LookupIPAddr(ctx, h)
+	if err != nil {
+		return h, nil, errors.Wrapf(err, "cannot resolve host %q", h)
+	}
+	addrs := make([]string, len(ips))
+	for i := range ips {
+		addrs[i] = ips[i].String()
+	}
+	return h, addrs, nil
+}
+
+// logResolvedEndpoints logs the IP addresses that the given endpoints, keyed
+// by a human friendly name, resolve to. It is a diagnostic aid only, so any
+// resolution failure is logged rather than returned and each resolution is
+// bounded by the given timeout.
+func logResolvedEndpoints(r resolver, endpoints map[string]string, timeout time.Duration, log logging.Logger) {
+	for name, e := range endpoints {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		h, addrs, err := resolveEndpoint(ctx, r, e)
+		cancel()
+		if err != nil {
+			log.Info("failed to resolve endpoint", "name", name, "endpoint", e, "error", err)
+			continue
+		}
+		log.Info("resolved endpoint", "name", name, "endpoint", e, "host", h, "addresses", addrs)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+
+	"github.com/crossplane/crossplane-runtime/pkg/test"
+)
+
+type mockResolver struct {
+	addrs map[string][]net.IPAddr
+}
+
+func (m mockResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	a, ok := m.addrs[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return a, nil
+}
+
+func Test_resolveEndpoint(t *testing.T) {
+	r := mockResolver{addrs: map[string][]net.IPAddr{
+		"api.upbound.io":     {{IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("10.0.0.2")}},
+		"connect.upbound.io": {{IP: net.ParseIP("10.0.1.1")}},
+	}}
+
+	type want struct {
+		host  string
+		addrs []string
+		err   error
+	}
+	cases := map[string]struct {
+		endpoint string
+		want
+	}{
+		"URLWithScheme": {
+			endpoint: "https://api.upbound.io",
+			want: want{
+				host:  "api.upbound.io",
+				addrs: []string{"10.0.0.1", "10.0.0.2"},
+			},
+		},
+		"URLWithSchemeAndPort": {
+			endpoint: "nats://connect.upbound.io:443",
+			want: want{
+				host:  "connect.upbound.io",
+				addrs: []string{"10.0.1.1"},
+			},
+		},
+		"HostAndPortOnly": {
+			endpoint: "connect.upbound.io:443",
+			want: want{
+				host:  "connect.upbound.io",
+				addrs: []string{"10.0.1.1"},
+			},
+		},
+		"HostOnly": {
+			endpoint: "api.upbound.io",
+			want: want{
+				host:  "api.upbound.io",
+				addrs: []string{"10.0.0.1", "10.0.0.2"},
+			},
+		},
+		"NoHost": {
+			endpoint: "",
+			want: want{
+				err: errors.Errorf(errEndpointNoHost, ""),
+			},
+		},
+		"ResolutionFailed": {
+			endpoint: "https://unknown.upbound.io",
+			want: want{
+				host: "unknown.upbound.io",
+				err:  errors.Wrap(errors.New("no such host"), fmt.Sprintf("cannot resolve host %q", "unknown.upbound.io")),
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			h, addrs, err := resolveEndpoint(context.Background(), r, tc.endpoint)
+			if diff := cmp.Diff(tc.want.err, err, test.EquateErrors()); diff != "" {
+				t.Fatalf("resolveEndpoint(...): -want error, +got error: %s", diff)
+			}
+			if diff := cmp.Diff(tc.want.host, h); diff != "" {
+				t.Errorf("resolveEndpoint(...): -want host, +got host: %s", diff)
+			}
+			if diff := cmp.Diff(tc.want.addrs, addrs); diff != "" {
+				t.Errorf("resolveEndpoint(...): -want addresses, +got addresses: %s", diff)
+			}
+		})
+	}
+}
+
+func Test_hostPortFromEndpoint(t *testing.T) {
+	cases := map[string]struct {
+		endpoint string
+		want     string
+	}{
+		"HTTPS":        {endpoint: "https://api.upbound.io", want: "api.upbound.io:443"},
+		"HTTP":         {endpoint: "http://api.upbound.io", want: "api.upbound.io:80"},
+		"ExplicitPort": {endpoint: "nats://connect.upbound.io:443", want: "connect.upbound.io:443"},
+		"NoScheme":     {endpoint: "connect.upbound.io", want: "connect.upbound.io:4222"},
+		"NoSchemePort": {endpoint: "connect.upbound.io:8443", want: "connect.upbound.io:8443"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := hostPortFromEndpoint(tc.endpoint, defaultNATSPort)
+			if err != nil {
+				t.Fatalf("hostPortFromEndpoint(...): %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("hostPortFromEndpoint(...): -want, +got:\n%s", diff)
+			}
+		})
+	}
+}
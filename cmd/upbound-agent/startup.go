@@ -0,0 +1,55 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/alecthomas/kong"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+)
+
+// Categories of startup failures.
+const (
+	failureToken  = "token"
+	failureCert   = "cert"
+	failureKube   = "kube"
+	failureNATS   = "nats"
+	failureConfig = "config"
+)
+
+const (
+	eventStartupFailed = "startup-failed"
+	msgStartupFailed   = "Upbound Agent failed to start"
+)
+
+// logStartupFailure logs a single terminal event with the category of the
+// startup failure, so that log based alerting can match on it.
+func logStartupFailure(log logging.Logger, category string, err error) {
+	log.Info(msgStartupFailed, "event", eventStartupFailed, "category", category, "error", err.Error())
+}
+
+// failStartup logs the startup failure and exits if err is not nil. When
+// validating, the steps up to the failure are reported first.
+func failStartup(ctx *kong.Context, log logging.Logger, v *validation, category string, err error) {
+	if err == nil {
+		return
+	}
+	logStartupFailure(log, category, err)
+	v.fail(category, err)
+	if werr := v.write(); werr != nil {
+		log.Info("cannot write validation report", "error", werr)
+	}
+	ctx.FatalIfErrorf(err)
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+)
+
+// recordingLogger records the key value pairs logged at info level.
+type recordingLogger struct {
+	entries []map[string]interface{}
+}
+
+func (l *recordingLogger) Info(_ string, keysAndValues ...interface{}) {
+	kv := map[string]interface{}{}
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		kv[keysAndValues[i].(string)] = keysAndValues[i+1]
+	}
+	l.entries = append(l.entries, kv)
+}
+
+func (l *recordingLogger) Debug(string, ...interface{}) {}
+
+func (l *recordingLogger) WithValues(...interface{}) logging.Logger { return l }
+
+func Test_logStartupFailure(t *testing.T) {
+	rl := &recordingLogger{}
+	logStartupFailure(rl, failureCert, errors.Wrap(errors.New("boom"), "failed to fetch public certs"))
+
+	want := []map[string]interface{}{{
+		"event":    eventStartupFailed,
+		"category": failureCert,
+		"error":    "failed to fetch public certs: boom",
+	}}
+	if diff := cmp.Diff(want, rl.entries); diff != "" {
+		t.Errorf("logStartupFailure(...): -want logged, +got logged:\n%s", diff)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/upbound/universal-crossplane/internal/version"
+)
+
+// ValidateCmd represents the "validate" command, which runs the startup steps
+// of the agent with the same flags and exits without serving requests.
+type ValidateCmd struct {
+	AgentCmd
+}
+
+// validation records the outcome of the startup steps of the agent when its
+// configuration is validated rather than run. Steps are named by the category
+// of startup failures they may cause. Its methods do nothing if it is nil,
+// i.e. when running the agent.
+type validation struct {
+	out    io.Writer
+	report checkReport
+	last   time.Time
+}
+
+func newValidation(out io.Writer) *validation {
+	now := time.Now()
+	return &validation{out: out, report: checkReport{Version: version.Version, Time: now.UTC(), Passed: true}, last: now}
+}
+
+// pass records that the given step passed, timed since the previous one.
+func (v *validation) pass(step, detail string) {
+	if v == nil {
+		return
+	}
+	v.add(checkResult{Name: step, Passed: true, Detail: detail})
+}
+
+// fail records that the given step failed, which ends the validation.
+func (v *validation) fail(step string, err error) {
+	if v == nil {
+		return
+	}
+	v.add(checkResult{Name: step, Error: err.Error()})
+	v.report.Passed = false
+}
+
+func (v *validation) add(r checkResult) {
+	now := time.Now()
+	r.DurationSeconds = now.Sub(v.last).Seconds()
+	v.last = now
+	v.report.Checks = append(v.report.Checks, r)
+}
+
+// write prints the steps recorded so far as a structured report.
+func (v *validation) write() error {
+	if v == nil {
+		return nil
+	}
+	e := json.NewEncoder(v.out)
+	e.SetIndent("", "  ")
+	return errors.Wrap(e.Encode(v.report), "cannot write report")
+}
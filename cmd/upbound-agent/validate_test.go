@@ -0,0 +1,83 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/pkg/errors"
+)
+
+func TestValidation(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		steps  func(v *validation)
+		want   checkReport
+	}{
+		"Passed": {
+			reason: "The report should pass if all steps passed.",
+			steps: func(v *validation) {
+				v.pass(failureConfig, "flags and environment are valid")
+				v.pass(failureToken, "control plane id cp")
+			},
+			want: checkReport{Passed: true, Checks: []checkResult{
+				{Name: failureConfig, Passed: true, Detail: "flags and environment are valid"},
+				{Name: failureToken, Passed: true, Detail: "control plane id cp"},
+			}},
+		},
+		"Failed": {
+			reason: "The report should fail with the error of the failed step.",
+			steps: func(v *validation) {
+				v.pass(failureConfig, "flags and environment are valid")
+				v.fail(failureToken, errors.New("token is expired"))
+			},
+			want: checkReport{Checks: []checkResult{
+				{Name: failureConfig, Passed: true, Detail: "flags and environment are valid"},
+				{Name: failureToken, Error: "token is expired"},
+			}},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			v := newValidation(out)
+			tc.steps(v)
+			if err := v.write(); err != nil {
+				t.Fatalf("write(): %v", err)
+			}
+			got := checkReport{}
+			if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+				t.Fatalf("cannot decode report: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got, cmpopts.IgnoreFields(checkReport{}, "Version", "Time"), cmpopts.IgnoreFields(checkResult{}, "DurationSeconds")); diff != "" {
+				t.Errorf("\n%s\nwrite(): -want report, +got report:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestValidationNil(t *testing.T) {
+	// The agent runs with a nil validation, which must not record anything.
+	var v *validation
+	v.pass(failureConfig, "ok")
+	v.fail(failureToken, errors.New("boom"))
+	if err := v.write(); err != nil {
+		t.Errorf("write(): %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+
+	"github.com/pkg/errors"
+
+	"github.com/upbound/universal-crossplane/internal/version"
+)
+
+// VersionCmd represents the "version" command
+type VersionCmd struct {
+	JSON bool `name:"json" help:"Print the version as JSON, e.g. for provenance scripts."`
+}
+
+// buildInfo is the version and build of the agent.
+type buildInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"gitCommit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+}
+
+func currentBuildInfo() buildInfo {
+	return buildInfo{
+		Version:   version.Version,
+		GitCommit: version.GitCommit,
+		BuildDate: version.BuildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+}
+
+// run prints the version and build of the agent.
+func (v VersionCmd) run(out io.Writer) error {
+	bi := currentBuildInfo()
+	if v.JSON {
+		return errors.Wrap(json.NewEncoder(out).Encode(bi), "cannot write version")
+	}
+	_, err := fmt.Fprintf(out, "Version:    %s\nGit commit: %s\nBuild date: %s\nGo version: %s\nPlatform:   %s\n",
+		bi.Version, bi.GitCommit, bi.BuildDate, bi.GoVersion, bi.Platform)
+	return errors.Wrap(err, "cannot write version")
+}
@@ -0,0 +1,48 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestVersionCmd_run(t *testing.T) {
+	out := &bytes.Buffer{}
+	if err := (VersionCmd{JSON: true}).run(out); err != nil {
+		t.Fatalf("run(): %v", err)
+	}
+	got := buildInfo{}
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("cannot decode version: %v", err)
+	}
+	if diff := cmp.Diff(currentBuildInfo(), got); diff != "" {
+		t.Errorf("run(): -want version, +got version:\n%s", diff)
+	}
+
+	out.Reset()
+	if err := (VersionCmd{}).run(out); err != nil {
+		t.Fatalf("run(): %v", err)
+	}
+	for _, want := range []string{"Version:    " + got.Version, "Git commit: " + got.GitCommit, "Build date: " + got.BuildDate} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("run(): want %q in output:\n%s", want, out.String())
+		}
+	}
+}
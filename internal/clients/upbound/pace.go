@@ -0,0 +1,156 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upbound
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"golang.org/x/time/rate"
+)
+
+const headerRetryAfter = "Retry-After"
+
+// maxRetryAfter bounds how long requests are held off after a 429, so that
+// a bogus Retry-After does not stall the agent for hours.
+const maxRetryAfter = 5 * time.Minute
+
+// defaultTimeout bounds each request to Upbound API, so that a request to an
+// unresponsive endpoint does not hang forever.
+const defaultTimeout = 30 * time.Second
+
+// Option configures the client.
+type Option func(*client)
+
+// WithTimeout bounds each request to Upbound API to the given timeout, if
+// positive, instead of the default of 30 seconds.
+func WithTimeout(d time.Duration) Option {
+	return func(c *client) {
+		if d > 0 {
+			c.resty.SetTimeout(d)
+		}
+	}
+}
+
+// WithQPS limits the rate of requests to Upbound API to the given number of
+// requests per second, if positive. Requests are spaced out evenly, without
+// bursts.
+func WithQPS(qps float64) Option {
+	return func(c *client) {
+		if qps > 0 {
+			c.pacer.limiter = rate.NewLimiter(rate.Limit(qps), 1)
+		}
+	}
+}
+
+// pacer spaces out requests to Upbound API, so that the agent does not trip
+// its rate limits during retry storms. Once Upbound API responds with 429, no
+// requests are sent until its Retry-After passed, for at most maxRetryAfter.
+type pacer struct {
+	limiter *rate.Limiter
+	now     func() time.Time
+	sleep   func(ctx context.Context, d time.Duration) error
+
+	mu        sync.Mutex
+	notBefore time.Time
+}
+
+func newPacer() *pacer {
+	return &pacer{now: time.Now, sleep: sleep}
+}
+
+// wait blocks until a request may be sent.
+func (p *pacer) wait(ctx context.Context) error {
+	p.mu.Lock()
+	d := p.notBefore.Sub(p.now())
+	p.mu.Unlock()
+	if d > 0 {
+		if err := p.sleep(ctx, d); err != nil {
+			return err
+		}
+	}
+	if p.limiter == nil {
+		return nil
+	}
+	return p.limiter.Wait(ctx)
+}
+
+// observe holds off further requests if the given response asks to retry
+// later.
+func (p *pacer) observe(status int, h http.Header) {
+	if status != http.StatusTooManyRequests {
+		return
+	}
+	now := p.now()
+	d, ok := parseRetryAfter(h.Get(headerRetryAfter), now)
+	if !ok {
+		return
+	}
+	if d > maxRetryAfter {
+		d = maxRetryAfter
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if nb := now.Add(d); nb.After(p.notBefore) {
+		p.notBefore = nb
+	}
+}
+
+// install hooks the pacer into the given resty client.
+func (p *pacer) install(c *resty.Client) {
+	c.OnBeforeRequest(func(_ *resty.Client, r *resty.Request) error {
+		return p.wait(r.Context())
+	})
+	c.OnAfterResponse(func(_ *resty.Client, r *resty.Response) error {
+		p.observe(r.StatusCode(), r.Header())
+		return nil
+	})
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date, into how long to wait from now.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		if s < 0 {
+			return 0, false
+		}
+		return time.Duration(s) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	return t.Sub(now), true
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upbound
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	"github.com/google/go-cmp/cmp"
+	"github.com/jarcoal/httpmock"
+	"github.com/pkg/errors"
+
+	"github.com/upbound/universal-crossplane/internal/tracing"
+)
+
+const testEndpoint = "https://foo.com"
+
+func Test_clientSpacing(t *testing.T) {
+	rc := NewClient(testEndpoint, logging.NewNopLogger(), false, WithQPS(20))
+	httpmock.ActivateNonDefault(rc.(*client).resty.GetClient())
+	httpmock.RegisterResponder(http.MethodGet, testEndpoint+gwCertsPath, httpmock.NewStringResponder(http.StatusOK, `{"jwt_public_key":"k","nats_ca":"ca"}`))
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := rc.GetGatewayCerts("token"); err != nil {
+			t.Fatalf("GetGatewayCerts(...): %v", err)
+		}
+	}
+	// The first request is sent right away and the others 50ms apart.
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("GetGatewayCerts(...): want requests spaced out by 50ms, took %s for 3 requests", elapsed)
+	}
+}
+
+func Test_clientRetryAfter(t *testing.T) {
+	rc := NewClient(testEndpoint, logging.NewNopLogger(), false)
+	p := rc.(*client).pacer
+	now := time.Unix(0, 0)
+	p.now = func() time.Time { return now }
+	var slept []time.Duration
+	p.sleep = func(_ context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		now = now.Add(d)
+		return nil
+	}
+
+	httpmock.ActivateNonDefault(rc.(*client).resty.GetClient())
+	calls := 0
+	httpmock.RegisterResponder(http.MethodGet, testEndpoint+gwCertsPath, func(r *http.Request) (*http.Response, error) {
+		calls++
+		if calls == 1 {
+			res := httpmock.NewStringResponse(http.StatusTooManyRequests, "slow down")
+			res.Header.Set(headerRetryAfter, "30")
+			return res, nil
+		}
+		return httpmock.NewStringResponse(http.StatusOK, `{"jwt_public_key":"k","nats_ca":"ca"}`), nil
+	})
+
+	if _, err := rc.GetGatewayCerts("token"); err == nil {
+		t.Fatal("GetGatewayCerts(...): want error on 429")
+	}
+	if _, err := rc.GetGatewayCerts("token"); err != nil {
+		t.Fatalf("GetGatewayCerts(...): %v", err)
+	}
+	if _, err := rc.GetGatewayCerts("token"); err != nil {
+		t.Fatalf("GetGatewayCerts(...): %v", err)
+	}
+	// Only the request right after the 429 waits.
+	if diff := cmp.Diff([]time.Duration{30 * time.Second}, slept); diff != "" {
+		t.Errorf("GetGatewayCerts(...): -want waits, +got waits:\n%s", diff)
+	}
+}
+
+func Test_pacerObserve(t *testing.T) {
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	cases := map[string]struct {
+		reason string
+		status int
+		value  string
+		want   time.Duration
+	}{
+		"RetryAfter": {
+			reason: "Requests should be held off until the Retry-After of a 429 passed.",
+			status: http.StatusTooManyRequests,
+			value:  "30",
+			want:   30 * time.Second,
+		},
+		"LongRetryAfter": {
+			reason: "Requests should be held off for at most maxRetryAfter.",
+			status: http.StatusTooManyRequests,
+			value:  "86400",
+			want:   maxRetryAfter,
+		},
+		"FarHTTPDate": {
+			reason: "Requests should be held off for at most maxRetryAfter if Retry-After is a date far ahead.",
+			status: http.StatusTooManyRequests,
+			value:  "Sat, 01 May 2100 12:00:00 GMT",
+			want:   maxRetryAfter,
+		},
+		"NotTooManyRequests": {
+			reason: "Requests should not be held off for responses other than 429.",
+			status: http.StatusServiceUnavailable,
+			value:  "30",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			p := newPacer()
+			p.now = func() time.Time { return now }
+			var slept time.Duration
+			p.sleep = func(_ context.Context, d time.Duration) error {
+				slept = d
+				return nil
+			}
+			p.observe(tc.status, http.Header{headerRetryAfter: []string{tc.value}})
+			if err := p.wait(context.Background()); err != nil {
+				t.Fatalf("wait(...): %v", err)
+			}
+			if diff := cmp.Diff(tc.want, slept); diff != "" {
+				t.Errorf("\n%s\nobserve(...): -want wait, +got wait:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func Test_parseRetryAfter(t *testing.T) {
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	type want struct {
+		d  time.Duration
+		ok bool
+	}
+	cases := map[string]struct {
+		value string
+		want  want
+	}{
+		"Seconds":  {value: "120", want: want{d: 2 * time.Minute, ok: true}},
+		"HTTPDate": {value: "Sat, 01 May 2021 12:00:30 GMT", want: want{d: 30 * time.Second, ok: true}},
+		"Negative": {value: "-1"},
+		"Invalid":  {value: "soon"},
+		"Empty":    {value: ""},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			d, ok := parseRetryAfter(tc.value, now)
+			if diff := cmp.Diff(tc.want, want{d: d, ok: ok}, cmp.AllowUnexported(want{})); diff != "" {
+				t.Errorf("parseRetryAfter(%q): -want, +got:\n%s", tc.value, diff)
+			}
+		})
+	}
+}
+
+func Test_clientMaintenance(t *testing.T) {
+	rc := NewClient(testEndpoint, logging.NewNopLogger(), false)
+	httpmock.ActivateNonDefault(rc.(*client).resty.GetClient())
+
+	cases := map[string]struct {
+		reason     string
+		retryAfter string
+		want       *MaintenanceError
+	}{
+		"Maintenance": {
+			reason:     "A 503 with Retry-After should be reported as maintenance.",
+			retryAfter: "900",
+			want:       &MaintenanceError{RetryAfter: 15 * time.Minute, Body: "down for maintenance"},
+		},
+		"Unavailable": {
+			reason: "A 503 without Retry-After should be a regular failure.",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			httpmock.RegisterResponder(http.MethodGet, testEndpoint+gwCertsPath, func(r *http.Request) (*http.Response, error) {
+				res := httpmock.NewStringResponse(http.StatusServiceUnavailable, "down for maintenance")
+				if tc.retryAfter != "" {
+					res.Header.Set(headerRetryAfter, tc.retryAfter)
+				}
+				return res, nil
+			})
+			_, err := rc.GetGatewayCerts("token")
+			if err == nil {
+				t.Fatal("GetGatewayCerts(...): want error on 503")
+			}
+			var got *MaintenanceError
+			if !errors.As(err, &got) {
+				got = nil
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("\n%s\nGetGatewayCerts(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func Test_clientTimeout(t *testing.T) {
+	if got := NewClient(testEndpoint, logging.NewNopLogger(), false).(*client).resty.GetClient().Timeout; got != defaultTimeout {
+		t.Errorf("NewClient(...): want default timeout %s, got %s", defaultTimeout, got)
+	}
+
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	rc := NewClient(srv.URL, logging.NewNopLogger(), false, WithTimeout(50*time.Millisecond))
+	start := time.Now()
+	if _, err := rc.GetGatewayCerts("token"); err == nil {
+		t.Fatal("GetGatewayCerts(...): want error when Upbound API does not respond in time")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("GetGatewayCerts(...): want request timed out after 50ms, took %s", elapsed)
+	}
+}
+
+func Test_clientTLSConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"jwt_public_key":"k","nats_ca":"ca"}`))
+	}))
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	cases := map[string]struct {
+		reason  string
+		cfg     *tls.Config
+		wantErr bool
+	}{
+		"SystemRoots": {
+			reason:  "The certificate of Upbound API should be verified against the system roots by default.",
+			wantErr: true,
+		},
+		"CustomRoots": {
+			reason: "The certificate of Upbound API should be verified against the configured roots.",
+			cfg:    &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			rc := NewClient(srv.URL, logging.NewNopLogger(), false, WithTLSConfig(tc.cfg))
+			_, err := rc.GetGatewayCerts("token")
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("\n%s\nGetGatewayCerts(...): want error %t, got %v", tc.reason, tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func Test_clientTracer(t *testing.T) {
+	var propagated string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		propagated = r.Header.Get(tracing.HeaderTraceparent)
+		_, _ = w.Write([]byte(`{"jwt_public_key":"k","nats_ca":"ca"}`))
+	}))
+	defer srv.Close()
+	tr, err := tracing.New("http://otel-collector:4318", "cp", logging.NewNopLogger())
+	if err != nil {
+		t.Fatalf("tracing.New(...): %v", err)
+	}
+	rc := NewClient(srv.URL, logging.NewNopLogger(), false, WithTracer(tr))
+	if _, err := rc.GetGatewayCerts("token"); err != nil {
+		t.Fatalf("GetGatewayCerts(...): %v", err)
+	}
+	if propagated == "" {
+		t.Error("GetGatewayCerts(...): want trace context propagated to Upbound API")
+	}
+}
@@ -1,9 +1,11 @@
 package upbound
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/go-resty/resty/v2"
 	"github.com/pkg/errors"
@@ -11,6 +13,8 @@ import (
 	"go.opencensus.io/plugin/ochttp"
 
 	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	"github.com/upbound/universal-crossplane/internal/tracing"
 )
 
 const (
@@ -22,6 +26,35 @@ const (
 	keyNATSCA       = "nats_ca"
 )
 
+// MaintenanceError is returned if Upbound API is unavailable for planned
+// maintenance, i.e. responds with 503 and a Retry-After header.
+type MaintenanceError struct {
+	// RetryAfter is how long to wait before trying again.
+	RetryAfter time.Duration
+	Body       string
+}
+
+func (e *MaintenanceError) Error() string {
+	return fmt.Sprintf("upbound api is under maintenance, retry after %s - %s", e.RetryAfter, e.Body)
+}
+
+// maintenance returns a MaintenanceError if the given response announces
+// planned maintenance, or nil otherwise.
+func maintenance(resp *resty.Response) error {
+	if resp.StatusCode() != http.StatusServiceUnavailable {
+		return nil
+	}
+	d, ok := parseRetryAfter(resp.Header().Get(headerRetryAfter), time.Now())
+	if !ok {
+		return nil
+	}
+	if d < 0 {
+		// An HTTP date that already passed.
+		d = 0
+	}
+	return &MaintenanceError{RetryAfter: d, Body: string(resp.Body())}
+}
+
 // PublicCerts keeps the public certificates/keys to interact with Upbound Cloud.
 type PublicCerts struct {
 	JWTPublicKey string
@@ -38,10 +71,13 @@ type Client interface {
 type client struct {
 	resty  *resty.Client
 	logger logging.Logger
+	pacer  *pacer
+	base   http.RoundTripper
+	tracer *tracing.Tracer
 }
 
 // NewClient returns a new Upbound client
-func NewClient(host string, log logging.Logger, debug bool) Client {
+func NewClient(host string, log logging.Logger, debug bool, opts ...Option) Client {
 	c := resty.New().
 		SetHostURL(host).
 		SetDebug(debug).
@@ -54,7 +90,7 @@ func NewClient(host string, log logging.Logger, debug bool) Client {
 		// Warnf(format string, v ...interface{})
 		SetLogger(logrus.StandardLogger())
 
-	c.SetTransport(&ochttp.Transport{})
+	c.SetTimeout(defaultTimeout)
 
 	c.OnRequestLog(func(r *resty.RequestLog) error {
 		// masking authorization header
@@ -68,9 +104,40 @@ func NewClient(host string, log logging.Logger, debug bool) Client {
 		return nil
 	})
 
-	return &client{
+	uc := &client{
 		resty:  c,
 		logger: log,
+		pacer:  newPacer(),
+	}
+	for _, o := range opts {
+		o(uc)
+	}
+	c.SetTransport(&ochttp.Transport{Base: uc.tracer.Transport(uc.base)})
+	uc.pacer.install(c)
+	return uc
+}
+
+// WithTLSConfig verifies and authenticates connections to Upbound API with the
+// given TLS config, e.g. to trust the CA of a custom PKI instead of the system
+// roots or to present a client certificate. The system roots are used if it is
+// nil.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(c *client) {
+		if cfg == nil {
+			return
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = cfg
+		c.base = t
+	}
+}
+
+// WithTracer records a span of each request to Upbound API with the given
+// tracer, propagating its trace context to Upbound API. Requests are not
+// traced if it is nil.
+func WithTracer(t *tracing.Tracer) Option {
+	return func(c *client) {
+		c.tracer = t
 	}
 }
 
@@ -83,6 +150,9 @@ func (c *client) GetGatewayCerts(cpToken string) (PublicCerts, error) {
 	if err != nil {
 		return PublicCerts{}, errors.Wrap(err, "failed to request gateway certs")
 	}
+	if err := maintenance(resp); err != nil {
+		return PublicCerts{}, err
+	}
 	if resp.StatusCode() != http.StatusOK {
 		return PublicCerts{}, errors.Errorf("gateway certs request failed with %s - %s", resp.Status(), string(resp.Body()))
 	}
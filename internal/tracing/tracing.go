@@ -0,0 +1,271 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing records OpenTelemetry spans of HTTP requests and exports
+// them to an OpenTelemetry collector.
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	"github.com/upbound/universal-crossplane/internal/version"
+)
+
+const (
+	// HeaderTraceparent is the W3C Trace Context header that trace context
+	// is propagated in.
+	HeaderTraceparent = "Traceparent"
+
+	// AttributeControlPlaneID is the span attribute of the control plane ID.
+	AttributeControlPlaneID = "upbound.control_plane_id"
+
+	tracesPath     = "/v1/traces"
+	exportInterval = 5 * time.Second
+	exportTimeout  = 10 * time.Second
+	serviceName    = "upbound-agent"
+
+	// maxQueuedSpans bounds the number of finished spans held until they are
+	// exported, e.g. while the collector is unreachable.
+	maxQueuedSpans = 2048
+)
+
+const (
+	errParseEndpoint = "cannot parse otel endpoint"
+	errNewExporter   = "cannot create otel exporter"
+)
+
+// propagator propagates trace context in the W3C Trace Context headers.
+var propagator = propagation.TraceContext{}
+
+// Tracer records spans and exports them in batches to an OpenTelemetry
+// collector, using OTLP over HTTP. All spans carry the control plane ID as an
+// attribute. A nil Tracer records nothing, so that tracing is a no-op unless
+// configured.
+type Tracer struct {
+	endpoint       string
+	controlPlaneID string
+	provider       *sdktrace.TracerProvider
+	tracer         trace.Tracer
+	log            logging.Logger
+}
+
+// New returns a tracer that exports spans to the given endpoint, or nil if
+// it is empty. The OTLP traces path is appended to endpoints without a path.
+func New(endpoint, controlPlaneID string, log logging.Logger) (*Tracer, error) {
+	if endpoint == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.Errorf("%s: %s", errParseEndpoint, endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = tracesPath
+	}
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithURLPath(u.Path),
+		otlptracehttp.WithTimeout(exportTimeout),
+		// Spans that cannot be exported are dropped rather than retried, so
+		// that a collector outage does not hold up the batches after them.
+		otlptracehttp.WithRetry(otlptracehttp.RetryConfig{Enabled: false}),
+	}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exp, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, errNewExporter)
+	}
+	bsp := sdktrace.WithBatcher(&loggingExporter{SpanExporter: exp, endpoint: u.String(), log: log},
+		sdktrace.WithBatchTimeout(exportInterval),
+		sdktrace.WithExportTimeout(exportTimeout),
+		sdktrace.WithMaxQueueSize(maxQueuedSpans),
+	)
+	return newTracer(u.String(), controlPlaneID, log, bsp), nil
+}
+
+func newTracer(endpoint, controlPlaneID string, log logging.Logger, opts ...sdktrace.TracerProviderOption) *Tracer {
+	res := resource.NewSchemaless(
+		attribute.String("service.name", serviceName),
+		attribute.String("service.version", version.Version),
+	)
+	tp := sdktrace.NewTracerProvider(append([]sdktrace.TracerProviderOption{sdktrace.WithResource(res)}, opts...)...)
+	return &Tracer{
+		endpoint:       endpoint,
+		controlPlaneID: controlPlaneID,
+		provider:       tp,
+		tracer:         tp.Tracer(serviceName, trace.WithInstrumentationVersion(version.Version)),
+		log:            log,
+	}
+}
+
+// Endpoint returns the endpoint spans are exported to, or an empty string if
+// the tracer is nil.
+func (t *Tracer) Endpoint() string {
+	if t == nil {
+		return ""
+	}
+	return t.endpoint
+}
+
+// StartServer starts a span of the given inbound request, continuing the trace
+// of its Traceparent header, if any. It returns the request with the span in
+// its context, so that spans of outbound requests made on its behalf are its
+// children.
+func (t *Tracer) StartServer(r *http.Request, name string) (*Span, *http.Request) {
+	if t == nil {
+		return nil, r
+	}
+	ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, s := t.start(ctx, name, trace.SpanKindServer,
+		attribute.String("http.method", r.Method),
+		attribute.String("http.target", r.URL.Path),
+	)
+	return s, r.WithContext(ctx)
+}
+
+// Transport returns a round tripper that records a span of each request sent
+// through the given one, or the default transport if nil, and propagates its
+// trace context to the server in the Traceparent header. The span is a child
+// of the span in the context of the request, if any. It returns the given
+// round tripper if the tracer is nil.
+func (t *Tracer) Transport(next http.RoundTripper) http.RoundTripper {
+	if t == nil {
+		return next
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &transport{tracer: t, next: next}
+}
+
+// Run exports the recorded spans in the background until the context is
+// done, and a last time then, bounded by the export timeout, so that spans of
+// in-flight requests are not lost on shutdown.
+func (t *Tracer) Run(ctx context.Context) {
+	<-ctx.Done()
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+	if err := t.provider.Shutdown(ctx); err != nil {
+		t.log.Info("cannot export final spans", "error", err)
+	}
+}
+
+func (t *Tracer) start(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, *Span) {
+	attrs = append(attrs, attribute.String(AttributeControlPlaneID, t.controlPlaneID))
+	ctx, s := t.tracer.Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+	return ctx, &Span{span: s, kind: kind}
+}
+
+// loggingExporter logs the spans that cannot be exported. The error is not
+// returned, since the batch span processor would pass it on to the global
+// OpenTelemetry error handler, which logs to stderr.
+type loggingExporter struct {
+	sdktrace.SpanExporter
+	endpoint string
+	log      logging.Logger
+}
+
+func (e *loggingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if err := e.SpanExporter.ExportSpans(ctx, spans); err != nil {
+		e.log.Info("cannot export spans", "endpoint", e.endpoint, "error", err)
+	}
+	return nil
+}
+
+// Span is a timed operation within a trace, e.g. a request. A nil Span
+// records nothing.
+type Span struct {
+	span trace.Span
+	kind trace.SpanKind
+}
+
+// SetAttribute sets an attribute of the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.span.SetAttributes(attribute.String(key, value))
+}
+
+// SetStatusCode records the HTTP status code of the request of the span.
+// Server spans fail with 5xx codes, client spans with 4xx codes too.
+func (s *Span) SetStatusCode(code int) {
+	if s == nil {
+		return
+	}
+	s.span.SetAttributes(attribute.Int("http.status_code", code))
+	if code >= 500 || (s.kind == trace.SpanKindClient && code >= 400) {
+		s.span.SetStatus(codes.Error, http.StatusText(code))
+	}
+}
+
+// SetError records that the operation of the span failed with the given
+// error.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+// End ends the span and queues it for export.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.span.End()
+}
+
+// transport records a span of each request.
+type transport struct {
+	tracer *Tracer
+	next   http.RoundTripper
+}
+
+// RoundTrip sends the request with the trace context of its span.
+func (t *transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx, s := t.tracer.start(r.Context(), r.Method+" "+r.URL.Path, trace.SpanKindClient,
+		attribute.String("http.method", r.Method),
+		attribute.String("http.url", (&url.URL{Scheme: r.URL.Scheme, Host: r.URL.Host, Path: r.URL.Path}).String()),
+	)
+	defer s.End()
+
+	// Round trippers must not modify the given request.
+	r = r.Clone(ctx)
+	propagator.Inject(ctx, propagation.HeaderCarrier(r.Header))
+	res, err := t.next.RoundTrip(r)
+	if err != nil {
+		s.SetError(err)
+		return nil, err
+	}
+	s.SetStatusCode(res.StatusCode)
+	return res, nil
+}
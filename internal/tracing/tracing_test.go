@@ -0,0 +1,194 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+)
+
+const (
+	testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanID  = "00f067aa0ba902b7"
+)
+
+func TestNew(t *testing.T) {
+	cases := map[string]struct {
+		reason   string
+		endpoint string
+		want     string
+		wantErr  bool
+	}{
+		"NoPath": {
+			reason:   "The OTLP traces path should be appended to endpoints without a path.",
+			endpoint: "http://otel-collector:4318",
+			want:     "http://otel-collector:4318/v1/traces",
+		},
+		"Path": {
+			reason:   "The path of endpoints with a path should be kept.",
+			endpoint: "https://otel.example.com/otlp/v1/traces",
+			want:     "https://otel.example.com/otlp/v1/traces",
+		},
+		"NoScheme": {
+			reason:   "Endpoints without a scheme should be rejected.",
+			endpoint: "otel-collector:4318",
+			wantErr:  true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			tr, err := New(tc.endpoint, "cp", logging.NewNopLogger())
+			if diff := cmp.Diff(tc.wantErr, err != nil); diff != "" {
+				t.Fatalf("\n%s\nNew(...): -want error, +got error:\n%s\nerror: %v", tc.reason, diff, err)
+			}
+			if diff := cmp.Diff(tc.want, tr.Endpoint()); diff != "" {
+				t.Errorf("\n%s\nNew(...): -want endpoint, +got endpoint:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestTracer(t *testing.T) {
+	var propagated string
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		propagated = r.Header.Get(HeaderTraceparent)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer downstream.Close()
+	exp := tracetest.NewInMemoryExporter()
+	tr := newTracer("", "cp", logging.NewNopLogger(), sdktrace.WithSyncer(exp))
+
+	in := httptest.NewRequest(http.MethodGet, "/k8s/api", nil)
+	in.Header.Set(HeaderTraceparent, "00-"+testTraceID+"-"+testSpanID+"-01")
+	s, in := tr.StartServer(in, "GET /k8s/*")
+	out, _ := http.NewRequestWithContext(in.Context(), http.MethodGet, downstream.URL+"/api", nil)
+	res, err := (&http.Client{Transport: tr.Transport(nil)}).Do(out)
+	if err != nil {
+		t.Fatalf("Do(...): %v", err)
+	}
+	_ = res.Body.Close()
+	s.SetStatusCode(http.StatusOK)
+	s.End()
+
+	spans := exp.GetSpans()
+	if diff := cmp.Diff(2, len(spans)); diff != "" {
+		t.Fatalf("End(...): -want spans, +got spans:\n%s", diff)
+	}
+	// The client span ends first.
+	client, server := spans[0], spans[1]
+	type ids struct {
+		Trace, Parent string
+		Kind          trace.SpanKind
+		Status        codes.Code
+	}
+	want := []ids{
+		{Trace: testTraceID, Parent: server.SpanContext.SpanID().String(), Kind: trace.SpanKindClient, Status: codes.Error},
+		{Trace: testTraceID, Parent: testSpanID, Kind: trace.SpanKindServer, Status: codes.Unset},
+	}
+	got := []ids{
+		{Trace: client.SpanContext.TraceID().String(), Parent: client.Parent.SpanID().String(), Kind: client.SpanKind, Status: client.Status.Code},
+		{Trace: server.SpanContext.TraceID().String(), Parent: server.Parent.SpanID().String(), Kind: server.SpanKind, Status: server.Status.Code},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("End(...): -want, +got:\n%s", diff)
+	}
+	if diff := cmp.Diff("00-"+testTraceID+"-"+client.SpanContext.SpanID().String()+"-01", propagated); diff != "" {
+		t.Errorf("Transport(...): -want propagated traceparent, +got:\n%s", diff)
+	}
+	for _, sp := range spans {
+		if !hasAttribute(sp.Attributes, attribute.String(AttributeControlPlaneID, "cp")) {
+			t.Errorf("End(...): want control plane id attribute of span %s, got %v", sp.Name, sp.Attributes)
+		}
+	}
+}
+
+func TestTracerInvalidTraceparent(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tr := newTracer("", "cp", logging.NewNopLogger(), sdktrace.WithSyncer(exp))
+
+	in := httptest.NewRequest(http.MethodGet, "/k8s/api", nil)
+	in.Header.Set(HeaderTraceparent, "00-"+testTraceID+"-00f067aa0ba902bz-01")
+	s, _ := tr.StartServer(in, "GET /k8s/*")
+	s.End()
+
+	spans := exp.GetSpans()
+	if diff := cmp.Diff(1, len(spans)); diff != "" {
+		t.Fatalf("End(...): -want spans, +got spans:\n%s", diff)
+	}
+	if spans[0].Parent.IsValid() || spans[0].SpanContext.TraceID().String() == testTraceID {
+		t.Errorf("StartServer(...): want a new trace for an invalid traceparent, got trace %s with parent %s", spans[0].SpanContext.TraceID(), spans[0].Parent.SpanID())
+	}
+}
+
+func TestTracerRunExportsOnStop(t *testing.T) {
+	var exports int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == tracesPath && r.Header.Get("Content-Type") == "application/x-protobuf" {
+			atomic.AddInt32(&exports, 1)
+		}
+	}))
+	defer collector.Close()
+
+	tr, err := New(collector.URL, "cp", logging.NewNopLogger())
+	if err != nil {
+		t.Fatalf("New(...): %v", err)
+	}
+	s, _ := tr.StartServer(httptest.NewRequest(http.MethodGet, "/k8s/api", nil), "GET /k8s/*")
+	s.End()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tr.Run(ctx)
+	if got := atomic.LoadInt32(&exports); got != 1 {
+		t.Errorf("Run(...): want the queued spans exported once stopped, got %d exports", got)
+	}
+}
+
+func TestTracerNil(t *testing.T) {
+	tr, err := New("", "cp", logging.NewNopLogger())
+	if err != nil || tr != nil {
+		t.Fatalf("New(...): want nil tracer without endpoint, got %v, %v", tr, err)
+	}
+	in := httptest.NewRequest(http.MethodGet, "/k8s/api", nil)
+	s, out := tr.StartServer(in, "GET /k8s/*")
+	s.SetStatusCode(http.StatusOK)
+	s.End()
+	if out != in {
+		t.Error("StartServer(...): want request unchanged by nil tracer")
+	}
+	if tr.Transport(http.DefaultTransport) != http.DefaultTransport {
+		t.Error("Transport(...): want round tripper unchanged by nil tracer")
+	}
+}
+
+func hasAttribute(attrs []attribute.KeyValue, want attribute.KeyValue) bool {
+	for _, a := range attrs {
+		if a == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// isErrorStatus returns true if the given status indicates a server error, a
+// timeout or an authentication or authorization failure.
+func isErrorStatus(code int) bool {
+	switch code {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestTimeout:
+		return true
+	}
+	return code >= http.StatusInternalServerError
+}
+
+// errorAccessLog returns a middleware that logs requests that resulted in an
+// error response and nothing else.
+func (p *Proxy) errorAccessLog() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			if err != nil {
+				// Let the error handler write the response so that we can log
+				// its status.
+				c.Error(err)
+			}
+			res := c.Response()
+			if !isErrorStatus(res.Status) {
+				return err
+			}
+			r := c.Request()
+			kv := []interface{}{
+				"method", r.Method,
+				"uri", r.RequestURI,
+				"status", res.Status,
+				"latency", time.Since(start).String(),
+				"remote-ip", c.RealIP(),
+				"bytes-out", res.Size,
+			}
+			if err != nil {
+				kv = append(kv, "error", err)
+			}
+			p.log.Info("request failed", kv...)
+			return err
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/labstack/echo/v4"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+)
+
+// recordingLogger records the messages and key value pairs logged at info
+// level.
+type recordingLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+type logEntry struct {
+	msg string
+	kv  map[string]interface{}
+}
+
+func (l *recordingLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kv := map[string]interface{}{}
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		kv[keysAndValues[i].(string)] = keysAndValues[i+1]
+	}
+	l.entries = append(l.entries, logEntry{msg: msg, kv: kv})
+}
+
+func (l *recordingLogger) Debug(string, ...interface{}) {}
+
+func (l *recordingLogger) WithValues(...interface{}) logging.Logger { return l }
+
+func TestProxy_errorAccessLog(t *testing.T) {
+	e := echo.New()
+	rl := &recordingLogger{}
+	p := &Proxy{log: rl, config: &Config{}}
+	e.Use(p.errorAccessLog())
+	e.GET("/ok", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+	e.GET("/notfound", func(c echo.Context) error { return c.NoContent(http.StatusNotFound) })
+	e.GET("/unauthorized", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid token")
+	})
+	e.GET("/unavailable", func(c echo.Context) error { return c.NoContent(http.StatusServiceUnavailable) })
+	e.GET("/internal", func(c echo.Context) error { return c.NoContent(http.StatusInternalServerError) })
+
+	for _, path := range []string{"/ok", "/notfound", "/unauthorized", "/unavailable", "/internal"} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	got := map[string]interface{}{}
+	for _, en := range rl.entries {
+		got[en.kv["uri"].(string)] = en.kv["status"]
+	}
+	want := map[string]interface{}{
+		"/unauthorized": http.StatusUnauthorized,
+		"/unavailable":  http.StatusServiceUnavailable,
+		"/internal":     http.StatusInternalServerError,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("errorAccessLog(): -want logged, +got logged:\n%s", diff)
+	}
+}
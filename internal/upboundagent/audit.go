@@ -0,0 +1,147 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/upbound/universal-crossplane/internal/upboundagent/internal"
+)
+
+const errOpenAuditLog = "cannot open audit log file %s"
+
+// contextKeyTokenClaims is the key of the claims of the valid token of a
+// request in its echo context, once the token was reviewed.
+const contextKeyTokenClaims = "token-claims"
+
+// contextKeyTokenReview is the key of the tokenReview of a request in its echo
+// context, so that its token is only reviewed once.
+const contextKeyTokenReview = "token-review"
+
+// auditRedactedHeaders are the headers whose values are redacted even if
+// headers are captured, since they carry credentials.
+var auditRedactedHeaders = []string{headerAuthorization, "Proxy-Authorization", "Cookie"}
+
+var auditWriteFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "audit_log_write_failures_total",
+	Help:      "Number of audit entries that could not be written.",
+})
+
+// auditEntry is the record of a request that the agent handled on behalf of
+// Upbound. Bodies are never recorded.
+type auditEntry struct {
+	Time      time.Time           `json:"time"`
+	Method    string              `json:"method"`
+	Path      string              `json:"path"`
+	Status    int                 `json:"status"`
+	Subject   string              `json:"subject,omitempty"`
+	UpboundID string              `json:"upboundID,omitempty"`
+	Headers   map[string][]string `json:"headers,omitempty"`
+}
+
+// auditLogger writes an audit entry as a line of JSON for every request to
+// each of its writers.
+type auditLogger struct {
+	mu      sync.Mutex
+	writers []io.Writer
+	file    *os.File
+	headers bool
+	now     func() time.Time
+}
+
+// newAuditLogger returns an audit logger that writes to the given writer and,
+// if the config has a path, to the file at that path, which is appended to.
+func newAuditLogger(c AuditConfig, w io.Writer) (*auditLogger, error) {
+	a := &auditLogger{writers: []io.Writer{w}, headers: c.Headers, now: time.Now}
+	if c.Path == "" {
+		return a, nil
+	}
+	f, err := os.OpenFile(filepath.Clean(c.Path), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, errors.Wrapf(err, errOpenAuditLog, c.Path)
+	}
+	a.file = f
+	a.writers = append(a.writers, f)
+	return a, nil
+}
+
+// middleware writes an audit entry once the request was handled, along with
+// the subject of its token if it was valid.
+func (a *auditLogger) middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			err := next(c)
+			r := c.Request()
+			e := auditEntry{Time: a.now().UTC(), Method: r.Method, Path: r.URL.Path, Status: responseStatus(c, err)}
+			if tc, ok := c.Get(contextKeyTokenClaims).(*internal.TokenClaims); ok {
+				e.Subject, e.UpboundID = tc.Subject, tc.Payload.UpboundID
+			}
+			if a.headers {
+				e.Headers = redactHeaders(r.Header, auditRedactedHeaders)
+			}
+			a.write(e)
+			return err
+		}
+	}
+}
+
+func (a *auditLogger) write(e auditEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		auditWriteFailuresTotal.Inc()
+		return
+	}
+	b = append(b, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, w := range a.writers {
+		if _, err := w.Write(b); err != nil {
+			auditWriteFailuresTotal.Inc()
+		}
+	}
+}
+
+// close closes the audit log file, if any.
+func (a *auditLogger) close() error {
+	if a == nil || a.file == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// redactHeaders returns a copy of the given headers with the values of the
+// given ones redacted.
+func redactHeaders(h http.Header, redact []string) map[string][]string {
+	c := h.Clone()
+	for _, k := range redact {
+		if _, ok := c[k]; ok {
+			c[k] = []string{redacted}
+		}
+	}
+	return c
+}
@@ -0,0 +1,115 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/go-cmp/cmp"
+	"github.com/labstack/echo/v4"
+
+	"github.com/upbound/universal-crossplane/internal/upboundagent/internal"
+)
+
+func TestAuditLogger_middleware(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	claims := &internal.TokenClaims{
+		Payload:        internal.CrossplaneAccessor{UpboundID: "user/231"},
+		StandardClaims: jwt.StandardClaims{Subject: "upbound|231"},
+	}
+	authorized := func(c echo.Context) error {
+		c.Set(contextKeyTokenClaims, claims)
+		return c.NoContent(http.StatusOK)
+	}
+	rejected := func(echo.Context) error {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid token")
+	}
+
+	cases := map[string]struct {
+		reason  string
+		headers bool
+		handler echo.HandlerFunc
+		want    auditEntry
+	}{
+		"Authorized": {
+			reason:  "Requests with a valid token should be recorded with its subject and without headers by default.",
+			handler: authorized,
+			want:    auditEntry{Time: now, Method: http.MethodGet, Path: "/k8s/api/v1/namespaces", Status: http.StatusOK, Subject: "upbound|231", UpboundID: "user/231"},
+		},
+		"Rejected": {
+			reason:  "Requests rejected before their token was found valid should be recorded with the status of the error and no subject.",
+			handler: rejected,
+			want:    auditEntry{Time: now, Method: http.MethodGet, Path: "/k8s/api/v1/namespaces", Status: http.StatusBadRequest},
+		},
+		"Headers": {
+			reason:  "Captured headers should have credentials redacted.",
+			headers: true,
+			handler: authorized,
+			want: auditEntry{Time: now, Method: http.MethodGet, Path: "/k8s/api/v1/namespaces", Status: http.StatusOK, Subject: "upbound|231", UpboundID: "user/231",
+				Headers: map[string][]string{headerAuthorization: {redacted}, "Accept": {"application/json"}}},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			a, err := newAuditLogger(AuditConfig{Enabled: true, Headers: tc.headers}, out)
+			if err != nil {
+				t.Fatalf("newAuditLogger(...): %v", err)
+			}
+			a.now = func() time.Time { return now }
+			req := httptest.NewRequest(http.MethodGet, "/k8s/api/v1/namespaces", nil)
+			req.Header.Set(headerAuthorization, "Bearer secret")
+			req.Header.Set("Accept", "application/json")
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+			_ = a.middleware()(tc.handler)(c)
+
+			got := auditEntry{}
+			if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+				t.Fatalf("cannot decode audit entry %q: %v", out.String(), err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("\n%s\nmiddleware(...): -want entry, +got entry:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestAuditLoggerFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	out := &bytes.Buffer{}
+	a, err := newAuditLogger(AuditConfig{Enabled: true, Path: path}, out)
+	if err != nil {
+		t.Fatalf("newAuditLogger(...): %v", err)
+	}
+	a.write(auditEntry{Method: http.MethodGet, Path: "/xgql", Status: http.StatusOK})
+	if err := a.close(); err != nil {
+		t.Fatalf("close(): %v", err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("cannot read audit log file: %v", err)
+	}
+	if diff := cmp.Diff(out.String(), string(b)); diff != "" {
+		t.Errorf("write(...): the file should have the entries written to stdout: -stdout, +file:\n%s", diff)
+	}
+}
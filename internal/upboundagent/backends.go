@@ -0,0 +1,189 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+)
+
+const (
+	healthCheckTimeout = 2 * time.Second
+)
+
+const (
+	errNoBackends       = "at least one backend is required"
+	errParseBackendURL  = "failed to parse backend url %q"
+	errBackendURL       = "backend url %q must have a scheme and a host"
+	errBackendUnhealthy = "backend responded with status %d"
+	errUnexpectedStatus = "backend responded with status %d instead of %d"
+)
+
+// backend is a single backend of a backendPool.
+type backend struct {
+	url       *url.URL
+	unhealthy int32
+}
+
+func (b *backend) healthy() bool {
+	return atomic.LoadInt32(&b.unhealthy) == 0
+}
+
+func (b *backend) setHealthy(h bool) bool {
+	v := int32(1)
+	if h {
+		v = 0
+	}
+	return atomic.SwapInt32(&b.unhealthy, v) != v
+}
+
+// backendPool balances requests across a set of backends in a round-robin
+// fashion, skipping backends that are unhealthy.
+type backendPool struct {
+	log      logging.Logger
+	backends []*backend
+	next     uint32
+}
+
+func newBackendPool(log logging.Logger, endpoints ...string) (*backendPool, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New(errNoBackends)
+	}
+	bp := &backendPool{log: log, backends: make([]*backend, len(endpoints))}
+	for i, e := range endpoints {
+		u, err := url.Parse(e)
+		if err != nil {
+			return nil, errors.Wrapf(err, errParseBackendURL, e)
+		}
+		// Relative URLs, e.g. without a scheme, parse as a path.
+		if u.Scheme == "" || u.Host == "" {
+			return nil, errors.Errorf(errBackendURL, e)
+		}
+		bp.backends[i] = &backend{url: u}
+	}
+	return bp, nil
+}
+
+// pick returns the next healthy backend. If all backends are unhealthy, it
+// returns the next one regardless, since health checks may lag behind their
+// recovery.
+func (bp *backendPool) pick() *backend {
+	n := uint32(len(bp.backends))
+	start := atomic.AddUint32(&bp.next, 1) - 1
+	for i := uint32(0); i < n; i++ {
+		if b := bp.backends[(start+i)%n]; b.healthy() {
+			return b
+		}
+	}
+	return bp.backends[start%n]
+}
+
+// markHealthy marks the given backend as healthy or unhealthy and logs the
+// change, if any.
+func (bp *backendPool) markHealthy(b *backend, h bool, reason error) {
+	if !b.setHealthy(h) {
+		return
+	}
+	if h {
+		bp.log.Info("backend is healthy again", "backend", b.url.String())
+		return
+	}
+	bp.log.Info("backend is unhealthy, removing it from rotation", "backend", b.url.String(), "error", reason)
+}
+
+// check checks the health of all backends with the given client. A backend is
+// healthy if it responds with a status below 500.
+func (bp *backendPool) check(ctx context.Context, c *http.Client) {
+	for _, b := range bp.backends {
+		err := checkBackend(ctx, c, b.url)
+		bp.markHealthy(b, err == nil, err)
+	}
+}
+
+func checkBackend(ctx context.Context, c *http.Client, u *url.URL) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+	if res.StatusCode >= http.StatusInternalServerError {
+		return errors.Errorf(errBackendUnhealthy, res.StatusCode)
+	}
+	return nil
+}
+
+// probe returns nil if any backend responds to a request for the given path
+// with the given status, and the error of the last backend otherwise.
+func (bp *backendPool) probe(ctx context.Context, c *http.Client, path string, status int) error {
+	var err error
+	for _, b := range bp.backends {
+		u := *b.url
+		u.Path = path
+		if err = probeBackend(ctx, c, &u, status); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func probeBackend(ctx context.Context, c *http.Client, u *url.URL, status int) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != status {
+		return errors.Errorf(errUnexpectedStatus, res.StatusCode, status)
+	}
+	return nil
+}
+
+// run checks the health of all backends on the given interval until the
+// context is done. The client is built for each check so that it picks up
+// rotated trust material, and its idle connections are closed after the check
+// so that they do not pile up.
+func (bp *backendPool) run(ctx context.Context, interval time.Duration, client func() *http.Client) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			c := client()
+			bp.check(ctx, c)
+			c.CloseIdleConnections()
+		}
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	"github.com/crossplane/crossplane-runtime/pkg/test"
+)
+
+func newTestBackendPool(t *testing.T, endpoints ...string) *backendPool {
+	t.Helper()
+	bp, err := newBackendPool(logging.NewNopLogger(), endpoints...)
+	if err != nil {
+		t.Fatalf("newBackendPool(...): %v", err)
+	}
+	return bp
+}
+
+func TestNewBackendPool(t *testing.T) {
+	cases := map[string]struct {
+		reason   string
+		endpoint string
+		want     error
+	}{
+		"Valid": {
+			reason:   "An absolute URL should be a valid backend.",
+			endpoint: "https://xgql:8443",
+		},
+		"NoScheme": {
+			reason:   "A URL without a scheme parses as a path and should be rejected.",
+			endpoint: "xgql:8443",
+			want:     errors.Errorf(errBackendURL, "xgql:8443"),
+		},
+		"NoHost": {
+			reason:   "A URL without a host should be rejected.",
+			endpoint: "https:///graphql",
+			want:     errors.Errorf(errBackendURL, "https:///graphql"),
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := newBackendPool(logging.NewNopLogger(), tc.endpoint)
+			if diff := cmp.Diff(tc.want, err, test.EquateErrors()); diff != "" {
+				t.Errorf("\n%s\nnewBackendPool(...): -want error, +got error:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+// idleClosingTransport counts how often its idle connections are closed.
+type idleClosingTransport struct {
+	http.RoundTripper
+	closed int32
+}
+
+func (t *idleClosingTransport) CloseIdleConnections() {
+	atomic.AddInt32(&t.closed, 1)
+}
+
+func TestBackendPool_runClosesIdleConnections(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	defer srv.Close()
+
+	bp := newTestBackendPool(t, srv.URL)
+	var built []*idleClosingTransport
+	checked := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bp.run(ctx, time.Millisecond, func() *http.Client {
+			rt := &idleClosingTransport{RoundTripper: http.DefaultTransport}
+			built = append(built, rt)
+			if len(built) == 3 {
+				close(checked)
+			}
+			return &http.Client{Transport: rt}
+		})
+	}()
+	<-checked
+	cancel()
+	<-done
+
+	// The client built last may not have been checked yet once cancelled.
+	for i, rt := range built[:2] {
+		if got := atomic.LoadInt32(&rt.closed); got != 1 {
+			t.Errorf("run(...): client %d: want idle connections closed once after its check, got %d", i, got)
+		}
+	}
+}
+
+func TestBackendPool_pick(t *testing.T) {
+	endpoints := []string{"https://xgql-0", "https://xgql-1", "https://xgql-2"}
+	cases := map[string]struct {
+		reason    string
+		unhealthy []int
+		want      []string
+	}{
+		"RoundRobin": {
+			reason: "Healthy backends should be picked in turn.",
+			want:   []string{"xgql-0", "xgql-1", "xgql-2", "xgql-0"},
+		},
+		"SkipUnhealthy": {
+			reason:    "Unhealthy backends should be skipped.",
+			unhealthy: []int{1},
+			want:      []string{"xgql-0", "xgql-2", "xgql-2", "xgql-0"},
+		},
+		"AllUnhealthy": {
+			reason:    "All backends should be picked in turn if none is healthy.",
+			unhealthy: []int{0, 1, 2},
+			want:      []string{"xgql-0", "xgql-1", "xgql-2", "xgql-0"},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			bp := newTestBackendPool(t, endpoints...)
+			for _, i := range tc.unhealthy {
+				bp.backends[i].setHealthy(false)
+			}
+			got := make([]string, 0, len(tc.want))
+			for range tc.want {
+				got = append(got, bp.pick().url.Host)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("\n%s\npick(): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestBackendPool_check(t *testing.T) {
+	status := func(code int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(code)
+		}))
+	}
+	ok := status(http.StatusOK)
+	defer ok.Close()
+	unauthorized := status(http.StatusUnauthorized)
+	defer unauthorized.Close()
+	failing := status(http.StatusServiceUnavailable)
+	defer failing.Close()
+	down := status(http.StatusOK)
+	down.Close()
+
+	bp := newTestBackendPool(t, ok.URL, unauthorized.URL, failing.URL, down.URL)
+	// A backend that recovers should be taken back into rotation.
+	bp.backends[0].setHealthy(false)
+	bp.check(context.Background(), http.DefaultClient)
+
+	got := make([]bool, 0, len(bp.backends))
+	for _, b := range bp.backends {
+		got = append(got, b.healthy())
+	}
+	if diff := cmp.Diff([]bool{true, true, false, false}, got); diff != "" {
+		t.Errorf("check(...): -want healthy, +got healthy:\n%s", diff)
+	}
+}
+
+func TestProxy_xgqlFailover(t *testing.T) {
+	hits := 0
+	healthy := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		hits++
+	}))
+	defer healthy.Close()
+	down := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	down.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(healthy.Certificate())
+
+	p := newTestProxy(t, "https://10.96.0.1")
+	p.config.XGQLHealthCheckInterval = time.Minute
+	p.xgqlCAs.set(pool)
+	p.xgqlBackends = newTestBackendPool(t, down.URL, healthy.URL)
+	e := echo.New()
+	e.Any(xgqlHandlerPath, p.xgql())
+
+	var codes []int
+	for i := 0; i < 4; i++ {
+		req := httptest.NewRequest(http.MethodPost, xgqlHandlerPath, nil)
+		req.Header.Set(headerAuthorization, "Bearer "+validJWTToken)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		codes = append(codes, rec.Code)
+	}
+
+	// The first request fails on the backend that is down, which takes it out
+	// of rotation for the following ones.
+	if diff := cmp.Diff([]int{http.StatusInternalServerError, http.StatusOK, http.StatusOK, http.StatusOK}, codes); diff != "" {
+		t.Errorf("xgql(...): -want codes, +got codes:\n%s", diff)
+	}
+	if diff := cmp.Diff(3, hits); diff != "" {
+		t.Errorf("requests reaching the healthy backend: -want, +got:\n%s", diff)
+	}
+	if p.xgqlBackends.backends[0].healthy() {
+		t.Errorf("backend that is down should be unhealthy")
+	}
+}
+
+func TestProxy_readyzXGQLHealthCheck(t *testing.T) {
+	xgql := func(code int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/healthz" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(code)
+		}))
+	}
+	healthy := xgql(http.StatusOK)
+	defer healthy.Close()
+	unhealthy := xgql(http.StatusServiceUnavailable)
+	defer unhealthy.Close()
+
+	cases := map[string]struct {
+		reason   string
+		backends []string
+		want     int
+	}{
+		"Healthy": {
+			reason:   "The agent should be ready if an xgql backend responds with the expected status.",
+			backends: []string{unhealthy.URL, healthy.URL},
+			want:     http.StatusOK,
+		},
+		"Unhealthy": {
+			reason:   "The agent should not be ready if no xgql backend responds with the expected status.",
+			backends: []string{unhealthy.URL},
+			want:     http.StatusServiceUnavailable,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			p := newTestProxy(t, "https://10.96.0.1")
+			p.config.XGQLHealthCheck = true
+			p.config.XGQLHealthCheckPath = "/healthz"
+			p.config.XGQLHealthCheckStatus = http.StatusOK
+			p.natsConn = &natsLink{}
+			p.cpToken = &tokenStore{token: validJWTToken}
+			p.isReady = &atomic.Value{}
+			p.isReady.Store(true)
+			p.xgqlBackends = newTestBackendPool(t, tc.backends...)
+			e := echo.New()
+			e.GET(readynessHandlerPath, p.readyz())
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, readynessHandlerPath, nil))
+			if diff := cmp.Diff(tc.want, rec.Code); diff != "" {
+				t.Errorf("\n%s\nreadyz(): -want status, +got status:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"net/http/httputil"
+	"sync"
+)
+
+// DefaultCopyBufferSize is the size of the buffers that response bodies are
+// copied with by default. Request bodies are written by the transport of the
+// reverse proxy, which does not use its buffer pool. It is the same as the size of the
+// buffers allocated by httputil.ReverseProxy per request if it has no buffer
+// pool.
+const DefaultCopyBufferSize = 32 * 1024
+
+// bufferPool is an httputil.BufferPool of buffers of a fixed size, so that
+// proxied responses do not allocate a buffer each.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// newBufferPool returns a pool of buffers of the given size, or nil if the
+// size is not positive, in which case the reverse proxy allocates its own.
+func newBufferPool(size int) httputil.BufferPool {
+	if size <= 0 {
+		return nil
+	}
+	bp := &bufferPool{size: size}
+	bp.pool.New = func() interface{} { return make([]byte, size) }
+	return bp
+}
+
+func (bp *bufferPool) Get() []byte {
+	return bp.pool.Get().([]byte)
+}
+
+func (bp *bufferPool) Put(b []byte) {
+	if cap(b) < bp.size {
+		return
+	}
+	bp.pool.Put(b[:bp.size]) // nolint:staticcheck // The slice header allocation is negligible compared to the buffer.
+}
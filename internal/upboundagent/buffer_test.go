@@ -0,0 +1,81 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	if bp := newBufferPool(0); bp != nil {
+		t.Errorf("newBufferPool(0): want nil pool, got %T", bp)
+	}
+
+	bp := newBufferPool(1024)
+	b := bp.Get()
+	if len(b) != 1024 {
+		t.Errorf("Get(): want buffer of length 1024, got %d", len(b))
+	}
+	bp.Put(b[:10])
+	if b := bp.Get(); len(b) != 1024 {
+		t.Errorf("Get() after Put(...) of a resliced buffer: want buffer of length 1024, got %d", len(b))
+	}
+	bp.Put(make([]byte, 10))
+	if b := bp.Get(); len(b) != 1024 {
+		t.Errorf("Get() after Put(...) of a small buffer: want buffer of length 1024, got %d", len(b))
+	}
+}
+
+// discardResponseWriter is an http.ResponseWriter that discards the response.
+type discardResponseWriter struct{ h http.Header }
+
+func (w *discardResponseWriter) Header() http.Header         { return w.h }
+func (w *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardResponseWriter) WriteHeader(int)             {}
+
+// BenchmarkReverseProxyCopy measures proxying a large response body with
+// buffers allocated per request and with pooled buffers of various sizes.
+func BenchmarkReverseProxyCopy(b *testing.B) {
+	payload := bytes.Repeat([]byte("x"), 8*1024*1024)
+	u, _ := url.Parse("https://10.96.0.1")
+	backend := roundTripFn(func(*http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{},
+			Body:          ioutil.NopCloser(bytes.NewReader(payload)),
+			ContentLength: int64(len(payload)),
+		}, nil
+	})
+	for _, size := range []int{0, DefaultCopyBufferSize, 256 * 1024, 1024 * 1024} {
+		b.Run(fmt.Sprintf("BufferSize%d", size), func(b *testing.B) {
+			rp := httputil.NewSingleHostReverseProxy(u)
+			rp.Transport = backend
+			rp.BufferPool = newBufferPool(size)
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rp.ServeHTTP(&discardResponseWriter{h: http.Header{}}, httptest.NewRequest(http.MethodGet, "/", nil))
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/upbound/universal-crossplane/internal/clients/upbound"
+)
+
+const certCacheFile = "gateway-certs.json"
+
+const (
+	errReadCertCache   = "cannot read gateway certs cache"
+	errDecodeCertCache = "cannot decode gateway certs cache"
+	errWriteCertCache  = "cannot write gateway certs cache"
+	errStaleCertCache  = "gateway certs cache was fetched at %s, more than the maximum age of %s ago"
+)
+
+var usingCachedCerts = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "using_cached_certs",
+	Help:      "1 if the agent runs off gateway certs from its cache since Upbound API was unreachable at startup, 0 once fresh certs were obtained.",
+})
+
+// CachedCerts are gateway certs persisted in the cache along with the time
+// they were fetched from Upbound API.
+type CachedCerts struct {
+	upbound.PublicCerts
+	FetchedAt time.Time
+}
+
+// WriteCertCache persists the given gateway certs in the given directory, so
+// that the agent can fall back to them if Upbound API is unreachable at
+// startup. The file is replaced atomically.
+func WriteCertCache(dir string, c upbound.PublicCerts, now time.Time) error {
+	return errors.Wrap(writeJSONFile(dir, certCacheFile, CachedCerts{PublicCerts: c, FetchedAt: now.UTC()}), errWriteCertCache)
+}
+
+// writeJSONFile atomically replaces the named file in the given directory with
+// the JSON encoding of the given value. The file is only accessible by its
+// owner.
+func writeJSONFile(dir, name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, name+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // nolint:errcheck
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, name))
+}
+
+// ReadCertCache reads the gateway certs persisted in the given directory.
+func ReadCertCache(dir string) (CachedCerts, error) {
+	b, err := os.ReadFile(filepath.Join(filepath.Clean(dir), certCacheFile))
+	if err != nil {
+		return CachedCerts{}, errors.Wrap(err, errReadCertCache)
+	}
+	c := CachedCerts{}
+	return c, errors.Wrap(json.Unmarshal(b, &c), errDecodeCertCache)
+}
+
+// ReadFreshCertCache reads the gateway certs persisted in the given directory
+// like ReadCertCache, but rejects them if they were fetched more than maxAge
+// before now, if positive.
+func ReadFreshCertCache(dir string, maxAge time.Duration, now time.Time) (CachedCerts, error) {
+	c, err := ReadCertCache(dir)
+	if err != nil {
+		return CachedCerts{}, err
+	}
+	if maxAge > 0 && now.Sub(c.FetchedAt) > maxAge {
+		return CachedCerts{}, errors.Errorf(errStaleCertCache, c.FetchedAt.Format(time.RFC3339), maxAge)
+	}
+	return c, nil
+}
+
+// UseCachedCerts records that the agent runs off cached gateway certs until
+// fresh certs are obtained by a refresh.
+func UseCachedCerts() {
+	usingCachedCerts.Set(1)
+}
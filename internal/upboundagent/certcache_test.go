@@ -0,0 +1,117 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	"github.com/upbound/universal-crossplane/internal/clients/upbound"
+)
+
+func TestCertCache(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := ReadCertCache(dir); err == nil {
+		t.Error("ReadCertCache(...): want error if nothing was cached")
+	}
+	c := upbound.PublicCerts{JWTPublicKey: "key", NATSCA: "ca"}
+	now := time.Unix(100, 0).UTC()
+	if err := WriteCertCache(dir, c, now); err != nil {
+		t.Fatalf("WriteCertCache(...): %v", err)
+	}
+	got, err := ReadCertCache(dir)
+	if err != nil {
+		t.Fatalf("ReadCertCache(...): %v", err)
+	}
+	if diff := cmp.Diff(CachedCerts{PublicCerts: c, FetchedAt: now}, got); diff != "" {
+		t.Errorf("ReadCertCache(...): -want, +got:\n%s", diff)
+	}
+}
+
+func TestReadFreshCertCache(t *testing.T) {
+	dir := t.TempDir()
+	fetched := time.Unix(100, 0).UTC()
+	if err := WriteCertCache(dir, upbound.PublicCerts{JWTPublicKey: "key", NATSCA: "ca"}, fetched); err != nil {
+		t.Fatalf("WriteCertCache(...): %v", err)
+	}
+	cases := map[string]struct {
+		reason  string
+		maxAge  time.Duration
+		now     time.Time
+		wantErr bool
+	}{
+		"Unlimited": {
+			reason: "Cached certs of any age should be used if no maximum age is set.",
+			now:    fetched.Add(365 * 24 * time.Hour),
+		},
+		"Fresh": {
+			reason: "Cached certs within the maximum age should be used.",
+			maxAge: time.Hour,
+			now:    fetched.Add(time.Hour),
+		},
+		"Stale": {
+			reason:  "Cached certs older than the maximum age should be rejected.",
+			maxAge:  time.Hour,
+			now:     fetched.Add(time.Hour + time.Second),
+			wantErr: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := ReadFreshCertCache(dir, tc.maxAge, tc.now)
+			if diff := cmp.Diff(tc.wantErr, err != nil); diff != "" {
+				t.Errorf("\n%s\nReadFreshCertCache(...): -want error, +got error:\n%s\n%v", tc.reason, diff, err)
+			}
+		})
+	}
+}
+
+func TestCertRefresher_clearsCachedCerts(t *testing.T) {
+	errBoom := errors.New("boom")
+	results := []error{errBoom, nil}
+	i := 0
+	r := &certRefresher{
+		log: logging.NewNopLogger(),
+		fetch: func() (upbound.PublicCerts, error) {
+			err := results[i]
+			i++
+			return upbound.PublicCerts{}, err
+		},
+		apply:          func(upbound.PublicCerts) error { return nil },
+		failures:       prometheus.NewGauge(prometheus.GaugeOpts{Name: "failures"}),
+		cached:         prometheus.NewGauge(prometheus.GaugeOpts{Name: "cached"}),
+		interval:       time.Hour,
+		initialBackoff: time.Second,
+		maxBackoff:     time.Minute,
+	}
+	r.cached.Set(1)
+
+	// The agent keeps running off cached certs while refreshes fail.
+	r.refresh()
+	if diff := cmp.Diff(float64(1), testutil.ToFloat64(r.cached)); diff != "" {
+		t.Errorf("refresh() failed: -want cached, +got cached:\n%s", diff)
+	}
+	r.refresh()
+	if diff := cmp.Diff(float64(0), testutil.ToFloat64(r.cached)); diff != "" {
+		t.Errorf("refresh() succeeded: -want cached, +got cached:\n%s", diff)
+	}
+}
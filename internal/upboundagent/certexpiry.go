@@ -0,0 +1,86 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Roles of certificates whose expiry is exported.
+const (
+	CertRoleServing         = "serving"
+	CertRoleNATSCA          = "nats-ca"
+	CertRoleXGQLCA          = "xgql-ca"
+	CertRoleClientCA        = "client-ca"
+	CertRoleMetricsClientCA = "metrics-client-ca"
+	CertRoleUpboundAPICA    = "upbound-api-ca"
+)
+
+var certExpiryTimestampSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "cert_expiry_timestamp_seconds",
+	Help:      "Expiry time of the loaded certificates since unix epoch in seconds, by role. The earliest expiry is reported for bundles of multiple certificates.",
+}, []string{"role"})
+
+// ObserveCertExpiry exports the earliest expiry of the certificates in the
+// given PEM bundle for the given role. Blocks that are not certificates are
+// skipped, and nothing is exported if there are none.
+func ObserveCertExpiry(role string, b []byte) {
+	if t, ok := earliestExpiry(b); ok {
+		certExpiryTimestampSeconds.WithLabelValues(role).Set(float64(t.Unix()))
+	}
+}
+
+// earliestExpiry returns the earliest NotAfter of the certificates in the
+// given PEM bundle, and whether there were any.
+func earliestExpiry(b []byte) (time.Time, bool) {
+	var earliest time.Time
+	found := false
+	for len(b) > 0 {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if !found || c.NotAfter.Before(earliest) {
+			earliest = c.NotAfter
+			found = true
+		}
+	}
+	return earliest, found
+}
+
+// observeCertExpiryBase64 exports the expiry of the certificates in the given
+// base64 encoded PEM bundle, as served by Upbound API.
+func observeCertExpiryBase64(role, s string) error {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	ObserveCertExpiry(role, b)
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"bytes"
+	"encoding/pem"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveCertExpiry(t *testing.T) {
+	ca := newTestCA(t)
+	serving := newTestCert(t, "upbound-agent", ca, false)
+	key := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte("not a key")})
+
+	earliest := ca.cert.NotAfter
+	if serving.cert.NotAfter.Before(earliest) {
+		earliest = serving.cert.NotAfter
+	}
+
+	cases := map[string]struct {
+		reason string
+		role   string
+		bundle []byte
+		want   float64
+	}{
+		"Certificate": {
+			reason: "The expiry of a single certificate should be exported.",
+			role:   CertRoleServing,
+			bundle: serving.pem,
+			want:   float64(serving.cert.NotAfter.Unix()),
+		},
+		"Bundle": {
+			reason: "The earliest expiry of a bundle should be exported, skipping blocks that are not certificates.",
+			role:   CertRoleClientCA,
+			bundle: bytes.Join([][]byte{key, ca.pem, serving.pem}, nil),
+			want:   float64(earliest.Unix()),
+		},
+		"NoCertificates": {
+			reason: "Nothing should be exported for a bundle without certificates.",
+			role:   CertRoleXGQLCA,
+			bundle: []byte("not a certificate"),
+			want:   0,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			certExpiryTimestampSeconds.Reset()
+			ObserveCertExpiry(tc.role, tc.bundle)
+			got := testutil.ToFloat64(certExpiryTimestampSeconds.WithLabelValues(tc.role))
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("\n%s\nObserveCertExpiry(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
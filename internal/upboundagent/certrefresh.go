@@ -0,0 +1,229 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/pem"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	"github.com/upbound/universal-crossplane/internal/clients/upbound"
+)
+
+const (
+	errDecodePublicKey = "failed to base64 decode provided jwt public key"
+	errParsePublicKey  = "failed to parse public key"
+)
+
+var certRefreshConsecutiveFailures = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "cert_refresh_consecutive_failures",
+	Help:      "Number of consecutive failures to refresh the gateway certs from Upbound API. Zero after a successful refresh.",
+})
+
+// ParseTokenPublicKeys parses the base64 encoded PEM of the public keys that
+// tokens of Upbound Cloud are signed with. It usually holds a single key, but
+// holds both the old and the new key while the signing key is rotated. Keys
+// may be RSA or EC keys.
+func ParseTokenPublicKeys(b64 string) ([]crypto.PublicKey, error) {
+	rest, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, errors.Wrap(err, errDecodePublicKey)
+	}
+	var keys []crypto.PublicKey
+	for {
+		var b *pem.Block
+		if b, rest = pem.Decode(rest); b == nil {
+			break
+		}
+		k, err := parseTokenPublicKey(pem.EncodeToMemory(b))
+		if err != nil {
+			return nil, errors.Wrap(err, errParsePublicKey)
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, errors.Wrap(jwt.ErrKeyMustBePEMEncoded, errParsePublicKey)
+	}
+	return keys, nil
+}
+
+// parseTokenPublicKey parses the given PEM encoded public key, or certificate,
+// with the parser for its key type.
+func parseTokenPublicKey(b []byte) (crypto.PublicKey, error) {
+	rk, err := jwt.ParseRSAPublicKeyFromPEM(b)
+	switch {
+	case err == nil:
+		return rk, nil
+	case !errors.Is(err, jwt.ErrNotRSAPublicKey):
+		return nil, err
+	}
+	ek, err := jwt.ParseECPublicKeyFromPEM(b)
+	if err != nil {
+		return nil, err
+	}
+	return ek, nil
+}
+
+// publicKeyStore holds a set of public keys that can be swapped while in use.
+type publicKeyStore struct {
+	mu   sync.RWMutex
+	keys []crypto.PublicKey
+}
+
+func (s *publicKeyStore) get() []crypto.PublicKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys
+}
+
+func (s *publicKeyStore) set(k []crypto.PublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = k
+}
+
+// certRefresher periodically refreshes the gateway certs. Failed refreshes are
+// retried with an exponential backoff, capped at the max backoff, before
+// returning to the regular interval once a refresh succeeds.
+type certRefresher struct {
+	log      logging.Logger
+	fetch    func() (upbound.PublicCerts, error)
+	apply    func(upbound.PublicCerts) error
+	failures prometheus.Gauge
+	// cached is cleared once fresh certs were applied.
+	cached prometheus.Gauge
+
+	interval       time.Duration
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	// onStart refreshes the certs right away rather than after the first
+	// interval, and until it succeeds if the interval is zero.
+	onStart bool
+
+	consecutiveFailures int
+}
+
+// refresh refreshes the certs once and returns how long to wait until the
+// next refresh, and whether the certs were refreshed. Planned maintenance of
+// Upbound API is not a failure, the current certs are kept until the refresh
+// is retried once it is over.
+func (r *certRefresher) refresh() (time.Duration, bool) {
+	err := r.refreshOnce()
+	var me *upbound.MaintenanceError
+	if errors.As(err, &me) {
+		d := me.RetryAfter
+		if d <= 0 {
+			d = r.initialBackoff
+		}
+		r.log.Info("upbound api is under maintenance, keeping current gateway certs", "retry-in", d.String())
+		return d, false
+	}
+	if err != nil {
+		r.consecutiveFailures++
+		r.failures.Set(float64(r.consecutiveFailures))
+		d := r.backoff()
+		r.log.Info("failed to refresh gateway certs", "error", err, "consecutive-failures", r.consecutiveFailures, "retry-in", d.String())
+		return d, false
+	}
+	if r.consecutiveFailures > 0 {
+		r.log.Info("refreshed gateway certs after failures", "consecutive-failures", r.consecutiveFailures)
+	}
+	r.consecutiveFailures = 0
+	r.failures.Set(0)
+	r.cached.Set(0)
+	return r.interval, true
+}
+
+func (r *certRefresher) refreshOnce() error {
+	c, err := r.fetch()
+	if err != nil {
+		return err
+	}
+	return r.apply(c)
+}
+
+// backoff returns the backoff for the current number of consecutive failures.
+func (r *certRefresher) backoff() time.Duration {
+	d := r.initialBackoff
+	for i := 1; i < r.consecutiveFailures && d < r.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.maxBackoff {
+		d = r.maxBackoff
+	}
+	return d
+}
+
+// run refreshes the certs until the context is done, or until a refresh
+// succeeded if there is no interval.
+func (r *certRefresher) run(ctx context.Context) {
+	d := r.interval
+	if r.onStart {
+		d = 0
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			d, ok := r.refresh()
+			if r.interval == 0 && ok {
+				return
+			}
+			t.Reset(d)
+		}
+	}
+}
+
+// applyGatewayCerts starts validating tokens with the public keys of the given
+// certs.
+func (p *Proxy) applyGatewayCerts(c upbound.PublicCerts) error {
+	k, err := ParseTokenPublicKeys(c.JWTPublicKey)
+	if err != nil {
+		return err
+	}
+	p.tokenKey.set(k)
+	if p.config.CertCacheDir != "" {
+		if err := WriteCertCache(p.config.CertCacheDir, c, time.Now()); err != nil {
+			p.log.Info("cannot update gateway certs cache", "error", err)
+		}
+	}
+	if !p.config.DisableNATS && c.NATSCA != p.config.NATS.CABundle {
+		// The NATS connection only verifies the CA it was established with.
+		p.log.Info("nats ca changed, it will be used once the agent restarts")
+	}
+	p.log.Debug("refreshed gateway certs")
+	return nil
+}
+
+// tokenPublicKeys returns the public keys to validate tokens with.
+func (p *Proxy) tokenPublicKeys() []crypto.PublicKey {
+	if k := p.tokenKey.get(); k != nil {
+		return k
+	}
+	return p.config.TokenPublicKeys
+}
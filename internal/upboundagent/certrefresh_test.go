@@ -0,0 +1,279 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	"github.com/upbound/universal-crossplane/internal/clients/upbound"
+	"github.com/upbound/universal-crossplane/internal/upboundagent/internal"
+)
+
+func TestCertRefresher_refresh(t *testing.T) {
+	errBoom := errors.New("boom")
+	errMaintenance := &upbound.MaintenanceError{RetryAfter: 15 * time.Minute}
+	type step struct {
+		Delay    time.Duration
+		Failures float64
+	}
+	cases := map[string]struct {
+		reason  string
+		results []error
+		want    []step
+	}{
+		"Steady": {
+			reason:  "Successful refreshes should happen on the regular interval.",
+			results: []error{nil, nil},
+			want:    []step{{Delay: time.Hour}, {Delay: time.Hour}},
+		},
+		"BackoffThenRecover": {
+			reason:  "Failed refreshes should back off exponentially up to the cap and return to the interval on success.",
+			results: []error{errBoom, errBoom, errBoom, errBoom, errBoom, nil, errBoom},
+			want: []step{
+				{Delay: 10 * time.Second, Failures: 1},
+				{Delay: 20 * time.Second, Failures: 2},
+				{Delay: 40 * time.Second, Failures: 3},
+				{Delay: time.Minute, Failures: 4},
+				{Delay: time.Minute, Failures: 5},
+				{Delay: time.Hour},
+				{Delay: 10 * time.Second, Failures: 1},
+			},
+		},
+		"Maintenance": {
+			reason:  "Planned maintenance should be retried after its Retry-After without counting as a failure.",
+			results: []error{errBoom, errors.Wrap(errMaintenance, "cannot fetch gateway certs"), nil},
+			want: []step{
+				{Delay: 10 * time.Second, Failures: 1},
+				{Delay: 15 * time.Minute, Failures: 1},
+				{Delay: time.Hour},
+			},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			i := 0
+			r := &certRefresher{
+				log: logging.NewNopLogger(),
+				fetch: func() (upbound.PublicCerts, error) {
+					err := tc.results[i]
+					i++
+					return upbound.PublicCerts{}, err
+				},
+				apply:          func(upbound.PublicCerts) error { return nil },
+				failures:       prometheus.NewGauge(prometheus.GaugeOpts{Name: "failures"}),
+				cached:         prometheus.NewGauge(prometheus.GaugeOpts{Name: "cached"}),
+				interval:       time.Hour,
+				initialBackoff: 10 * time.Second,
+				maxBackoff:     time.Minute,
+			}
+			got := make([]step, 0, len(tc.results))
+			for range tc.results {
+				d, _ := r.refresh()
+				got = append(got, step{Delay: d, Failures: testutil.ToFloat64(r.failures)})
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("\n%s\nrefresh(): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestProxy_applyGatewayCerts(t *testing.T) {
+	p := newTestProxy(t, "https://10.96.0.1")
+	p.config.NATS = &NATSClientConfig{CABundle: "ca"}
+	old := p.tokenPublicKeys()
+
+	err := p.applyGatewayCerts(upbound.PublicCerts{JWTPublicKey: "not a key", NATSCA: "ca"})
+	if err == nil {
+		t.Fatal("applyGatewayCerts(...): expected error for an invalid public key")
+	}
+	if got := p.tokenPublicKeys(); len(got) != 1 || got[0] != old[0] {
+		t.Error("applyGatewayCerts(...): the current public keys should be kept on error")
+	}
+
+	err = p.applyGatewayCerts(upbound.PublicCerts{JWTPublicKey: base64.StdEncoding.EncodeToString([]byte(validPublicKey)), NATSCA: "ca"})
+	if err != nil {
+		t.Fatalf("applyGatewayCerts(...): %v", err)
+	}
+	if _, err := p.reviewToken(map[string][]string{headerAuthorization: {"Bearer " + validJWTToken}}); err != nil {
+		t.Errorf("reviewToken(...) with refreshed key: %v", err)
+	}
+}
+
+func TestProxy_reviewTokenKeyRotation(t *testing.T) {
+	pemOf := func(k crypto.Signer) []byte {
+		der, err := x509.MarshalPKIXPublicKey(k.Public())
+		if err != nil {
+			t.Fatalf("cannot marshal public key: %v", err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	}
+	newRSAKey := func() crypto.Signer {
+		k, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("cannot generate key: %v", err)
+		}
+		return k
+	}
+	newECKey := func(c elliptic.Curve) crypto.Signer {
+		k, err := ecdsa.GenerateKey(c, rand.Reader)
+		if err != nil {
+			t.Fatalf("cannot generate key: %v", err)
+		}
+		return k
+	}
+	oldKey, newerKey, otherKey := newRSAKey(), newRSAKey(), newRSAKey()
+	p256Key, p384Key := newECKey(elliptic.P256()), newECKey(elliptic.P384())
+
+	// During a rotation, Upbound API serves both the old and the new key,
+	// which may be of another type.
+	p := newTestProxy(t, "https://10.96.0.1")
+	p.config.NATS = &NATSClientConfig{CABundle: "ca"}
+	var b []byte
+	for _, k := range []crypto.Signer{oldKey, newerKey, p256Key, p384Key} {
+		b = append(b, pemOf(k)...)
+	}
+	bundle := base64.StdEncoding.EncodeToString(b)
+	if err := p.applyGatewayCerts(upbound.PublicCerts{JWTPublicKey: bundle, NATSCA: "ca"}); err != nil {
+		t.Fatalf("applyGatewayCerts(...): %v", err)
+	}
+
+	cases := map[string]struct {
+		reason  string
+		method  jwt.SigningMethod
+		key     crypto.Signer
+		wantErr bool
+	}{
+		"OldKey": {
+			reason: "Tokens signed with the old key should be valid during the rotation.",
+			method: jwt.SigningMethodRS256,
+			key:    oldKey,
+		},
+		"NewKey": {
+			reason: "Tokens signed with the new key should be valid during the rotation.",
+			method: jwt.SigningMethodRS256,
+			key:    newerKey,
+		},
+		"ES256Key": {
+			reason: "Tokens signed with an EC P-256 key in the set should be valid.",
+			method: jwt.SigningMethodES256,
+			key:    p256Key,
+		},
+		"ES384Key": {
+			reason: "Tokens signed with an EC P-384 key in the set should be valid.",
+			method: jwt.SigningMethodES384,
+			key:    p384Key,
+		},
+		"OtherKey": {
+			reason:  "Tokens signed with a key that is not in the set should be invalid.",
+			method:  jwt.SigningMethodRS256,
+			key:     otherKey,
+			wantErr: true,
+		},
+		"OtherECKey": {
+			reason:  "Tokens signed with an EC key that is not in the set should be invalid.",
+			method:  jwt.SigningMethodES256,
+			key:     newECKey(elliptic.P256()),
+			wantErr: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			claims := &internal.TokenClaims{
+				Payload:        internal.CrossplaneAccessor{UpboundID: "user/231"},
+				StandardClaims: jwt.StandardClaims{Audience: p.config.ControlPlaneID, ExpiresAt: time.Now().Add(time.Hour).Unix()},
+			}
+			token, err := jwt.NewWithClaims(tc.method, claims).SignedString(tc.key)
+			if err != nil {
+				t.Fatalf("cannot sign token: %v", err)
+			}
+			got, err := p.reviewToken(map[string][]string{headerAuthorization: {"Bearer " + token}})
+			if diff := cmp.Diff(tc.wantErr, err != nil); diff != "" {
+				t.Fatalf("\n%s\nreviewToken(...): -want error, +got error:\n%s\nerror: %v", tc.reason, diff, err)
+			}
+			if err == nil && got.Payload.UpboundID != "user/231" {
+				t.Errorf("\n%s\nreviewToken(...): want upbound id user/231, got %s", tc.reason, got.Payload.UpboundID)
+			}
+		})
+	}
+}
+
+func TestParseTokenPublicKeys(t *testing.T) {
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&ek.PublicKey)
+	if err != nil {
+		t.Fatalf("cannot marshal public key: %v", err)
+	}
+	ecPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	cases := map[string]struct {
+		reason  string
+		b64     string
+		want    int
+		wantErr bool
+	}{
+		"Single": {
+			reason: "A single key should be parsed.",
+			b64:    base64.StdEncoding.EncodeToString([]byte(validPublicKey)),
+			want:   1,
+		},
+		"Multiple": {
+			reason: "All keys of a bundle should be parsed.",
+			b64:    base64.StdEncoding.EncodeToString([]byte(validPublicKey + "\n" + validPublicKey)),
+			want:   2,
+		},
+		"MixedTypes": {
+			reason: "RSA and EC keys of a bundle should be parsed.",
+			b64:    base64.StdEncoding.EncodeToString([]byte(validPublicKey + "\n" + ecPEM)),
+			want:   2,
+		},
+		"NoKey": {
+			reason:  "A bundle without keys should be rejected.",
+			b64:     base64.StdEncoding.EncodeToString([]byte("not a key")),
+			wantErr: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := ParseTokenPublicKeys(tc.b64)
+			if diff := cmp.Diff(tc.wantErr, err != nil); diff != "" {
+				t.Fatalf("\n%s\nParseTokenPublicKeys(...): -want error, +got error:\n%s\nerror: %v", tc.reason, diff, err)
+			}
+			if diff := cmp.Diff(tc.want, len(got)); diff != "" {
+				t.Errorf("\n%s\nParseTokenPublicKeys(...): -want keys, +got keys:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
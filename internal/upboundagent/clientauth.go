@@ -0,0 +1,72 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	errClientCertRequired = "a client certificate is required"
+	errClientCertInvalid  = "client certificate is not valid"
+)
+
+// serverTLSConfig returns the TLS config of the server for authenticating
+// clients by their certificates, or nil if clients are not asked for any.
+//
+// Client certificates are only requested in the handshake and verified by the
+// routes that need them, so that the probe endpoints stay reachable without a
+// certificate, and so that scrapers can present certificates signed by the
+// metrics CAs instead of the client CAs.
+func (p *Proxy) serverTLSConfig() *tls.Config {
+	if p.config.ClientAuth == tls.NoClientCert && p.config.Metrics.ClientCACertPool == nil {
+		return nil
+	}
+	return &tls.Config{
+		ClientAuth: tls.RequestClientCert,
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// clientAuth returns a middleware that verifies the client certificates of
+// requests received on the serving port as configured by the client
+// authentication mode. Requests from Upbound Cloud are received over NATS and
+// are not affected.
+func (p *Proxy) clientAuth() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r := c.Request()
+			if p.config.ClientAuth == tls.NoClientCert || r.TLS == nil {
+				return next(c)
+			}
+			switch {
+			case len(r.TLS.PeerCertificates) == 0 && p.config.ClientAuth == tls.RequireAndVerifyClientCert:
+				return echo.NewHTTPError(http.StatusUnauthorized, errClientCertRequired)
+			case len(r.TLS.PeerCertificates) > 0 && !verifyClientCert(r.TLS, p.config.ClientCACertPool):
+				return echo.NewHTTPError(http.StatusUnauthorized, errClientCertInvalid)
+			}
+			return next(c)
+		}
+	}
+}
+
+// verifiedClientCert returns true if the request presented a client
+// certificate that is verified by the client authentication mode.
+func (p *Proxy) verifiedClientCert(r *http.Request) bool {
+	return p.config.ClientAuth != tls.NoClientCert && verifyClientCert(r.TLS, p.config.ClientCACertPool)
+}
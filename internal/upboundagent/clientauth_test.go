@@ -0,0 +1,122 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/labstack/echo/v4"
+)
+
+func TestProxy_clientAuth(t *testing.T) {
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+	metricsCA := newTestCA(t)
+	valid := newTestCert(t, "client", ca, false, x509.ExtKeyUsageClientAuth)
+	invalid := newTestCert(t, "client", otherCA, false, x509.ExtKeyUsageClientAuth)
+	scraper := newTestCert(t, "prometheus", metricsCA, false, x509.ExtKeyUsageClientAuth)
+
+	// Whether a request to a proxied route with a valid, invalid or absent
+	// client certificate succeeds, and whether a probe without a certificate
+	// and a scrape with a certificate signed by the metrics CA succeed.
+	type want struct {
+		valid, invalid, absent, probe, scrape bool
+	}
+	cases := map[string]struct {
+		reason string
+		mode   tls.ClientAuthType
+		want   want
+	}{
+		"None": {
+			reason: "Client certificates should not be verified if client authentication is disabled.",
+			mode:   tls.NoClientCert,
+			want:   want{valid: true, invalid: true, absent: true, probe: true, scrape: true},
+		},
+		"VerifyIfGiven": {
+			reason: "Client certificates should be verified only if presented.",
+			mode:   tls.VerifyClientCertIfGiven,
+			want:   want{valid: true, invalid: false, absent: true, probe: true, scrape: true},
+		},
+		"RequireAndVerify": {
+			reason: "Clients of proxied routes should be required to present a valid certificate, but not probes and scrapers.",
+			mode:   tls.RequireAndVerifyClientCert,
+			want:   want{valid: true, invalid: false, absent: false, probe: true, scrape: true},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			p := &Proxy{config: &Config{
+				ClientAuth:       tc.mode,
+				ClientCACertPool: certPool(ca),
+				Metrics:          MetricsConfig{Secure: true, ClientCACertPool: certPool(metricsCA)},
+			}}
+			ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+			e := echo.New()
+			e.GET("/k8s", ok, p.clientAuth())
+			e.GET(readynessHandlerPath, ok)
+			e.GET(metricsHandlerPath, ok, p.metricsAuth())
+			srv := httptest.NewUnstartedServer(e)
+			srv.TLS = p.serverTLSConfig()
+			srv.StartTLS()
+			defer srv.Close()
+
+			roots := x509.NewCertPool()
+			roots.AddCert(srv.Certificate())
+			get := func(path string, c *testCert) bool {
+				cfg := &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+				if c != nil {
+					cfg.Certificates = []tls.Certificate{{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}}
+				}
+				hc := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+				res, err := hc.Get(srv.URL + path)
+				if err != nil {
+					return false
+				}
+				_ = res.Body.Close()
+				return res.StatusCode == http.StatusOK
+			}
+			got := want{
+				valid:   get("/k8s", valid),
+				invalid: get("/k8s", invalid),
+				absent:  get("/k8s", nil),
+				probe:   get(readynessHandlerPath, nil),
+				scrape:  get(metricsHandlerPath, scraper),
+			}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(want{})); diff != "" {
+				t.Errorf("\n%s\nclientAuth(): -want succeeded, +got succeeded:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestProxy_serverTLSConfig(t *testing.T) {
+	p := &Proxy{config: &Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCACertPool: certPool(newTestCA(t))}}
+	if got := p.serverTLSConfig().ClientAuth; got != tls.RequestClientCert {
+		t.Errorf("serverTLSConfig(): want client certificates only requested in the handshake, got %v", got)
+	}
+	p = &Proxy{config: &Config{Metrics: MetricsConfig{ClientCACertPool: certPool(newTestCA(t))}}}
+	if got := p.serverTLSConfig().ClientAuth; got != tls.RequestClientCert {
+		t.Errorf("serverTLSConfig(): want client certificates requested for metrics, got %v", got)
+	}
+	p = &Proxy{config: &Config{}}
+	if got := p.serverTLSConfig(); got != nil {
+		t.Errorf("serverTLSConfig(): want no TLS config, got %v", got)
+	}
+}
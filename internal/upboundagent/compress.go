@@ -0,0 +1,217 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"bufio"
+	"compress/gzip"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	headerContentEncoding = "Content-Encoding"
+	headerVary            = "Vary"
+
+	encodingGzip = "gzip"
+)
+
+// minCompressLength is the length below which responses of a known length are
+// not compressed, since the gzip framing would outweigh the savings.
+const minCompressLength = 1024
+
+// compressedContentTypes are the prefixes of content types that are already
+// compressed and thus not compressed again.
+var compressedContentTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zip",
+	"application/zstd",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+}
+
+var compressionSavedBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "compression_saved_bytes_total",
+	Help:      "Number of bytes saved by compressing proxied responses, i.e. their uncompressed minus their compressed size.",
+})
+
+// compress compresses proxied responses with gzip, as they are written, for
+// clients that accept it. Responses that are already encoded, e.g. by the
+// Kubernetes API server, or whose content type is compressed are passed
+// through, and so are upgraded connections, which are not HTTP responses once
+// they switched protocols.
+func compress(saved prometheus.Counter) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r := c.Request()
+			if r.Method == http.MethodHead || !acceptsGzip(r.Header) || isUpgradeRequest(r) {
+				return next(c)
+			}
+			res := c.Response()
+			w := &gzipResponseWriter{ResponseWriter: res.Writer}
+			res.Writer = w
+			defer func() {
+				res.Writer = w.ResponseWriter
+				if in, out, ok := w.close(); ok && in > out {
+					saved.Add(float64(in - out))
+				}
+			}()
+			return next(c)
+		}
+	}
+}
+
+// acceptsGzip returns true if the Accept-Encoding header of a request accepts
+// gzip, either explicitly or by a wildcard, with a non zero quality.
+func acceptsGzip(h http.Header) bool {
+	for _, v := range h.Values(headerAcceptEncoding) {
+		for _, e := range strings.Split(v, ",") {
+			parts := strings.Split(e, ";")
+			name := strings.ToLower(strings.TrimSpace(parts[0]))
+			if name != encodingGzip && name != "*" {
+				continue
+			}
+			q := 1.0
+			for _, p := range parts[1:] {
+				kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "q") {
+					if f, err := strconv.ParseFloat(kv[1], 64); err == nil {
+						q = f
+					}
+				}
+			}
+			if q > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compressible returns true if a response with the given status and headers
+// should be compressed.
+func compressible(code int, h http.Header) bool {
+	if code == http.StatusNoContent || code == http.StatusNotModified || h.Get(headerContentEncoding) != "" {
+		return false
+	}
+	if l, err := strconv.Atoi(h.Get(headerContentLength)); err == nil && l < minCompressLength {
+		return false
+	}
+	ct := strings.ToLower(h.Get(headerContentType))
+	for _, p := range compressedContentTypes {
+		if strings.HasPrefix(ct, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// gzipResponseWriter decides whether to compress a response once its header is
+// written, and then streams it through a gzip writer. Flushes are passed
+// through, so that watches are not held back by the compression.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+
+	wroteHeader bool
+	gz          *gzip.Writer
+	// in and out are the number of bytes written before and after
+	// compression.
+	in  int
+	out *countingWriter
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	// Informational responses, including protocol switches, precede the
+	// actual response.
+	if code < http.StatusOK {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	if compressible(code, h) {
+		h.Del(headerContentLength)
+		h.Set(headerContentEncoding, encodingGzip)
+		h.Add(headerVary, headerAcceptEncoding)
+		w.out = &countingWriter{w: w.ResponseWriter}
+		w.gz = gzip.NewWriter(w.out)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	w.in += len(b)
+	return w.gz.Write(b)
+}
+
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		_ = w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	return h.Hijack()
+}
+
+// close completes the compressed response, if it was compressed, and returns
+// the number of bytes before and after compression.
+func (w *gzipResponseWriter) close() (int, int, bool) {
+	if w.gz == nil {
+		return 0, 0, false
+	}
+	_ = w.gz.Close()
+	return w.in, w.out.n, true
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w http.ResponseWriter
+	n int
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += n
+	return n, err
+}
@@ -0,0 +1,163 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCompress(t *testing.T) {
+	large := strings.Repeat(`{"kind":"ConfigMap"}`, 1000)
+
+	cases := map[string]struct {
+		reason         string
+		acceptEncoding string
+		header         map[string]string
+		body           string
+		wantEncoding   string
+		wantSaved      bool
+	}{
+		"Compressed": {
+			reason:         "Responses should be compressed for clients that accept gzip.",
+			acceptEncoding: "gzip, deflate",
+			header:         map[string]string{headerContentType: "application/json"},
+			body:           large,
+			wantEncoding:   encodingGzip,
+			wantSaved:      true,
+		},
+		"NotAccepted": {
+			reason:         "Responses should not be compressed for clients that do not accept gzip.",
+			acceptEncoding: "gzip;q=0, deflate",
+			header:         map[string]string{headerContentType: "application/json"},
+			body:           large,
+		},
+		"AlreadyEncoded": {
+			reason:         "Responses that are already encoded should be passed through.",
+			acceptEncoding: "gzip",
+			header:         map[string]string{headerContentType: "application/json", headerContentEncoding: "br"},
+			body:           large,
+			wantEncoding:   "br",
+		},
+		"CompressedContentType": {
+			reason:         "Responses with a compressed content type should be passed through.",
+			acceptEncoding: "*",
+			header:         map[string]string{headerContentType: "application/gzip"},
+			body:           large,
+		},
+		"Small": {
+			reason:         "Responses of a known length below the minimum should not be compressed.",
+			acceptEncoding: "gzip",
+			header:         map[string]string{headerContentType: "application/json", headerContentLength: "2"},
+			body:           "{}",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			saved := prometheus.NewCounter(prometheus.CounterOpts{Name: "saved"})
+			req := httptest.NewRequest(http.MethodGet, "/k8s/api/v1/configmaps", nil)
+			req.Header.Set(headerAcceptEncoding, tc.acceptEncoding)
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(req, rec)
+			h := func(c echo.Context) error {
+				for k, v := range tc.header {
+					c.Response().Header().Set(k, v)
+				}
+				c.Response().WriteHeader(http.StatusOK)
+				_, err := c.Response().Write([]byte(tc.body))
+				return err
+			}
+			if err := compress(saved)(h)(c); err != nil {
+				t.Fatalf("compress(...): %v", err)
+			}
+			if diff := cmp.Diff(tc.wantEncoding, rec.Header().Get(headerContentEncoding)); diff != "" {
+				t.Errorf("\n%s\ncompress(...): -want encoding, +got encoding:\n%s", tc.reason, diff)
+			}
+			body := rec.Body.String()
+			if tc.wantEncoding == encodingGzip {
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatalf("cannot read compressed body: %v", err)
+				}
+				b, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatalf("cannot read compressed body: %v", err)
+				}
+				body = string(b)
+			}
+			if diff := cmp.Diff(tc.body, body); diff != "" {
+				t.Errorf("\n%s\ncompress(...): -want body, +got body:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.wantSaved, testutil.ToFloat64(saved) > 0); diff != "" {
+				t.Errorf("\n%s\ncompress(...): -want saved bytes, +got saved bytes:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestCompressFlush(t *testing.T) {
+	// Watch events must reach the client as they are flushed, rather than
+	// once the compressed response is complete.
+	req := httptest.NewRequest(http.MethodGet, "/k8s/api/v1/pods?watch=true", nil)
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	h := func(c echo.Context) error {
+		c.Response().Header().Set(headerContentType, "application/json")
+		if _, err := c.Response().Write([]byte(`{"type":"ADDED"}`)); err != nil {
+			return err
+		}
+		c.Response().Flush()
+		if rec.Body.Len() == 0 {
+			t.Error("Flush(): want the compressed event written to the client")
+		}
+		return nil
+	}
+	if err := compress(prometheus.NewCounter(prometheus.CounterOpts{Name: "saved"}))(h)(c); err != nil {
+		t.Fatalf("compress(...): %v", err)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	cases := map[string]bool{
+		"":                    false,
+		"gzip":                true,
+		"deflate, gzip;q=0.5": true,
+		"GZIP":                true,
+		"*":                   true,
+		"gzip;q=0":            false,
+		"identity":            false,
+	}
+	for v, want := range cases {
+		t.Run(v, func(t *testing.T) {
+			h := http.Header{}
+			if v != "" {
+				h.Set(headerAcceptEncoding, v)
+			}
+			if got := acceptsGzip(h); got != want {
+				t.Errorf("acceptsGzip(%q): want %t, got %t", v, want, got)
+			}
+		})
+	}
+}
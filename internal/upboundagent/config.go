@@ -15,27 +15,251 @@
 package upboundagent
 
 import (
-	"crypto/rsa"
+	"crypto"
+	"crypto/tls"
 	"crypto/x509"
+	"net"
+	"time"
+
+	"github.com/upbound/universal-crossplane/internal/tracing"
 )
 
 // NATSClientConfig is the configuration for a NATS Client
 type NATSClientConfig struct {
-	Name     string
-	Endpoint string
+	Name string
+	// Endpoints are the URLs of the NATS servers to connect to. The client
+	// fails over between them if the server it is connected to goes down.
+	Endpoints []string
 	// JWTEndpoint is the Upbound API endpoint for fetching NATS JWT for control planes
 	JWTEndpoint string
-	// ControlPlaneToken is the token to authenticate against JWTEndpoint
+	// ControlPlaneToken is the token to authenticate against JWTEndpoint. It
+	// is replaced by the content of the control plane token file on reload.
 	ControlPlaneToken string
 	CABundle          string
+	// MaxReconnects is the number of attempts to re-establish a lost
+	// connection before it is closed for good. Unlimited if zero.
+	MaxReconnects int
+	// ReconnectWait is the wait before the first attempt to re-establish a
+	// lost connection, one second if zero. It doubles with every attempt up
+	// to MaxReconnectWait, 30 seconds if zero.
+	ReconnectWait    time.Duration
+	MaxReconnectWait time.Duration
+	// ReconnectJitter is the fraction of the wait, e.g. 0.2, that is randomly
+	// added to it, so that agents do not reconnect all at once.
+	ReconnectJitter float64
+}
+
+// MetricsConfig is the configuration for the metrics endpoint
+type MetricsConfig struct {
+	// Secure requires scrapers to authenticate either with BearerToken or
+	// with a client certificate signed by ClientCACertPool.
+	Secure           bool
+	BearerToken      string
+	ClientCACertPool *x509.CertPool
+	// OTLPEndpoint is the endpoint of an OpenTelemetry collector that the
+	// metrics are pushed to every OTLPInterval. Not pushed if empty.
+	OTLPEndpoint string
+	OTLPInterval time.Duration
+	// DisablePrometheus disables the Prometheus metrics endpoint, e.g. when
+	// metrics are pushed to a collector instead.
+	DisablePrometheus bool
+	// Address is the address that the Prometheus metrics endpoint is served
+	// on over plain HTTP, in addition to the serving port. Not served
+	// separately if empty.
+	Address string
+}
+
+// AuditConfig is the configuration of the audit log of proxied requests.
+type AuditConfig struct {
+	// Enabled writes an audit entry for every proxied request to stdout.
+	Enabled bool
+	// Path is a file that audit entries are appended to in addition, if set.
+	Path string
+	// Headers captures the request headers in audit entries, with
+	// credentials redacted.
+	Headers bool
+}
+
+// CertRefreshConfig is the configuration for refreshing the gateway certs
+type CertRefreshConfig struct {
+	// Interval is the interval between successful refreshes. Certs are not
+	// refreshed if zero.
+	Interval time.Duration
+	// InitialBackoff is the wait after the first failed refresh, which is
+	// doubled for each consecutive failure up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// OnStart refreshes the certs right away, e.g. when the agent started
+	// with certs restored from its state directory. Certs are refreshed once
+	// if Interval is zero.
+	OnStart bool
 }
 
 // Config maintains the configurations for the Upbound Agent
 type Config struct {
 	// DebugMode enables debug level logging
-	DebugMode         bool
-	ControlPlaneID    string
-	TokenRSAPublicKey *rsa.PublicKey
-	XGQLCACertPool    *x509.CertPool
-	NATS              *NATSClientConfig
+	DebugMode bool
+	// ProbeAddress is the address that the probe endpoints are served on
+	// over plain HTTP, in addition to the serving port. Not served separately
+	// if empty.
+	ProbeAddress string
+	// DebugAddress is the localhost address that diagnostic endpoints are
+	// served on in debug mode. Not served if empty.
+	DebugAddress string
+	// AccessLogErrorsOnly logs only requests that resulted in an error
+	// response, instead of every request in debug mode and none otherwise.
+	AccessLogErrorsOnly bool
+	ControlPlaneID      string
+	// TokenPublicKeys are the RSA or EC public keys that tokens are
+	// validated with. Tokens signed with any of them are valid.
+	TokenPublicKeys []crypto.PublicKey
+	XGQLCACertPool  *x509.CertPool
+	// XGQLCABundleFile is reloaded into XGQLCACertPool on
+	// XGQLCAReloadInterval, if both are set.
+	XGQLCABundleFile     string
+	XGQLCAReloadInterval time.Duration
+	// XGQLEndpoints are the xgql backends that requests are balanced across.
+	// Backends are health checked on XGQLHealthCheckInterval, if set.
+	XGQLEndpoints           []string
+	XGQLHealthCheckInterval time.Duration
+	// XGQLHealthCheck makes the agent ready only if any xgql backend responds
+	// to a request for XGQLHealthCheckPath with XGQLHealthCheckStatus.
+	XGQLHealthCheck       bool
+	XGQLHealthCheckPath   string
+	XGQLHealthCheckStatus int
+	NATS                  *NATSClientConfig
+	Metrics               MetricsConfig
+	CertRefresh           CertRefreshConfig
+	Audit                 AuditConfig
+	// ControlPlaneTokenFile is reloaded into the control plane token on
+	// ControlPlaneTokenReloadInterval, if both are set. Rotated tokens are
+	// only used if ValidateControlPlaneToken, if set, returns the ID of the
+	// same control plane for them.
+	ControlPlaneTokenFile           string
+	ControlPlaneTokenReloadInterval time.Duration
+	ValidateControlPlaneToken       func(token string) (string, error)
+	// SwitchControlPlane restarts the agent gracefully for a rotated token
+	// of a different control plane, instead of keeping the current token.
+	SwitchControlPlane bool
+	// ServingCertReloadInterval is the interval on which the serving
+	// certificate and key files are reloaded if they changed. Not reloaded if
+	// zero.
+	ServingCertReloadInterval time.Duration
+	// ServingCertDir is a directory of additional serving certificate and key
+	// pairs, which are served to clients asking for one of their names via
+	// SNI instead of the serving certificate, if set. They are only loaded at
+	// startup.
+	ServingCertDir string
+	// CertCacheDir is where refreshed gateway certs are persisted, if set.
+	CertCacheDir string
+	// ReadHeaderTimeout bounds how long the server reads the headers of a
+	// request, so that slow clients cannot hold connections open. The default
+	// of 5 seconds is used if zero.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout bounds how long the server reads a whole request, including
+	// its body. Not bounded if zero.
+	ReadTimeout time.Duration
+	// WriteTimeout bounds how long the server writes a response. Not bounded
+	// if zero, which is required to serve watches.
+	WriteTimeout time.Duration
+	// IdleTimeout bounds how long idle keep-alive connections are kept open.
+	// ReadTimeout is used if zero.
+	IdleTimeout time.Duration
+	// ShutdownGracePeriod is how long the server waits on shutdown for
+	// in-flight requests to complete before it closes their connections.
+	ShutdownGracePeriod time.Duration
+	// WatchShutdownGrace is how long in-flight watches are kept open on
+	// shutdown before they are ended. It must be shorter than
+	// ShutdownGracePeriod.
+	WatchShutdownGrace time.Duration
+	// ShutdownRejectNew rejects new requests with 503 once the agent shuts
+	// down, while in-flight requests complete within ShutdownGracePeriod.
+	ShutdownRejectNew bool
+	// AllowedPaths are regular expressions of the paths of the Kubernetes API
+	// server that can be proxied, or any path if empty. They match the whole
+	// path.
+	AllowedPaths []string
+	// DeniedPaths are regular expressions of the paths of the Kubernetes API
+	// server that cannot be proxied, even if allowed.
+	DeniedPaths []string
+	// ForwardClientIP sets X-Forwarded-For and X-Real-IP headers on proxied
+	// requests based on the remote client address.
+	ForwardClientIP bool
+	// TrustedProxies are the networks of proxies in front of the agent whose
+	// X-Forwarded-For entries are kept when forwarding the client IP. Entries
+	// of other clients are dropped.
+	TrustedProxies []*net.IPNet
+	// ControlPlaneHeader is the name of a header that is set to the control
+	// plane ID on requests proxied to the API server. Not set if empty.
+	ControlPlaneHeader string
+	// NATSStatsInterval is the interval on which the statistics of the NATS
+	// connection are exported as metrics.
+	NATSStatsInterval time.Duration
+	// MaxConcurrentRequests limits the number of proxied requests handled at
+	// the same time, if positive. Further requests wait for a free slot up to
+	// QueueTimeout, or as long as the client waits if zero.
+	MaxConcurrentRequests int
+	QueueTimeout          time.Duration
+	// RouteConcurrencyLimits limits the number of proxied requests handled at
+	// the same time per route, keyed by RouteK8s, RouteK8sWatch or RouteXGQL,
+	// in addition to MaxConcurrentRequests. Further requests wait for a free
+	// slot of their route up to QueueTimeout. Routes are not limited if
+	// missing.
+	RouteConcurrencyLimits map[string]int
+	// DeadlineHeader is the header that carries the deadline of requests, if
+	// set. Requests whose deadline has passed or is less than
+	// MinRequestDeadline away are rejected.
+	DeadlineHeader     string
+	MinRequestDeadline time.Duration
+	// AdvertisedAddress replaces the server addresses in Kubernetes discovery
+	// responses, if set.
+	AdvertisedAddress string
+	// CopyBufferSize is the size of the pooled buffers that proxied response
+	// bodies are copied with. Buffers are allocated per request if zero.
+	CopyBufferSize int
+	// EnableCompression compresses proxied responses with gzip for clients
+	// that accept it, unless they are already encoded or compressed.
+	EnableCompression bool
+	// IdleHeartbeatInterval is the interval on which the agent logs that it
+	// is alive if it did not handle any requests in the meantime.
+	IdleHeartbeatInterval time.Duration
+	// APIServerCertPin is the SHA-256 fingerprint that the certificate served
+	// by the API server must match, in addition to being trusted, if set.
+	APIServerCertPin string
+	// ClientAuth is the policy for authenticating clients of the server by
+	// certificates signed by a CA in ClientCACertPool. It is enforced per
+	// route, so that the probe and metrics endpoints are not affected.
+	ClientAuth       tls.ClientAuthType
+	ClientCACertPool *x509.CertPool
+	// DisableNATS skips connecting to NATS, so that the proxy only serves its
+	// local endpoint, e.g. for testing or on-cluster only setups. The control
+	// plane token in NATS is still used to refresh gateway certs.
+	DisableNATS bool
+	// LazyNATSConnect defers connecting to NATS until the first proxied
+	// request, which waits up to LazyNATSConnectTimeout for the connection.
+	LazyNATSConnect        bool
+	LazyNATSConnectTimeout time.Duration
+	// NATSSubscribeFlushTimeout is how long the agent waits for the NATS
+	// server to acknowledge its subscription before it is ready. Not waited
+	// for if zero.
+	NATSSubscribeFlushTimeout time.Duration
+	// RejectOversizedNATSRequests rejects requests relayed over NATS whose
+	// body exceeds the max payload of the NATS connection with 413.
+	RejectOversizedNATSRequests bool
+	// ClientRateLimitQPS limits the rate of proxied requests of each client,
+	// identified by its certificate or token, if positive. Clients may exceed
+	// it by up to ClientRateLimitBurst requests.
+	ClientRateLimitQPS   float64
+	ClientRateLimitBurst int
+	// MaxRequestsPerSecond limits the rate of all proxied requests, shared by
+	// all clients, if positive. It may be exceeded by up to RequestBurst
+	// requests.
+	MaxRequestsPerSecond float64
+	RequestBurst         int
+	// TraceDownstream measures the phases of proxied requests to the API
+	// server and xgql, e.g. DNS lookup and TLS handshake.
+	TraceDownstream bool
+	// Tracer records OpenTelemetry spans of proxied requests and their
+	// requests to the API server and xgql. Not traced if nil.
+	Tracer *tracing.Tracer
 }
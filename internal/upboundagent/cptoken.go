@@ -0,0 +1,86 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	errEmptyControlPlaneToken   = "control plane token is empty"
+	errControlPlaneTokenChanged = "control plane token is for control plane %s instead of %s"
+)
+
+// eventControlPlaneSwitched is logged when the agent restarts for a rotated
+// control plane token of a different control plane.
+const eventControlPlaneSwitched = "control-plane-switched"
+
+// tokenStore holds the control plane token that can be swapped while in use.
+type tokenStore struct {
+	mu    sync.RWMutex
+	token string
+}
+
+func (s *tokenStore) get() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.token
+}
+
+func (s *tokenStore) set(t string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = t
+}
+
+// loadControlPlaneToken validates the given rotated control plane token and
+// starts using it to authenticate against Upbound API, i.e. to fetch NATS JWTs
+// and gateway certs. The token must be for the same control plane since the
+// agent keeps listening for its requests, unless switching control planes is
+// allowed. The agent then restarts gracefully, since it can only listen for
+// the requests of the new control plane once started with its token. Its
+// signature is verified with the current public keys for tokens, if any.
+func (p *Proxy) loadControlPlaneToken(b []byte) error {
+	t := string(b)
+	if t == "" {
+		return errors.New(errEmptyControlPlaneToken)
+	}
+	if keys := p.tokenPublicKeys(); len(keys) > 0 {
+		if err := VerifyTokenSignature(t, keys); err != nil {
+			return err
+		}
+	}
+	if v := p.config.ValidateControlPlaneToken; v != nil {
+		id, err := v(t)
+		if err != nil {
+			return err
+		}
+		if id != p.config.ControlPlaneID {
+			if !p.config.SwitchControlPlane {
+				return errors.Errorf(errControlPlaneTokenChanged, id, p.config.ControlPlaneID)
+			}
+			p.cpToken.set(t)
+			p.log.Info("warning: control plane token is for a different control plane, restarting the agent for it", "event", eventControlPlaneSwitched, "from", p.config.ControlPlaneID, "to", id)
+			if p.restart != nil {
+				p.restart()
+			}
+			return nil
+		}
+	}
+	p.cpToken.set(t)
+	return nil
+}
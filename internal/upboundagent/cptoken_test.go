@@ -0,0 +1,171 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"crypto"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	"github.com/crossplane/crossplane-runtime/pkg/test"
+
+	"github.com/upbound/universal-crossplane/internal/clients/upbound"
+)
+
+// recordingUpboundClient records the control plane tokens it is called with.
+type recordingUpboundClient struct {
+	tokens []string
+}
+
+func (c *recordingUpboundClient) GetGatewayCerts(cpToken string) (upbound.PublicCerts, error) {
+	c.tokens = append(c.tokens, cpToken)
+	return upbound.PublicCerts{}, nil
+}
+
+func (c *recordingUpboundClient) FetchNewJWTToken(cpToken, _, _ string) (string, error) {
+	c.tokens = append(c.tokens, cpToken)
+	// Not a valid NATS JWT, so that it is fetched again on each refresh.
+	return "jwt", nil
+}
+
+func TestNATSConnManager_userTokenRefresherRotatedToken(t *testing.T) {
+	c := &recordingUpboundClient{}
+	s := &tokenStore{token: "old"}
+	n := &natsConnManager{log: logging.NewNopLogger(), upClient: c, cpToken: s.get}
+	if _, err := n.userTokenRefresher(); err != nil {
+		t.Fatalf("userTokenRefresher(): %v", err)
+	}
+	s.set("new")
+	if _, err := n.userTokenRefresher(); err != nil {
+		t.Fatalf("userTokenRefresher(): %v", err)
+	}
+	if diff := cmp.Diff([]string{"old", "new"}, c.tokens); diff != "" {
+		t.Errorf("userTokenRefresher(): -want control plane tokens, +got:\n%s", diff)
+	}
+}
+
+func TestProxy_reloadControlPlaneToken(t *testing.T) {
+	const cpID = "c21561da-087b-4efc-af6b-718e99bfd85f"
+	errBoom := errors.New("boom")
+	// validate returns the control plane ID that tokens are named after.
+	validate := func(t string) (string, error) {
+		switch t {
+		case "expired":
+			return "", errBoom
+		case "other":
+			return "0a8b9b0c-6a8e-4c4e-9a43-6a1b7e0a0b55", nil
+		}
+		return cpID, nil
+	}
+	type want struct {
+		changed   bool
+		err       error
+		token     string
+		restarted bool
+	}
+	k, err := jwt.ParseRSAPublicKeyFromPEM([]byte(validPublicKey))
+	if err != nil {
+		t.Fatalf("invalid input public key: %v", err)
+	}
+	cases := map[string]struct {
+		reason   string
+		token    string
+		switchCP bool
+		keys     []crypto.PublicKey
+		want     want
+	}{
+		"Unchanged": {
+			reason: "An unchanged token should not be loaded again.",
+			token:  "old",
+			want:   want{token: "old"},
+		},
+		"Rotated": {
+			reason: "A rotated token for the same control plane should be used.",
+			token:  "new",
+			want:   want{changed: true, token: "new"},
+		},
+		"Invalid": {
+			reason: "An invalid rotated token should keep the current one.",
+			token:  "expired",
+			want:   want{err: errors.Wrapf(errBoom, errLoadFile, "token"), token: "old"},
+		},
+		"OtherControlPlane": {
+			reason: "A rotated token for another control plane should keep the current one.",
+			token:  "other",
+			want: want{
+				err:   errors.Wrapf(errors.Errorf(errControlPlaneTokenChanged, "0a8b9b0c-6a8e-4c4e-9a43-6a1b7e0a0b55", cpID), errLoadFile, "token"),
+				token: "old",
+			},
+		},
+		"SwitchControlPlane": {
+			reason:   "A rotated token for another control plane should be used and restart the agent if switching is allowed.",
+			token:    "other",
+			switchCP: true,
+			want:     want{changed: true, token: "other", restarted: true},
+		},
+		"SwitchControlPlaneSameControlPlane": {
+			reason:   "A rotated token for the same control plane should not restart the agent if switching is allowed.",
+			token:    "new",
+			switchCP: true,
+			want:     want{changed: true, token: "new"},
+		},
+		"UnverifiedSignature": {
+			reason: "A rotated token that is not signed with a public key for tokens should keep the current one.",
+			token:  "new",
+			keys:   []crypto.PublicKey{k},
+			want: want{
+				err:   errors.Wrapf(jwt.NewValidationError("token contains an invalid number of segments", jwt.ValidationErrorMalformed), errLoadFile, "token"),
+				token: "old",
+			},
+		},
+		"Empty": {
+			reason: "An empty token file, e.g. while the secret is updated, should keep the current token.",
+			token:  "",
+			want:   want{err: errors.Wrapf(errors.New(errEmptyControlPlaneToken), errLoadFile, "token"), token: "old"},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "token")
+			if err := os.WriteFile(path, []byte(tc.token), 0o600); err != nil {
+				t.Fatalf("cannot write token: %v", err)
+			}
+			restarted := false
+			p := &Proxy{
+				log:     logging.NewNopLogger(),
+				config:  &Config{ControlPlaneID: cpID, ValidateControlPlaneToken: validate, SwitchControlPlane: tc.switchCP, TokenPublicKeys: tc.keys},
+				cpToken: &tokenStore{token: "old"},
+				restart: func() { restarted = true },
+			}
+			f := &fileReloader{name: reloadNameControlPlaneToken, path: path, load: p.loadControlPlaneToken, log: p.log, last: []byte("old")}
+			changed, err := f.reload()
+
+			// Errors contain the temporary path, so we compare their base.
+			if err != nil {
+				err = errors.Wrapf(errors.Cause(err), errLoadFile, filepath.Base(path))
+			}
+			got := want{changed: changed, err: err, token: p.cpToken.get(), restarted: restarted}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(want{}), test.EquateErrors()); diff != "" {
+				t.Errorf("\n%s\nreload(): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+)
+
+const (
+	errDeadlineExpired  = "request deadline has already passed"
+	errDeadlineTooTight = "request deadline is too close to be met"
+	errParseDeadline    = "deadline is neither an RFC 3339 timestamp nor a duration"
+)
+
+// deadlineChecker fast-fails requests whose deadline, as given in a header, has
+// already passed or leaves less than the minimum time to be useful.
+type deadlineChecker struct {
+	log    logging.Logger
+	header string
+	min    time.Duration
+	now    func() time.Time
+}
+
+// middleware returns a middleware that rejects requests with an expired or too
+// tight deadline with 504, without sending them downstream. Requests with a
+// deadline that can be met are handled with it as their context deadline, so
+// that work on their behalf stops once it passes. Requests without a deadline
+// or with one that cannot be parsed are handled as is.
+func (d *deadlineChecker) middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			v := c.Request().Header.Get(d.header)
+			if v == "" {
+				return next(c)
+			}
+			now := d.now()
+			dl, err := parseDeadline(v, now)
+			if err != nil {
+				d.log.Debug("ignoring request deadline", "header", d.header, "error", err)
+				return next(c)
+			}
+			switch left := dl.Sub(now); {
+			case left <= 0:
+				return echo.NewHTTPError(http.StatusGatewayTimeout, errDeadlineExpired)
+			case left < d.min:
+				return echo.NewHTTPError(http.StatusGatewayTimeout, errDeadlineTooTight)
+			}
+			ctx, cancel := context.WithDeadline(c.Request().Context(), dl)
+			defer cancel()
+			c.SetRequest(c.Request().WithContext(ctx))
+			return next(c)
+		}
+	}
+}
+
+// parseDeadline parses a deadline given either as an absolute RFC 3339
+// timestamp or as a duration relative to now, e.g. 30s.
+func parseDeadline(v string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return time.Time{}, errors.New(errParseDeadline)
+	}
+	return now.Add(d), nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/labstack/echo/v4"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+)
+
+const headerDeadline = "X-Request-Deadline"
+
+func TestDeadlineChecker_middleware(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	type want struct {
+		code     int
+		handled  bool
+		deadline time.Time
+	}
+	cases := map[string]struct {
+		reason   string
+		deadline string
+		want     want
+	}{
+		"NoDeadline": {
+			reason: "Requests without a deadline should be handled.",
+			want:   want{code: http.StatusOK, handled: true},
+		},
+		"Expired": {
+			reason:   "Requests whose deadline has passed should be rejected without being handled.",
+			deadline: now.Add(-time.Second).Format(time.RFC3339),
+			want:     want{code: http.StatusGatewayTimeout},
+		},
+		"ExpiredDuration": {
+			reason:   "Requests with no time left should be rejected without being handled.",
+			deadline: "0s",
+			want:     want{code: http.StatusGatewayTimeout},
+		},
+		"TooTight": {
+			reason:   "Requests whose deadline is closer than the minimum should be rejected without being handled.",
+			deadline: "500ms",
+			want:     want{code: http.StatusGatewayTimeout},
+		},
+		"TooTightTimestamp": {
+			reason:   "Requests whose absolute deadline is closer than the minimum should be rejected without being handled.",
+			deadline: now.Add(500 * time.Millisecond).Format(time.RFC3339Nano),
+			want:     want{code: http.StatusGatewayTimeout},
+		},
+		"Sufficient": {
+			reason:   "Requests with enough time left should be handled with their deadline.",
+			deadline: "30s",
+			want:     want{code: http.StatusOK, handled: true, deadline: now.Add(30 * time.Second)},
+		},
+		"SufficientTimestamp": {
+			reason:   "Requests with an absolute deadline far enough away should be handled with their deadline.",
+			deadline: now.Add(time.Minute).Format(time.RFC3339),
+			want:     want{code: http.StatusOK, handled: true, deadline: now.Add(time.Minute)},
+		},
+		"Malformed": {
+			reason:   "Requests with a deadline that cannot be parsed should be handled as is.",
+			deadline: "tomorrow",
+			want:     want{code: http.StatusOK, handled: true},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			d := &deadlineChecker{
+				log:    logging.NewNopLogger(),
+				header: headerDeadline,
+				min:    time.Second,
+				now:    func() time.Time { return now },
+			}
+			got := want{}
+			e := echo.New()
+			e.GET("/k8s/api", func(c echo.Context) error {
+				got.handled = true
+				got.deadline, _ = c.Request().Context().Deadline()
+				return c.NoContent(http.StatusOK)
+			}, d.middleware())
+
+			req := httptest.NewRequest(http.MethodGet, "/k8s/api", nil)
+			if tc.deadline != "" {
+				req.Header.Set(headerDeadline, tc.deadline)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			got.code = rec.Code
+
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(want{})); diff != "" {
+				t.Errorf("\n%s\nmiddleware(): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"net"
+	"net/http"
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+const debugStacksPath = "/debug/stacks"
+
+const errDebugAddressNotLoopback = "debug address %s is not a localhost address"
+
+// newDebugServer returns a server for diagnostic endpoints. It only listens
+// on a localhost address, separate from the serving port, so that it can only
+// be reached from within the pod, e.g. with kubectl port-forward.
+func newDebugServer(addr string) (*http.Server, error) {
+	if !loopbackAddress(addr) {
+		return nil, errors.Errorf(errDebugAddressNotLoopback, addr)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(debugStacksPath, stacks)
+	return &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: readHeaderTimeout}, nil
+}
+
+// loopbackAddress returns true if the given host:port address is on localhost.
+func loopbackAddress(addr string) bool {
+	h, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if h == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(h)
+	return ip != nil && ip.IsLoopback()
+}
+
+// stacks writes the stack traces of all goroutines as plain text.
+func stacks(w http.ResponseWriter, _ *http.Request) {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write(buf)
+}
@@ -0,0 +1,82 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_newDebugServer(t *testing.T) {
+	cases := map[string]struct {
+		reason  string
+		addr    string
+		wantErr bool
+	}{
+		"IPv4Loopback": {
+			reason: "The IPv4 loopback address should be accepted.",
+			addr:   "127.0.0.1:6060",
+		},
+		"IPv6Loopback": {
+			reason: "The IPv6 loopback address should be accepted.",
+			addr:   "[::1]:6060",
+		},
+		"Localhost": {
+			reason: "localhost should be accepted.",
+			addr:   "localhost:6060",
+		},
+		"AllInterfaces": {
+			reason:  "Listening on all interfaces would expose the endpoints outside of the pod.",
+			addr:    ":6060",
+			wantErr: true,
+		},
+		"PodIP": {
+			reason:  "Listening on the pod IP would expose the endpoints outside of the pod.",
+			addr:    "10.0.0.12:6060",
+			wantErr: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := newDebugServer(tc.addr)
+			if diff := cmp.Diff(tc.wantErr, err != nil); diff != "" {
+				t.Errorf("\n%s\nnewDebugServer(...): -want error, +got error:\n%s\nerror: %v", tc.reason, diff, err)
+			}
+		})
+	}
+}
+
+func TestDebugServer_stacks(t *testing.T) {
+	s, err := newDebugServer("127.0.0.1:6060")
+	if err != nil {
+		t.Fatalf("newDebugServer(...): %v", err)
+	}
+	rec := httptest.NewRecorder()
+	s.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, debugStacksPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: want status %d, got %d", debugStacksPath, http.StatusOK, rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("GET %s: want plain text, got %s", debugStacksPath, ct)
+	}
+	// The stacks of all goroutines include the one running this test.
+	if body := rec.Body.String(); !strings.Contains(body, "goroutine ") || !strings.Contains(body, "TestDebugServer_stacks") {
+		t.Errorf("GET %s: want stacks of all goroutines, got:\n%s", debugStacksPath, body)
+	}
+}
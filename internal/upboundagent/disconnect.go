@@ -0,0 +1,66 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httputil"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// statusClientClosedRequest is the non-standard status that access logs show
+// for requests whose client disconnected before the response, as in nginx.
+const statusClientClosedRequest = 499
+
+var clientDisconnectsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "client_disconnects_total",
+	Help:      "Number of proxied requests whose client disconnected before the response was complete.",
+})
+
+// clientGone returns true if the client of the given request disconnected.
+// The request context, which is the context of the downstream request too,
+// is canceled by the server then.
+func clientGone(r *http.Request) bool {
+	return errors.Is(r.Context().Err(), context.Canceled)
+}
+
+// clientDisconnected records that the client of the given request disconnected
+// before the response. This is a normal occurrence rather than an error of the
+// agent and thus only logged in debug mode.
+func (p *Proxy) clientDisconnected(r *http.Request, err error) {
+	clientDisconnectsTotal.Inc()
+	p.log.Debug("client disconnected before the response was complete", "err", err, "url", r.URL.String(), "remote-addr", r.RemoteAddr)
+}
+
+// serveProxy serves the given request with the reverse proxy. The reverse
+// proxy aborts the handler if the client disconnects while the response is
+// copied, which the recover middleware would report as a panic, so that is
+// recorded as a disconnect instead.
+func (p *Proxy) serveProxy(rp *httputil.ReverseProxy, c echo.Context, r *http.Request) {
+	defer func() {
+		if v := recover(); v != nil {
+			if v != http.ErrAbortHandler || !clientGone(r) {
+				panic(v)
+			}
+			p.clientDisconnected(r, r.Context().Err())
+		}
+	}()
+	rp.ServeHTTP(informationalWriter{c.Response()}, r)
+}
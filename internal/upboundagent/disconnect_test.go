@@ -0,0 +1,101 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProxy_k8sClientDisconnect(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		// respond is whether the downstream starts the response before the
+		// client disconnects.
+		respond bool
+	}{
+		"BeforeResponse": {
+			reason: "A client disconnecting while waiting for the downstream should cancel the downstream request.",
+		},
+		"DuringResponse": {
+			reason:  "A client disconnecting while the response is streamed should cancel the downstream request.",
+			respond: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			started := make(chan struct{})
+			canceled := make(chan struct{})
+			kube := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tc.respond {
+					w.WriteHeader(http.StatusOK)
+					w.(http.Flusher).Flush()
+				}
+				close(started)
+				<-r.Context().Done()
+				close(canceled)
+			}))
+			defer kube.Close()
+
+			rl := &recordingLogger{}
+			p := newTestProxy(t, kube.URL)
+			p.log = rl
+			e := echo.New()
+			e.Any(k8sHandlerPath, p.k8s())
+			srv := httptest.NewServer(e)
+			defer srv.Close()
+
+			before := testutil.ToFloat64(clientDisconnectsTotal)
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				<-started
+				cancel()
+			}()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/k8s/api/v1/pods", nil)
+			req.Header.Set(headerAuthorization, "Bearer "+validJWTToken)
+			if res, err := http.DefaultClient.Do(req); err == nil {
+				_, _ = io.Copy(io.Discard, res.Body)
+				_ = res.Body.Close()
+			}
+
+			select {
+			case <-canceled:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("\n%s\ndownstream request was not canceled", tc.reason)
+			}
+			// The proxy records the disconnect right after the downstream
+			// request was canceled.
+			deadline := time.Now().Add(5 * time.Second)
+			for testutil.ToFloat64(clientDisconnectsTotal) != before+1 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if got := testutil.ToFloat64(clientDisconnectsTotal); got != before+1 {
+				t.Errorf("\n%s\nclientDisconnectsTotal: want %v, got %v", tc.reason, before+1, got)
+			}
+			rl.mu.Lock()
+			defer rl.mu.Unlock()
+			if len(rl.entries) != 0 {
+				t.Errorf("\n%s\nwant disconnect not logged as an error, got %+v", tc.reason, rl.entries)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+)
+
+const (
+	keyServerAddresses = "serverAddressByClientCIDRs"
+	keyServerAddress   = "serverAddress"
+	keyGroups          = "groups"
+
+	headerAcceptEncoding = "Accept-Encoding"
+	headerContentLength  = "Content-Length"
+	headerContentType    = "Content-Type"
+)
+
+const (
+	errReadDiscovery   = "cannot read discovery response"
+	errDecodeDiscovery = "cannot decode discovery response"
+	errEncodeDiscovery = "cannot encode discovery response"
+)
+
+// discoveryPath matches the paths of the Kubernetes discovery documents that
+// embed server addresses, i.e. /api, /apis and /apis/<group>. The leading slash
+// is optional since it is stripped from the paths of proxied requests.
+var discoveryPath = regexp.MustCompile(`^/?(api|apis(/[^/]+)?)/?$`)
+
+// isDiscoveryRequest returns true if the given request is for a Kubernetes
+// discovery document that embeds server addresses.
+func isDiscoveryRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet && discoveryPath.MatchString(r.URL.Path) && !isWatchRequest(r)
+}
+
+// rewriteServerAddresses returns a function to modify discovery responses so
+// that all server addresses are the given advertised address. Responses that
+// are not JSON, e.g. protobuf, are left untouched, as are those that cannot be
+// decoded, which are logged and passed through rather than failing the request.
+func rewriteServerAddresses(advertised string, log logging.Logger) func(*http.Response) error {
+	return func(res *http.Response) error {
+		if res.StatusCode != http.StatusOK || res.Header.Get("Content-Encoding") != "" {
+			return nil
+		}
+		if mt, _, err := mime.ParseMediaType(res.Header.Get(headerContentType)); err != nil || mt != "application/json" {
+			return nil
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		_ = res.Body.Close()
+		if err != nil {
+			return errors.Wrap(err, errReadDiscovery)
+		}
+		out, err := rewriteDiscovery(b, advertised)
+		if err != nil {
+			log.Info("warning: cannot rewrite server addresses of discovery response", "error", err)
+			res.Body = io.NopCloser(bytes.NewReader(b))
+			return nil
+		}
+		b = out
+		res.Body = io.NopCloser(bytes.NewReader(b))
+		res.ContentLength = int64(len(b))
+		res.Header.Set(headerContentLength, strconv.Itoa(len(b)))
+		return nil
+	}
+}
+
+// rewriteDiscovery replaces the server addresses of an APIVersions,
+// APIGroupList or APIGroup document with the advertised address.
+func rewriteDiscovery(b []byte, advertised string) ([]byte, error) {
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, errors.Wrap(err, errDecodeDiscovery)
+	}
+	rewriteAddresses(doc, advertised)
+	if groups, ok := doc[keyGroups].([]interface{}); ok {
+		for _, g := range groups {
+			if g, ok := g.(map[string]interface{}); ok {
+				rewriteAddresses(g, advertised)
+			}
+		}
+	}
+	out, err := json.Marshal(doc)
+	return out, errors.Wrap(err, errEncodeDiscovery)
+}
+
+func rewriteAddresses(obj map[string]interface{}, advertised string) {
+	addrs, ok := obj[keyServerAddresses].([]interface{})
+	if !ok {
+		return
+	}
+	for _, a := range addrs {
+		if a, ok := a.(map[string]interface{}); ok {
+			a[keyServerAddress] = advertised
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/labstack/echo/v4"
+)
+
+const advertisedAddress = "agent.upbound.io:443"
+
+func Test_isDiscoveryRequest(t *testing.T) {
+	cases := map[string]struct {
+		method string
+		url    string
+		want   bool
+	}{
+		"CoreVersions": {method: http.MethodGet, url: "/api", want: true},
+		"GroupList":    {method: http.MethodGet, url: "/apis/", want: true},
+		"Group":        {method: http.MethodGet, url: "/apis/apps", want: true},
+		"GroupVersion": {method: http.MethodGet, url: "/apis/apps/v1", want: false},
+		"Resource":     {method: http.MethodGet, url: "/api/v1/pods", want: false},
+		"Watch":        {method: http.MethodGet, url: "/apis/apps?watch=true", want: false},
+		"NotGet":       {method: http.MethodPost, url: "/api", want: false},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.url, nil)
+			if diff := cmp.Diff(tc.want, isDiscoveryRequest(r)); diff != "" {
+				t.Errorf("isDiscoveryRequest(...): -want, +got:\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_rewriteServerAddresses(t *testing.T) {
+	type args struct {
+		status      int
+		contentType string
+		encoding    string
+		body        string
+	}
+	cases := map[string]struct {
+		reason string
+		args
+		want   string
+		warned bool
+	}{
+		"APIVersions": {
+			reason: "Server addresses of the core API versions should be rewritten.",
+			args: args{
+				status:      http.StatusOK,
+				contentType: "application/json",
+				body:        `{"kind":"APIVersions","versions":["v1"],"serverAddressByClientCIDRs":[{"clientCIDR":"0.0.0.0/0","serverAddress":"10.0.0.1:6443"}]}`,
+			},
+			want: `{"kind":"APIVersions","serverAddressByClientCIDRs":[{"clientCIDR":"0.0.0.0/0","serverAddress":"agent.upbound.io:443"}],"versions":["v1"]}`,
+		},
+		"APIGroupList": {
+			reason: "Server addresses of every group should be rewritten.",
+			args: args{
+				status:      http.StatusOK,
+				contentType: "application/json; charset=utf-8",
+				body:        `{"kind":"APIGroupList","groups":[{"name":"apps","serverAddressByClientCIDRs":[{"clientCIDR":"0.0.0.0/0","serverAddress":"10.0.0.1:6443"}]},{"name":"batch"}]}`,
+			},
+			want: `{"groups":[{"name":"apps","serverAddressByClientCIDRs":[{"clientCIDR":"0.0.0.0/0","serverAddress":"agent.upbound.io:443"}]},{"name":"batch"}],"kind":"APIGroupList"}`,
+		},
+		"Protobuf": {
+			reason: "Responses that are not JSON should be untouched.",
+			args: args{
+				status:      http.StatusOK,
+				contentType: "application/vnd.kubernetes.protobuf",
+				body:        "k8s\x00binary",
+			},
+			want: "k8s\x00binary",
+		},
+		"Compressed": {
+			reason: "Compressed responses should be untouched.",
+			args: args{
+				status:      http.StatusOK,
+				contentType: "application/json",
+				encoding:    "gzip",
+				body:        "\x1f\x8bcompressed",
+			},
+			want: "\x1f\x8bcompressed",
+		},
+		"Error": {
+			reason: "Error responses should be untouched.",
+			args: args{
+				status:      http.StatusForbidden,
+				contentType: "application/json",
+				body:        `{"kind":"Status","code":403}`,
+			},
+			want: `{"kind":"Status","code":403}`,
+		},
+		"Malformed": {
+			reason: "JSON responses that cannot be decoded should be logged and passed through untouched.",
+			args: args{
+				status:      http.StatusOK,
+				contentType: "application/json",
+				body:        `{"kind":"APIVersions",`,
+			},
+			want:   `{"kind":"APIVersions",`,
+			warned: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			res := &http.Response{
+				StatusCode: tc.args.status,
+				Header:     http.Header{headerContentType: {tc.args.contentType}},
+				Body:       io.NopCloser(strings.NewReader(tc.args.body)),
+			}
+			if tc.args.encoding != "" {
+				res.Header.Set("Content-Encoding", tc.args.encoding)
+			}
+			rl := &recordingLogger{}
+			if err := rewriteServerAddresses(advertisedAddress, rl)(res); err != nil {
+				t.Fatalf("rewriteServerAddresses(...): %v", err)
+			}
+			b, _ := ioutil.ReadAll(res.Body)
+			if diff := cmp.Diff(tc.want, string(b)); diff != "" {
+				t.Errorf("\n%s\nrewriteServerAddresses(...): -want body, +got body:\n%s", tc.reason, diff)
+			}
+			if got := len(rl.entries) > 0; got != tc.warned {
+				t.Errorf("\n%s\nrewriteServerAddresses(...): want warned %t, got %t", tc.reason, tc.warned, got)
+			}
+		})
+	}
+}
+
+func TestProxy_k8sDiscoveryRewrite(t *testing.T) {
+	kube := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(headerContentType, "application/json")
+		_, _ = io.WriteString(w, `{"kind":"APIVersions","serverAddressByClientCIDRs":[{"clientCIDR":"0.0.0.0/0","serverAddress":"10.0.0.1:6443"}]}`)
+	}))
+	defer kube.Close()
+
+	p := newTestProxy(t, kube.URL)
+	p.config.AdvertisedAddress = advertisedAddress
+	req := httptest.NewRequest(http.MethodGet, "/k8s/api", nil)
+	req.Header.Set(headerAuthorization, "Bearer "+validJWTToken)
+	req.Header.Set(headerAcceptEncoding, "gzip")
+	rec := httptest.NewRecorder()
+	e := echo.New()
+	e.Any(k8sHandlerPath, p.k8s())
+	e.ServeHTTP(rec, req)
+
+	want := `{"kind":"APIVersions","serverAddressByClientCIDRs":[{"clientCIDR":"0.0.0.0/0","serverAddress":"agent.upbound.io:443"}]}`
+	if diff := cmp.Diff(want, rec.Body.String()); diff != "" {
+		t.Errorf("k8s(...): -want body, +got body:\n%s", diff)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	shutdownDrainingConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "shutdown_draining_connections",
+		Help:      "Number of connections that were serving requests when the agent started to shut down.",
+	})
+	shutdownDrainDurationSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "shutdown_drain_duration_seconds",
+		Help:      "How long draining the connections of the agent took on shutdown.",
+	})
+	shutdownForcedClosesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "shutdown_forced_closes_total",
+		Help:      "Number of connections closed forcibly on shutdown since they did not drain within the grace period.",
+	})
+	shutdownRejectedRequestsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "shutdown_rejected_requests_total",
+		Help:      "Number of new requests rejected since the agent was shutting down.",
+	})
+)
+
+const errShuttingDown = "agent is shutting down"
+
+// shutdownGate records whether the agent is shutting down. Its zero value is
+// ready to use.
+type shutdownGate struct {
+	closed int32
+}
+
+// close records that the agent is shutting down.
+func (g *shutdownGate) close() {
+	atomic.StoreInt32(&g.closed, 1)
+}
+
+// middleware returns a middleware that rejects requests with 503 once the
+// agent is shutting down, so that load balancers route them to another
+// replica while in-flight requests complete. Clients are asked to close their
+// connection, lest they send further requests over it.
+func (g *shutdownGate) middleware(rejected prometheus.Counter) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if atomic.LoadInt32(&g.closed) == 0 {
+				return next(c)
+			}
+			rejected.Inc()
+			c.Response().Header().Set("Connection", "close")
+			return echo.NewHTTPError(http.StatusServiceUnavailable, errShuttingDown)
+		}
+	}
+}
+
+// connTracker keeps track of the state of the connections of a server so that
+// those still serving requests can be counted on shutdown. Its zero value is
+// ready to use.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]http.ConnState
+}
+
+// track records the new state of the given connection. It is meant to be the
+// ConnState hook of a server.
+func (t *connTracker) track(c net.Conn, s http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		t.conns = map[net.Conn]http.ConnState{}
+	}
+	switch s {
+	case http.StateClosed, http.StateHijacked:
+		delete(t.conns, c)
+	default:
+		t.conns[c] = s
+	}
+}
+
+// active returns the number of connections that are not idle, i.e. serve a
+// request or did not send one yet.
+func (t *connTracker) active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, s := range t.conns {
+		if s != http.StateIdle {
+			n++
+		}
+	}
+	return n
+}
+
+// drainServer shuts down the given server, waiting up to the grace period for
+// its active connections to complete their requests, and closes those that
+// did not forcibly then. It logs a summary either way.
+func (p *Proxy) drainServer(s *http.Server, conns *connTracker, grace time.Duration) error {
+	start := time.Now()
+	n := conns.active()
+	shutdownDrainingConnections.Set(float64(n))
+	p.log.Info("proxy shutdown: draining connections", "count", n, "grace-period", grace.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		d := time.Since(start)
+		shutdownDrainDurationSeconds.Set(d.Seconds())
+		p.log.Info("proxy shutdown: drained connections", "count", n, "duration", d.String())
+		return err
+	}
+
+	forced := conns.active()
+	if cerr := s.Close(); cerr != nil {
+		p.log.Info("proxy shutdown: cannot close connections", "error", cerr)
+	}
+	d := time.Since(start)
+	shutdownDrainDurationSeconds.Set(d.Seconds())
+	shutdownForcedClosesTotal.Add(float64(forced))
+	p.log.Info("proxy shutdown: grace period expired, closed remaining connections", "count", n, "forcibly-closed", forced, "duration", d.String())
+	return err
+}
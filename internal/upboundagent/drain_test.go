@@ -0,0 +1,178 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProxy_drainServer(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		// slow is how long the in-flight requests take.
+		slow       time.Duration
+		grace      time.Duration
+		wantMsg    string
+		wantForced int
+	}{
+		"Drained": {
+			reason:  "Connections that complete their requests within the grace period should be drained.",
+			slow:    100 * time.Millisecond,
+			grace:   5 * time.Second,
+			wantMsg: "proxy shutdown: drained connections",
+		},
+		"GracePeriodExpired": {
+			reason:     "Connections that do not complete their requests within the grace period should be closed forcibly.",
+			slow:       time.Minute,
+			grace:      100 * time.Millisecond,
+			wantMsg:    "proxy shutdown: grace period expired, closed remaining connections",
+			wantForced: 2,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			started := make(chan struct{}, 2)
+			done := make(chan struct{})
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/fast" {
+					return
+				}
+				started <- struct{}{}
+				select {
+				case <-time.After(tc.slow):
+				case <-done:
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			p := &Proxy{log: &recordingLogger{}, config: &Config{}}
+			srv.Config.ConnState = p.conns.track
+			srv.Start()
+			defer srv.Close()
+			// Closing the server waits for the handlers.
+			defer close(done)
+
+			// A request that completed, leaving its connection idle, and two
+			// slow requests.
+			idle := &http.Transport{}
+			defer idle.CloseIdleConnections()
+			res, err := (&http.Client{Transport: idle}).Get(srv.URL + "/fast")
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			_ = res.Body.Close()
+			// The server marks the connection idle after the response.
+			for p.conns.active() > 0 {
+				time.Sleep(time.Millisecond)
+			}
+			for i := 0; i < 2; i++ {
+				go func() {
+					res, err := (&http.Client{Transport: &http.Transport{}}).Get(srv.URL)
+					if err == nil {
+						_ = res.Body.Close()
+					}
+				}()
+				<-started
+			}
+
+			before := testutil.ToFloat64(shutdownForcedClosesTotal)
+			if err := p.drainServer(srv.Config, &p.conns, tc.grace); (err != nil) != (tc.wantForced > 0) {
+				t.Errorf("\n%s\ndrainServer(...): unexpected error: %v", tc.reason, err)
+			}
+
+			rl := p.log.(*recordingLogger)
+			last := rl.entries[len(rl.entries)-1]
+			if diff := cmp.Diff(tc.wantMsg, last.msg); diff != "" {
+				t.Errorf("\n%s\ndrainServer(...): -want message, +got message:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(2, last.kv["count"]); diff != "" {
+				t.Errorf("\n%s\ndrainServer(...): -want draining connections, +got:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(float64(tc.wantForced), testutil.ToFloat64(shutdownForcedClosesTotal)-before); diff != "" {
+				t.Errorf("\n%s\ndrainServer(...): -want forcibly closed connections, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestShutdownGate_middleware(t *testing.T) {
+	cases := map[string]struct {
+		reason       string
+		rejectNew    bool
+		wantNew      int
+		wantRejected float64
+	}{
+		"RejectNew": {
+			reason:       "New requests should be rejected once shutting down, while in-flight ones complete.",
+			rejectNew:    true,
+			wantNew:      http.StatusServiceUnavailable,
+			wantRejected: 1,
+		},
+		"AcceptNew": {
+			reason:  "New requests should be accepted and completed while shutting down unless rejected.",
+			wantNew: http.StatusOK,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			g := &shutdownGate{}
+			started := make(chan struct{})
+			release := make(chan struct{})
+			var mw []echo.MiddlewareFunc
+			if tc.rejectNew {
+				mw = append(mw, g.middleware(shutdownRejectedRequestsTotal))
+			}
+			e := echo.New()
+			e.GET("/k8s/slow", func(c echo.Context) error {
+				close(started)
+				<-release
+				return c.NoContent(http.StatusOK)
+			}, mw...)
+			e.GET("/k8s/new", func(c echo.Context) error { return c.NoContent(http.StatusOK) }, mw...)
+
+			inFlight := httptest.NewRecorder()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				e.ServeHTTP(inFlight, httptest.NewRequest(http.MethodGet, "/k8s/slow", nil))
+			}()
+			<-started
+
+			// The agent starts to shut down while a request is in flight.
+			g.close()
+			before := testutil.ToFloat64(shutdownRejectedRequestsTotal)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/k8s/new", nil))
+			close(release)
+			<-done
+
+			if diff := cmp.Diff(tc.wantNew, rec.Code); diff != "" {
+				t.Errorf("\n%s\nmiddleware(): -want status of new request, +got status:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(http.StatusOK, inFlight.Code); diff != "" {
+				t.Errorf("\n%s\nmiddleware(): -want status of in-flight request, +got status:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.wantRejected, testutil.ToFloat64(shutdownRejectedRequestsTotal)-before); diff != "" {
+				t.Errorf("\n%s\nmiddleware(): -want rejected requests, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	headerXForwardedFor = "X-Forwarded-For"
+	headerXRealIP       = "X-Real-IP"
+)
+
+// setForwardingHeaders sets the X-Forwarded-For and X-Real-IP headers of the
+// outgoing request based on the incoming one. X-Forwarded-For entries of the
+// incoming request are only kept, in order, if it was sent by one of the given
+// trusted proxies in front of the agent, since any client could set them
+// otherwise. The remote address is appended to them by the reverse proxy.
+// X-Real-IP is the original client as determined by clientIP.
+func setForwardingHeaders(out, in *http.Request, trusted []*net.IPNet) {
+	var prior []string
+	if isTrustedProxy(parseIP(in.RemoteAddr), trusted) {
+		prior = forwardedFor(in.Header)
+	}
+	out.Header.Del(headerXForwardedFor)
+	if len(prior) > 0 {
+		out.Header.Set(headerXForwardedFor, strings.Join(prior, ", "))
+	}
+	out.Header.Del(headerXRealIP)
+	if ip := clientIP(prior, in.RemoteAddr, trusted); ip != "" {
+		out.Header.Set(headerXRealIP, ip)
+	}
+}
+
+// forwardedFor returns the entries of all X-Forwarded-For headers, which may
+// be sent as multiple headers and as comma separated lists.
+func forwardedFor(h http.Header) []string {
+	var addrs []string
+	for _, v := range h.Values(headerXForwardedFor) {
+		for _, a := range strings.Split(v, ",") {
+			if a = strings.TrimSpace(a); a != "" {
+				addrs = append(addrs, a)
+			}
+		}
+	}
+	return addrs
+}
+
+// clientIP returns the IP of the remote address, unless it is a trusted proxy.
+// The forwarded addresses are then walked from the right, i.e. from the hop
+// closest to the agent, to the first one that is not a trusted proxy, since
+// only the entries appended by trusted proxies can be relied upon. The walk
+// stops at the last trusted hop if an entry is not a valid IP.
+func clientIP(forwarded []string, remoteAddr string, trusted []*net.IPNet) string {
+	ip := parseIP(remoteAddr)
+	for i := len(forwarded) - 1; i >= 0 && isTrustedProxy(ip, trusted); i-- {
+		next := parseIP(forwarded[i])
+		if next == "" {
+			break
+		}
+		ip = next
+	}
+	return ip
+}
+
+// isTrustedProxy returns true if the given IP is in any of the trusted
+// networks.
+func isTrustedProxy(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIP returns the IP of the given address, which may have a port and, for
+// IPv6, be enclosed in brackets. It returns an empty string if the address is
+// not an IP.
+func parseIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(strings.Trim(addr, "[]"))
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// setControlPlaneHeader sets the header with the given name of the outgoing
+// request to the ID of the control plane, e.g. to attribute requests to it in
+// audit logs. Any values sent by the client are removed first, so that they
+// cannot be spoofed.
+func setControlPlaneHeader(out *http.Request, name, cpID string) {
+	out.Header.Del(name)
+	out.Header.Set(name, cpID)
+}
@@ -0,0 +1,212 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/labstack/echo/v4"
+)
+
+func Test_setForwardingHeaders(t *testing.T) {
+	_, lb, _ := net.ParseCIDR("10.0.0.0/8")
+	_, edge, _ := net.ParseCIDR("198.51.100.0/24")
+	type want struct {
+		forwardedFor string
+		realIP       string
+	}
+	cases := map[string]struct {
+		reason     string
+		remoteAddr string
+		header     http.Header
+		trusted    []*net.IPNet
+		want       want
+	}{
+		"Direct": {
+			reason:     "The remote address should be the real IP if there is no prior proxy.",
+			remoteAddr: "10.0.0.1:51234",
+			want:       want{realIP: "10.0.0.1"},
+		},
+		"SpoofedForwardedFor": {
+			reason:     "X-Forwarded-For sent by a client that is not a trusted proxy should be dropped and not determine the real IP.",
+			remoteAddr: "203.0.113.9:51234",
+			header:     http.Header{headerXForwardedFor: {"1.1.1.1"}},
+			trusted:    []*net.IPNet{lb},
+			want:       want{realIP: "203.0.113.9"},
+		},
+		"SpoofedForwardedForNoTrustedProxies": {
+			reason:     "X-Forwarded-For should be dropped if no proxies are trusted.",
+			remoteAddr: "10.0.0.1:51234",
+			header:     http.Header{headerXForwardedFor: {"1.1.1.1"}},
+			want:       want{realIP: "10.0.0.1"},
+		},
+		"BehindProxy": {
+			reason:     "The rightmost forwarded address that is not a trusted proxy should be the real IP if the agent is behind a trusted proxy.",
+			remoteAddr: "10.0.0.1:51234",
+			header:     http.Header{headerXForwardedFor: {"203.0.113.7"}},
+			trusted:    []*net.IPNet{lb},
+			want:       want{forwardedFor: "203.0.113.7", realIP: "203.0.113.7"},
+		},
+		"SpoofedBehindProxy": {
+			reason:     "Entries the client prepended before reaching the trusted proxy should be kept but not determine the real IP.",
+			remoteAddr: "10.0.0.1:51234",
+			header:     http.Header{headerXForwardedFor: {"1.1.1.1, 203.0.113.7"}},
+			trusted:    []*net.IPNet{lb},
+			want:       want{forwardedFor: "1.1.1.1, 203.0.113.7", realIP: "203.0.113.7"},
+		},
+		"MultipleHeaders": {
+			reason:     "Entries of multiple headers should be kept in order, and trusted proxies skipped from the right.",
+			remoteAddr: "10.0.0.1:51234",
+			header:     http.Header{headerXForwardedFor: {"203.0.113.7", " 192.0.2.1 ,, 198.51.100.2"}},
+			trusted:    []*net.IPNet{lb, edge},
+			want:       want{forwardedFor: "203.0.113.7, 192.0.2.1, 198.51.100.2", realIP: "192.0.2.1"},
+		},
+		"InvalidEntries": {
+			reason:     "The last trusted hop should be the real IP if the entry before it is not an IP.",
+			remoteAddr: "10.0.0.1:51234",
+			header:     http.Header{headerXForwardedFor: {"203.0.113.7, unknown, [2001:db8::1]:8080"}},
+			trusted:    []*net.IPNet{lb},
+			want:       want{forwardedFor: "203.0.113.7, unknown, [2001:db8::1]:8080", realIP: "2001:db8::1"},
+		},
+		"AllTrusted": {
+			reason:     "The leftmost forwarded address should be the real IP if all hops are trusted proxies.",
+			remoteAddr: "10.0.0.1:51234",
+			header:     http.Header{headerXForwardedFor: {"10.1.1.1, 10.2.2.2"}},
+			trusted:    []*net.IPNet{lb},
+			want:       want{forwardedFor: "10.1.1.1, 10.2.2.2", realIP: "10.1.1.1"},
+		},
+		"SpoofedRealIP": {
+			reason:     "An incoming X-Real-IP should be replaced.",
+			remoteAddr: "10.0.0.1:51234",
+			header:     http.Header{headerXRealIP: {"1.1.1.1"}},
+			want:       want{realIP: "10.0.0.1"},
+		},
+		"NoRemoteAddr": {
+			reason: "No real IP should be set if the client is unknown.",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			in := httptest.NewRequest(http.MethodGet, "/k8s/api", nil)
+			in.RemoteAddr = tc.remoteAddr
+			if tc.header != nil {
+				in.Header = tc.header
+			}
+			out := sanitizeRequest(in)
+			out.Header.Set(headerXRealIP, "stale")
+			setForwardingHeaders(out, in, tc.trusted)
+
+			got := want{forwardedFor: out.Header.Get(headerXForwardedFor), realIP: out.Header.Get(headerXRealIP)}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(want{})); diff != "" {
+				t.Errorf("\n%s\nsetForwardingHeaders(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func Test_setForwardingHeadersReverseProxy(t *testing.T) {
+	_, lb, _ := net.ParseCIDR("10.0.0.0/8")
+	var got http.Header
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	}))
+	defer ds.Close()
+	u, _ := url.Parse(ds.URL)
+
+	in := httptest.NewRequest(http.MethodGet, "/api", nil)
+	in.RemoteAddr = "10.0.0.1:51234"
+	in.Header.Add(headerXForwardedFor, "203.0.113.7")
+	in.Header.Add(headerXForwardedFor, "198.51.100.2")
+	out := sanitizeRequest(in)
+	setForwardingHeaders(out, in, []*net.IPNet{lb})
+	httputil.NewSingleHostReverseProxy(u).ServeHTTP(httptest.NewRecorder(), out)
+
+	// The reverse proxy appends the remote address of the agent's client.
+	if diff := cmp.Diff("203.0.113.7, 198.51.100.2, 10.0.0.1", got.Get(headerXForwardedFor)); diff != "" {
+		t.Errorf("X-Forwarded-For: -want, +got:\n%s", diff)
+	}
+	if diff := cmp.Diff("198.51.100.2", got.Get(headerXRealIP)); diff != "" {
+		t.Errorf("X-Real-IP: -want, +got:\n%s", diff)
+	}
+}
+
+func TestProxy_k8sControlPlaneHeader(t *testing.T) {
+	const cpID = "c21561da-087b-4efc-af6b-718e99bfd85f"
+	cases := map[string]struct {
+		reason  string
+		header  string
+		enabled bool
+		in      []string
+		want    []string
+	}{
+		"Disabled": {
+			reason: "The header should not reach the API server if it is not configured, even if the client sent it.",
+			header: "X-Upbound-Control-Plane-ID",
+			in:     []string{"spoofed"},
+		},
+		"Set": {
+			reason:  "The header should carry the control plane ID.",
+			header:  "X-Upbound-Control-Plane-ID",
+			enabled: true,
+			want:    []string{cpID},
+		},
+		"Spoofed": {
+			reason:  "Values sent by the client should be replaced by the control plane ID.",
+			header:  "X-Upbound-Control-Plane-ID",
+			enabled: true,
+			in:      []string{"spoofed", "also-spoofed"},
+			want:    []string{cpID},
+		},
+		"SpoofedAllowedHeader": {
+			reason:  "Values sent by the client should be replaced even for headers that are otherwise forwarded.",
+			header:  "User-Agent",
+			enabled: true,
+			in:      []string{"spoofed"},
+			want:    []string{cpID},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var got []string
+			kube := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Values(tc.header)
+			}))
+			defer kube.Close()
+
+			p := newTestProxy(t, kube.URL)
+			if tc.enabled {
+				p.config.ControlPlaneHeader = tc.header
+			}
+			e := echo.New()
+			e.Any(k8sHandlerPath, p.k8s())
+
+			req := httptest.NewRequest(http.MethodGet, "/k8s/api/v1/pods", nil)
+			req.Header.Set(headerAuthorization, "Bearer "+validJWTToken)
+			for _, v := range tc.in {
+				req.Header.Add(tc.header, v)
+			}
+			e.ServeHTTP(httptest.NewRecorder(), req)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("\n%s\nk8s(...): -want header values, +got header values:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
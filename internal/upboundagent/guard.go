@@ -0,0 +1,55 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// errTargetNotAllowed is returned by a hostGuard for requests that target a
+// host other than the allowed one.
+type errTargetNotAllowed struct {
+	target  string
+	allowed string
+}
+
+func (e *errTargetNotAllowed) Error() string {
+	return fmt.Sprintf("proxy target %s is not allowed, expecting: %s", e.target, e.allowed)
+}
+
+// hostGuard is a http.RoundTripper that only lets requests through to the given
+// host, so that the agent can never be used to reach any other host.
+type hostGuard struct {
+	allowed *url.URL
+	next    http.RoundTripper
+}
+
+func (g *hostGuard) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !strings.EqualFold(r.URL.Scheme, g.allowed.Scheme) || !strings.EqualFold(r.URL.Host, g.allowed.Host) {
+		// RoundTrippers must always close the request body.
+		if r.Body != nil {
+			_ = r.Body.Close()
+		}
+		return nil, &errTargetNotAllowed{target: origin(r.URL), allowed: origin(g.allowed)}
+	}
+	return g.next.RoundTrip(r)
+}
+
+func origin(u *url.URL) string {
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host}).String()
+}
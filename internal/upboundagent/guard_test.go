@@ -0,0 +1,128 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/labstack/echo/v4"
+
+	"github.com/crossplane/crossplane-runtime/pkg/test"
+)
+
+type roundTripFn func(*http.Request) (*http.Response, error)
+
+func (fn roundTripFn) RoundTrip(r *http.Request) (*http.Response, error) {
+	return fn(r)
+}
+
+func TestHostGuard_RoundTrip(t *testing.T) {
+	allowed, _ := url.Parse("https://10.96.0.1:443")
+	ok := roundTripFn(func(*http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+
+	cases := map[string]struct {
+		reason string
+		url    string
+		want   error
+	}{
+		"AllowedHost": {
+			reason: "Requests to the allowed host should be let through.",
+			url:    "https://10.96.0.1:443/api/v1/pods",
+		},
+		"AllowedHostCase": {
+			reason: "Hosts should be compared case insensitively.",
+			url:    "HTTPS://10.96.0.1:443/api",
+		},
+		"OtherHost": {
+			reason: "Requests to another host should be rejected.",
+			url:    "https://169.254.169.254/latest/meta-data",
+			want:   &errTargetNotAllowed{target: "https://169.254.169.254", allowed: "https://10.96.0.1:443"},
+		},
+		"OtherPort": {
+			reason: "Requests to another port of the allowed host should be rejected.",
+			url:    "https://10.96.0.1:10250/pods",
+			want:   &errTargetNotAllowed{target: "https://10.96.0.1:10250", allowed: "https://10.96.0.1:443"},
+		},
+		"OtherScheme": {
+			reason: "Requests with another scheme should be rejected.",
+			url:    "http://10.96.0.1:443/api",
+			want:   &errTargetNotAllowed{target: "http://10.96.0.1:443", allowed: "https://10.96.0.1:443"},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			g := &hostGuard{allowed: allowed, next: ok}
+			r := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			_, err := g.RoundTrip(r)
+			if diff := cmp.Diff(tc.want, err, test.EquateErrors()); diff != "" {
+				t.Errorf("\n%s\nRoundTrip(...): -want error, +got error:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestProxy_k8sRedirectTarget(t *testing.T) {
+	hits := 0
+	kube := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+	}))
+	defer kube.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request reached another host: %s", r.URL)
+	}))
+	defer other.Close()
+	otherURL, _ := url.Parse(other.URL)
+
+	p := newTestProxy(t, kube.URL)
+	e := echo.New()
+	e.Any(k8sHandlerPath, p.k8s())
+
+	cases := map[string]struct {
+		target string
+		host   string
+	}{
+		"AbsoluteURL": {target: "http://" + otherURL.Host + "/k8s/api/v1/pods"},
+		"HostHeader":  {target: "/k8s/api/v1/pods", host: otherURL.Host},
+		"SchemeLess":  {target: "/k8s//" + otherURL.Host + "/api"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			if tc.host != "" {
+				req.Host = tc.host
+			}
+			req.Header.Set(headerAuthorization, "Bearer "+validJWTToken)
+			e.ServeHTTP(httptest.NewRecorder(), req)
+		})
+	}
+	if diff := cmp.Diff(len(cases), hits); diff != "" {
+		t.Errorf("requests reaching the configured host: -want, +got:\n%s", diff)
+	}
+}
+
+func TestProxy_errorTargetNotAllowed(t *testing.T) {
+	p := newTestProxy(t, "https://10.96.0.1")
+	rec := httptest.NewRecorder()
+	p.error(rec, httptest.NewRequest(http.MethodGet, "/k8s/api", nil), &url.Error{Op: "Get", URL: "https://169.254.169.254", Err: &errTargetNotAllowed{}})
+	if diff := cmp.Diff(http.StatusForbidden, rec.Code); diff != "" {
+		t.Errorf("error(...): -want code, +got code:\n%s", diff)
+	}
+}
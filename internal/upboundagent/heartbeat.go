@@ -0,0 +1,86 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+)
+
+// countRequests returns a middleware that counts the requests handled since
+// start, along with those that failed with a server error, and keeps track of
+// the peak number of concurrent requests.
+func (p *Proxy) countRequests() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			atomic.AddUint64(&p.requests, 1)
+			observePeak(&p.peakInFlight, atomic.AddInt64(&p.inFlight, 1))
+			defer atomic.AddInt64(&p.inFlight, -1)
+			err := next(c)
+			if responseStatus(c, err) >= http.StatusInternalServerError {
+				atomic.AddUint64(&p.serverErrors, 1)
+			}
+			return err
+		}
+	}
+}
+
+// requestsSinceStart returns the number of requests handled since start.
+func (p *Proxy) requestsSinceStart() uint64 {
+	return atomic.LoadUint64(&p.requests)
+}
+
+// heartbeat logs that the agent is alive if it did not handle any requests
+// since the last heartbeat, so that idle agents do not look stuck to operators
+// monitoring logs.
+type heartbeat struct {
+	log       logging.Logger
+	requests  func() uint64
+	connected func() bool
+
+	last uint64
+}
+
+// beat logs the heartbeat if the agent was idle since the last beat, and
+// returns whether it did.
+func (h *heartbeat) beat() bool {
+	n := h.requests()
+	if n != h.last {
+		h.last = n
+		return false
+	}
+	h.log.Info("alive", "nats-connected", h.connected(), "requests-since-start", n)
+	return true
+}
+
+// run beats on the given interval until the context is done.
+func (h *heartbeat) run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			h.beat()
+		}
+	}
+}
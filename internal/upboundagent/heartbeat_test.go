@@ -0,0 +1,50 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/labstack/echo/v4"
+)
+
+func TestHeartbeat_beat(t *testing.T) {
+	p := &Proxy{config: &Config{}}
+	e := echo.New()
+	e.GET("/k8s/api", func(c echo.Context) error { return c.NoContent(http.StatusOK) }, p.countRequests())
+	request := func() { e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/k8s/api", nil)) }
+
+	rl := &recordingLogger{}
+	h := &heartbeat{log: rl, requests: p.requestsSinceStart, connected: func() bool { return true }}
+
+	got := []bool{h.beat()}
+	request()
+	request()
+	got = append(got, h.beat(), h.beat())
+	request()
+	got = append(got, h.beat(), h.beat())
+
+	want := []bool{true, false, true, false, true}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("beat(): -want logged, +got logged:\n%s", diff)
+	}
+	wantKV := map[string]interface{}{"nats-connected": true, "requests-since-start": uint64(3)}
+	if diff := cmp.Diff(wantKV, rl.entries[len(rl.entries)-1].kv); diff != "" {
+		t.Errorf("beat(): -want key values, +got key values:\n%s", diff)
+	}
+}
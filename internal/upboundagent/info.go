@@ -0,0 +1,153 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/upbound/universal-crossplane/internal/version"
+)
+
+const (
+	infoHandlerPath = "/info"
+
+	redacted = "REDACTED"
+)
+
+// feature is the state of an optional feature of the agent, along with its
+// key parameters. Sensitive parameters, like credentials, are never included.
+type feature struct {
+	Enabled bool              `json:"enabled"`
+	Params  map[string]string `json:"params,omitempty"`
+}
+
+// features returns the state of the optional features that the given
+// configuration enables, by name.
+func features(c Config) map[string]feature { // nolint:gocyclo
+	on := func(enabled bool, kv ...string) feature {
+		f := feature{Enabled: enabled}
+		if !enabled || len(kv) == 0 {
+			return f
+		}
+		f.Params = make(map[string]string, len(kv)/2)
+		for i := 0; i+1 < len(kv); i += 2 {
+			f.Params[kv[i]] = kv[i+1]
+		}
+		return f
+	}
+	metricsAuth := "none"
+	switch {
+	case c.Metrics.BearerToken != "" && c.Metrics.ClientCACertPool != nil:
+		metricsAuth = "bearer-token,client-cert"
+	case c.Metrics.BearerToken != "":
+		metricsAuth = "bearer-token"
+	case c.Metrics.ClientCACertPool != nil:
+		metricsAuth = "client-cert"
+	}
+	var routeLimits []string
+	for route, max := range c.RouteConcurrencyLimits {
+		routeLimits = append(routeLimits, route, strconv.Itoa(max))
+	}
+	return map[string]feature{
+		"debug":                      on(c.DebugMode, "address", c.DebugAddress),
+		"probe-server":               on(c.ProbeAddress != "", "address", c.ProbeAddress),
+		"access-log-errors-only":     on(c.AccessLogErrorsOnly),
+		"prometheus-metrics":         on(!c.Metrics.DisablePrometheus),
+		"metrics-server":             on(c.Metrics.Address != "" && !c.Metrics.DisablePrometheus, "address", c.Metrics.Address),
+		"secure-metrics":             on(c.Metrics.Secure, "auth", metricsAuth),
+		"otlp-metrics":               on(c.Metrics.OTLPEndpoint != "", "endpoint", redactURL(c.Metrics.OTLPEndpoint), "interval", c.Metrics.OTLPInterval.String()),
+		"cert-refresh":               on(c.CertRefresh.Interval > 0, "interval", c.CertRefresh.Interval.String()),
+		"cert-cache":                 on(c.CertCacheDir != "", "dir", c.CertCacheDir),
+		"control-plane-token-reload": on(c.ControlPlaneTokenFile != "" && c.ControlPlaneTokenReloadInterval > 0, "interval", c.ControlPlaneTokenReloadInterval.String()),
+		"xgql-ca-reload":             on(c.XGQLCABundleFile != "" && c.XGQLCAReloadInterval > 0, "interval", c.XGQLCAReloadInterval.String()),
+		"xgql-health-checks":         on(c.XGQLHealthCheckInterval > 0, "interval", c.XGQLHealthCheckInterval.String(), "backends", strconv.Itoa(len(c.XGQLEndpoints))),
+		"xgql-readiness-check":       on(c.XGQLHealthCheck, "path", c.XGQLHealthCheckPath, "status", strconv.Itoa(c.XGQLHealthCheckStatus)),
+		"client-auth":                on(c.ClientAuth != tls.NoClientCert, "mode", c.ClientAuth.String()),
+		"rate-limit":                 on(c.MaxRequestsPerSecond > 0, "max-requests-per-second", strconv.FormatFloat(c.MaxRequestsPerSecond, 'f', -1, 64), "burst", strconv.Itoa(c.RequestBurst)),
+		"client-rate-limit":          on(c.ClientRateLimitQPS > 0, "qps", strconv.FormatFloat(c.ClientRateLimitQPS, 'f', -1, 64), "burst", strconv.Itoa(c.ClientRateLimitBurst)),
+		"concurrency-limit":          on(c.MaxConcurrentRequests > 0, "max-concurrent-requests", strconv.Itoa(c.MaxConcurrentRequests), "queue-timeout", c.QueueTimeout.String()),
+		"control-plane-switch":       on(c.SwitchControlPlane),
+		"shutdown-reject-new":        on(c.ShutdownRejectNew, "grace-period", c.ShutdownGracePeriod.String()),
+		"audit-log":                  on(c.Audit.Enabled, "path", c.Audit.Path, "headers", strconv.FormatBool(c.Audit.Headers)),
+		"k8s-path-policy":            on(len(c.AllowedPaths)+len(c.DeniedPaths) > 0, "allowed", strconv.Itoa(len(c.AllowedPaths)), "denied", strconv.Itoa(len(c.DeniedPaths))),
+		"route-concurrency-limits":   on(len(c.RouteConcurrencyLimits) > 0, routeLimits...),
+		"request-deadlines":          on(c.DeadlineHeader != "", "header", c.DeadlineHeader, "min", c.MinRequestDeadline.String()),
+		"lazy-nats-connect":          on(c.LazyNATSConnect, "timeout", c.LazyNATSConnectTimeout.String()),
+		"nats-payload-limit":         on(c.RejectOversizedNATSRequests),
+		"nats-disabled":              on(c.DisableNATS),
+		"client-ip-forwarding":       on(c.ForwardClientIP, "trusted-proxies", strconv.Itoa(len(c.TrustedProxies))),
+		"control-plane-header":       on(c.ControlPlaneHeader != "", "header", c.ControlPlaneHeader),
+		"discovery-rewriting":        on(c.AdvertisedAddress != "", "address", c.AdvertisedAddress),
+		"api-server-cert-pin":        on(c.APIServerCertPin != ""),
+		"downstream-tracing":         on(c.TraceDownstream),
+		"otel-tracing":               on(c.Tracer != nil, "endpoint", redactURL(c.Tracer.Endpoint())),
+		"sni-certificates":           on(c.ServingCertDir != "", "dir", c.ServingCertDir),
+		"compression":                on(c.EnableCompression),
+		"copy-buffers":               on(c.CopyBufferSize > 0, "size", strconv.Itoa(c.CopyBufferSize)),
+		"idle-heartbeat":             on(c.IdleHeartbeatInterval > 0, "interval", c.IdleHeartbeatInterval.String()),
+	}
+}
+
+// redactURL redacts the password of the given URL, if any.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return redacted
+	}
+	return u.Redacted()
+}
+
+// stripCredentials removes the user info of the given URL, if any. Unlike
+// redactURL it removes the user name too, since NATS URLs may carry a token as
+// the user name.
+func stripCredentials(s string) string {
+	if s == "" {
+		return ""
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return redacted
+	}
+	u.User = nil
+	return u.String()
+}
+
+// info returns a handler that reports the version of the agent, the control
+// plane and cluster IDs it resolved, the state of its optional features and the
+// NATS server it is connected to, so that operators can confirm the effective
+// configuration of a deployed agent and which server it failed over to, if any.
+// Neither the control plane token nor any keys are reported.
+func (p *Proxy) info() echo.HandlerFunc {
+	f := features(*p.config)
+	return func(c echo.Context) error {
+		natsServer, natsConnected := "", false
+		if p.natsConn != nil {
+			natsServer, natsConnected = p.natsConn.connectedURL(), p.natsConn.connected()
+		}
+		return c.JSON(http.StatusOK, echo.Map{
+			"version":          version.Version,
+			"control-plane-id": p.config.ControlPlaneID,
+			"kube-cluster-id":  p.clusterID,
+			"nats-connected":   natsConnected,
+			"nats-server":      natsServer,
+			"features":         f,
+		})
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// observePeak raises the given peak to n if it is higher.
+func observePeak(peak *int64, n int64) {
+	for {
+		cur := atomic.LoadInt64(peak)
+		if n <= cur || atomic.CompareAndSwapInt64(peak, cur, n) {
+			return
+		}
+	}
+}
+
+// responseStatus returns the status of the response to the request of the
+// given context, which is only written by the error handler of echo if the
+// handler returned an error.
+func responseStatus(c echo.Context, err error) int {
+	if err == nil {
+		return c.Response().Status
+	}
+	if he, ok := err.(*echo.HTTPError); ok {
+		return he.Code
+	}
+	return http.StatusInternalServerError
+}
+
+// logLifetimeSummary logs a summary of the lifetime of the agent, e.g. to
+// compare the replicas replaced by a rolling update.
+func (p *Proxy) logLifetimeSummary() {
+	p.log.Info("proxy shutdown: lifetime summary",
+		"requests", atomic.LoadUint64(&p.requests),
+		"server-errors", atomic.LoadUint64(&p.serverErrors),
+		"nats-reconnects", p.natsConn.stats().Reconnects,
+		"peak-concurrent-requests", atomic.LoadInt64(&p.peakInFlight),
+		"uptime", time.Since(startTime).Round(time.Second).String())
+}
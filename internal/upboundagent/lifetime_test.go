@@ -0,0 +1,79 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/labstack/echo/v4"
+)
+
+func TestProxy_shutdownLogsLifetimeSummary(t *testing.T) {
+	rl := &recordingLogger{}
+	p := &Proxy{log: rl, config: &Config{ShutdownGracePeriod: time.Second}, natsConn: &natsLink{}, isReady: &atomic.Value{}, server: &http.Server{}}
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	e := echo.New()
+	e.GET("/k8s/ok", func(c echo.Context) error { return c.NoContent(http.StatusOK) }, p.countRequests())
+	e.GET("/k8s/fail", func(c echo.Context) error { return echo.NewHTTPError(http.StatusBadGateway) }, p.countRequests())
+	e.GET("/k8s/slow", func(c echo.Context) error {
+		started <- struct{}{}
+		<-release
+		return c.NoContent(http.StatusOK)
+	}, p.countRequests())
+	request := func(path string) { e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil)) }
+
+	// Two requests in flight at once, followed by a successful and a failed
+	// one.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request("/k8s/slow")
+		}()
+		<-started
+	}
+	close(release)
+	wg.Wait()
+	request("/k8s/ok")
+	request("/k8s/fail")
+
+	if err := p.shutdown(); err != nil {
+		t.Fatalf("shutdown(): %v", err)
+	}
+
+	last := rl.entries[len(rl.entries)-1]
+	if diff := cmp.Diff("proxy shutdown: lifetime summary", last.msg); diff != "" {
+		t.Fatalf("shutdown(): -want last message, +got last message:\n%s", diff)
+	}
+	delete(last.kv, "uptime")
+	want := map[string]interface{}{
+		"requests":                 uint64(4),
+		"server-errors":            uint64(1),
+		"nats-reconnects":          uint64(0),
+		"peak-concurrent-requests": int64(2),
+	}
+	if diff := cmp.Diff(want, last.kv); diff != "" {
+		t.Errorf("shutdown(): -want summary, +got summary:\n%s", diff)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	headerRetryAfter = "Retry-After"
+)
+
+const (
+	errQueueTimeout   = "timed out waiting for a free request slot"
+	errQueueCancelled = "request cancelled while waiting for a free request slot"
+)
+
+var queueWaitSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Namespace: metricsNamespace,
+	Name:      "request_queue_wait_seconds",
+	Help:      "Time proxied requests waited for a free request slot when concurrency limiting is enabled.",
+	Buckets:   []float64{0.001, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+})
+
+// queueRequestSlots is the name of the queue of requests waiting for a free
+// request slot.
+const queueRequestSlots = "request_slots"
+
+// queueRouteSlotsPrefix prefixes the route in the name of the queue of
+// requests waiting for a free slot of their route.
+const queueRouteSlotsPrefix = "route_slots_"
+
+// Routes that concurrency can be limited for individually.
+const (
+	// RouteK8s are requests to the API server, except for long running ones.
+	RouteK8s = "k8s"
+	// RouteK8sWatch are long running requests to the API server, i.e. watches
+	// and upgraded connections.
+	RouteK8sWatch = "k8s-watch"
+	// RouteXGQL are requests to xgql.
+	RouteXGQL = "xgql"
+)
+
+// Routes are the routes that concurrency can be limited for individually.
+var Routes = []string{RouteK8s, RouteK8sWatch, RouteXGQL}
+
+var routeRequestsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "route_requests_in_flight",
+	Help:      "Number of proxied requests currently handled, by route.",
+}, []string{"route"})
+
+var queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "queue_depth",
+	Help:      "Number of items currently waiting in the internal queues of the agent.",
+}, []string{"queue"})
+
+// concurrencyLimiter limits the number of requests that are handled at the
+// same time. Further requests wait for a free slot, up to the queue timeout.
+type concurrencyLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+	wait    prometheus.Observer
+	depth   prometheus.Gauge
+}
+
+func newConcurrencyLimiter(max int, queueTimeout time.Duration, wait prometheus.Observer, depth prometheus.Gauge) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		slots:   make(chan struct{}, max),
+		timeout: queueTimeout,
+		wait:    wait,
+		depth:   depth,
+	}
+}
+
+// middleware returns a middleware that only calls the next handler once a slot
+// is free. The queue timeout only bounds the wait for a slot, not the handling
+// of the request itself. Requests that time out are rejected with 503 so that
+// clients can retry elsewhere. Watches and upgraded connections, e.g. of
+// kubectl exec, are long running and not limited, since they would otherwise
+// hold their slots indefinitely.
+func (l *concurrencyLimiter) middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if isLongRunningRequest(c.Request()) {
+				return next(c)
+			}
+			return l.handle(c, next)
+		}
+	}
+}
+
+// handle calls the next handler once a slot is free.
+func (l *concurrencyLimiter) handle(c echo.Context, next echo.HandlerFunc) error {
+	start := time.Now()
+	var expired <-chan time.Time
+	if l.timeout > 0 {
+		t := time.NewTimer(l.timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	l.depth.Inc()
+	select {
+	case l.slots <- struct{}{}:
+		l.done(start)
+		defer func() { <-l.slots }()
+		return next(c)
+	case <-expired:
+		l.done(start)
+		c.Response().Header().Set(headerRetryAfter, "1")
+		return echo.NewHTTPError(http.StatusServiceUnavailable, errQueueTimeout)
+	case <-c.Request().Context().Done():
+		l.done(start)
+		return echo.NewHTTPError(http.StatusServiceUnavailable, errQueueCancelled)
+	}
+}
+
+// done records that a request that started waiting at the given time is no
+// longer waiting for a slot.
+func (l *concurrencyLimiter) done(start time.Time) {
+	l.depth.Dec()
+	l.wait.Observe(time.Since(start).Seconds())
+}
+
+// routeLimiter limits the number of requests that are handled at the same time
+// per route, so that e.g. long running watches cannot take up the slots that
+// quick queries need. Routes without a limiter are not limited.
+type routeLimiter struct {
+	limiters map[string]*concurrencyLimiter
+	inFlight *prometheus.GaugeVec
+}
+
+// newRouteLimiter returns a limiter of the given routes to their positive
+// limits. Further requests wait for a free slot of their route, up to the
+// queue timeout.
+func newRouteLimiter(limits map[string]int, queueTimeout time.Duration, wait prometheus.Observer, depth *prometheus.GaugeVec, inFlight *prometheus.GaugeVec) *routeLimiter {
+	l := &routeLimiter{limiters: map[string]*concurrencyLimiter{}, inFlight: inFlight}
+	for route, max := range limits {
+		if max > 0 {
+			l.limiters[route] = newConcurrencyLimiter(max, queueTimeout, wait, depth.WithLabelValues(queueRouteSlotsPrefix+route))
+		}
+	}
+	return l
+}
+
+// middleware returns a middleware that calls the next handler once a slot of
+// the route of the request, as returned by route, is free. Requests are
+// counted as in flight once they are handled, whether their route is limited
+// or not.
+func (l *routeLimiter) middleware(route func(*http.Request) string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r := route(c.Request())
+			g := l.inFlight.WithLabelValues(r)
+			counted := func(c echo.Context) error {
+				g.Inc()
+				defer g.Dec()
+				return next(c)
+			}
+			cl, ok := l.limiters[r]
+			if !ok {
+				return counted(c)
+			}
+			return cl.handle(c, counted)
+		}
+	}
+}
+
+// k8sRoute returns the route of a request to the API server.
+func k8sRoute(r *http.Request) string {
+	if isLongRunningRequest(r) {
+		return RouteK8sWatch
+	}
+	return RouteK8s
+}
+
+// fixedRoute returns a function that returns the given route for any request.
+func fixedRoute(route string) func(*http.Request) string {
+	return func(*http.Request) string { return route }
+}
@@ -0,0 +1,225 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// sampleCount returns the number of observations of the given histogram.
+func sampleCount(t *testing.T, h prometheus.Histogram) int {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := h.Write(m); err != nil {
+		t.Fatalf("cannot write histogram: %v", err)
+	}
+	return int(m.GetHistogram().GetSampleCount())
+}
+
+func TestConcurrencyLimiter_queueTimeout(t *testing.T) {
+	type want struct {
+		code       int
+		retryAfter string
+		waits      int
+	}
+	cases := map[string]struct {
+		reason  string
+		timeout time.Duration
+		hold    time.Duration
+		url     string
+		want    want
+	}{
+		"Saturated": {
+			reason:  "A request should be rejected once it waited for the queue timeout.",
+			timeout: 20 * time.Millisecond,
+			hold:    time.Second,
+			url:     "/k8s/api/v1/pods",
+			want:    want{code: http.StatusServiceUnavailable, retryAfter: "1", waits: 2},
+		},
+		"FreedInTime": {
+			reason:  "A request should be handled if a slot is freed before the queue timeout.",
+			timeout: time.Second,
+			hold:    20 * time.Millisecond,
+			url:     "/k8s/api/v1/pods",
+			want:    want{code: http.StatusOK, waits: 2},
+		},
+		"Watch": {
+			reason:  "Watches should not wait for a slot.",
+			timeout: 20 * time.Millisecond,
+			hold:    time.Second,
+			url:     "/k8s/api/v1/pods?watch=true",
+			want:    want{code: http.StatusOK, waits: 1},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			wait := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "wait"})
+			l := newConcurrencyLimiter(1, tc.timeout, wait, prometheus.NewGauge(prometheus.GaugeOpts{Name: "depth"}))
+
+			started := make(chan struct{})
+			release := make(chan struct{})
+			e := echo.New()
+			e.Any(k8sHandlerPath, func(c echo.Context) error {
+				if c.Request().Header.Get("X-Hold") != "" {
+					close(started)
+					select {
+					case <-release:
+					case <-time.After(tc.hold):
+					}
+				}
+				return c.NoContent(http.StatusOK)
+			}, l.middleware())
+
+			// Occupy the only slot.
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				req := httptest.NewRequest(http.MethodGet, "/k8s/api/v1/pods", nil)
+				req.Header.Set("X-Hold", "true")
+				e.ServeHTTP(httptest.NewRecorder(), req)
+			}()
+			<-started
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+			close(release)
+			<-done
+
+			got := want{
+				code:       rec.Code,
+				retryAfter: rec.Header().Get(headerRetryAfter),
+				waits:      sampleCount(t, wait),
+			}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(want{})); diff != "" {
+				t.Errorf("\n%s\nmiddleware(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestConcurrencyLimiter_depth(t *testing.T) {
+	depth := prometheus.NewGauge(prometheus.GaugeOpts{Name: "depth"})
+	l := newConcurrencyLimiter(1, 0, prometheus.NewHistogram(prometheus.HistogramOpts{Name: "wait"}), depth)
+
+	handled := make(chan struct{}, 3)
+	release := make(chan struct{})
+	e := echo.New()
+	e.Any(k8sHandlerPath, func(c echo.Context) error {
+		handled <- struct{}{}
+		<-release
+		return c.NoContent(http.StatusOK)
+	}, l.middleware())
+
+	done := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		go func() {
+			e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/k8s/api/v1/pods", nil))
+			done <- struct{}{}
+		}()
+	}
+
+	// One request holds the only slot while the others wait for it.
+	<-handled
+	waitForGauge(t, depth, 2)
+	for want := 1.0; want >= 0; want-- {
+		release <- struct{}{}
+		<-done
+		<-handled
+		waitForGauge(t, depth, want)
+	}
+	release <- struct{}{}
+	<-done
+	if got := testutil.ToFloat64(depth); got != 0 {
+		t.Errorf("middleware(): want depth 0 once all requests are handled, got %v", got)
+	}
+}
+
+// waitForGauge waits until the given gauge has the wanted value.
+func waitForGauge(t *testing.T, g prometheus.Gauge, want float64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(g) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("want gauge %v, got %v", want, testutil.ToFloat64(g))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRouteLimiter_isolation(t *testing.T) {
+	inFlight := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "in_flight"}, []string{"route"})
+	depth := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "depth"}, []string{"queue"})
+	l := newRouteLimiter(map[string]int{RouteK8s: 1, RouteK8sWatch: 1}, 20*time.Millisecond, prometheus.NewHistogram(prometheus.HistogramOpts{Name: "wait"}), depth, inFlight)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	e := echo.New()
+	e.Any(k8sHandlerPath, func(c echo.Context) error {
+		if c.Request().Header.Get("X-Hold") != "" {
+			close(started)
+			<-release
+		}
+		return c.NoContent(http.StatusOK)
+	}, l.middleware(k8sRoute))
+	e.Any(xgqlHandlerPath, func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}, l.middleware(fixedRoute(RouteXGQL)))
+
+	// Occupy the only watch slot.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest(http.MethodGet, "/k8s/api/v1/pods?watch=true", nil)
+		req.Header.Set("X-Hold", "true")
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	<-started
+
+	serve := func(url string) int {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec.Code
+	}
+	type want struct {
+		Watch, Query, XGQL int
+		WatchesInFlight    float64
+	}
+	got := want{
+		Watch:           serve("/k8s/api/v1/pods?watch=true"),
+		Query:           serve("/k8s/api/v1/pods"),
+		XGQL:            serve(xgqlHandlerPath),
+		WatchesInFlight: testutil.ToFloat64(inFlight.WithLabelValues(RouteK8sWatch)),
+	}
+	close(release)
+	<-done
+
+	// Only further watches wait for the held watch slot, and time out.
+	w := want{Watch: http.StatusServiceUnavailable, Query: http.StatusOK, XGQL: http.StatusOK, WatchesInFlight: 1}
+	if diff := cmp.Diff(w, got); diff != "" {
+		t.Errorf("middleware(...): -want, +got:\n%s", diff)
+	}
+	if diff := cmp.Diff(0.0, testutil.ToFloat64(inFlight.WithLabelValues(RouteK8sWatch))); diff != "" {
+		t.Errorf("in flight watches once done: -want, +got:\n%s", diff)
+	}
+}
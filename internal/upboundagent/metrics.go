@@ -0,0 +1,136 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/upbound/universal-crossplane/internal/version"
+)
+
+const (
+	metricsHandlerPath = "/metrics"
+)
+
+const (
+	errMetricsUnauthorized = "metrics require a valid bearer token or client certificate"
+)
+
+// startTime is when the agent started.
+var startTime = time.Now()
+
+var (
+	startTimeSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "start_time_seconds",
+		Help:      "Start time of the agent since unix epoch in seconds.",
+	})
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "build_info",
+		Help:      "A metric with a constant '1' value labeled by the version of the agent and the Go version it was built with.",
+	}, []string{"version", "goversion"})
+	unsignedTokensRejectedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "unsigned_tokens_rejected_total",
+		Help:      "Number of requests rejected since their token was not signed, i.e. used the none signing method.",
+	})
+)
+
+// The default registry, which /metrics serves, includes the Go runtime and
+// process collectors already, so only the metrics of the agent are registered.
+func init() {
+	startTimeSeconds.Set(float64(startTime.Unix()))
+	buildInfo.WithLabelValues(version.Version, runtime.Version()).Set(1)
+	prometheus.MustRegister(startTimeSeconds, buildInfo)
+	prometheus.MustRegister(defaultNATSMetrics.collectors()...)
+	prometheus.MustRegister(natsReconnectDowntimeSeconds, natsConnected, natsJWTRefreshesTotal)
+	prometheus.MustRegister(reloadsTotal, queueWaitSeconds, queueDepth, certRefreshConsecutiveFailures)
+	prometheus.MustRegister(certExpiryTimestampSeconds, throttledRequestsTotal, rateLimitedRequestsTotal, downstreamPhaseSeconds, unsignedTokensRejectedTotal)
+	prometheus.MustRegister(clientDisconnectsTotal, usingCachedCerts, auditWriteFailuresTotal, compressionSavedBytesTotal)
+	prometheus.MustRegister(shutdownDrainingConnections, shutdownDrainDurationSeconds, shutdownForcedClosesTotal, shutdownRejectedRequestsTotal)
+	prometheus.MustRegister(tokenValidationsTotal, tokenRejectionsTotal, routeRequestsInFlight, k8sPathDecisionsTotal)
+}
+
+// metricsAuth returns a middleware that, in secure mode, only lets requests
+// through that either carry the configured bearer token or present a client
+// certificate signed by the configured CA.
+func (p *Proxy) metricsAuth() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			m := p.config.Metrics
+			if !m.Secure {
+				return next(c)
+			}
+			r := c.Request()
+			if validBearer(r.Header, m.BearerToken) || verifyClientCert(r.TLS, m.ClientCACertPool) {
+				return next(c)
+			}
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+			return echo.NewHTTPError(http.StatusUnauthorized, errMetricsUnauthorized)
+		}
+	}
+}
+
+// validBearer returns true if the authorization header of the request carries
+// the expected, non-empty bearer token.
+func validBearer(h http.Header, want string) bool {
+	if want == "" {
+		return false
+	}
+	parts := strings.SplitN(strings.TrimSpace(h.Get(headerAuthorization)), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(parts[1])), []byte(want)) == 1
+}
+
+// verifyClientCert returns true if the peer of the given connection presented
+// a client certificate that chains up to the given pool.
+func verifyClientCert(cs *tls.ConnectionState, pool *x509.CertPool) bool {
+	if cs == nil || len(cs.PeerCertificates) == 0 || pool == nil {
+		return false
+	}
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, c := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err == nil
+}
+
+// newMetricsServer returns a plain HTTP server for the Prometheus metrics
+// endpoint, so that scrapers do not need to be set up for the TLS and client
+// authentication of the serving port. Client certificates cannot be presented
+// over plain HTTP, so secure mode only accepts the bearer token there.
+func (p *Proxy) newMetricsServer(addr string) *http.Server {
+	e := echo.New()
+	e.GET(metricsHandlerPath, echo.WrapHandler(promhttp.Handler()), p.metricsAuth())
+	return &http.Server{Addr: addr, Handler: e, ReadHeaderTimeout: readHeaderTimeout}
+}
@@ -0,0 +1,276 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	"github.com/upbound/universal-crossplane/internal/version"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCert returns a certificate for the given common name, signed by the
+// given parent or self-signed, as a CA if isCA is true.
+func newTestCert(t *testing.T, cn string, parent *testCert, isCA bool, usages ...x509.ExtKeyUsage) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              []string{cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		ExtKeyUsage:           usages,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %v", err)
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("cannot parse certificate: %v", err)
+	}
+	return &testCert{cert: c, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func newTestCA(t *testing.T) *testCert {
+	t.Helper()
+	return newTestCert(t, "test-ca", nil, true)
+}
+
+func certPool(certs ...*testCert) *x509.CertPool {
+	p := x509.NewCertPool()
+	for _, c := range certs {
+		p.AddCert(c.cert)
+	}
+	return p
+}
+
+func TestProxy_metricsAuth(t *testing.T) {
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+	client := newTestCert(t, "scraper", ca, false, x509.ExtKeyUsageClientAuth)
+	untrusted := newTestCert(t, "scraper", otherCA, false, x509.ExtKeyUsageClientAuth)
+
+	type args struct {
+		config MetricsConfig
+		header http.Header
+		tls    *tls.ConnectionState
+	}
+	cases := map[string]struct {
+		reason string
+		args
+		want int
+	}{
+		"NotSecure": {
+			reason: "Metrics should be served without authentication if not in secure mode.",
+			want:   http.StatusOK,
+		},
+		"NoCredentials": {
+			reason: "Requests without credentials should be rejected in secure mode.",
+			args: args{
+				config: MetricsConfig{Secure: true, BearerToken: "s3cr3t", ClientCACertPool: certPool(ca)},
+			},
+			want: http.StatusUnauthorized,
+		},
+		"ValidBearer": {
+			reason: "Requests with the configured bearer token should be allowed.",
+			args: args{
+				config: MetricsConfig{Secure: true, BearerToken: "s3cr3t"},
+				header: http.Header{headerAuthorization: {"Bearer s3cr3t"}},
+			},
+			want: http.StatusOK,
+		},
+		"InvalidBearer": {
+			reason: "Requests with another bearer token should be rejected.",
+			args: args{
+				config: MetricsConfig{Secure: true, BearerToken: "s3cr3t"},
+				header: http.Header{headerAuthorization: {"Bearer guess"}},
+			},
+			want: http.StatusUnauthorized,
+		},
+		"ValidClientCert": {
+			reason: "Requests with a client certificate signed by the configured CA should be allowed.",
+			args: args{
+				config: MetricsConfig{Secure: true, ClientCACertPool: certPool(ca)},
+				tls:    &tls.ConnectionState{PeerCertificates: []*x509.Certificate{client.cert}},
+			},
+			want: http.StatusOK,
+		},
+		"UntrustedClientCert": {
+			reason: "Requests with a client certificate signed by another CA should be rejected.",
+			args: args{
+				config: MetricsConfig{Secure: true, ClientCACertPool: certPool(ca)},
+				tls:    &tls.ConnectionState{PeerCertificates: []*x509.Certificate{untrusted.cert}},
+			},
+			want: http.StatusUnauthorized,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			p := &Proxy{
+				config: &Config{Metrics: tc.args.config},
+				log:    logging.NewNopLogger(),
+			}
+			e := echo.New()
+			e.GET(metricsHandlerPath, func(c echo.Context) error {
+				return c.String(http.StatusOK, "metrics")
+			}, p.metricsAuth())
+
+			req := httptest.NewRequest(http.MethodGet, metricsHandlerPath, nil)
+			if tc.args.header != nil {
+				req.Header = tc.args.header
+			}
+			req.TLS = tc.args.tls
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if diff := cmp.Diff(tc.want, rec.Code); diff != "" {
+				t.Errorf("\n%s\nmetricsAuth(...): -want code, +got code:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestIdentityMetrics(t *testing.T) {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("cannot gather metrics: %v", err)
+	}
+	got := map[string]*dto.Metric{}
+	for _, mf := range mfs {
+		if len(mf.GetMetric()) > 0 {
+			got[mf.GetName()] = mf.GetMetric()[0]
+		}
+	}
+
+	st, ok := got["upbound_agent_start_time_seconds"]
+	if !ok {
+		t.Fatal("upbound_agent_start_time_seconds is not registered")
+	}
+	if v := st.GetGauge().GetValue(); v <= 0 || v > float64(time.Now().Unix()) {
+		t.Errorf("upbound_agent_start_time_seconds: unexpected value %v", v)
+	}
+
+	bi, ok := got["upbound_agent_build_info"]
+	if !ok {
+		t.Fatal("upbound_agent_build_info is not registered")
+	}
+	labels := map[string]string{}
+	for _, l := range bi.GetLabel() {
+		labels[l.GetName()] = l.GetValue()
+	}
+	want := map[string]string{"version": version.Version, "goversion": runtime.Version()}
+	if diff := cmp.Diff(want, labels); diff != "" {
+		t.Errorf("upbound_agent_build_info labels: -want, +got:\n%s", diff)
+	}
+	if diff := cmp.Diff(float64(1), bi.GetGauge().GetValue()); diff != "" {
+		t.Errorf("upbound_agent_build_info value: -want, +got:\n%s", diff)
+	}
+}
+
+func TestRuntimeMetrics(t *testing.T) {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("cannot gather metrics: %v", err)
+	}
+	got := map[string]bool{}
+	for _, mf := range mfs {
+		got[mf.GetName()] = true
+	}
+	// The process collector only reports on platforms with procfs.
+	want := []string{"go_goroutines", "go_threads", "go_gc_duration_seconds", "go_memstats_heap_alloc_bytes"}
+	if runtime.GOOS == "linux" {
+		want = append(want, "process_resident_memory_bytes", "process_open_fds")
+	}
+	for _, n := range want {
+		if !got[n] {
+			t.Errorf("%s is not registered", n)
+		}
+	}
+}
+
+func TestProxy_metricsServer(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		header http.Header
+		want   int
+	}{
+		"NoCredentials": {
+			reason: "Scrapes without the bearer token should be rejected in secure mode.",
+			want:   http.StatusUnauthorized,
+		},
+		"ValidBearer": {
+			reason: "Scrapes with the configured bearer token should be served over plain HTTP.",
+			header: http.Header{headerAuthorization: {"Bearer s3cr3t"}},
+			want:   http.StatusOK,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			p := &Proxy{config: &Config{Metrics: MetricsConfig{Secure: true, BearerToken: "s3cr3t"}}}
+			srv := httptest.NewServer(p.newMetricsServer("").Handler)
+			defer srv.Close()
+
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+metricsHandlerPath, nil)
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("GET %s: %v", metricsHandlerPath, err)
+			}
+			_ = res.Body.Close()
+			if diff := cmp.Diff(tc.want, res.StatusCode); diff != "" {
+				t.Errorf("\n%s\nstatus: -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -16,30 +16,41 @@ package upboundagent
 
 import (
 	"encoding/base64"
+	"fmt"
 	"io/ioutil"
+	"strings"
 
 	natsjwt "github.com/nats-io/jwt"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nkeys"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/upbound/nats-proxy/pkg/natsproxy"
 
 	"github.com/crossplane/crossplane-runtime/pkg/logging"
 
 	"github.com/upbound/universal-crossplane/internal/clients/upbound"
 )
 
+var natsJWTRefreshesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Subsystem: metricsNATS,
+	Name:      "jwt_refreshes_total",
+	Help:      "Number of times a NATS user JWT was fetched from Upbound API, by result.",
+}, []string{"result"})
+
 type natsConnManager struct {
 	log       logging.Logger
 	upClient  upbound.Client
 	kp        nkeys.KeyPair
 	pubKey    string
 	clusterID string
-	cpToken   string
+	cpToken   func() string
 	jwtToken  string
 	caFile    string
 }
 
-func newNATSConnManager(log logging.Logger, upClient upbound.Client, cID, cpToken string, caBundle string) (*natsConnManager, error) {
+func newNATSConnManager(log logging.Logger, upClient upbound.Client, cID string, cpToken func() string, caBundle string) (*natsConnManager, error) {
 	kp, err := nkeys.CreateUser()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create nats user")
@@ -65,6 +76,38 @@ func newNATSConnManager(log logging.Logger, upClient upbound.Client, cID, cpToke
 
 	return n, nil
 }
+
+// ConnectNATS connects to NATS, authenticating with a NATS JWT for the control
+// plane that is fetched from Upbound API.
+func ConnectNATS(config *Config, upClient upbound.Client, log logging.Logger, clusterID string) (*nats.Conn, error) {
+	return connectNATS(config, func() string { return config.NATS.ControlPlaneToken }, upClient, log, clusterID)
+}
+
+// connectNATS connects to NATS like ConnectNATS, fetching NATS JWTs with the
+// current control plane token.
+func connectNATS(config *Config, cpToken func() string, upClient upbound.Client, log logging.Logger, clusterID string) (*nats.Conn, error) {
+	natsConn, err := newNATSConnManager(log, upClient, clusterID, cpToken, config.NATS.CABundle)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create new nats connection manager")
+	}
+	nopts := []nats.Option{nats.Name(fmt.Sprintf("%s-%s", config.ControlPlaneID, config.NATS.Name))}
+	nopts = natsproxy.SetupConnOptions(nopts)
+	nopts = append(nopts, natsConn.setupAuthOption(), natsConn.setupTLSOption())
+	nopts = append(nopts, reconnectOptions(*config.NATS)...)
+	// Replaces the disconnect and reconnect handlers of nats-proxy, which only
+	// log these events.
+	d := newNATSDowntimeTracker(log)
+	nopts = append(nopts, d.options()...)
+	// The servers form the server pool of the client, which picks one of them
+	// at random and reconnects to the others once it goes down.
+	nc, err := nats.Connect(strings.Join(config.NATS.Endpoints, ","), nopts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect NATS")
+	}
+	d.established()
+	return nc, nil
+}
+
 func (n *natsConnManager) setupAuthOption() nats.Option {
 	return nats.UserJWT(n.userTokenRefresher, n.signatureHandler)
 }
@@ -76,10 +119,12 @@ func (n *natsConnManager) setupTLSOption() nats.Option {
 func (n *natsConnManager) userTokenRefresher() (string, error) {
 	n.log.Debug("handling NATS user JWT")
 	if !isJWTValid(n.jwtToken, n.log) {
-		tk, err := n.upClient.FetchNewJWTToken(n.cpToken, n.clusterID, n.pubKey)
+		tk, err := n.upClient.FetchNewJWTToken(n.cpToken(), n.clusterID, n.pubKey)
 		if err != nil {
+			natsJWTRefreshesTotal.WithLabelValues(reloadResultFailure).Inc()
 			return "", err
 		}
+		natsJWTRefreshesTotal.WithLabelValues(reloadResultSuccess).Inc()
 		n.jwtToken = tk
 	}
 	return n.jwtToken, nil
@@ -0,0 +1,162 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+)
+
+const errNATSConnectTimeout = "timed out after %s waiting for nats connection"
+
+// natsLink holds the NATS connection of the proxy, which is either
+// established at startup or, if lazy, on the first use.
+type natsLink struct {
+	log     logging.Logger
+	dial    func() (*nats.Conn, error)
+	timeout time.Duration
+	// setup is called with a newly established connection before it is used,
+	// e.g. to start listening for requests.
+	setup func(nc *nats.Conn) error
+
+	mu      sync.Mutex
+	nc      *nats.Conn
+	pending *natsDial
+}
+
+// natsDial is an attempt to establish the connection.
+type natsDial struct {
+	done chan struct{}
+	err  error
+}
+
+// current returns the connection, or nil if it is not established yet.
+func (l *natsLink) current() *nats.Conn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.nc
+}
+
+// get returns the connection, establishing it if necessary. It waits up to the
+// timeout of the link, after which the connection is still established in the
+// background for subsequent calls. Concurrent calls share a single attempt.
+func (l *natsLink) get(ctx context.Context) (*nats.Conn, error) {
+	l.mu.Lock()
+	if l.nc != nil {
+		defer l.mu.Unlock()
+		return l.nc, nil
+	}
+	d := l.pending
+	if d == nil {
+		d = &natsDial{done: make(chan struct{})}
+		l.pending = d
+		go l.establish(d)
+	}
+	l.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+	select {
+	case <-d.done:
+	case <-ctx.Done():
+		return nil, errors.Errorf(errNATSConnectTimeout, l.timeout)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return l.current(), nil
+}
+
+func (l *natsLink) establish(d *natsDial) {
+	start := time.Now()
+	nc, err := l.dial()
+	if err == nil && l.setup != nil {
+		if err = l.setup(nc); err != nil {
+			nc.Close()
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending = nil
+	d.err = err
+	if err == nil {
+		l.nc = nc
+		l.log.Info("connected to nats on demand", "url", stripCredentials(nc.ConnectedUrl()), "duration", time.Since(start).String())
+	}
+	close(d.done)
+}
+
+// middleware returns a middleware that establishes the connection on the first
+// request. Requests are handled even if it cannot be established, since they
+// do not depend on it, and the next request tries again.
+func (l *natsLink) middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if _, err := l.get(c.Request().Context()); err != nil {
+				l.log.Info("cannot connect to nats on demand", "error", err)
+			}
+			return next(c)
+		}
+	}
+}
+
+// connected returns whether the connection is established and connected.
+func (l *natsLink) connected() bool {
+	nc := l.current()
+	return nc != nil && nc.IsConnected()
+}
+
+// connectedURL returns the URL of the NATS server the connection is currently
+// connected to, without credentials, or an empty string if not connected.
+func (l *natsLink) connectedURL() string {
+	nc := l.current()
+	if nc == nil {
+		return ""
+	}
+	return stripCredentials(nc.ConnectedUrl())
+}
+
+// closed returns whether the connection was established but closed for good
+// since, e.g. after giving up to re-establish it.
+func (l *natsLink) closed() bool {
+	nc := l.current()
+	return nc != nil && nc.IsClosed()
+}
+
+// stats returns the statistics of the connection, which are zero until it is
+// established.
+func (l *natsLink) stats() nats.Statistics {
+	if nc := l.current(); nc != nil {
+		return nc.Stats()
+	}
+	return nats.Statistics{}
+}
+
+// buffered returns the number of bytes buffered while the connection is
+// re-established, which is zero until it is established.
+func (l *natsLink) buffered() (int, error) {
+	if nc := l.current(); nc != nil {
+		return nc.Buffered()
+	}
+	return 0, nil
+}
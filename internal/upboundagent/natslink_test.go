@@ -0,0 +1,247 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/labstack/echo/v4"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+func TestNATSLink_get(t *testing.T) {
+	var dials int32
+	nc := &nats.Conn{}
+	var setup *nats.Conn
+	l := &natsLink{
+		log:     &recordingLogger{},
+		timeout: 5 * time.Second,
+		dial: func() (*nats.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return nc, nil
+		},
+		setup: func(c *nats.Conn) error {
+			setup = c
+			return nil
+		},
+	}
+	if l.current() != nil {
+		t.Fatal("current(): want no connection before first use")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := l.get(context.Background())
+			if err != nil || got != nc {
+				t.Errorf("get(...): want connection, got %v, %v", got, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := l.get(context.Background()); err != nil {
+		t.Fatalf("get(...): %v", err)
+	}
+	if diff := cmp.Diff(int32(1), atomic.LoadInt32(&dials)); diff != "" {
+		t.Errorf("get(...): -want dials, +got dials:\n%s", diff)
+	}
+	if setup != nc {
+		t.Error("get(...): want connection to be set up before use")
+	}
+}
+
+func TestNATSLink_getTimeout(t *testing.T) {
+	release := make(chan struct{})
+	nc := &nats.Conn{}
+	l := &natsLink{
+		log:     &recordingLogger{},
+		timeout: 10 * time.Millisecond,
+		dial: func() (*nats.Conn, error) {
+			<-release
+			return nc, nil
+		},
+	}
+	if _, err := l.get(context.Background()); err == nil {
+		t.Fatal("get(...): want error if not connected within timeout")
+	}
+
+	// The connection is still established after the timeout.
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for l.current() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("current(): connection was not established after timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNATSLink_getRetry(t *testing.T) {
+	errBoom := errors.New("boom")
+	nc := &nats.Conn{}
+	var dials int32
+	l := &natsLink{
+		log:     &recordingLogger{},
+		timeout: 5 * time.Second,
+		dial: func() (*nats.Conn, error) {
+			if atomic.AddInt32(&dials, 1) == 1 {
+				return nil, errBoom
+			}
+			return nc, nil
+		},
+	}
+	if _, err := l.get(context.Background()); !errors.Is(err, errBoom) {
+		t.Fatalf("get(...): want %v, got %v", errBoom, err)
+	}
+	if got, err := l.get(context.Background()); err != nil || got != nc {
+		t.Errorf("get(...): want connection on retry, got %v, %v", got, err)
+	}
+}
+
+func TestNATSLink_middleware(t *testing.T) {
+	cases := map[string]struct {
+		reason    string
+		dialErr   error
+		connected bool
+	}{
+		"Connected": {
+			reason:    "The first request should establish the connection.",
+			connected: true,
+		},
+		"DialFailed": {
+			reason:  "Requests should be handled even if the connection cannot be established.",
+			dialErr: errors.New("boom"),
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			l := &natsLink{
+				log:     &recordingLogger{},
+				timeout: 5 * time.Second,
+				dial: func() (*nats.Conn, error) {
+					if tc.dialErr != nil {
+						return nil, tc.dialErr
+					}
+					return &nats.Conn{}, nil
+				},
+			}
+			e := echo.New()
+			e.GET("/k8s/api", func(c echo.Context) error { return c.NoContent(http.StatusOK) }, l.middleware())
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/k8s/api", nil))
+
+			if diff := cmp.Diff(http.StatusOK, rec.Code); diff != "" {
+				t.Errorf("\n%s\nmiddleware(): -want status, +got status:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.connected, l.current() != nil); diff != "" {
+				t.Errorf("\n%s\nmiddleware(): -want connection, +got connection:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestProxy_probesNotConnectedLazily(t *testing.T) {
+	p := &Proxy{config: &Config{LazyNATSConnect: true}, natsConn: &natsLink{}, isReady: &atomic.Value{}, cpToken: &tokenStore{token: validJWTToken}}
+	p.isReady.Store(true)
+	e := echo.New()
+	e.GET(readynessHandlerPath, p.readyz())
+	e.GET(livenessHandlerPath, p.livez())
+
+	for _, path := range []string{readynessHandlerPath, livenessHandlerPath} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if diff := cmp.Diff(http.StatusOK, rec.Code); diff != "" {
+			t.Errorf("%s: -want status, +got status:\n%s", path, diff)
+		}
+		body := map[string]interface{}{}
+		_ = json.Unmarshal(rec.Body.Bytes(), &body)
+		if diff := cmp.Diff(false, body["nats-connected"]); diff != "" {
+			t.Errorf("%s: -want nats-connected, +got nats-connected:\n%s", path, diff)
+		}
+		if path == readynessHandlerPath {
+			if diff := cmp.Diff(true, body["nats-lazy-connect"]); diff != "" {
+				t.Errorf("%s: -want nats-lazy-connect, +got nats-lazy-connect:\n%s", path, diff)
+			}
+		}
+	}
+}
+
+func TestProxy_probesNATSDisabled(t *testing.T) {
+	p := &Proxy{config: &Config{DisableNATS: true}, natsConn: &natsLink{}, isReady: &atomic.Value{}, cpToken: &tokenStore{token: validJWTToken}}
+	p.isReady.Store(true)
+	e := echo.New()
+	e.GET(readynessHandlerPath, p.readyz())
+	e.GET(livenessHandlerPath, p.livez())
+
+	for _, path := range []string{readynessHandlerPath, livenessHandlerPath} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if diff := cmp.Diff(http.StatusOK, rec.Code); diff != "" {
+			t.Errorf("%s: -want status, +got status:\n%s", path, diff)
+		}
+		body := map[string]interface{}{}
+		_ = json.Unmarshal(rec.Body.Bytes(), &body)
+		if diff := cmp.Diff(true, body["nats-disabled"]); diff != "" {
+			t.Errorf("%s: -want nats-disabled, +got nats-disabled:\n%s", path, diff)
+		}
+	}
+}
+
+func TestProxy_readyzReportsNATSServer(t *testing.T) {
+	s := newFakeNATSServer(t)
+	defer s.ln.Close() // nolint:errcheck
+	defer close(s.pong)
+
+	// Nothing listens on the first server, so the client fails over to the
+	// second one of its server pool.
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	downURL := "nats://" + down.Addr().String()
+	_ = down.Close()
+	upURL := "nats://" + s.ln.Addr().String()
+	nc, err := nats.Connect(strings.Join([]string{downURL, upURL}, ","), nats.DontRandomize(), nats.NoReconnect())
+	if err != nil {
+		t.Fatalf("cannot connect to fake nats server: %v", err)
+	}
+	defer nc.Close()
+
+	p := &Proxy{config: &Config{}, natsConn: &natsLink{nc: nc}, isReady: &atomic.Value{}, cpToken: &tokenStore{token: validJWTToken}}
+	p.isReady.Store(true)
+	e := echo.New()
+	e.GET(readynessHandlerPath, p.readyz())
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, readynessHandlerPath, nil))
+
+	body := map[string]interface{}{}
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	if diff := cmp.Diff(upURL, body["nats-server"]); diff != "" {
+		t.Errorf("readyz(): -want nats-server, +got nats-server:\n%s", diff)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+const errNATSPayloadTooLarge = "request body exceeds the nats max payload of %d bytes"
+
+// limitNATSPayload returns a handler that rejects requests relayed over NATS
+// with 413 Payload Too Large if their body exceeds the given max payload of the
+// connection, so that clients get an actionable error. Bodies of relayed
+// requests are already in memory, so reading them up front to check their size
+// is cheap.
+func limitNATSPayload(next http.Handler, max int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if max <= 0 || r.Body == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > max {
+			http.Error(w, fmt.Sprintf(errNATSPayloadTooLarge, max), http.StatusRequestEntityTooLarge)
+			return
+		}
+		b, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+		_ = r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if int64(len(b)) > max {
+			http.Error(w, fmt.Sprintf(errNATSPayloadTooLarge, max), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(b))
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_limitNATSPayload(t *testing.T) {
+	type want struct {
+		status int
+		body   string
+	}
+	cases := map[string]struct {
+		reason        string
+		max           int64
+		body          string
+		contentLength int64
+		want          want
+	}{
+		"WithinLimit": {
+			reason:        "Requests whose body is within the max payload should be handled with their body intact.",
+			max:           8,
+			body:          "12345678",
+			contentLength: 8,
+			want:          want{status: http.StatusOK, body: "12345678"},
+		},
+		"OversizedContentLength": {
+			reason:        "Requests whose declared content length exceeds the max payload should be rejected.",
+			max:           8,
+			body:          "123456789",
+			contentLength: 9,
+			want:          want{status: http.StatusRequestEntityTooLarge, body: fmt.Sprintf(errNATSPayloadTooLarge, 8) + "\n"},
+		},
+		"OversizedBody": {
+			reason:        "Requests whose body exceeds the max payload should be rejected even without a content length.",
+			max:           8,
+			body:          "123456789",
+			contentLength: -1,
+			want:          want{status: http.StatusRequestEntityTooLarge, body: fmt.Sprintf(errNATSPayloadTooLarge, 8) + "\n"},
+		},
+		"NoLimit": {
+			reason:        "Requests should not be limited without a max payload.",
+			body:          "123456789",
+			contentLength: 9,
+			want:          want{status: http.StatusOK, body: "123456789"},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			h := limitNATSPayload(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.Copy(w, r.Body)
+			}), tc.max)
+			req := httptest.NewRequest(http.MethodPost, "/k8s/api/v1/namespaces/default/configmaps", strings.NewReader(tc.body))
+			req.ContentLength = tc.contentLength
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			got := want{status: rec.Code, body: rec.Body.String()}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(want{})); diff != "" {
+				t.Errorf("\n%s\nlimitNATSPayload(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
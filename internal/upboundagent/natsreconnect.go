@@ -0,0 +1,79 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	defaultNATSReconnectWait    = time.Second
+	defaultNATSMaxReconnectWait = 30 * time.Second
+)
+
+// natsReconnectBackoff computes the wait before an attempt to re-establish the
+// NATS connection. The wait doubles with every attempt, capped at max, and is
+// extended by a random fraction of up to jitter to spread out the reconnects
+// of many agents after an outage.
+type natsReconnectBackoff struct {
+	wait   time.Duration
+	max    time.Duration
+	jitter float64
+	rand   func() float64
+}
+
+func newNATSReconnectBackoff(c NATSClientConfig) *natsReconnectBackoff {
+	b := &natsReconnectBackoff{wait: c.ReconnectWait, max: c.MaxReconnectWait, jitter: c.ReconnectJitter, rand: rand.Float64} // nolint:gosec
+	if b.wait <= 0 {
+		b.wait = defaultNATSReconnectWait
+	}
+	if b.max <= 0 {
+		b.max = defaultNATSMaxReconnectWait
+	}
+	if b.max < b.wait {
+		b.max = b.wait
+	}
+	return b
+}
+
+// delay returns the wait before the given attempt, counting from one.
+func (b *natsReconnectBackoff) delay(attempts int) time.Duration {
+	d := b.wait
+	for i := 1; i < attempts && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+	return d + time.Duration(b.jitter*b.rand()*float64(d))
+}
+
+// reconnectOptions returns the NATS options that apply the reconnect policy
+// of the given config. They replace the fixed policy of nats-proxy, which
+// gives up after ten minutes.
+func reconnectOptions(c NATSClientConfig) []nats.Option {
+	maxReconnects := c.MaxReconnects
+	if maxReconnects <= 0 {
+		// A negative number of reconnects has NATS retry forever.
+		maxReconnects = -1
+	}
+	return []nats.Option{
+		nats.MaxReconnects(maxReconnects),
+		nats.CustomReconnectDelay(newNATSReconnectBackoff(c).delay),
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nats-io/nats.go"
+)
+
+func TestNATSReconnectBackoff_delay(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		config NATSClientConfig
+		rand   float64
+		want   []time.Duration
+	}{
+		"Defaults": {
+			reason: "The wait should start at one second and double up to 30 seconds by default.",
+			want:   []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second},
+		},
+		"Jitter": {
+			reason: "The jitter should add the random fraction of the wait.",
+			config: NATSClientConfig{ReconnectWait: time.Second, MaxReconnectWait: 4 * time.Second, ReconnectJitter: 0.2},
+			rand:   0.5,
+			want:   []time.Duration{1100 * time.Millisecond, 2200 * time.Millisecond, 4400 * time.Millisecond, 4400 * time.Millisecond},
+		},
+		"MaxBelowWait": {
+			reason: "A max wait below the wait should not shorten the wait.",
+			config: NATSClientConfig{ReconnectWait: 5 * time.Second, MaxReconnectWait: time.Second},
+			want:   []time.Duration{5 * time.Second, 5 * time.Second},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			b := newNATSReconnectBackoff(tc.config)
+			b.rand = func() float64 { return tc.rand }
+			got := make([]time.Duration, len(tc.want))
+			for i := range got {
+				got[i] = b.delay(i + 1)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("\n%s\ndelay(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestReconnectOptions(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		config NATSClientConfig
+		want   int
+	}{
+		"Unlimited": {
+			reason: "Reconnects should be unlimited by default.",
+			want:   -1,
+		},
+		"Limited": {
+			reason: "The configured number of reconnects should be passed on.",
+			config: NATSClientConfig{MaxReconnects: 10},
+			want:   10,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			o := nats.GetDefaultOptions()
+			for _, opt := range reconnectOptions(tc.config) {
+				if err := opt(&o); err != nil {
+					t.Fatalf("option: %v", err)
+				}
+			}
+			if diff := cmp.Diff(tc.want, o.MaxReconnect); diff != "" {
+				t.Errorf("\n%s\nMaxReconnect: -want, +got:\n%s", tc.reason, diff)
+			}
+			if o.CustomReconnectDelayCB == nil {
+				t.Errorf("\n%s\nCustomReconnectDelayCB: want the backoff, got nil", tc.reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+)
+
+const (
+	metricsNamespace = "upbound_agent"
+	metricsNATS      = "nats"
+)
+
+// natsMetrics are the metrics exported from the statistics of the NATS
+// connection.
+type natsMetrics struct {
+	inMsgs     prometheus.Counter
+	outMsgs    prometheus.Counter
+	inBytes    prometheus.Counter
+	outBytes   prometheus.Counter
+	reconnects prometheus.Counter
+	// reconnectBuffer is a gauge, since the buffer drains once reconnected.
+	reconnectBuffer prometheus.Gauge
+}
+
+func newNATSMetrics() *natsMetrics {
+	c := func(name, help string) prometheus.Counter {
+		return prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsNATS,
+			Name:      name,
+			Help:      help,
+		})
+	}
+	return &natsMetrics{
+		inMsgs:     c("in_messages_total", "Number of messages received over the NATS connection."),
+		outMsgs:    c("out_messages_total", "Number of messages sent over the NATS connection."),
+		inBytes:    c("in_bytes_total", "Number of payload bytes received over the NATS connection."),
+		outBytes:   c("out_bytes_total", "Number of payload bytes sent over the NATS connection."),
+		reconnects: c("reconnects_total", "Number of times the NATS connection was re-established."),
+		reconnectBuffer: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsNATS,
+			Name:      "reconnect_buffer_bytes",
+			Help:      "Number of bytes of outgoing messages currently buffered while the NATS connection is re-established.",
+		}),
+	}
+}
+
+func (m *natsMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.inMsgs, m.outMsgs, m.inBytes, m.outBytes, m.reconnects, m.reconnectBuffer}
+}
+
+var defaultNATSMetrics = newNATSMetrics()
+
+var natsReconnectDowntimeSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Namespace: metricsNamespace,
+	Subsystem: metricsNATS,
+	Name:      "reconnect_downtime_seconds",
+	Help:      "Time the NATS connection was down before it was re-established.",
+	Buckets:   []float64{0.5, 1, 2, 5, 10, 30, 60, 120, 300, 600},
+})
+
+var natsConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Subsystem: metricsNATS,
+	Name:      "connected",
+	Help:      "Whether the NATS connection is currently established, one if so and zero otherwise.",
+})
+
+// natsStatsExporter exports the statistics of a NATS connection, which are
+// cumulative over its lifetime, by adding their increase since the last update
+// to the metrics. The size of the reconnect buffer is exported as is, if
+// buffered is set.
+type natsStatsExporter struct {
+	metrics  *natsMetrics
+	stats    func() nats.Statistics
+	buffered func() (int, error)
+	last     nats.Statistics
+}
+
+func (x *natsStatsExporter) update() {
+	cur := x.stats()
+	x.metrics.inMsgs.Add(delta(cur.InMsgs, x.last.InMsgs))
+	x.metrics.outMsgs.Add(delta(cur.OutMsgs, x.last.OutMsgs))
+	x.metrics.inBytes.Add(delta(cur.InBytes, x.last.InBytes))
+	x.metrics.outBytes.Add(delta(cur.OutBytes, x.last.OutBytes))
+	x.metrics.reconnects.Add(delta(cur.Reconnects, x.last.Reconnects))
+	x.last = cur
+	if x.buffered != nil {
+		// Nothing is buffered once the connection is closed.
+		b, err := x.buffered()
+		if err != nil {
+			b = 0
+		}
+		x.metrics.reconnectBuffer.Set(float64(b))
+	}
+}
+
+// run updates the metrics on the given interval until the context is done.
+func (x *natsStatsExporter) run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			x.update()
+		}
+	}
+}
+
+// delta returns the increase from last to cur, treating a decrease as a reset
+// of the statistics.
+func delta(cur, last uint64) float64 {
+	if cur < last {
+		return float64(cur)
+	}
+	return float64(cur - last)
+}
+
+// natsDowntimeTracker measures how long the NATS connection was down between
+// being disconnected and reconnected.
+type natsDowntimeTracker struct {
+	log       logging.Logger
+	downtime  prometheus.Observer
+	connected prometheus.Gauge
+	now       func() time.Time
+
+	mu             sync.Mutex
+	disconnectedAt time.Time
+}
+
+func newNATSDowntimeTracker(log logging.Logger) *natsDowntimeTracker {
+	return &natsDowntimeTracker{log: log, downtime: natsReconnectDowntimeSeconds, connected: natsConnected, now: time.Now}
+}
+
+// options returns the NATS options that notify the tracker about disconnects,
+// reconnects and the connection being closed for good.
+func (d *natsDowntimeTracker) options() []nats.Option {
+	return []nats.Option{
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			d.disconnected(err)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			d.reconnected(stripCredentials(nc.ConnectedUrl()))
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			d.closed(nc.LastError())
+		}),
+	}
+}
+
+// established notifies the tracker that the initial connection is
+// established.
+func (d *natsDowntimeTracker) established() {
+	d.connected.Set(1)
+}
+
+func (d *natsDowntimeTracker) disconnected(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// Keep the first disconnect if notified again before a reconnect.
+	if d.disconnectedAt.IsZero() {
+		d.disconnectedAt = d.now()
+	}
+	d.connected.Set(0)
+	d.log.Info("disconnected from nats", "error", err)
+}
+
+func (d *natsDowntimeTracker) reconnected(url string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.connected.Set(1)
+	if d.disconnectedAt.IsZero() {
+		d.log.Info("reconnected to nats", "url", url)
+		return
+	}
+	down := d.now().Sub(d.disconnectedAt)
+	d.disconnectedAt = time.Time{}
+	d.downtime.Observe(down.Seconds())
+	d.log.Info("reconnected to nats", "url", url, "downtime", down.String())
+}
+
+func (d *natsDowntimeTracker) closed(err error) {
+	d.connected.Set(0)
+	d.log.Info("nats connection closed, not reconnecting anymore", "error", err)
+}
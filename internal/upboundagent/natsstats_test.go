@@ -0,0 +1,215 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+)
+
+func TestNATSStatsExporter_update(t *testing.T) {
+	type counters struct {
+		InMsgs, OutMsgs, InBytes, OutBytes, Reconnects float64
+	}
+	cases := map[string]struct {
+		reason string
+		stats  []nats.Statistics
+		want   counters
+	}{
+		"Initial": {
+			reason: "The first update should export the statistics as they are.",
+			stats:  []nats.Statistics{{InMsgs: 3, OutMsgs: 2, InBytes: 300, OutBytes: 200, Reconnects: 1}},
+			want:   counters{InMsgs: 3, OutMsgs: 2, InBytes: 300, OutBytes: 200, Reconnects: 1},
+		},
+		"Increase": {
+			reason: "Later updates should only add the increase since the last update.",
+			stats: []nats.Statistics{
+				{InMsgs: 3, OutMsgs: 2, InBytes: 300, OutBytes: 200},
+				{InMsgs: 5, OutMsgs: 2, InBytes: 500, OutBytes: 200, Reconnects: 2},
+			},
+			want: counters{InMsgs: 5, OutMsgs: 2, InBytes: 500, OutBytes: 200, Reconnects: 2},
+		},
+		"Reset": {
+			reason: "A decrease should be treated as a reset of the statistics.",
+			stats: []nats.Statistics{
+				{InMsgs: 10},
+				{InMsgs: 4},
+			},
+			want: counters{InMsgs: 14},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := newNATSMetrics()
+			i := 0
+			x := &natsStatsExporter{metrics: m, stats: func() nats.Statistics {
+				s := tc.stats[i]
+				i++
+				return s
+			}}
+			for range tc.stats {
+				x.update()
+			}
+			got := counters{
+				InMsgs:     testutil.ToFloat64(m.inMsgs),
+				OutMsgs:    testutil.ToFloat64(m.outMsgs),
+				InBytes:    testutil.ToFloat64(m.inBytes),
+				OutBytes:   testutil.ToFloat64(m.outBytes),
+				Reconnects: testutil.ToFloat64(m.reconnects),
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("\n%s\nupdate(): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestNATSStatsExporter_updateReconnectBuffer(t *testing.T) {
+	cases := map[string]struct {
+		reason   string
+		buffered []int
+		err      error
+		want     float64
+	}{
+		"Buffering": {
+			reason:   "The reconnect buffer should reflect the current size as it grows.",
+			buffered: []int{100, 300},
+			want:     300,
+		},
+		"Drained": {
+			reason:   "The reconnect buffer should be empty once it drained after reconnecting.",
+			buffered: []int{300, 0},
+			want:     0,
+		},
+		"Closed": {
+			reason:   "The reconnect buffer should be empty once the connection is closed.",
+			buffered: []int{300, 0},
+			err:      nats.ErrConnectionClosed,
+			want:     0,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := newNATSMetrics()
+			i := 0
+			x := &natsStatsExporter{
+				metrics: m,
+				stats:   func() nats.Statistics { return nats.Statistics{} },
+				buffered: func() (int, error) {
+					b := tc.buffered[i]
+					i++
+					if i == len(tc.buffered) && tc.err != nil {
+						return -1, tc.err
+					}
+					return b, nil
+				},
+			}
+			for range tc.buffered {
+				x.update()
+			}
+			if diff := cmp.Diff(tc.want, testutil.ToFloat64(m.reconnectBuffer)); diff != "" {
+				t.Errorf("\n%s\nupdate(): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestNATSDowntimeTracker(t *testing.T) {
+	start := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	cases := map[string]struct {
+		reason string
+		// events are disconnects (true) and reconnects (false) at the offset
+		// from start.
+		events []natsEvent
+		want   []float64
+	}{
+		"Reconnect": {
+			reason: "Downtime should be the time between disconnect and reconnect.",
+			events: []natsEvent{{0, true}, {5 * time.Second, false}},
+			want:   []float64{5},
+		},
+		"RepeatedDisconnect": {
+			reason: "Downtime should start from the first disconnect before a reconnect.",
+			events: []natsEvent{{0, true}, {2 * time.Second, true}, {7 * time.Second, false}},
+			want:   []float64{7},
+		},
+		"MultipleOutages": {
+			reason: "Each outage should be measured separately.",
+			events: []natsEvent{{0, true}, {time.Second, false}, {time.Minute, true}, {time.Minute + 30*time.Second, false}},
+			want:   []float64{1, 30},
+		},
+		"ReconnectWithoutDisconnect": {
+			reason: "A reconnect without a preceding disconnect should not be measured.",
+			events: []natsEvent{{time.Second, false}},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var now time.Time
+			obs := &recordingObserver{}
+			d := &natsDowntimeTracker{log: logging.NewNopLogger(), downtime: obs, connected: prometheus.NewGauge(prometheus.GaugeOpts{Name: "connected"}), now: func() time.Time { return now }}
+			for _, e := range tc.events {
+				now = start.Add(e.at)
+				if e.disconnect {
+					d.disconnected(errors.New("connection reset"))
+					continue
+				}
+				d.reconnected("tls://nats.upbound.io:4222")
+			}
+			if diff := cmp.Diff(tc.want, obs.values); diff != "" {
+				t.Errorf("\n%s\ndowntime: -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+type natsEvent struct {
+	at         time.Duration
+	disconnect bool
+}
+
+type recordingObserver struct {
+	values []float64
+}
+
+func (o *recordingObserver) Observe(v float64) {
+	o.values = append(o.values, v)
+}
+
+func TestNATSDowntimeTracker_connected(t *testing.T) {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "connected"})
+	d := &natsDowntimeTracker{log: logging.NewNopLogger(), downtime: &recordingObserver{}, connected: g, now: time.Now}
+
+	var got []float64
+	track := func(f func()) {
+		f()
+		got = append(got, testutil.ToFloat64(g))
+	}
+	track(d.established)
+	track(func() { d.disconnected(errors.New("connection reset")) })
+	track(func() { d.reconnected("tls://nats.upbound.io:4222") })
+	track(func() { d.closed(nats.ErrConnectionClosed) })
+	if diff := cmp.Diff([]float64{1, 0, 1, 0}, got); diff != "" {
+		t.Errorf("connected: -want, +got:\n%s", diff)
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"context"
+	"math"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric/number"
+	"go.opentelemetry.io/otel/metric/sdkapi"
+	export "go.opentelemetry.io/otel/sdk/export/metric"
+	"go.opentelemetry.io/otel/sdk/export/metric/aggregation"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	"go.opentelemetry.io/otel/sdk/resource"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	"github.com/upbound/universal-crossplane/internal/version"
+)
+
+const (
+	otlpMetricsPath   = "/v1/metrics"
+	otlpExportTimeout = 10 * time.Second
+	otlpServiceName   = "upbound-agent"
+)
+
+const (
+	errParseOTLPEndpoint = "cannot parse otel metrics endpoint"
+	errNewOTLPExporter   = "cannot create otel metrics exporter"
+)
+
+// otlpExporter periodically pushes the metrics registered with a Prometheus
+// gatherer to an OpenTelemetry collector, using the OTLP over HTTP exporter of
+// the OpenTelemetry SDK. The metrics are thus only defined once, as Prometheus
+// collectors, and can be scraped, pushed, or both.
+type otlpExporter struct {
+	endpoint string
+	exporter *otlpmetric.Exporter
+	resource *resource.Resource
+	gatherer prometheus.Gatherer
+	log      logging.Logger
+
+	// start is the start time of cumulative metrics.
+	start time.Time
+	now   func() time.Time
+}
+
+// newOTLPExporter returns an exporter that pushes the metrics registered with
+// the default Prometheus registry to the given endpoint. The OTLP metrics path
+// is appended to endpoints without a path.
+func newOTLPExporter(endpoint string, log logging.Logger) (*otlpExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.Errorf("%s: %s", errParseOTLPEndpoint, endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = otlpMetricsPath
+	}
+	opts := []otlpmetrichttp.Option{
+		otlpmetrichttp.WithEndpoint(u.Host),
+		otlpmetrichttp.WithURLPath(u.Path),
+		otlpmetrichttp.WithTimeout(otlpExportTimeout),
+		// Failed pushes are retried with the values at the next interval.
+		otlpmetrichttp.WithMaxAttempts(1),
+	}
+	if u.Scheme == "http" {
+		opts = append(opts, otlpmetrichttp.WithInsecure())
+	}
+	exp, err := otlpmetrichttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, errNewOTLPExporter)
+	}
+	return &otlpExporter{
+		endpoint: u.String(),
+		exporter: exp,
+		resource: resource.NewSchemaless(
+			attribute.String("service.name", otlpServiceName),
+			attribute.String("service.version", version.Version),
+		),
+		gatherer: prometheus.DefaultGatherer,
+		log:      log,
+		start:    time.Now(),
+		now:      time.Now,
+	}, nil
+}
+
+// run exports the metrics on the given interval until the context is done, and
+// a last time then so that the final values are not lost on shutdown.
+func (x *otlpExporter) run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			ctx, cancel := context.WithTimeout(context.Background(), otlpExportTimeout)
+			defer cancel()
+			if err := x.export(ctx); err != nil {
+				x.log.Info("cannot export final metrics", "error", err)
+			}
+			if err := x.exporter.Shutdown(ctx); err != nil {
+				x.log.Debug("cannot shut down otel metrics exporter", "error", err)
+			}
+			return
+		case <-t.C:
+			if err := x.export(ctx); err != nil {
+				x.log.Info("cannot export metrics", "endpoint", x.endpoint, "error", err)
+			}
+		}
+	}
+}
+
+// runInBackground runs the exporter in the background until the given context is done,
+// and returns a function that stops it and waits for its final export, which
+// is bounded by its timeout.
+func (x *otlpExporter) runInBackground(ctx context.Context, interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		x.run(ctx, interval)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// export pushes the current values of all metrics.
+func (x *otlpExporter) export(ctx context.Context) error {
+	mfs, err := x.gatherer.Gather()
+	if err != nil {
+		return errors.Wrap(err, "cannot gather metrics")
+	}
+	r := &prometheusReader{families: mfs, start: x.start, now: x.now()}
+	return errors.Wrap(x.exporter.Export(ctx, x.resource, library{reader: r}), "cannot export metrics")
+}
+
+// prometheusReader reads gathered Prometheus metrics as the records of an
+// OpenTelemetry metrics export. Counters become monotonic cumulative sums,
+// gauges and untyped metrics become gauges, and histograms become cumulative
+// histograms. Summaries have no equivalent in the SDK and are not exported.
+type prometheusReader struct {
+	sync.RWMutex
+	families []*dto.MetricFamily
+	start    time.Time
+	now      time.Time
+}
+
+// library reads all metrics as those of a single instrumentation library.
+type library struct {
+	reader export.Reader
+}
+
+func (l library) ForEach(fn func(instrumentation.Library, export.Reader) error) error {
+	return fn(instrumentation.Library{Name: otlpServiceName, Version: version.Version}, l.reader)
+}
+
+// ForEach calls fn with the record of each metric. Records are always
+// cumulative, which is what Prometheus counters and histograms are, so the
+// temporality selector is ignored.
+func (r *prometheusReader) ForEach(_ aggregation.TemporalitySelector, fn func(export.Record) error) error {
+	for _, mf := range r.families {
+		for _, m := range mf.GetMetric() {
+			rec, ok := r.record(mf, m)
+			if !ok {
+				continue
+			}
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *prometheusReader) record(mf *dto.MetricFamily, m *dto.Metric) (export.Record, bool) {
+	var kind sdkapi.InstrumentKind
+	var agg aggregation.Aggregation
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		kind, agg = sdkapi.CounterObserverInstrumentKind, sum(m.GetCounter().GetValue())
+	case dto.MetricType_GAUGE:
+		kind, agg = sdkapi.GaugeObserverInstrumentKind, lastValue{value: m.GetGauge().GetValue(), time: r.now}
+	case dto.MetricType_UNTYPED:
+		kind, agg = sdkapi.GaugeObserverInstrumentKind, lastValue{value: m.GetUntyped().GetValue(), time: r.now}
+	case dto.MetricType_HISTOGRAM:
+		kind, agg = sdkapi.HistogramInstrumentKind, newHistogram(m.GetHistogram())
+	default:
+		return export.Record{}, false
+	}
+	desc := sdkapi.NewDescriptor(mf.GetName(), kind, number.Float64Kind, mf.GetHelp(), "")
+	attrs := make([]attribute.KeyValue, len(m.GetLabel()))
+	for i, l := range m.GetLabel() {
+		attrs[i] = attribute.String(l.GetName(), l.GetValue())
+	}
+	labels := attribute.NewSet(attrs...)
+	return export.NewRecord(&desc, &labels, agg, r.start, r.now), true
+}
+
+// sum is the aggregation of a Prometheus counter.
+type sum float64
+
+func (s sum) Kind() aggregation.Kind { return aggregation.SumKind }
+
+func (s sum) Sum() (number.Number, error) { return number.NewFloat64Number(float64(s)), nil }
+
+// lastValue is the aggregation of a Prometheus gauge.
+type lastValue struct {
+	value float64
+	time  time.Time
+}
+
+func (v lastValue) Kind() aggregation.Kind { return aggregation.LastValueKind }
+
+func (v lastValue) LastValue() (number.Number, time.Time, error) {
+	return number.NewFloat64Number(v.value), v.time, nil
+}
+
+// histogram is the aggregation of a Prometheus histogram.
+type histogram struct {
+	count   uint64
+	sum     float64
+	buckets aggregation.Buckets
+}
+
+// newHistogram converts the cumulative buckets of a Prometheus histogram to
+// the per bucket counts of OpenTelemetry. OpenTelemetry has an implicit +Inf
+// bucket, which Prometheus only has if it was given explicitly.
+func newHistogram(h *dto.Histogram) histogram {
+	out := histogram{count: h.GetSampleCount(), sum: h.GetSampleSum(), buckets: aggregation.Buckets{Boundaries: []float64{}, Counts: []uint64{}}}
+	var last uint64
+	for _, b := range h.GetBucket() {
+		if math.IsInf(b.GetUpperBound(), 1) {
+			break
+		}
+		out.buckets.Boundaries = append(out.buckets.Boundaries, b.GetUpperBound())
+		out.buckets.Counts = append(out.buckets.Counts, b.GetCumulativeCount()-last)
+		last = b.GetCumulativeCount()
+	}
+	out.buckets.Counts = append(out.buckets.Counts, h.GetSampleCount()-last)
+	return out
+}
+
+func (h histogram) Kind() aggregation.Kind { return aggregation.HistogramKind }
+
+func (h histogram) Count() (uint64, error) { return h.count, nil }
+
+func (h histogram) Sum() (number.Number, error) { return number.NewFloat64Number(h.sum), nil }
+
+func (h histogram) Histogram() (aggregation.Buckets, error) { return h.buckets, nil }
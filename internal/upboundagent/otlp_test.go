@@ -0,0 +1,206 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	"github.com/upbound/universal-crossplane/internal/version"
+)
+
+func Test_newOTLPExporter(t *testing.T) {
+	cases := map[string]struct {
+		reason   string
+		endpoint string
+		want     string
+		wantErr  bool
+	}{
+		"NoPath": {
+			reason:   "The OTLP metrics path should be appended to endpoints without a path.",
+			endpoint: "http://otel-collector:4318",
+			want:     "http://otel-collector:4318/v1/metrics",
+		},
+		"Path": {
+			reason:   "The path of endpoints with a path should be kept.",
+			endpoint: "https://otel.example.com/otlp/v1/metrics",
+			want:     "https://otel.example.com/otlp/v1/metrics",
+		},
+		"NoScheme": {
+			reason:   "Endpoints without a scheme should be rejected.",
+			endpoint: "otel-collector:4318",
+			wantErr:  true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			x, err := newOTLPExporter(tc.endpoint, logging.NewNopLogger())
+			if diff := cmp.Diff(tc.wantErr, err != nil); diff != "" {
+				t.Fatalf("\n%s\nnewOTLPExporter(...): -want error, +got error:\n%s\nerror: %v", tc.reason, diff, err)
+			}
+			if err == nil && x.endpoint != tc.want {
+				t.Errorf("\n%s\nnewOTLPExporter(...): want endpoint %s, got %s", tc.reason, tc.want, x.endpoint)
+			}
+		})
+	}
+}
+
+func TestOTLPExporter_export(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total", Help: "Requests."}, []string{"code"})
+	depth := prometheus.NewGauge(prometheus.GaugeOpts{Name: "queue_depth", Help: "Depth."})
+	latency := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "latency_seconds", Help: "Latency.", Buckets: []float64{0.1, 1}})
+	size := prometheus.NewSummary(prometheus.SummaryOpts{Name: "size_bytes", Help: "Size.", Objectives: map[float64]float64{0.5: 0.05}})
+	reg.MustRegister(requests, depth, latency, size)
+	requests.WithLabelValues("200").Add(3)
+	depth.Set(2)
+	for _, v := range []float64{0.05, 0.5, 0.5, 5} {
+		latency.Observe(v)
+	}
+	size.Observe(4)
+
+	got := &collectorpb.ExportMetricsServiceRequest{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != otlpMetricsPath || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		if err := proto.Unmarshal(b, got); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	x, err := newOTLPExporter(srv.URL, logging.NewNopLogger())
+	if err != nil {
+		t.Fatalf("newOTLPExporter(...): %v", err)
+	}
+	x.gatherer = reg
+	x.start = time.Unix(100, 0)
+	x.now = func() time.Time { return time.Unix(200, 0) }
+	if err := x.export(context.Background()); err != nil {
+		t.Fatalf("export(...): %v", err)
+	}
+
+	rms := got.GetResourceMetrics()
+	if len(rms) != 1 || len(rms[0].GetInstrumentationLibraryMetrics()) != 1 {
+		t.Fatalf("export(...): want a single resource and library, got %v", got)
+	}
+	wantLib := &commonpb.InstrumentationLibrary{Name: otlpServiceName, Version: version.Version}
+	if diff := cmp.Diff(wantLib, rms[0].GetInstrumentationLibraryMetrics()[0].GetInstrumentationLibrary(), protocmp.Transform()); diff != "" {
+		t.Errorf("export(...): -want library, +got library:\n%s", diff)
+	}
+	// Summaries are not exported.
+	want := []*metricpb.Metric{
+		{
+			Name:        "latency_seconds",
+			Description: "Latency.",
+			Data: &metricpb.Metric_Histogram{Histogram: &metricpb.Histogram{
+				AggregationTemporality: metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				DataPoints: []*metricpb.HistogramDataPoint{{
+					StartTimeUnixNano: 100000000000,
+					TimeUnixNano:      200000000000,
+					Count:             4,
+					Sum:               6.05,
+					BucketCounts:      []uint64{1, 2, 1},
+					ExplicitBounds:    []float64{0.1, 1},
+				}},
+			}},
+		},
+		{
+			Name:        "queue_depth",
+			Description: "Depth.",
+			Data: &metricpb.Metric_Gauge{Gauge: &metricpb.Gauge{DataPoints: []*metricpb.NumberDataPoint{{
+				TimeUnixNano: 200000000000,
+				Value:        &metricpb.NumberDataPoint_AsDouble{AsDouble: 2},
+			}}}},
+		},
+		{
+			Name:        "requests_total",
+			Description: "Requests.",
+			Data: &metricpb.Metric_Sum{Sum: &metricpb.Sum{
+				AggregationTemporality: metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				IsMonotonic:            true,
+				DataPoints: []*metricpb.NumberDataPoint{{
+					Attributes:        []*commonpb.KeyValue{{Key: "code", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "200"}}}},
+					StartTimeUnixNano: 100000000000,
+					TimeUnixNano:      200000000000,
+					Value:             &metricpb.NumberDataPoint_AsDouble{AsDouble: 3},
+				}},
+			}},
+		},
+	}
+	metrics := rms[0].GetInstrumentationLibraryMetrics()[0].GetMetrics()
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].GetName() < metrics[j].GetName() })
+	if diff := cmp.Diff(want, metrics, protocmp.Transform()); diff != "" {
+		t.Errorf("export(...): -want metrics, +got metrics:\n%s", diff)
+	}
+}
+
+func TestOTLPExporter_exportRejected(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "unsupported", http.StatusUnsupportedMediaType)
+	}))
+	defer srv.Close()
+
+	x, err := newOTLPExporter(srv.URL, logging.NewNopLogger())
+	if err != nil {
+		t.Fatalf("newOTLPExporter(...): %v", err)
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "queue_depth", Help: "Depth."}))
+	x.gatherer = reg
+	if err := x.export(context.Background()); err == nil {
+		t.Error("export(...): want error if the collector rejects the metrics")
+	}
+}
+
+func TestOTLPExporter_runInBackgroundExportsOnStop(t *testing.T) {
+	var exports int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(&exports, 1)
+	}))
+	defer srv.Close()
+
+	x, err := newOTLPExporter(srv.URL, logging.NewNopLogger())
+	if err != nil {
+		t.Fatalf("newOTLPExporter(...): %v", err)
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "queue_depth", Help: "Depth."}))
+	x.gatherer = reg
+	stop := x.runInBackground(context.Background(), time.Hour)
+	stop()
+	if got := atomic.LoadInt32(&exports); got != 1 {
+		t.Errorf("runInBackground(...): want the final export done once stopped, got %d exports", got)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Decisions of a path policy.
+const (
+	pathAllowed = "allowed"
+	pathDenied  = "denied"
+)
+
+const (
+	errInvalidPathPattern = "invalid path pattern %q"
+	errPathNotAllowed     = "path is not allowed to be proxied"
+)
+
+var k8sPathDecisionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "k8s_path_decisions_total",
+	Help:      "Number of requests to the Kubernetes API server that the path policy allowed or denied, by decision.",
+}, []string{"decision"})
+
+// pathPolicy decides which paths of the Kubernetes API server can be proxied.
+// Patterns are regular expressions that match the whole path.
+type pathPolicy struct {
+	allowed []*regexp.Regexp
+	denied  []*regexp.Regexp
+}
+
+// newPathPolicy returns a policy that allows the paths matching any of the
+// allowed patterns, or any path if there are none, unless they match any of
+// the denied patterns. It returns nil if there are no patterns at all.
+func newPathPolicy(allowed, denied []string) (*pathPolicy, error) {
+	if len(allowed) == 0 && len(denied) == 0 {
+		return nil, nil
+	}
+	compile := func(patterns []string) ([]*regexp.Regexp, error) {
+		res := make([]*regexp.Regexp, len(patterns))
+		for i, p := range patterns {
+			re, err := regexp.Compile("^(?:" + p + ")$")
+			if err != nil {
+				return nil, errors.Wrapf(err, errInvalidPathPattern, p)
+			}
+			res[i] = re
+		}
+		return res, nil
+	}
+	pp := &pathPolicy{}
+	var err error
+	if pp.allowed, err = compile(allowed); err != nil {
+		return nil, err
+	}
+	if pp.denied, err = compile(denied); err != nil {
+		return nil, err
+	}
+	return pp, nil
+}
+
+// allows returns whether the given path can be proxied. Patterns are matched
+// against the unescaped path without a trailing slash. Paths that cannot be
+// unescaped or are not clean, e.g. that contain "..", are denied, since the
+// API server might resolve them to a path other than the one that was
+// matched.
+func (pp *pathPolicy) allows(p string) bool {
+	p, err := url.PathUnescape(p)
+	if err != nil {
+		return false
+	}
+	p = "/" + strings.TrimPrefix(p, "/")
+	c := path.Clean(p)
+	if c != p && c != strings.TrimSuffix(p, "/") {
+		return false
+	}
+	p = c
+	for _, re := range pp.denied {
+		if re.MatchString(p) {
+			return false
+		}
+	}
+	if len(pp.allowed) == 0 {
+		return true
+	}
+	for _, re := range pp.allowed {
+		if re.MatchString(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// decide returns whether the given path can be proxied and counts the
+// decision.
+func (pp *pathPolicy) decide(p string) bool {
+	ok := pp.allows(p)
+	d := pathAllowed
+	if !ok {
+		d = pathDenied
+	}
+	k8sPathDecisionsTotal.WithLabelValues(d).Inc()
+	return ok
+}
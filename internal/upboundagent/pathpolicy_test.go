@@ -0,0 +1,153 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/client-go/rest"
+)
+
+const secretsPattern = `/api/v1/(namespaces/[^/]+/)?secrets(/.*)?`
+
+func Test_pathPolicy(t *testing.T) {
+	cases := map[string]struct {
+		reason  string
+		allowed []string
+		denied  []string
+		path    string
+		want    bool
+	}{
+		"NotDenied": {
+			reason: "A path that matches no denied pattern should be allowed.",
+			denied: []string{secretsPattern},
+			path:   "api/v1/namespaces/default/configmaps",
+			want:   true,
+		},
+		"Denied": {
+			reason: "A path that matches a denied pattern should be denied.",
+			denied: []string{secretsPattern},
+			path:   "api/v1/namespaces/default/secrets/db",
+		},
+		"DeniedTrailingSlash": {
+			reason: "A trailing slash should not get a denied path past the policy.",
+			denied: []string{secretsPattern},
+			path:   "api/v1/secrets/",
+		},
+		"DeniedEscaped": {
+			reason: "An escaped path should be matched unescaped.",
+			denied: []string{secretsPattern},
+			path:   "api/v1/namespaces/default/%73ecrets",
+		},
+		"NotClean": {
+			reason: "A path that is not clean should be denied.",
+			denied: []string{secretsPattern},
+			path:   "api/v1/namespaces/default/configmaps/../../../secrets",
+		},
+		"Allowed": {
+			reason:  "A path that matches an allowed pattern should be allowed.",
+			allowed: []string{`/apis/pkg\.crossplane\.io/.*`},
+			path:    "apis/pkg.crossplane.io/v1/providers",
+			want:    true,
+		},
+		"NotAllowed": {
+			reason:  "A path that matches no allowed pattern should be denied.",
+			allowed: []string{`/apis/pkg\.crossplane\.io/.*`},
+			path:    "api/v1/namespaces",
+		},
+		"AllowedButDenied": {
+			reason:  "Denied patterns should take precedence over allowed ones.",
+			allowed: []string{`/api/v1/.*`},
+			denied:  []string{secretsPattern},
+			path:    "api/v1/namespaces/default/secrets",
+		},
+		"WholePath": {
+			reason: "Patterns should match the whole path rather than a part of it.",
+			denied: []string{`/api/v1/secrets`},
+			path:   "api/v1/secretsx",
+			want:   true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			pp, err := newPathPolicy(tc.allowed, tc.denied)
+			if err != nil {
+				t.Fatalf("newPathPolicy(...): %v", err)
+			}
+			if diff := cmp.Diff(tc.want, pp.allows(tc.path)); diff != "" {
+				t.Errorf("\n%s\nallows(%q): -want, +got:\n%s", tc.reason, tc.path, diff)
+			}
+		})
+	}
+}
+
+func Test_newPathPolicyInvalid(t *testing.T) {
+	if _, err := newPathPolicy(nil, []string{"/api/v1/(secrets"}); err == nil {
+		t.Error("newPathPolicy(...): want error for an invalid pattern")
+	}
+	if pp, err := newPathPolicy(nil, nil); pp != nil || err != nil {
+		t.Errorf("newPathPolicy(...): want no policy without patterns, got %v, %v", pp, err)
+	}
+}
+
+func TestProxy_k8sPathPolicy(t *testing.T) {
+	kube := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer kube.Close()
+
+	p := newTestProxy(t, kube.URL)
+	rt, err := roundTripperForRestConfig(&rest.Config{Host: kube.URL}, "")
+	if err != nil {
+		t.Fatalf("roundTripperForRestConfig(...): %v", err)
+	}
+	p.kubeTransport = rt
+	if p.paths, err = newPathPolicy(nil, []string{secretsPattern}); err != nil {
+		t.Fatalf("newPathPolicy(...): %v", err)
+	}
+	e := echo.New()
+	e.Any(k8sHandlerPath, p.k8s())
+
+	cases := map[string]int{
+		"/k8s/api/v1/namespaces/default/configmaps": http.StatusOK,
+		"/k8s/api/v1/namespaces/default/secrets":    http.StatusForbidden,
+	}
+	for path, want := range cases {
+		denied := testutil.ToFloat64(k8sPathDecisionsTotal.WithLabelValues(pathDenied))
+		allowed := testutil.ToFloat64(k8sPathDecisionsTotal.WithLabelValues(pathAllowed))
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(headerAuthorization, "Bearer "+validJWTToken)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if diff := cmp.Diff(want, rec.Code); diff != "" {
+			t.Errorf("k8s(): %s: -want status, +got status:\n%s", path, diff)
+		}
+		wantDenied, wantAllowed := 0.0, 1.0
+		if want == http.StatusForbidden {
+			wantDenied, wantAllowed = 1, 0
+		}
+		if diff := cmp.Diff(wantDenied, testutil.ToFloat64(k8sPathDecisionsTotal.WithLabelValues(pathDenied))-denied); diff != "" {
+			t.Errorf("k8s(): %s: -want denied decisions, +got:\n%s", path, diff)
+		}
+		if diff := cmp.Diff(wantAllowed, testutil.ToFloat64(k8sPathDecisionsTotal.WithLabelValues(pathAllowed))-allowed); diff != "" {
+			t.Errorf("k8s(): %s: -want allowed decisions, +got:\n%s", path, diff)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	errParseCertPin    = "certificate pin is not a hex encoded sha256 fingerprint"
+	errCertPinNoTLS    = "certificate pinning requires a TLS connection to the api server"
+	errCertPinNoCert   = "api server presented no certificate"
+	errCertPinMismatch = "api server certificate with sha256 fingerprint %s does not match the pinned fingerprint"
+)
+
+// parseCertPin parses a hex encoded SHA-256 fingerprint of a certificate. The
+// hex digits may be separated by colons and prefixed with sha256:, as printed
+// by e.g. openssl x509 -fingerprint -sha256.
+func parseCertPin(s string) ([]byte, error) {
+	s = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "sha256:")
+	s = strings.ReplaceAll(s, ":", "")
+	pin, err := hex.DecodeString(s)
+	if err != nil || len(pin) != sha256.Size {
+		return nil, errors.New(errParseCertPin)
+	}
+	return pin, nil
+}
+
+// verifyCertPin returns a function to verify that the leaf certificate served
+// by a peer has the given SHA-256 fingerprint. It is meant to be used as the
+// VerifyPeerCertificate callback of a TLS config, and thus runs in addition
+// to the regular verification against the trusted CAs.
+func verifyCertPin(pin []byte) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New(errCertPinNoCert)
+		}
+		fp := sha256.Sum256(rawCerts[0])
+		if subtle.ConstantTimeCompare(fp[:], pin) != 1 {
+			return errors.Errorf(errCertPinMismatch, hex.EncodeToString(fp[:]))
+		}
+		return nil
+	}
+}
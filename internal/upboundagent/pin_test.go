@@ -0,0 +1,109 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/client-go/rest"
+)
+
+func Test_parseCertPin(t *testing.T) {
+	fp := strings.Repeat("ab", sha256.Size)
+	cases := map[string]struct {
+		pin     string
+		wantErr bool
+	}{
+		"Hex":          {pin: fp},
+		"OpenSSL":      {pin: "SHA256:" + strings.TrimSuffix(strings.Repeat("AB:", sha256.Size), ":")},
+		"TooShort":     {pin: "abcd", wantErr: true},
+		"NotHex":       {pin: strings.Repeat("zz", sha256.Size), wantErr: true},
+		"OtherDigests": {pin: strings.Repeat("ab", 20), wantErr: true},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseCertPin(tc.pin)
+			if diff := cmp.Diff(tc.wantErr, err != nil); diff != "" {
+				t.Fatalf("parseCertPin(...): -want error, +got error:\n%s", diff)
+			}
+			if err == nil && hex.EncodeToString(got) != fp {
+				t.Errorf("parseCertPin(...): want %s, got %s", fp, hex.EncodeToString(got))
+			}
+		})
+	}
+}
+
+func Test_roundTripperForRestConfigCertPin(t *testing.T) {
+	kube := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer kube.Close()
+	fp := sha256.Sum256(kube.Certificate().Raw)
+
+	cases := map[string]struct {
+		reason  string
+		pin     string
+		wantErr bool
+	}{
+		"NotPinned": {
+			reason: "Connections should succeed if the certificate is not pinned.",
+		},
+		"Matching": {
+			reason: "Connections should succeed if the served certificate matches the pin.",
+			pin:    hex.EncodeToString(fp[:]),
+		},
+		"Mismatching": {
+			reason:  "Connections should be rejected if the served certificate does not match the pin.",
+			pin:     strings.Repeat("00", sha256.Size),
+			wantErr: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			rc := &rest.Config{
+				Host: kube.URL,
+				TLSClientConfig: rest.TLSClientConfig{
+					CAData: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: kube.Certificate().Raw}),
+				},
+			}
+			rt, err := roundTripperForRestConfig(rc, tc.pin)
+			if err != nil {
+				t.Fatalf("roundTripperForRestConfig(...): %v", err)
+			}
+			req, _ := http.NewRequest(http.MethodGet, kube.URL, nil)
+			res, err := rt.RoundTrip(req)
+			if err == nil {
+				_ = res.Body.Close()
+			}
+			if diff := cmp.Diff(tc.wantErr, err != nil); diff != "" {
+				t.Errorf("\n%s\nRoundTrip(...): -want error, +got error:\n%s\nerror: %v", tc.reason, diff, err)
+			}
+		})
+	}
+}
+
+func Test_roundTripperForRestConfigCertPinNoTLS(t *testing.T) {
+	_, err := roundTripperForRestConfig(&rest.Config{Host: "http://10.96.0.1"}, strings.Repeat("ab", sha256.Size))
+	if err == nil {
+		t.Error("roundTripperForRestConfig(...): want error when pinning without TLS")
+	}
+}
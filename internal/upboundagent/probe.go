@@ -0,0 +1,62 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+const healthzHandlerPath = "/healthz"
+
+// healthz returns a handler that only confirms that the agent is responsive,
+// regardless of its connections.
+func (p *Proxy) healthz() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, echo.Map{"status": http.StatusOK})
+	}
+}
+
+// tokenValid returns whether a control plane token is loaded that is still
+// valid, e.g. has not expired since it was loaded.
+func (p *Proxy) tokenValid() bool {
+	if p.cpToken == nil {
+		return false
+	}
+	t := p.cpToken.get()
+	if t == "" {
+		return false
+	}
+	if v := p.config.ValidateControlPlaneToken; v != nil {
+		_, err := v(t)
+		return err == nil
+	}
+	return true
+}
+
+// newProbeServer returns a plain HTTP server for the probe endpoints and
+// /info, so that neither Kubernetes probes nor operators debugging the agent
+// need to be set up for the TLS and client authentication of the serving port.
+// /info is only served here, since the router of the serving port is also
+// served over NATS.
+func (p *Proxy) newProbeServer(addr string) *http.Server {
+	e := echo.New()
+	e.GET(healthzHandlerPath, p.healthz())
+	e.GET(livenessHandlerPath, p.livez())
+	e.GET(readynessHandlerPath, p.readyz())
+	e.GET(infoHandlerPath, p.info())
+	return &http.Server{Addr: addr, Handler: e, ReadHeaderTimeout: readHeaderTimeout}
+}
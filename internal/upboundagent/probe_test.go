@@ -0,0 +1,90 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+)
+
+func TestProxy_probeServer(t *testing.T) {
+	errExpired := errors.New("control plane token expired")
+
+	type want struct {
+		healthz, readyz int
+		tokenValid      bool
+	}
+	cases := map[string]struct {
+		reason   string
+		token    string
+		validate func(string) (string, error)
+		want     want
+	}{
+		"ValidToken": {
+			reason: "The agent should be ready with a valid control plane token.",
+			token:  validJWTToken,
+			want:   want{healthz: http.StatusOK, readyz: http.StatusOK, tokenValid: true},
+		},
+		"ExpiredToken": {
+			reason:   "The agent should not be ready once its control plane token expired, yet still be alive.",
+			token:    validJWTToken,
+			validate: func(string) (string, error) { return "", errExpired },
+			want:     want{healthz: http.StatusOK, readyz: http.StatusServiceUnavailable},
+		},
+		"NoToken": {
+			reason: "The agent should not be ready without a control plane token, yet still be alive.",
+			want:   want{healthz: http.StatusOK, readyz: http.StatusServiceUnavailable},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			p := &Proxy{
+				config:   &Config{ValidateControlPlaneToken: tc.validate},
+				natsConn: &natsLink{},
+				isReady:  &atomic.Value{},
+				cpToken:  &tokenStore{token: tc.token},
+			}
+			p.isReady.Store(true)
+			srv := httptest.NewServer(p.newProbeServer("").Handler)
+			defer srv.Close()
+
+			get := func(path string) (int, map[string]interface{}) {
+				res, err := http.Get(srv.URL + path)
+				if err != nil {
+					t.Fatalf("GET %s: %v", path, err)
+				}
+				defer res.Body.Close() // nolint:errcheck
+				body := map[string]interface{}{}
+				_ = json.NewDecoder(res.Body).Decode(&body)
+				return res.StatusCode, body
+			}
+			healthz, _ := get(healthzHandlerPath)
+			readyz, body := get(readynessHandlerPath)
+			got := want{healthz: healthz, readyz: readyz, tokenValid: body["token-valid"] == true}
+			if info, _ := get(infoHandlerPath); info != http.StatusOK {
+				t.Errorf("\n%s\nprobe server: want %s served, got status %d", tc.reason, infoHandlerPath, info)
+			}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(want{})); diff != "" {
+				t.Errorf("\n%s\nprobe server: -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
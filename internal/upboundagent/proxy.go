@@ -16,19 +16,20 @@ package upboundagent
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
 	"crypto/tls"
 	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
-	"os/signal"
 	"strings"
 	"sync/atomic"
-	"syscall"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
 	"github.com/labstack/echo-contrib/jaegertracing"
 	"github.com/labstack/echo-contrib/prometheus"
@@ -37,6 +38,7 @@ import (
 	"github.com/labstack/gommon/log"
 	"github.com/nats-io/nats.go"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/upbound/nats-proxy/pkg/natsproxy"
 	"k8s.io/client-go/rest"
@@ -57,20 +59,27 @@ const (
 	xgqlHandlerPath      = "/query"
 
 	headerAuthorization      = "Authorization"
+	headerExpect             = "Expect"
+	expectContinue           = "100-continue"
+	headerTE                 = "Te"
+	teTrailers               = "trailers"
 	groupSystemAuthenticated = "system:authenticated"
 
 	impersonatorExtraKeyUpboundID = "upbound-id"
 	impersonatorUserUpboundCloud  = "upbound-cloud-impersonator"
 
-	serviceXgql = "xgql"
+	defaultXGQLEndpoint = "https://xgql"
 
 	readHeaderTimeout = 5 * time.Second
-	readTimeout       = 10 * time.Second
 	keepAliveInterval = 5 * time.Second
 	drainTimeout      = 20 * time.Second
-	shutdownTimeout   = 20 * time.Second
 
 	clockSkewTolerance = 120 * time.Second
+
+	// expectContinueTimeout is how long the body of a request that expects
+	// 100 Continue is held back until the downstream either continues or
+	// responds, as in http.DefaultTransport.
+	expectContinueTimeout = time.Second
 )
 
 const (
@@ -80,7 +89,10 @@ const (
 	errMissingBearer                  = "missing bearer token"
 	errInvalidToken                   = "invalid token"
 	errInvalidEnvID                   = "invalid environment id: %s, expecting: %s"
-	errUnexpectedSigningMethod        = "unexpected signing method, expecting RS256 but found: %v"
+	errUnexpectedSigningMethod        = "unexpected signing method, expecting one of RS256, ES256 or ES384 but found: %v"
+	errNoKeyForSigningMethod          = "no public key to validate tokens signed with %v"
+	errUnsignedToken                  = "rejected unsigned token with signing method none"
+	errNoTokenPublicKey               = "no public key to validate tokens with"
 	errFailedToGetImpersonationConfig = "failed to get impersonation config"
 )
 
@@ -97,24 +109,51 @@ var (
 
 // Proxy is an Upbound Agent Proxy
 type Proxy struct {
+	// These are accessed atomically and thus first, to be 64-bit aligned.
+	requests     uint64
+	serverErrors uint64
+	inFlight     int64
+	peakInFlight int64
+
 	log           logging.Logger
 	config        *Config
 	kubeHost      *url.URL
 	kubeTransport http.RoundTripper
-	nc            *nats.Conn
-	xgqlHost      *url.URL
+	natsConn      *natsLink
+	clusterID     string
+	xgqlBackends  *backendPool
 	k8sBearer     string
 	agent         *natsproxy.Agent
 	server        *http.Server
+	conns         connTracker
+	shuttingDown  shutdownGate
+	paths         *pathPolicy
+	audit         *auditLogger
 	isReady       *atomic.Value
+	watches       watchTracker
+	xgqlCAs       certPoolStore
+	xgqlCAReload  *fileReloader
+	cpToken       *tokenStore
+	cpTokenReload *fileReloader
+	servingCert   certificateStore
+	tokenKey      publicKeyStore
+	certRefresh   *certRefresher
+	otlp          *otlpExporter
+	buffers       httputil.BufferPool
+	// restart shuts the agent down gracefully, for it to be restarted.
+	restart context.CancelFunc
 }
 
 // NewProxy returns a new Proxy
 func NewProxy(config *Config, restConfig *rest.Config, upClient upbound.Client, log logging.Logger, clusterID string) (*Proxy, error) {
-	krt, err := roundTripperForRestConfig(restConfig)
+	krt, err := roundTripperForRestConfig(restConfig, config.APIServerCertPin)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to build round tripper for rest config")
 	}
+	if config.TraceDownstream {
+		krt = &tracingTransport{next: krt, downstream: downstreamKube, phases: downstreamPhaseSeconds, log: log}
+	}
+	krt = config.Tracer.Transport(krt)
 
 	// get k8s API server url
 	kubeHost, err := url.Parse(restConfig.Host)
@@ -122,9 +161,13 @@ func NewProxy(config *Config, restConfig *rest.Config, upClient upbound.Client,
 		return nil, errors.Wrap(err, "failed to parse kube url")
 	}
 
-	xgqlHost, err := url.Parse(fmt.Sprintf("https://%s", serviceXgql))
+	xgqlEndpoints := config.XGQLEndpoints
+	if len(xgqlEndpoints) == 0 {
+		xgqlEndpoints = []string{defaultXGQLEndpoint}
+	}
+	xgqlBackends, err := newBackendPool(log, xgqlEndpoints...)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to parse xgql url")
+		return nil, errors.Wrap(err, "failed to build xgql backends")
 	}
 
 	// TODO(turkenh): remove once nats-proxy starts using logging interface: https://github.com/upbound/nats-proxy/issues/3
@@ -132,74 +175,282 @@ func NewProxy(config *Config, restConfig *rest.Config, upClient upbound.Client,
 		// set log level for nats-proxy
 		logrus.SetLevel(logrus.DebugLevel)
 	}
-	var nc *nats.Conn
-	natsConn, err := newNATSConnManager(log, upClient, clusterID, config.NATS.ControlPlaneToken, config.NATS.CABundle)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to create new nats connection manager")
+	cpToken := &tokenStore{token: config.NATS.ControlPlaneToken}
+	natsConn := &natsLink{
+		log:     log,
+		timeout: config.LazyNATSConnectTimeout,
+		dial: func() (*nats.Conn, error) {
+			return connectNATS(config, cpToken.get, upClient, log, clusterID)
+		},
 	}
-	nopts := []nats.Option{nats.Name(fmt.Sprintf("%s-%s", config.ControlPlaneID, config.NATS.Name))}
-	nopts = natsproxy.SetupConnOptions(nopts)
-	nopts = append(nopts, natsConn.setupAuthOption(), natsConn.setupTLSOption())
-	// Connect to NATS
-	nc, err = nats.Connect(config.NATS.Endpoint, nopts...)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to connect NATS")
+	if !config.LazyNATSConnect && !config.DisableNATS {
+		if natsConn.nc, err = natsConn.dial(); err != nil {
+			return nil, err
+		}
 	}
 
 	pxy := &Proxy{
 		log:           log,
-		nc:            nc,
+		natsConn:      natsConn,
+		clusterID:     clusterID,
+		cpToken:       cpToken,
 		kubeHost:      kubeHost,
 		kubeTransport: krt,
 		config:        config,
-		xgqlHost:      xgqlHost,
+		xgqlBackends:  xgqlBackends,
 		k8sBearer:     restConfig.BearerToken,
 		isReady:       &atomic.Value{},
+		xgqlCAs:       certPoolStore{pool: config.XGQLCACertPool},
+		buffers:       newBufferPool(config.CopyBufferSize),
+	}
+	pxy.tokenKey.set(config.TokenPublicKeys)
+	if pxy.paths, err = newPathPolicy(config.AllowedPaths, config.DeniedPaths); err != nil {
+		return nil, errors.Wrap(err, "failed to build path policy")
+	}
+	if config.Audit.Enabled {
+		if pxy.audit, err = newAuditLogger(config.Audit, os.Stdout); err != nil {
+			return nil, err
+		}
+	}
+	// The NATS connection keeps verifying the CA it was established with, so
+	// its expiry is not updated on refresh.
+	if !config.DisableNATS {
+		if err := observeCertExpiryBase64(CertRoleNATSCA, config.NATS.CABundle); err != nil {
+			log.Info("cannot export expiry of nats ca", "error", err)
+		}
+	}
+	if config.Metrics.OTLPEndpoint != "" {
+		if pxy.otlp, err = newOTLPExporter(config.Metrics.OTLPEndpoint, log); err != nil {
+			return nil, err
+		}
+	}
+	if config.CertRefresh.Interval > 0 || config.CertRefresh.OnStart {
+		pxy.certRefresh = &certRefresher{
+			log: log,
+			fetch: func() (upbound.PublicCerts, error) {
+				return upClient.GetGatewayCerts(cpToken.get())
+			},
+			apply:          pxy.applyGatewayCerts,
+			failures:       certRefreshConsecutiveFailures,
+			cached:         usingCachedCerts,
+			interval:       config.CertRefresh.Interval,
+			initialBackoff: config.CertRefresh.InitialBackoff,
+			maxBackoff:     config.CertRefresh.MaxBackoff,
+			onStart:        config.CertRefresh.OnStart,
+		}
+	}
+	if config.XGQLCABundleFile != "" && config.XGQLCAReloadInterval > 0 {
+		load := func(b []byte) error {
+			if err := pxy.xgqlCAs.loadPEM(b); err != nil {
+				return err
+			}
+			ObserveCertExpiry(CertRoleXGQLCA, b)
+			return nil
+		}
+		pxy.xgqlCAReload = &fileReloader{name: reloadNameXGQLCA, path: config.XGQLCABundleFile, load: load, log: log}
+		if _, err := pxy.xgqlCAReload.reload(); err != nil {
+			return nil, errors.Wrap(err, "failed to load xgql ca bundle")
+		}
+	}
+	if config.ControlPlaneTokenFile != "" && config.ControlPlaneTokenReloadInterval > 0 {
+		// The token was validated at startup, so it is only loaded once it
+		// changed.
+		pxy.cpTokenReload = &fileReloader{
+			name: reloadNameControlPlaneToken,
+			path: config.ControlPlaneTokenFile,
+			load: pxy.loadControlPlaneToken,
+			log:  log,
+			last: []byte(config.NATS.ControlPlaneToken),
+		}
 	}
 
 	return pxy, nil
 }
 
-// Run runs Upbound Agent Proxy.
-func (p *Proxy) Run(addr, certFile, keyFile string) error {
-	p.isReady.Store(true)
+// Run runs Upbound Agent Proxy until the given context is done, e.g. on a
+// shutdown signal, and then shuts it down gracefully.
+func (p *Proxy) Run(ctx context.Context, addr, certFile, keyFile string) error {
+	ctx, p.restart = context.WithCancel(ctx)
+	defer p.restart()
+	certReload := newServingCertReloader(certFile, keyFile, &p.servingCert, p.log)
+	if _, err := certReload.reload(); err != nil {
+		return errors.Wrap(err, "failed to load serving certificate")
+	}
+	if d := p.config.ServingCertDir; d != "" {
+		named, err := loadServingCertDir(d)
+		if err != nil {
+			return errors.Wrap(err, "failed to load serving certificates by server name")
+		}
+		p.servingCert.setNamed(named)
+		for _, c := range named {
+			p.log.Info("loaded serving certificate by server name", "subject", c.Leaf.Subject.String(), "names", strings.Join(c.Leaf.DNSNames, ","))
+		}
+	}
 
 	e, err := p.setupRouter()
 	if err != nil {
 		return errors.Wrap(err, "failed to setup router")
 	}
+	// Unless connecting lazily or NATS is disabled, setupRouter only returns
+	// once the agent listens for requests from Upbound Cloud, i.e. the NATS
+	// server acknowledged its subscription. When connecting lazily, the agent
+	// is ready once configured, since the connection is only established by
+	// the requests that an unready agent would not be routed.
+	p.isReady.Store(true)
 
-	s := &http.Server{
-		Handler:           e,
-		Addr:              addr,
-		ReadTimeout:       readTimeout,
-		ReadHeaderTimeout: readHeaderTimeout,
-		// Note(turkenh): WriteTimeout intentionally left as "0" since setting a write timeout breaks k8s watch requests.
-		WriteTimeout: 0,
+	// Background work keeps running while shutting down, e.g. so that a
+	// rotated serving certificate is still reloaded, and stops once Run
+	// returns.
+	bg, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if p.config.NATSStatsInterval > 0 {
+		x := &natsStatsExporter{metrics: defaultNATSMetrics, stats: p.natsConn.stats, buffered: p.natsConn.buffered}
+		go x.run(bg, p.config.NATSStatsInterval)
+	}
+	if p.xgqlCAReload != nil {
+		go p.xgqlCAReload.run(bg, p.config.XGQLCAReloadInterval)
+	}
+	if p.cpTokenReload != nil {
+		go p.cpTokenReload.run(bg, p.config.ControlPlaneTokenReloadInterval)
+	}
+	if p.config.ServingCertReloadInterval > 0 {
+		go certReload.run(bg, p.config.ServingCertReloadInterval)
+	}
+	if p.certRefresh != nil {
+		go p.certRefresh.run(bg)
+	}
+	if p.otlp != nil {
+		// Waited for on return, so that the final export is not lost once the
+		// agent exits.
+		stop := p.otlp.runInBackground(bg, p.config.Metrics.OTLPInterval)
+		defer stop()
+	}
+	if p.config.Tracer != nil {
+		go p.config.Tracer.Run(bg)
+	}
+	if p.config.IdleHeartbeatInterval > 0 {
+		h := &heartbeat{log: p.log, requests: p.requestsSinceStart, connected: p.natsConn.connected}
+		go h.run(bg, p.config.IdleHeartbeatInterval)
+	}
+	if p.config.XGQLHealthCheckInterval > 0 {
+		go p.xgqlBackends.run(bg, p.config.XGQLHealthCheckInterval, func() *http.Client {
+			return &http.Client{Transport: p.xgqlTransport(), Timeout: healthCheckTimeout}
+		})
+	}
+
+	if p.config.ProbeAddress != "" {
+		ps := p.newProbeServer(p.config.ProbeAddress)
+		defer ps.Close() // nolint:errcheck
+		go func() {
+			if err := ps.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				p.log.Info("probe server stopped", "error", err)
+			}
+		}()
+	}
+
+	if a := p.config.Metrics.Address; a != "" && !p.config.Metrics.DisablePrometheus {
+		ms := p.newMetricsServer(a)
+		defer ms.Close() // nolint:errcheck
+		go func() {
+			if err := ms.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				p.log.Info("metrics server stopped", "error", err)
+			}
+		}()
 	}
+
+	if p.config.DebugMode && p.config.DebugAddress != "" {
+		ds, err := newDebugServer(p.config.DebugAddress)
+		if err != nil {
+			return errors.Wrap(err, "failed to setup debug server")
+		}
+		defer ds.Close() // nolint:errcheck
+		go func() {
+			if err := ds.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				p.log.Info("debug server stopped", "error", err)
+			}
+		}()
+	}
+
+	s := p.newServer(e, addr)
 	p.server = s
 	go func() {
-		if err := s.ListenAndServeTLS(certFile, keyFile); err != nil && err != http.ErrServerClosed {
+		if err := s.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
 			err = errors.Wrap(err, "service stopped unexpectedly")
 			p.log.Info(err.Error())
 			os.Exit(-1)
 		}
 	}()
 
-	// Graceful shutdown
-	quit := make(chan os.Signal, 1)
-	// interrupt signal sent from terminal
-	signal.Notify(quit, syscall.SIGINT)
-	// sigterm signal sent from kubernetes
-	signal.Notify(quit, syscall.SIGTERM)
-	<-quit
-
+	<-ctx.Done()
 	return p.shutdown()
 }
 
+// newServer returns the server of the proxy, bounded by the configured
+// timeouts.
+func (p *Proxy) newServer(h http.Handler, addr string) *http.Server {
+	s := &http.Server{
+		Handler:           h,
+		Addr:              addr,
+		ReadTimeout:       p.config.ReadTimeout,
+		ReadHeaderTimeout: p.config.ReadHeaderTimeout,
+		// Note(turkenh): WriteTimeout is "0" by default since setting a write timeout breaks k8s watch requests.
+		WriteTimeout: p.config.WriteTimeout,
+		IdleTimeout:  p.config.IdleTimeout,
+	}
+	if s.ReadHeaderTimeout <= 0 {
+		s.ReadHeaderTimeout = readHeaderTimeout
+	}
+	s.TLSConfig = p.serverTLSConfig()
+	if s.TLSConfig == nil {
+		s.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	// The serving certificate is looked up on every handshake, so that a
+	// rotated one is served as soon as it is reloaded, and by the server name
+	// the client asks for.
+	s.TLSConfig.GetCertificate = p.servingCert.getCertificate
+	s.ConnState = p.conns.track
+	return s
+}
+
+// Close closes the connection to NATS of a proxy that is not run, e.g. once
+// its startup was validated.
+func (p *Proxy) Close() {
+	if nc := p.natsConn.current(); nc != nil {
+		nc.Close()
+	}
+	_ = p.audit.close()
+}
+
 func (p *Proxy) shutdown() error {
 	p.isReady.Store(false)
+	p.shuttingDown.close()
+	// Logged once the requests in flight completed or were closed.
+	defer p.logLifetimeSummary()
+
+	// Watches never complete on their own, so we end them cleanly after the
+	// grace period to let clients re-establish them against another replica.
+	wt := time.AfterFunc(p.config.WatchShutdownGrace, func() {
+		p.log.Info("proxy shutdown: closed in-flight watches", "count", p.watches.closeAll())
+	})
+	defer wt.Stop()
 
+	// The agent only listens once connected, which may not be the case yet
+	// if connecting lazily.
+	if p.natsConn.current() != nil {
+		if err := p.drainAgent(); err != nil {
+			return err
+		}
+	}
+
+	p.log.Info("proxy shutdown: shutting down server")
+	err := p.drainServer(p.server, &p.conns, p.config.ShutdownGracePeriod)
+	if cerr := p.audit.close(); cerr != nil {
+		p.log.Info("cannot close audit log", "error", cerr)
+	}
+	return err
+}
+
+func (p *Proxy) drainAgent() error {
 	p.log.Debug("proxy shutdown: draining nats agent")
 	dtc, cancel := context.WithTimeout(context.Background(), drainTimeout)
 	defer cancel()
@@ -219,12 +470,7 @@ draining:
 			time.Sleep(100 * time.Millisecond)
 		}
 	}
-
-	p.log.Info("proxy shutdown: shutting down server")
-	stc, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
-	defer cancel()
-
-	return p.server.Shutdown(stc)
+	return nil
 }
 
 // setupRouter setup an echo instance as a router.
@@ -233,54 +479,189 @@ func (p *Proxy) setupRouter() (*echo.Echo, error) {
 
 	e.Logger.SetLevel(log.INFO)
 	if p.config.DebugMode {
-		e.Use(middleware.Logger())
 		e.Logger.SetLevel(log.DEBUG)
 	}
+	switch {
+	case p.config.AccessLogErrorsOnly:
+		e.Use(p.errorAccessLog())
+	case p.config.DebugMode:
+		e.Use(middleware.Logger())
+	}
 
 	e.Use(middleware.Recover())
 
-	prm := prometheus.NewPrometheus("upbound_agent", nil)
-	prm.Use(e)
+	prm := prometheus.NewPrometheus(metricsNamespace, nil)
+	e.Use(prm.HandlerFunc)
+	if !p.config.Metrics.DisablePrometheus {
+		e.GET(metricsHandlerPath, echo.WrapHandler(promhttp.Handler()), p.metricsAuth())
+	}
 
 	jt := jaegertracing.New(e, nil)
 	defer jt.Close() // nolint:errcheck
 
 	// TODO(turkenh): use different routers for nats agent and http server once graphql removed, which will let us
 	// remove k8s from http server
-	e.Any(k8sHandlerPath, p.k8s())
-	e.Any(xgqlHandlerPath, p.xgql())
+	pmw := []echo.MiddlewareFunc{p.countRequests()}
+	if p.config.ClientAuth != tls.NoClientCert {
+		// Verified per route rather than in the handshake, so that the probe
+		// and metrics endpoints of the serving port are not affected.
+		pmw = append(pmw, p.clientAuth())
+	}
+	if p.config.Tracer != nil {
+		// Traced first, so that the spans cover the time spent in all other
+		// middlewares.
+		pmw = append([]echo.MiddlewareFunc{p.traceRequests()}, pmw...)
+	}
+	if p.audit != nil {
+		// Audited first, so that requests rejected by any of the other
+		// middlewares are recorded with their status too.
+		pmw = append([]echo.MiddlewareFunc{p.audit.middleware()}, pmw...)
+	}
+	if p.config.ShutdownRejectNew {
+		// Checked before anything waits, so that rejected requests return
+		// right away.
+		pmw = append(pmw, p.shuttingDown.middleware(shutdownRejectedRequestsTotal))
+	}
+	if p.config.DeadlineHeader != "" {
+		// Checked before the rate limits below, and before the concurrency
+		// limits that routeMW appends after all of these, so that requests
+		// that cannot be met neither use up tokens nor queue for a slot.
+		d := &deadlineChecker{log: p.log, header: p.config.DeadlineHeader, min: p.config.MinRequestDeadline, now: time.Now}
+		pmw = append(pmw, d.middleware())
+	}
+	if p.config.ClientRateLimitQPS > 0 {
+		// Checked before waiting for anything, so that throttled requests
+		// do not hold up others.
+		l := newClientRateLimiter(p.config.ClientRateLimitQPS, p.config.ClientRateLimitBurst, p.clientIdentity, throttledRequestsTotal)
+		pmw = append(pmw, l.middleware())
+	}
+	if p.config.MaxRequestsPerSecond > 0 {
+		// Checked after the limit of each client, so that a single client
+		// exceeding its own limit does not use up the shared one.
+		pmw = append(pmw, newRateLimiter(p.config.MaxRequestsPerSecond, p.config.RequestBurst, rateLimitedRequestsTotal).middleware())
+	}
+	if p.config.LazyNATSConnect && !p.config.DisableNATS {
+		pmw = append(pmw, p.natsConn.middleware())
+	}
+	if p.config.EnableCompression {
+		pmw = append(pmw, compress(compressionSavedBytesTotal))
+	}
+	// Requests wait for a slot of their route before waiting for a global
+	// one, so that they do not hold up other routes while waiting.
+	rl := newRouteLimiter(p.config.RouteConcurrencyLimits, p.config.QueueTimeout, queueWaitSeconds, queueDepth, routeRequestsInFlight)
+	var global echo.MiddlewareFunc
+	if p.config.MaxConcurrentRequests > 0 {
+		global = newConcurrencyLimiter(p.config.MaxConcurrentRequests, p.config.QueueTimeout, queueWaitSeconds, queueDepth.WithLabelValues(queueRequestSlots)).middleware()
+	}
+	routeMW := func(route func(*http.Request) string) []echo.MiddlewareFunc {
+		mw := append(append([]echo.MiddlewareFunc{}, pmw...), rl.middleware(route))
+		if global != nil {
+			mw = append(mw, global)
+		}
+		return mw
+	}
+
+	e.Any(k8sHandlerPath, p.k8s(), routeMW(k8sRoute)...)
+	e.Any(xgqlHandlerPath, p.xgql(), routeMW(fixedRoute(RouteXGQL))...)
 	e.Any(readynessHandlerPath, p.readyz())
 	e.Any(livenessHandlerPath, p.livez())
+	e.Any(healthzHandlerPath, p.healthz())
 
+	if p.config.DisableNATS {
+		// Only the local endpoint is served.
+		return e, nil
+	}
 	agentID, err := uuid.Parse(p.config.ControlPlaneID)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to parse control plane id as uid")
 	}
-	agent := natsproxy.NewAgent(p.nc, agentID, e, getSubjectForAgent(agentID), keepAliveInterval)
-	err = agent.Listen()
-
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to listen to nats")
+	listen := func(nc *nats.Conn) error {
+		var h http.Handler = e
+		if p.config.RejectOversizedNATSRequests {
+			// Only requests relayed over NATS are limited, not those to the
+			// serving port.
+			h = limitNATSPayload(e, nc.MaxPayload())
+		}
+		agent := natsproxy.NewAgent(nc, agentID, h, getSubjectForAgent(agentID), keepAliveInterval)
+		if err := agent.Listen(); err != nil {
+			return errors.Wrap(err, "failed to listen to nats")
+		}
+		// Subscribing only sends the subscription to the server, so wait for
+		// the server to process it lest requests are not received yet.
+		if t := p.config.NATSSubscribeFlushTimeout; t > 0 {
+			if err := nc.FlushTimeout(t); err != nil {
+				return errors.Wrap(err, "failed to flush nats subscription")
+			}
+		}
+		p.agent = agent
+		return nil
+	}
+	nc := p.natsConn.current()
+	if nc == nil {
+		// Listens once connected on demand.
+		p.natsConn.setup = listen
+		return e, nil
+	}
+	if err := listen(nc); err != nil {
+		return nil, err
 	}
-	p.agent = agent
 	return e, nil
 }
 
 func (p *Proxy) livez() echo.HandlerFunc {
 	return func(c echo.Context) error {
-		if p.nc.Status() == nats.CONNECTED {
-			return c.JSON(http.StatusOK, echo.Map{"status": http.StatusOK, "nats-status": p.nc.Status()})
+		if p.config.DisableNATS {
+			return c.JSON(http.StatusOK, echo.Map{"status": http.StatusOK, "nats-disabled": true})
 		}
-		return c.JSON(http.StatusServiceUnavailable, echo.Map{"status": http.StatusServiceUnavailable, "nats-status": p.nc.Status()})
+		nc := p.natsConn.current()
+		if nc == nil {
+			// Not connected lazily yet, which does not make the agent unhealthy.
+			return c.JSON(http.StatusOK, echo.Map{"status": http.StatusOK, "nats-connected": false})
+		}
+		if nc.Status() == nats.CONNECTED {
+			return c.JSON(http.StatusOK, echo.Map{"status": http.StatusOK, "nats-status": nc.Status()})
+		}
+		return c.JSON(http.StatusServiceUnavailable, echo.Map{"status": http.StatusServiceUnavailable, "nats-status": nc.Status()})
 	}
 }
 
 func (p *Proxy) readyz() echo.HandlerFunc {
 	return func(c echo.Context) error {
-		if p.isReady.Load().(bool) {
-			return c.JSON(http.StatusOK, echo.Map{"status": http.StatusOK})
+		// Without a valid control plane token, the agent can neither fetch
+		// NATS JWTs nor gateway certs.
+		valid := p.tokenValid()
+		// A closed connection is not re-established anymore, so requests
+		// from Upbound Cloud are not received until the agent restarts.
+		closed := p.natsConn.closed()
+		status := http.StatusServiceUnavailable
+		if p.isReady.Load().(bool) && valid && !closed {
+			status = http.StatusOK
+		}
+		res := echo.Map{"nats-connected": p.natsConn.connected(), "nats-closed": closed, "nats-server": p.natsConn.connectedURL(), "token-valid": valid}
+		if p.config.LazyNATSConnect {
+			// Ready means configured rather than subscribed until the first
+			// request established the connection.
+			res["nats-lazy-connect"] = true
+		}
+		if p.config.DisableNATS {
+			// Not connected on purpose, which does not make the agent
+			// unready.
+			res = echo.Map{"nats-disabled": true, "token-valid": valid}
+		}
+		if status == http.StatusOK && p.config.XGQLHealthCheck {
+			// Not ready to accept xgql-bound traffic if no xgql backend is
+			// reachable.
+			hc := &http.Client{Transport: p.xgqlTransport(), Timeout: healthCheckTimeout}
+			err := p.xgqlBackends.probe(c.Request().Context(), hc, p.config.XGQLHealthCheckPath, p.config.XGQLHealthCheckStatus)
+			hc.CloseIdleConnections()
+			res["xgql-reachable"] = err == nil
+			if err != nil {
+				p.log.Debug("xgql is not reachable", "error", err)
+				status = http.StatusServiceUnavailable
+			}
 		}
-		return c.JSON(http.StatusServiceUnavailable, echo.Map{"status": http.StatusServiceUnavailable})
+		res["status"] = status
+		return c.JSON(status, res)
 	}
 }
 
@@ -288,84 +669,137 @@ func (p *Proxy) xgql() echo.HandlerFunc {
 	return func(c echo.Context) error {
 		p.log.Debug("incoming xgql request", "url", c.Request().URL.String())
 
-		ic, err := p.getImpersonationConfig(c.Request().Header)
+		ic, tc, err := p.getImpersonationConfig(c)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusBadRequest, echo.Map{"message": err.Error()})
 		}
+		c.Set(contextKeyTokenClaims, tc)
 
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: false,
-				RootCAs:            p.config.XGQLCACertPool,
-				MinVersion:         tls.VersionTLS12,
-			},
+		var xrt http.RoundTripper = p.xgqlTransport()
+		if p.config.TraceDownstream {
+			xrt = &tracingTransport{next: xrt, downstream: downstreamXGQL, phases: downstreamPhaseSeconds, log: p.log}
 		}
-		btr := transport.NewBearerAuthRoundTripper(p.k8sBearer, tr)
+		xrt = p.config.Tracer.Transport(xrt)
+		btr := transport.NewBearerAuthRoundTripper(p.k8sBearer, xrt)
 		itr := transport.NewImpersonatingRoundTripper(ic, btr)
 
-		rp := httputil.NewSingleHostReverseProxy(p.xgqlHost)
-		rp.Transport = itr
-		rp.ErrorHandler = p.error
+		b := p.xgqlBackends.pick()
+		rp := httputil.NewSingleHostReverseProxy(b.url)
+		rp.Transport = &hostGuard{allowed: b.url, next: itr}
+		rp.BufferPool = p.buffers
+		rp.ErrorHandler = func(rw http.ResponseWriter, r *http.Request, err error) {
+			// Take backends that cannot be reached out of rotation until
+			// they pass a health check again.
+			var tna *errTargetNotAllowed
+			if p.config.XGQLHealthCheckInterval > 0 && !errors.As(err, &tna) && r.Context().Err() == nil {
+				p.xgqlBackends.markHealthy(b, false, err)
+			}
+			p.error(rw, r, err)
+		}
 
 		reqCopy := sanitizeRequest(c.Request())
-		reqCopy.URL.Host = p.xgqlHost.Host
+		reqCopy.URL.Host = b.url.Host
+		if p.config.ForwardClientIP {
+			setForwardingHeaders(reqCopy, c.Request(), p.config.TrustedProxies)
+		}
 
-		rp.ServeHTTP(c.Response(), reqCopy)
-		p.log.Debug("response from xgql", "status", c.Response().Status)
+		p.serveProxy(rp, c, reqCopy)
+		p.log.Debug("response from xgql", "status", c.Response().Status, "backend", b.url.String())
 		return nil
 	}
 }
 
+// xgqlTransport returns a transport that trusts the current xgql CA pool.
+func (p *Proxy) xgqlTransport() *http.Transport {
+	return &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: false,
+			RootCAs:            p.xgqlCAs.get(),
+			MinVersion:         tls.VersionTLS12,
+		},
+		ExpectContinueTimeout: expectContinueTimeout,
+	}
+}
+
 func (p *Proxy) k8s() echo.HandlerFunc {
 	return func(c echo.Context) error {
 		p.log.Debug("incoming k8s request", "url", c.Request().URL.String())
 
-		ic, err := p.getImpersonationConfig(c.Request().Header)
+		ic, tc, err := p.getImpersonationConfig(c)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusBadRequest, echo.Map{"message": err.Error()})
 		}
+		c.Set(contextKeyTokenClaims, tc)
+		if p.paths != nil && !p.paths.decide(parseDestinationPath(c)) {
+			return echo.NewHTTPError(http.StatusForbidden, errPathNotAllowed)
+		}
 
 		irt := transport.NewImpersonatingRoundTripper(ic, p.kubeTransport)
 
 		rp := httputil.NewSingleHostReverseProxy(p.kubeHost)
-		rp.Transport = irt
+		rp.Transport = &hostGuard{allowed: p.kubeHost, next: irt}
+		rp.BufferPool = p.buffers
 		rp.ErrorHandler = p.error
 
 		reqCopy := sanitizeRequest(c.Request())
 		reqCopy.URL.Path = parseDestinationPath(c) // k8s/path -> path
+		if p.config.ForwardClientIP {
+			setForwardingHeaders(reqCopy, c.Request(), p.config.TrustedProxies)
+		}
+		if p.config.ControlPlaneHeader != "" {
+			setControlPlaneHeader(reqCopy, p.config.ControlPlaneHeader, p.config.ControlPlaneID)
+		}
+		if isWatchRequest(reqCopy) {
+			rp.ModifyResponse = func(res *http.Response) error {
+				res.Body = p.watches.track(res.Body)
+				return nil
+			}
+		}
+		if p.config.AdvertisedAddress != "" && isDiscoveryRequest(reqCopy) {
+			// Let the transport negotiate compression, so that it hands us
+			// an uncompressed response to rewrite.
+			reqCopy.Header.Del(headerAcceptEncoding)
+			rp.ModifyResponse = rewriteServerAddresses(p.config.AdvertisedAddress, p.log)
+		}
 
-		rp.ServeHTTP(c.Response(), reqCopy)
+		p.serveProxy(rp, c, reqCopy)
 		p.log.Debug("response from k8s", "status", c.Response().Status)
 		return nil
 	}
 }
 
-func (p *Proxy) getImpersonationConfig(requestHeader http.Header) (transport.ImpersonationConfig, error) {
+// getImpersonationConfig reviews the token of a request and returns the
+// impersonation config for it along with the claims of the valid token.
+func (p *Proxy) getImpersonationConfig(c echo.Context) (transport.ImpersonationConfig, *internal.TokenClaims, error) {
 	var cfg transport.ImpersonationConfig
 
-	tc, err := p.reviewToken(requestHeader)
+	tc, err := p.reviewRequestToken(c)
 	if err != nil {
+		observeTokenValidation(rejectionReason(err))
 		err = errors.Wrap(err, errUnableToValidateToken)
 		p.log.Info(err.Error())
-		return cfg, err
+		return cfg, nil, err
 	}
 
 	cid := tc.Audience
 	if cid != p.config.ControlPlaneID {
+		observeTokenValidation(rejectReasonWrongControlPlane)
 		err = errors.Errorf(errInvalidEnvID, cid, p.config.ControlPlaneID)
 		p.log.Info(err.Error())
-		return cfg, err
+		return cfg, nil, err
 	}
 
 	p.log.Debug("token is valid")
 
 	cfg, err = impersonationConfigForUser(tc.Payload, p.log)
 	if err != nil {
+		observeTokenValidation(rejectReasonInvalidClaims)
 		err = errors.Wrap(err, errFailedToGetImpersonationConfig)
 		p.log.Info(err.Error())
-		return cfg, err
+		return cfg, nil, err
 	}
-	return cfg, nil
+	observeTokenValidation("")
+	return cfg, tc, nil
 }
 
 func parseDestinationPath(c echo.Context) string {
@@ -383,9 +817,55 @@ func sanitizeRequest(req *http.Request) *http.Request {
 	// deep copy headers
 	r.Header = cloneAllowedHeaders(req.Header)
 
+	// Forward the expectation, so that the client only sends the body once the
+	// downstream continued, rather than the server continuing on its own. The
+	// server relays the 100 Continue as soon as the transport reads the body.
+	if strings.EqualFold(req.Header.Get(headerExpect), expectContinue) {
+		r.Header.Set(headerExpect, expectContinue)
+	}
+
+	// Tell the downstream that the client accepts trailers, which protocols
+	// like gRPC require. The reverse proxy forwards the response trailers.
+	if acceptsTrailers(req.Header) {
+		r.Header.Set(headerTE, teTrailers)
+	}
+
+	// The reverse proxy hijacks the connection once the downstream switched
+	// protocols, and then streams both directions.
+	if isUpgradeRequest(req) {
+		copyUpgradeHeaders(r.Header, req.Header)
+	}
+
 	return r
 }
 
+// acceptsTrailers returns true if the TE header of a request lists trailers.
+func acceptsTrailers(h http.Header) bool {
+	for _, v := range h.Values(headerTE) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), teTrailers) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// informationalWriter writes informational responses relayed by a reverse
+// proxy, like 100 Continue, directly to the underlying writer. The echo
+// response would consider itself committed by them and drop the final status.
+type informationalWriter struct {
+	*echo.Response
+}
+
+func (w informationalWriter) WriteHeader(code int) {
+	if code >= http.StatusContinue && code < http.StatusOK && code != http.StatusSwitchingProtocols {
+		w.Writer.WriteHeader(code)
+		return
+	}
+	w.Response.WriteHeader(code)
+}
+
 // cloneAllowedHeaders deep copies allowed headers
 func cloneAllowedHeaders(in http.Header) http.Header {
 	out := http.Header{}
@@ -400,10 +880,40 @@ func cloneAllowedHeaders(in http.Header) http.Header {
 }
 
 func (p *Proxy) error(rw http.ResponseWriter, r *http.Request, err error) {
+	var tna *errTargetNotAllowed
+	if errors.As(err, &tna) {
+		p.log.Info("rejected request to disallowed target", "err", err, "remote-addr", r.RemoteAddr)
+		http.Error(rw, "", http.StatusForbidden)
+		return
+	}
+	if clientGone(r) {
+		p.clientDisconnected(r, err)
+		rw.WriteHeader(statusClientClosedRequest)
+		return
+	}
 	p.log.Info("unknown error", "err", err, "remote-addr", r.RemoteAddr)
 	http.Error(rw, "", http.StatusInternalServerError)
 }
 
+// tokenReview is the result of reviewing the token of a request.
+type tokenReview struct {
+	claims *internal.TokenClaims
+	err    error
+}
+
+// reviewRequestToken reviews the token of the request of the given echo
+// context once, and returns the result of the first review for subsequent
+// calls, e.g. by the client rate limiter and then the handler. This spares
+// verifying the signature again and counting rejections twice.
+func (p *Proxy) reviewRequestToken(c echo.Context) (*internal.TokenClaims, error) {
+	if tr, ok := c.Get(contextKeyTokenReview).(tokenReview); ok {
+		return tr.claims, tr.err
+	}
+	tc, err := p.reviewToken(c.Request().Header)
+	c.Set(contextKeyTokenReview, tokenReview{claims: tc, err: err})
+	return tc, err
+}
+
 func (p *Proxy) reviewToken(requestHeaders http.Header) (*internal.TokenClaims, error) {
 	auth := strings.TrimSpace(requestHeaders.Get(headerAuthorization))
 	if auth == "" {
@@ -414,16 +924,13 @@ func (p *Proxy) reviewToken(requestHeaders http.Header) (*internal.TokenClaims,
 		return nil, errors.New(errMissingBearer)
 	}
 
-	tokenStr := parts[1]
-	tcs := &internal.TokenClaims{}
-	token, err := jwt.ParseWithClaims(tokenStr, tcs, func(token *jwt.Token) (interface{}, error) {
-		if sm, ok := token.Method.(*jwt.SigningMethodRSA); !ok || sm.Name != "RS256" {
-			return nil, errors.Errorf(errUnexpectedSigningMethod, token.Header["alg"])
-		}
-		return p.config.TokenRSAPublicKey, nil
-	})
+	token, tcs, err := p.parseToken(parts[1])
+	if token != nil && token.Method == jwt.SigningMethodNone {
+		unsignedTokensRejectedTotal.Inc()
+	}
 
-	if token.Valid {
+	// The token is nil if it is malformed.
+	if token != nil && token.Valid {
 		return tcs, nil
 	} else if ve, ok := err.(*jwt.ValidationError); ok {
 		if ve.Errors == jwt.ValidationErrorIssuedAt {
@@ -441,14 +948,110 @@ func (p *Proxy) reviewToken(requestHeaders http.Header) (*internal.TokenClaims,
 	return nil, errors.Wrap(err, errInvalidToken)
 }
 
-func roundTripperForRestConfig(config *rest.Config) (http.RoundTripper, error) {
+// parseToken parses the given token and verifies it with each accepted public
+// key in turn, so that tokens signed with any of them are valid, e.g. while the
+// signing key is rotated.
+func (p *Proxy) parseToken(tokenStr string) (*jwt.Token, *internal.TokenClaims, error) {
+	var tcs *internal.TokenClaims
+	token, err := parseTokenWithKeys(&jwt.Parser{}, tokenStr, func() jwt.Claims {
+		tcs = &internal.TokenClaims{}
+		return tcs
+	}, p.tokenPublicKeys)
+	return token, tcs, err
+}
+
+// VerifyTokenSignature verifies that the given token is signed with one of the
+// given public keys. Its claims are not validated.
+func VerifyTokenSignature(tokenStr string, keys []crypto.PublicKey) error {
+	_, err := parseTokenWithKeys(&jwt.Parser{SkipClaimsValidation: true}, tokenStr, func() jwt.Claims {
+		return jwt.MapClaims{}
+	}, func() []crypto.PublicKey { return keys })
+	return errors.Wrap(err, errInvalidToken)
+}
+
+// parseTokenWithKeys parses the given token into the claims returned by
+// newClaims with the given parser, and verifies it with each of the accepted
+// public keys in turn.
+func parseTokenWithKeys(parser *jwt.Parser, tokenStr string, newClaims func() jwt.Claims, accepted func() []crypto.PublicKey) (*jwt.Token, error) {
+	var keys []crypto.PublicKey
+	for i := 0; ; i++ {
+		last := true
+		token, err := parser.ParseWithClaims(tokenStr, newClaims(), func(token *jwt.Token) (interface{}, error) {
+			// Unsigned tokens would be rejected below as well, but are
+			// reported explicitly since they are an attempt to bypass the
+			// verification of the signature.
+			if token.Method == jwt.SigningMethodNone {
+				return nil, errors.New(errUnsignedToken)
+			}
+			if !tokenSigningMethods[token.Method] {
+				return nil, errors.Errorf(errUnexpectedSigningMethod, token.Header["alg"])
+			}
+			if keys == nil {
+				all := accepted()
+				if len(all) == 0 {
+					return nil, errors.New(errNoTokenPublicKey)
+				}
+				if keys = keysForSigningMethod(token.Method, all); len(keys) == 0 {
+					return nil, errors.Errorf(errNoKeyForSigningMethod, token.Header["alg"])
+				}
+			}
+			last = i == len(keys)-1
+			return keys[i], nil
+		})
+		// Only a signature that does not match the key is worth another try.
+		var ve *jwt.ValidationError
+		if last || !errors.As(err, &ve) || ve.Errors&jwt.ValidationErrorSignatureInvalid == 0 {
+			return token, err
+		}
+	}
+}
+
+// tokenSigningMethods are the methods that tokens may be signed with.
+var tokenSigningMethods = map[jwt.SigningMethod]bool{
+	jwt.SigningMethodRS256: true,
+	jwt.SigningMethodES256: true,
+	jwt.SigningMethodES384: true,
+}
+
+// keysForSigningMethod returns the given keys that signatures of the given
+// method can be verified with, i.e. RSA keys for RSA signatures and EC keys of
+// the curve matching the method for ECDSA signatures.
+func keysForSigningMethod(m jwt.SigningMethod, keys []crypto.PublicKey) []crypto.PublicKey {
+	var r []crypto.PublicKey
+	for _, k := range keys {
+		switch kt := k.(type) {
+		case *rsa.PublicKey:
+			if _, ok := m.(*jwt.SigningMethodRSA); ok {
+				r = append(r, k)
+			}
+		case *ecdsa.PublicKey:
+			if em, ok := m.(*jwt.SigningMethodECDSA); ok && kt.Curve.Params().BitSize == em.CurveBits {
+				r = append(r, k)
+			}
+		}
+	}
+	return r
+}
+
+func roundTripperForRestConfig(config *rest.Config, certPin string) (http.RoundTripper, error) {
 	tlsConf, err := rest.TLSConfigFor(config)
 	if err != nil {
 		return nil, err
 	}
+	if certPin != "" {
+		if tlsConf == nil {
+			return nil, errors.New(errCertPinNoTLS)
+		}
+		pin, err := parseCertPin(certPin)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.VerifyPeerCertificate = verifyCertPin(pin)
+	}
 
 	tlsTransport := &http.Transport{
-		TLSClientConfig: tlsConf,
+		TLSClientConfig:       tlsConf,
+		ExpectContinueTimeout: expectContinueTimeout,
 	}
 
 	restTransportConfig, err := config.TransportConfig()
@@ -15,20 +15,32 @@
 package upboundagent
 
 import (
+	"bufio"
 	"bytes"
+	"crypto"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/crossplane/crossplane-runtime/pkg/logging"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
+	"github.com/nats-io/nats.go"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/transport"
 
 	"github.com/crossplane/crossplane-runtime/pkg/test"
@@ -255,8 +267,8 @@ WNF1xiFz8ZOCiTgLAgMBAAE=
 					t.Fatalf("invalid input public key: %v", err)
 				}
 				p.config = &Config{
-					ControlPlaneID:    testEnvID,
-					TokenRSAPublicKey: k,
+					ControlPlaneID:  testEnvID,
+					TokenPublicKeys: []crypto.PublicKey{k},
 				}
 			}
 			rec := httptest.NewRecorder()
@@ -335,6 +347,20 @@ func TestProxy_reviewToken(t *testing.T) {
 				err: errors.New(errMissingBearer),
 			},
 		},
+		"Malformed": {
+			args: args{
+				req: &http.Request{
+					Header: map[string][]string{
+						headerAuthorization: {
+							"Bearer malformed",
+						},
+					},
+				},
+			},
+			want: want{
+				err: errors.Wrap(jwt.NewValidationError("token contains an invalid number of segments", jwt.ValidationErrorMalformed), errInvalidToken),
+			},
+		},
 		"UnexpectedSigningMethod": {
 			args: args{
 				req: &http.Request{
@@ -405,7 +431,7 @@ WNF1xiFz8ZOCiTgLAgMBAAE=
 					t.Fatalf("invalid input public key: %v", err)
 				}
 				p.config = &Config{
-					TokenRSAPublicKey: k,
+					TokenPublicKeys: []crypto.PublicKey{k},
 				}
 			}
 			got, gotErr := p.reviewToken(tc.args.req.Header)
@@ -419,6 +445,308 @@ WNF1xiFz8ZOCiTgLAgMBAAE=
 	}
 }
 
+func TestProxy_reviewTokenUnsigned(t *testing.T) {
+	// The claims of a valid token with the signature stripped, as in an
+	// attempt to bypass its verification.
+	claims := strings.Split(validJWTToken, ".")[1]
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." + claims + "."
+
+	k, err := jwt.ParseRSAPublicKeyFromPEM([]byte(validPublicKey))
+	if err != nil {
+		t.Fatalf("invalid input public key: %v", err)
+	}
+	p := &Proxy{log: logging.NewNopLogger(), config: &Config{TokenPublicKeys: []crypto.PublicKey{k}}}
+	before := testutil.ToFloat64(unsignedTokensRejectedTotal)
+	got, err := p.reviewToken(http.Header{headerAuthorization: {"Bearer " + unsigned}})
+	want := errors.Wrap(jwt.NewValidationError(errUnsignedToken, jwt.ValidationErrorUnverifiable), errInvalidToken)
+	if diff := cmp.Diff(want, err, test.EquateErrors()); diff != "" {
+		t.Fatalf("reviewToken(...): -want error, +got error: %s", diff)
+	}
+	if got != nil {
+		t.Errorf("reviewToken(...): want no claims, got %+v", got)
+	}
+	if diff := cmp.Diff(before+1, testutil.ToFloat64(unsignedTokensRejectedTotal)); diff != "" {
+		t.Errorf("unsignedTokensRejectedTotal: -want, +got:\n%s", diff)
+	}
+}
+
+func TestVerifyTokenSignature(t *testing.T) {
+	k, err := jwt.ParseRSAPublicKeyFromPEM([]byte(validPublicKey))
+	if err != nil {
+		t.Fatalf("invalid input public key: %v", err)
+	}
+	parts := strings.Split(validJWTToken, ".")
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"controlPlane|c21561da-087b-4efc-af6b-718e99bfd85f"}`)) + "." + parts[2]
+
+	cases := map[string]struct {
+		reason string
+		token  string
+		keys   []crypto.PublicKey
+		want   error
+	}{
+		"Valid": {
+			reason: "A token signed with an accepted key should be verified.",
+			token:  validJWTToken,
+			keys:   []crypto.PublicKey{k},
+		},
+		"Tampered": {
+			reason: "A token whose claims were changed after signing should be rejected.",
+			token:  tampered,
+			keys:   []crypto.PublicKey{k},
+			want:   errors.Wrap(jwt.NewValidationError("crypto/rsa: verification error", jwt.ValidationErrorSignatureInvalid), errInvalidToken),
+		},
+		"NoKeys": {
+			reason: "A token cannot be verified without any public keys.",
+			token:  validJWTToken,
+			want:   errors.Wrap(jwt.NewValidationError(errNoTokenPublicKey, jwt.ValidationErrorUnverifiable), errInvalidToken),
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := VerifyTokenSignature(tc.token, tc.keys)
+			if diff := cmp.Diff(tc.want, err, test.EquateErrors()); diff != "" {
+				t.Errorf("\n%s\nVerifyTokenSignature(...): -want error, +got error:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestProxy_k8sExpectContinue(t *testing.T) {
+	body := strings.Repeat("x", 1<<20)
+	cases := map[string]struct {
+		reason string
+		accept bool
+		want   []int
+	}{
+		"Continued": {
+			reason: "The client should only be continued once the downstream continued, and then send the body.",
+			accept: true,
+			want:   []int{http.StatusContinue, http.StatusCreated},
+		},
+		"Rejected": {
+			reason: "The client should not be continued if the downstream responds right away, and thus not send the body.",
+			want:   []int{http.StatusRequestEntityTooLarge},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			kube := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get(headerExpect) != expectContinue {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				if !tc.accept {
+					w.WriteHeader(http.StatusRequestEntityTooLarge)
+					return
+				}
+				// Reading the body continues the client.
+				b, _ := io.ReadAll(r.Body)
+				w.WriteHeader(http.StatusCreated)
+				_, _ = fmt.Fprint(w, len(b))
+			}))
+			defer kube.Close()
+
+			p := newTestProxy(t, kube.URL)
+			rt, err := roundTripperForRestConfig(&rest.Config{Host: kube.URL}, "")
+			if err != nil {
+				t.Fatalf("roundTripperForRestConfig(...): %v", err)
+			}
+			p.kubeTransport = rt
+			e := echo.New()
+			e.Any(k8sHandlerPath, p.k8s())
+			srv := httptest.NewServer(e)
+			defer srv.Close()
+
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatalf("cannot connect to proxy: %v", err)
+			}
+			defer conn.Close() // nolint:errcheck
+			_, _ = fmt.Fprintf(conn, "POST /k8s/api/v1/namespaces/default/configmaps HTTP/1.1\r\nHost: agent\r\nAuthorization: Bearer %s\r\nContent-Length: %d\r\nExpect: 100-continue\r\n\r\n", validJWTToken, len(body))
+
+			br := bufio.NewReader(conn)
+			var got []int
+			for {
+				res, err := http.ReadResponse(br, nil)
+				if err != nil {
+					t.Fatalf("cannot read response: %v", err)
+				}
+				got = append(got, res.StatusCode)
+				if res.StatusCode != http.StatusContinue {
+					b, _ := io.ReadAll(res.Body)
+					if res.StatusCode == http.StatusCreated && string(b) != strconv.Itoa(len(body)) {
+						t.Errorf("downstream received %s bytes, want %d", b, len(body))
+					}
+					break
+				}
+				_, _ = io.WriteString(conn, body)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("\n%s\nk8s(...): -want status codes, +got status codes:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestProxy_k8sTrailers(t *testing.T) {
+	kube := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("X-Te", r.Header.Get("Te"))
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, "streamed")
+		w.(http.Flusher).Flush()
+		w.Header().Set("Grpc-Status", "0")
+		// Trailers that were not announced before the body.
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+	}))
+	defer kube.Close()
+
+	p := newTestProxy(t, kube.URL)
+	e := echo.New()
+	e.Any(k8sHandlerPath, p.k8s())
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/k8s/api/v1/pods", nil)
+	req.Header.Set(headerAuthorization, "Bearer "+validJWTToken)
+	req.Header.Set("Te", "trailers")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer res.Body.Close() // nolint:errcheck
+	// Trailers are only available once the body was read.
+	if _, err := io.ReadAll(res.Body); err != nil {
+		t.Fatalf("cannot read body: %v", err)
+	}
+	want := http.Header{"Grpc-Status": {"0"}, "Grpc-Message": {"ok"}}
+	if diff := cmp.Diff(want, res.Trailer); diff != "" {
+		t.Errorf("k8s(...): -want trailers, +got trailers:\n%s", diff)
+	}
+	// Protocols like gRPC only send trailers to clients that accept them.
+	if diff := cmp.Diff("trailers", res.Header.Get("X-Te")); diff != "" {
+		t.Errorf("k8s(...): -want TE of the downstream request, +got:\n%s", diff)
+	}
+}
+
+// fakeNATSServer speaks just enough of the NATS protocol to accept a single
+// client. It answers the ping of the client while connecting right away, and
+// subsequent pings, i.e. flushes, only once pong is closed.
+type fakeNATSServer struct {
+	ln   net.Listener
+	pong chan struct{}
+
+	mu     sync.Mutex
+	events []string
+}
+
+func newFakeNATSServer(t *testing.T) *fakeNATSServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	s := &fakeNATSServer{ln: ln, pong: make(chan struct{})}
+	go s.serve()
+	return s
+}
+
+func (s *fakeNATSServer) serve() {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close() // nolint:errcheck
+	_, _ = io.WriteString(conn, "INFO {\"server_id\":\"fake\",\"version\":\"2.2.0\",\"proto\":1,\"max_payload\":1048576}\r\n")
+	connected := false
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		op := strings.Fields(sc.Text())
+		if len(op) == 0 {
+			continue
+		}
+		switch op[0] {
+		case "SUB":
+			s.record("SUB " + op[1])
+		case "PING":
+			if connected {
+				s.record("PING")
+				<-s.pong
+			}
+			connected = true
+			_, _ = io.WriteString(conn, "PONG\r\n")
+		}
+	}
+}
+
+func (s *fakeNATSServer) record(e string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+}
+
+func (s *fakeNATSServer) recorded() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.events...)
+}
+
+func TestProxy_setupRouterFlushesSubscription(t *testing.T) {
+	cases := map[string]struct {
+		reason  string
+		ack     bool
+		timeout time.Duration
+		wantErr bool
+	}{
+		"Acknowledged": {
+			reason:  "The router should only be set up once the server acknowledged the subscription.",
+			ack:     true,
+			timeout: 5 * time.Second,
+		},
+		"NotAcknowledged": {
+			reason:  "Setting up the router should fail if the server does not acknowledge the subscription in time.",
+			timeout: 100 * time.Millisecond,
+			wantErr: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			s := newFakeNATSServer(t)
+			defer s.ln.Close() // nolint:errcheck
+			defer close(s.pong)
+
+			nc, err := nats.Connect("nats://"+s.ln.Addr().String(), nats.NoReconnect())
+			if err != nil {
+				t.Fatalf("cannot connect to fake nats server: %v", err)
+			}
+			defer nc.Close()
+
+			p := newTestProxy(t, "https://10.96.0.1")
+			p.natsConn = &natsLink{nc: nc}
+			p.config.NATSSubscribeFlushTimeout = tc.timeout
+			if tc.ack {
+				// Acknowledge only once the subscription was flushed, i.e.
+				// while the proxy still waits for it.
+				go func() {
+					for len(s.recorded()) < 2 {
+						time.Sleep(10 * time.Millisecond)
+					}
+					s.pong <- struct{}{}
+				}()
+			}
+			// Run only reports readiness once the router is set up.
+			_, err = p.setupRouter()
+			if diff := cmp.Diff(tc.wantErr, err != nil); diff != "" {
+				t.Errorf("\n%s\nsetupRouter(): -want error, +got error:\n%s\nerror: %v", tc.reason, diff, err)
+			}
+			want := []string{"SUB " + getSubjectForAgent(uuid.MustParse(p.config.ControlPlaneID)), "PING"}
+			if diff := cmp.Diff(want, s.recorded()); diff != "" {
+				t.Errorf("\n%s\nsetupRouter(): -want nats events, +got nats events:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
 type mockRoundTripper struct {
 }
 
@@ -426,3 +754,34 @@ func (mockRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
 	body := io.NopCloser(bytes.NewReader([]byte(fmt.Sprintf("mock success - proxied to: %+v", r.URL))))
 	return &http.Response{StatusCode: http.StatusOK, Body: body, Request: r}, nil
 }
+
+func TestProxy_newServer(t *testing.T) {
+	type timeouts struct {
+		ReadHeader, Read, Write, Idle time.Duration
+	}
+	cases := map[string]struct {
+		reason string
+		config Config
+		want   timeouts
+	}{
+		"Defaults": {
+			reason: "The headers of requests should always be read within a bounded time, while watches must not be bounded.",
+			want:   timeouts{ReadHeader: readHeaderTimeout},
+		},
+		"Configured": {
+			reason: "The configured timeouts should be set on the server.",
+			config: Config{ReadHeaderTimeout: time.Second, ReadTimeout: 2 * time.Second, WriteTimeout: 3 * time.Second, IdleTimeout: 4 * time.Second},
+			want:   timeouts{ReadHeader: time.Second, Read: 2 * time.Second, Write: 3 * time.Second, Idle: 4 * time.Second},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			p := &Proxy{config: &tc.config}
+			s := p.newServer(http.NotFoundHandler(), ":8443")
+			got := timeouts{ReadHeader: s.ReadHeaderTimeout, Read: s.ReadTimeout, Write: s.WriteTimeout, Idle: s.IdleTimeout}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("\n%s\nnewServer(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
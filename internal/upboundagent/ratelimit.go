@@ -0,0 +1,203 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	errClientRateLimited = "client rate limit exceeded"
+	errRateLimited       = "rate limit exceeded"
+)
+
+// clientUnauthenticated is the identity of clients that present neither a
+// verified certificate nor a valid token. Their requests are rejected by the
+// handlers anyway, so they share a single limit.
+const clientUnauthenticated = "unauthenticated"
+
+// clientLimitIdleExpiry is how long the limit of a client is kept after its
+// last request.
+const clientLimitIdleExpiry = 10 * time.Minute
+
+var throttledRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "throttled_requests_total",
+	Help:      "Number of proxied requests rejected since the client exceeded its rate limit, by client.",
+}, []string{"client"})
+
+var rateLimitedRequestsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "rate_limited_requests_total",
+	Help:      "Number of proxied requests rejected since the rate limit shared by all clients was exceeded.",
+})
+
+// defaultBurst returns the given burst, or the given rate rounded up if it is
+// not positive.
+func defaultBurst(qps float64, burst int) int {
+	if burst < 1 {
+		return int(math.Max(1, math.Ceil(qps)))
+	}
+	return burst
+}
+
+// reserveAt takes a token from the given bucket. It returns zero if one was
+// available, or how long to wait for one otherwise, in which case no token is
+// taken.
+func reserveAt(l *rate.Limiter, now time.Time) time.Duration {
+	r := l.ReserveN(now, 1)
+	if d := r.DelayFrom(now); d > 0 {
+		r.CancelAt(now)
+		return d
+	}
+	return 0
+}
+
+// throttle rejects a request with 429, telling the client to retry after the
+// given duration.
+func throttle(c echo.Context, d time.Duration, msg string) error {
+	c.Response().Header().Set(headerRetryAfter, strconv.Itoa(int(math.Ceil(d.Seconds()))))
+	return echo.NewHTTPError(http.StatusTooManyRequests, msg)
+}
+
+// rateLimiter limits the rate of all proxied requests with a single token
+// bucket shared by all clients and connections, so that the API server is not
+// overwhelmed by a flood of requests.
+type rateLimiter struct {
+	limiter   *rate.Limiter
+	throttled prometheus.Counter
+	now       func() time.Time
+}
+
+func newRateLimiter(qps float64, burst int, throttled prometheus.Counter) *rateLimiter {
+	return &rateLimiter{
+		limiter:   rate.NewLimiter(rate.Limit(qps), defaultBurst(qps, burst)),
+		throttled: throttled,
+		now:       time.Now,
+	}
+}
+
+// middleware returns a middleware that rejects requests exceeding the rate
+// limit with 429, telling clients when to retry.
+func (l *rateLimiter) middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			d := reserveAt(l.limiter, l.now())
+			if d == 0 {
+				return next(c)
+			}
+			l.throttled.Inc()
+			return throttle(c, d, errRateLimited)
+		}
+	}
+}
+
+// clientRateLimiter limits the rate of requests of each client with a token
+// bucket, so that a single misbehaving client cannot overload the API server
+// that is shared with other clients.
+type clientRateLimiter struct {
+	limit     rate.Limit
+	burst     int
+	identify  func(c echo.Context) string
+	throttled *prometheus.CounterVec
+	now       func() time.Time
+
+	mu        sync.Mutex
+	clients   map[string]*clientLimit
+	lastSweep time.Time
+}
+
+type clientLimit struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newClientRateLimiter(qps float64, burst int, identify func(c echo.Context) string, throttled *prometheus.CounterVec) *clientRateLimiter {
+	return &clientRateLimiter{
+		limit:     rate.Limit(qps),
+		burst:     defaultBurst(qps, burst),
+		identify:  identify,
+		throttled: throttled,
+		now:       time.Now,
+		clients:   map[string]*clientLimit{},
+	}
+}
+
+// reserve takes a token from the bucket of the given client. It returns zero
+// if one was available, or how long the client has to wait for one otherwise.
+func (l *clientRateLimiter) reserve(client string) time.Duration {
+	now := l.now()
+	l.mu.Lock()
+	cl, ok := l.clients[client]
+	if !ok {
+		cl = &clientLimit{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[client] = cl
+	}
+	cl.lastSeen = now
+	if now.Sub(l.lastSweep) > clientLimitIdleExpiry {
+		l.sweep(now)
+	}
+	l.mu.Unlock()
+
+	return reserveAt(cl.limiter, now)
+}
+
+// sweep forgets the limits of clients that were idle for longer than the
+// expiry, whose buckets would be full again anyway.
+func (l *clientRateLimiter) sweep(now time.Time) {
+	for c, cl := range l.clients {
+		if now.Sub(cl.lastSeen) > clientLimitIdleExpiry {
+			delete(l.clients, c)
+		}
+	}
+	l.lastSweep = now
+}
+
+// middleware returns a middleware that rejects requests of clients that
+// exceeded their rate limit with 429, telling them when to retry.
+func (l *clientRateLimiter) middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			client := l.identify(c)
+			d := l.reserve(client)
+			if d == 0 {
+				return next(c)
+			}
+			l.throttled.WithLabelValues(client).Inc()
+			return throttle(c, d, errClientRateLimited)
+		}
+	}
+}
+
+// clientIdentity returns the identity of the client of the given request,
+// which is the common name of its verified certificate or the Upbound ID of
+// its valid token. The review of the token is kept for the handler.
+func (p *Proxy) clientIdentity(c echo.Context) string {
+	if r := c.Request(); p.verifiedClientCert(r) {
+		return "cert:" + r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if tc, err := p.reviewRequestToken(c); err == nil && tc.Payload.UpboundID != "" {
+		return "upbound:" + tc.Payload.UpboundID
+	}
+	return clientUnauthenticated
+}
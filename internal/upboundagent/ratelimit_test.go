@@ -0,0 +1,243 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestClientRateLimiter_middleware(t *testing.T) {
+	type result struct {
+		Client     string
+		Status     int
+		RetryAfter string
+	}
+	type want struct {
+		results   []result
+		throttled map[string]float64
+	}
+	cases := map[string]struct {
+		reason   string
+		qps      float64
+		burst    int
+		requests []string
+		advance  time.Duration
+		want     want
+	}{
+		"Isolated": {
+			reason:   "A client exceeding its limit should not affect the limit of other clients.",
+			qps:      0.5,
+			burst:    2,
+			requests: []string{"a", "a", "a", "b", "b", "a"},
+			want: want{
+				results: []result{
+					{Client: "a", Status: http.StatusOK},
+					{Client: "a", Status: http.StatusOK},
+					{Client: "a", Status: http.StatusTooManyRequests, RetryAfter: "2"},
+					{Client: "b", Status: http.StatusOK},
+					{Client: "b", Status: http.StatusOK},
+					{Client: "a", Status: http.StatusTooManyRequests, RetryAfter: "2"},
+				},
+				throttled: map[string]float64{"a": 2, "b": 0},
+			},
+		},
+		"Refilled": {
+			reason:   "Throttled requests should not use up tokens, so that clients can retry after the advertised delay.",
+			qps:      1,
+			requests: []string{"a", "a", "a"},
+			advance:  time.Second,
+			want: want{
+				results: []result{
+					{Client: "a", Status: http.StatusOK},
+					{Client: "a", Status: http.StatusOK},
+					{Client: "a", Status: http.StatusOK},
+				},
+				throttled: map[string]float64{"a": 0},
+			},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			throttled := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "throttled"}, []string{"client"})
+			identify := func(c echo.Context) string { return c.Request().Header.Get("X-Client") }
+			l := newClientRateLimiter(tc.qps, tc.burst, identify, throttled)
+			now := time.Unix(0, 0)
+			l.now = func() time.Time { return now }
+
+			e := echo.New()
+			e.GET("/k8s/api", func(c echo.Context) error { return c.NoContent(http.StatusOK) }, l.middleware())
+			got := want{throttled: map[string]float64{}}
+			for _, client := range tc.requests {
+				req := httptest.NewRequest(http.MethodGet, "/k8s/api", nil)
+				req.Header.Set("X-Client", client)
+				rec := httptest.NewRecorder()
+				e.ServeHTTP(rec, req)
+				got.results = append(got.results, result{Client: client, Status: rec.Code, RetryAfter: rec.Header().Get(headerRetryAfter)})
+				got.throttled[client] = testutil.ToFloat64(throttled.WithLabelValues(client))
+				now = now.Add(tc.advance)
+			}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(want{})); diff != "" {
+				t.Errorf("\n%s\nmiddleware(): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestClientRateLimiter_sweep(t *testing.T) {
+	l := newClientRateLimiter(1, 1, nil, nil)
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+	l.reserve("a")
+	now = now.Add(clientLimitIdleExpiry + time.Second)
+	l.reserve("b")
+	if _, ok := l.clients["a"]; ok {
+		t.Error("reserve(...): want limit of idle client to be forgotten")
+	}
+	if _, ok := l.clients["b"]; !ok {
+		t.Error("reserve(...): want limit of active client to be kept")
+	}
+}
+
+func TestRateLimiter_middleware(t *testing.T) {
+	type result struct {
+		Status     int
+		RetryAfter string
+	}
+	type want struct {
+		results   []result
+		throttled float64
+	}
+	cases := map[string]struct {
+		reason   string
+		qps      float64
+		burst    int
+		requests []string
+		advance  time.Duration
+		want     want
+	}{
+		"Shared": {
+			reason:   "All clients should share a single limit.",
+			qps:      0.5,
+			burst:    2,
+			requests: []string{"a", "b", "c", "a"},
+			want: want{
+				results: []result{
+					{Status: http.StatusOK},
+					{Status: http.StatusOK},
+					{Status: http.StatusTooManyRequests, RetryAfter: "2"},
+					{Status: http.StatusTooManyRequests, RetryAfter: "2"},
+				},
+				throttled: 2,
+			},
+		},
+		"Refilled": {
+			reason:   "Throttled requests should not use up tokens, so that clients can retry after the advertised delay.",
+			qps:      1,
+			requests: []string{"a", "b", "c"},
+			advance:  time.Second,
+			want: want{
+				results: []result{
+					{Status: http.StatusOK},
+					{Status: http.StatusOK},
+					{Status: http.StatusOK},
+				},
+			},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			throttled := prometheus.NewCounter(prometheus.CounterOpts{Name: "rate_limited"})
+			l := newRateLimiter(tc.qps, tc.burst, throttled)
+			now := time.Unix(0, 0)
+			l.now = func() time.Time { return now }
+
+			e := echo.New()
+			e.GET("/k8s/api", func(c echo.Context) error { return c.NoContent(http.StatusOK) }, l.middleware())
+			got := want{}
+			for _, client := range tc.requests {
+				req := httptest.NewRequest(http.MethodGet, "/k8s/api", nil)
+				req.Header.Set("X-Client", client)
+				rec := httptest.NewRecorder()
+				e.ServeHTTP(rec, req)
+				got.results = append(got.results, result{Status: rec.Code, RetryAfter: rec.Header().Get(headerRetryAfter)})
+				now = now.Add(tc.advance)
+			}
+			got.throttled = testutil.ToFloat64(throttled)
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(want{})); diff != "" {
+				t.Errorf("\n%s\nmiddleware(): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestProxy_clientIdentity(t *testing.T) {
+	ca := newTestCA(t)
+	client := newTestCert(t, "prometheus", ca, false, x509.ExtKeyUsageClientAuth)
+	other := newTestCert(t, "prometheus", newTestCA(t), false, x509.ExtKeyUsageClientAuth)
+	p := newTestProxy(t, "https://10.96.0.1")
+	p.config.ClientAuth = tls.VerifyClientCertIfGiven
+	p.config.ClientCACertPool = certPool(ca)
+
+	cases := map[string]struct {
+		reason string
+		tls    *tls.ConnectionState
+		token  string
+		want   string
+	}{
+		"Certificate": {
+			reason: "Clients with a verified certificate should be identified by its common name.",
+			tls:    &tls.ConnectionState{PeerCertificates: []*x509.Certificate{client.cert}},
+			token:  validJWTToken,
+			want:   "cert:prometheus",
+		},
+		"UnverifiedCertificate": {
+			reason: "Certificates that were not verified should not identify clients.",
+			tls:    &tls.ConnectionState{PeerCertificates: []*x509.Certificate{other.cert}},
+			token:  validJWTToken,
+			want:   "upbound:user/231",
+		},
+		"Token": {
+			reason: "Clients with a valid token should be identified by its Upbound ID.",
+			token:  validJWTToken,
+			want:   "upbound:user/231",
+		},
+		"Unauthenticated": {
+			reason: "Clients with an invalid token should share an identity.",
+			token:  "invalid",
+			want:   clientUnauthenticated,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/k8s/api", nil)
+			req.TLS = tc.tls
+			req.Header.Set(headerAuthorization, "Bearer "+tc.token)
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+			if diff := cmp.Diff(tc.want, p.clientIdentity(c)); diff != "" {
+				t.Errorf("\n%s\nclientIdentity(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+)
+
+const (
+	reloadResultSuccess = "success"
+	reloadResultFailure = "failure"
+
+	reloadNameXGQLCA            = "xgql-ca"
+	reloadNameControlPlaneToken = "control-plane-token"
+)
+
+const (
+	errReadFile     = "cannot read file %s"
+	errLoadFile     = "cannot load file %s"
+	errNoCertsInPEM = "no certificates found in PEM"
+)
+
+var reloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "file_reloads_total",
+	Help:      "Number of times a rotated file was reloaded, by file and result.",
+}, []string{"file", "result"})
+
+// fileReloader reads a file and passes its content to load whenever it changed
+// since the last successful load. The last successfully loaded content stays
+// in effect if loading fails.
+type fileReloader struct {
+	name string
+	path string
+	load func([]byte) error
+	log  logging.Logger
+
+	last []byte
+}
+
+// reload loads the file if its content changed and returns whether it did.
+func (f *fileReloader) reload() (bool, error) {
+	b, err := os.ReadFile(filepath.Clean(f.path))
+	if err != nil {
+		return false, errors.Wrapf(err, errReadFile, f.path)
+	}
+	if f.last != nil && bytes.Equal(b, f.last) {
+		return false, nil
+	}
+	if err := f.load(b); err != nil {
+		return false, errors.Wrapf(err, errLoadFile, f.path)
+	}
+	f.last = b
+	return true, nil
+}
+
+// run reloads the file on the given interval until the context is done.
+func (f *fileReloader) run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			changed, err := f.reload()
+			if err != nil {
+				reloadsTotal.WithLabelValues(f.name, reloadResultFailure).Inc()
+				f.log.Info("cannot reload file, keeping the current one", "file", f.name, "error", err)
+				continue
+			}
+			if changed {
+				reloadsTotal.WithLabelValues(f.name, reloadResultSuccess).Inc()
+				f.log.Info("reloaded file", "file", f.name, "path", f.path)
+			}
+		}
+	}
+}
+
+// certPoolStore holds a cert pool that can be swapped while in use.
+type certPoolStore struct {
+	mu   sync.RWMutex
+	pool *x509.CertPool
+}
+
+func (s *certPoolStore) get() *x509.CertPool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pool
+}
+
+func (s *certPoolStore) set(p *x509.CertPool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pool = p
+}
+
+// loadPEM replaces the pool with the certificates in the given PEM bundle.
+func (s *certPoolStore) loadPEM(b []byte) error {
+	p := x509.NewCertPool()
+	if !p.AppendCertsFromPEM(b) {
+		return errors.New(errNoCertsInPEM)
+	}
+	s.set(p)
+	return nil
+}
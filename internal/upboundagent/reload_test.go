@@ -0,0 +1,100 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	"github.com/crossplane/crossplane-runtime/pkg/test"
+)
+
+func TestFileReloader_xgqlCA(t *testing.T) {
+	oldCA := newTestCA(t)
+	newCA := newTestCA(t)
+	xgql := newTestCert(t, "xgql", newCA, false, x509.ExtKeyUsageServerAuth)
+
+	// trusts returns whether the current pool trusts the xgql certificate
+	// issued by the new CA.
+	trusts := func(s *certPoolStore) bool {
+		_, err := xgql.cert.Verify(x509.VerifyOptions{Roots: s.get(), DNSName: "xgql"})
+		return err == nil
+	}
+
+	type want struct {
+		changed bool
+		err     error
+		trusts  bool
+	}
+	cases := map[string]struct {
+		reason string
+		bundle []byte
+		want   want
+	}{
+		"Unchanged": {
+			reason: "An unchanged bundle should not be reloaded.",
+			bundle: oldCA.pem,
+			want:   want{changed: false, trusts: false},
+		},
+		"ValidNewBundle": {
+			reason: "A valid new bundle should replace the cert pool.",
+			bundle: newCA.pem,
+			want:   want{changed: true, trusts: true},
+		},
+		"InvalidNewBundle": {
+			reason: "An invalid new bundle should keep the current cert pool.",
+			bundle: []byte("not a certificate"),
+			want: want{
+				err:    errors.Wrapf(errors.New(errNoCertsInPEM), errLoadFile, "ca.crt"),
+				trusts: false,
+			},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			p := filepath.Join(dir, "ca.crt")
+			if err := os.WriteFile(p, oldCA.pem, 0o600); err != nil {
+				t.Fatalf("cannot write bundle: %v", err)
+			}
+			s := &certPoolStore{}
+			f := &fileReloader{name: reloadNameXGQLCA, path: p, load: s.loadPEM, log: logging.NewNopLogger()}
+			if _, err := f.reload(); err != nil {
+				t.Fatalf("initial reload(): %v", err)
+			}
+
+			// Rotate the bundle.
+			if err := os.WriteFile(p, tc.bundle, 0o600); err != nil {
+				t.Fatalf("cannot write bundle: %v", err)
+			}
+			changed, err := f.reload()
+
+			// Errors contain the temporary path, so we compare their base.
+			if err != nil {
+				err = errors.Wrapf(errors.Cause(err), errLoadFile, filepath.Base(p))
+			}
+			got := want{changed: changed, err: err, trusts: trusts(s)}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(want{}), test.EquateErrors()); diff != "" {
+				t.Errorf("\n%s\nreload(): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+)
+
+const reloadNameServingCert = "serving-cert"
+
+const (
+	errLoadKeyPair      = "cannot load serving certificate and key"
+	errNoServingCert    = "no certificate found in serving certificate bundle"
+	errParseServingCert = "cannot parse serving certificate bundle"
+	errIncompleteChain  = "serving certificate chain is incomplete: %q is issued by %q, which is neither included in the bundle nor a trusted root"
+	errReadCertDir      = "cannot read serving certificate directory %s"
+	errLoadDirKeyPair   = "cannot load serving certificate %s and key %s"
+	errNoCertsInDir     = "no serving certificates found in directory %s"
+)
+
+const (
+	// certDirCertSuffix and certDirKeySuffix are the suffixes of the
+	// certificate and key files of a pair in a serving certificate directory.
+	certDirCertSuffix = ".crt"
+	certDirKeySuffix  = ".key"
+)
+
+// maxChainLength bounds the walk up the chain of a serving certificate bundle,
+// e.g. if it contains a loop of cross-signed certificates.
+const maxChainLength = 10
+
+// certificateStore holds a serving certificate that can be swapped while in
+// use, along with certificates that are only served to clients asking for one
+// of their names.
+type certificateStore struct {
+	mu    sync.RWMutex
+	cert  *tls.Certificate
+	named []*tls.Certificate
+}
+
+func (s *certificateStore) get() *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert
+}
+
+func (s *certificateStore) set(c *tls.Certificate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cert = c
+}
+
+// setNamed sets the certificates that are selected by server name. Their
+// leaves must be parsed.
+func (s *certificateStore) setNamed(c []*tls.Certificate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.named = c
+}
+
+// getCertificate serves the first of the named certificates that is valid for
+// the server name the client asks for via SNI, and the current certificate
+// otherwise, for use as tls.Config.GetCertificate.
+func (s *certificateStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if hello == nil || hello.ServerName == "" {
+		return s.cert, nil
+	}
+	for _, c := range s.named {
+		if c.Leaf.VerifyHostname(hello.ServerName) == nil {
+			return c, nil
+		}
+	}
+	return s.cert, nil
+}
+
+// loadServingCertDir loads the serving certificates in the given directory,
+// where each certificate file ending in .crt has its key in the file of the
+// same name ending in .key, in the order of their file names.
+func loadServingCertDir(dir string) ([]*tls.Certificate, error) {
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return nil, errors.Wrapf(err, errReadCertDir, dir)
+	}
+	var certs []*tls.Certificate
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), certDirCertSuffix) {
+			continue
+		}
+		certFile := filepath.Join(dir, e.Name())
+		keyFile := strings.TrimSuffix(certFile, certDirCertSuffix) + certDirKeySuffix
+		c, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, errLoadDirKeyPair, certFile, keyFile)
+		}
+		if c.Leaf, err = x509.ParseCertificate(c.Certificate[0]); err != nil {
+			return nil, errors.Wrapf(err, errLoadDirKeyPair, certFile, keyFile)
+		}
+		certs = append(certs, &c)
+	}
+	if len(certs) == 0 {
+		return nil, errors.Errorf(errNoCertsInDir, dir)
+	}
+	return certs, nil
+}
+
+// VerifyServingCertChain verifies that the leaf, i.e. first, certificate of the
+// given PEM bundle chains up to a root using only the intermediates in the
+// bundle. The chain is complete once it reaches a self-signed certificate in
+// the bundle or a certificate signed by one of the given roots, which are the
+// system roots if nil. Clients then do not need to have the intermediates
+// themselves to verify the certificate.
+func VerifyServingCertChain(bundle []byte, roots *x509.CertPool) error {
+	var certs []*x509.Certificate
+	for {
+		var b *pem.Block
+		if b, bundle = pem.Decode(bundle); b == nil {
+			break
+		}
+		if b.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(b.Bytes)
+		if err != nil {
+			return errors.Wrap(err, errParseServingCert)
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return errors.New(errNoServingCert)
+	}
+	top := certs[0]
+	for i := 0; i < maxChainLength; i++ {
+		parent := issuerOf(top, certs)
+		if parent == nil || parent == top {
+			break
+		}
+		top = parent
+	}
+	if bytes.Equal(top.RawIssuer, top.RawSubject) && top.CheckSignatureFrom(top) == nil {
+		return nil
+	}
+	if _, err := top.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err == nil {
+		return nil
+	}
+	return errors.Errorf(errIncompleteChain, top.Subject.String(), top.Issuer.String())
+}
+
+// issuerOf returns the certificate among the given ones that signed c, if any.
+func issuerOf(c *x509.Certificate, certs []*x509.Certificate) *x509.Certificate {
+	for _, p := range certs {
+		if bytes.Equal(c.RawIssuer, p.RawSubject) && c.CheckSignatureFrom(p) == nil {
+			return p
+		}
+	}
+	return nil
+}
+
+// newServingCertReloader returns a reloader of the serving certificate in the
+// given cert file, along with its key in the given key file, into the given
+// store. The key is read whenever the certificate changed, and a certificate
+// that does not match its key, e.g. since only one of them was rotated yet,
+// is retried on the next reload.
+func newServingCertReloader(certFile, keyFile string, s *certificateStore, log logging.Logger) *fileReloader {
+	load := func(b []byte) error {
+		k, err := os.ReadFile(filepath.Clean(keyFile))
+		if err != nil {
+			return errors.Wrapf(err, errReadFile, keyFile)
+		}
+		c, err := tls.X509KeyPair(b, k)
+		if err != nil {
+			return errors.Wrap(err, errLoadKeyPair)
+		}
+		s.set(&c)
+		ObserveCertExpiry(CertRoleServing, b)
+		return nil
+	}
+	return &fileReloader{name: reloadNameServingCert, path: certFile, load: load, log: log}
+}
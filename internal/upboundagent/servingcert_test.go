@@ -0,0 +1,244 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	"github.com/crossplane/crossplane-runtime/pkg/test"
+)
+
+func writeTestKeyPair(t *testing.T, certFile, keyFile string, c *testCert) {
+	t.Helper()
+	if certFile != "" {
+		if err := os.WriteFile(certFile, c.pem, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keyFile != "" {
+		der, err := x509.MarshalECPrivateKey(c.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestServingCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	ca := newTestCA(t)
+	old := newTestCert(t, "upbound-agent", ca, false, x509.ExtKeyUsageServerAuth)
+	rotated := newTestCert(t, "upbound-agent", ca, false, x509.ExtKeyUsageServerAuth)
+	writeTestKeyPair(t, certFile, keyFile, old)
+
+	s := &certificateStore{}
+	r := newServingCertReloader(certFile, keyFile, s, logging.NewNopLogger())
+	serves := func(c *testCert) bool {
+		got, _ := s.getCertificate(nil)
+		return got != nil && bytes.Equal(got.Certificate[0], c.cert.Raw)
+	}
+	if _, err := r.reload(); err != nil {
+		t.Fatalf("reload(): %v", err)
+	}
+	if !serves(old) {
+		t.Fatal("reload(): want the initial certificate served")
+	}
+
+	// A certificate that does not match the key yet keeps the previous one
+	// in effect.
+	writeTestKeyPair(t, certFile, "", rotated)
+	if _, err := r.reload(); err == nil {
+		t.Error("reload(): want error for a certificate that does not match its key")
+	}
+	if !serves(old) {
+		t.Error("reload(): want the previous certificate served after a failed reload")
+	}
+
+	writeTestKeyPair(t, "", keyFile, rotated)
+	if changed, err := r.reload(); err != nil || !changed {
+		t.Fatalf("reload(): want rotated certificate loaded, got changed %t, error %v", changed, err)
+	}
+	if !serves(rotated) {
+		t.Error("reload(): want the rotated certificate served")
+	}
+}
+
+func TestVerifyServingCertChain(t *testing.T) {
+	root := newTestCA(t)
+	intermediate := newTestCert(t, "intermediate", root, true)
+	leaf := newTestCert(t, "upbound-agent", intermediate, false, x509.ExtKeyUsageServerAuth)
+	direct := newTestCert(t, "upbound-agent", root, false, x509.ExtKeyUsageServerAuth)
+	bundle := func(certs ...*testCert) []byte {
+		var b []byte
+		for _, c := range certs {
+			b = append(b, c.pem...)
+		}
+		return b
+	}
+
+	cases := map[string]struct {
+		reason string
+		bundle []byte
+		roots  *x509.CertPool
+		want   error
+	}{
+		"LeafOnly": {
+			reason: "A leaf without the intermediate that issued it should be incomplete.",
+			bundle: bundle(leaf),
+			roots:  certPool(root),
+			want:   errors.Errorf(errIncompleteChain, "CN=upbound-agent", "CN=intermediate"),
+		},
+		"Complete": {
+			reason: "A leaf along with its intermediate signed by a trusted root should be complete.",
+			bundle: bundle(leaf, intermediate),
+			roots:  certPool(root),
+		},
+		"WithRoot": {
+			reason: "A bundle up to a self-signed root should be complete, regardless of whether the root is trusted.",
+			bundle: bundle(leaf, intermediate, root),
+			roots:  x509.NewCertPool(),
+		},
+		"SignedByRoot": {
+			reason: "A leaf signed by a trusted root needs no intermediates.",
+			bundle: bundle(direct),
+			roots:  certPool(root),
+		},
+		"Empty": {
+			reason: "A bundle without certificates should be invalid.",
+			bundle: []byte("not a certificate"),
+			want:   errors.New(errNoServingCert),
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := VerifyServingCertChain(tc.bundle, tc.roots)
+			if diff := cmp.Diff(tc.want, err, test.EquateErrors()); diff != "" {
+				t.Errorf("\n%s\nVerifyServingCertChain(...): -want error, +got error:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestCertificateStoreServerName(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	def := newTestCert(t, "upbound-agent", ca, false, x509.ExtKeyUsageServerAuth)
+	a := newTestCert(t, "a.example.com", ca, false, x509.ExtKeyUsageServerAuth)
+	b := newTestCert(t, "b.example.com", ca, false, x509.ExtKeyUsageServerAuth)
+	writeTestKeyPair(t, filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key"), a)
+	writeTestKeyPair(t, filepath.Join(dir, "b.crt"), filepath.Join(dir, "b.key"), b)
+	writeTestKeyPair(t, "", filepath.Join(dir, "unrelated.key"), def)
+
+	named, err := loadServingCertDir(dir)
+	if err != nil {
+		t.Fatalf("loadServingCertDir(...): %v", err)
+	}
+	if len(named) != 2 {
+		t.Fatalf("loadServingCertDir(...): want 2 certificates, got %d", len(named))
+	}
+	s := &certificateStore{}
+	k, err := os.ReadFile(filepath.Join(dir, "unrelated.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kp, err := tls.X509KeyPair(def.pem, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.set(&kp)
+	s.setNamed(named)
+
+	cases := map[string]struct {
+		reason     string
+		serverName string
+		want       *testCert
+	}{
+		"NoServerName": {
+			reason: "Clients that do not send a server name should get the default certificate.",
+			want:   def,
+		},
+		"MatchingA": {
+			reason:     "Clients asking for a name of a certificate in the directory should get it.",
+			serverName: "a.example.com",
+			want:       a,
+		},
+		"MatchingB": {
+			reason:     "Clients asking for a name of another certificate in the directory should get that one.",
+			serverName: "b.example.com",
+			want:       b,
+		},
+		"Unknown": {
+			reason:     "Clients asking for an unknown name should get the default certificate.",
+			serverName: "c.example.com",
+			want:       def,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := s.getCertificate(&tls.ClientHelloInfo{ServerName: tc.serverName})
+			if err != nil {
+				t.Fatalf("getCertificate(...): %v", err)
+			}
+			if diff := cmp.Diff(tc.want.cert.Raw, got.Certificate[0]); diff != "" {
+				t.Errorf("\n%s\ngetCertificate(...): -want certificate, +got certificate:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestLoadServingCertDirErrors(t *testing.T) {
+	empty := t.TempDir()
+	missingKey := t.TempDir()
+	writeTestKeyPair(t, filepath.Join(missingKey, "a.crt"), "", newTestCA(t))
+
+	cases := map[string]struct {
+		reason string
+		dir    string
+		want   string
+	}{
+		"Empty": {
+			reason: "A directory without certificates should fail.",
+			dir:    empty,
+			want:   errors.Errorf(errNoCertsInDir, empty).Error(),
+		},
+		"MissingKey": {
+			reason: "A certificate without its key should fail naming both files.",
+			dir:    missingKey,
+			want:   errors.Errorf(errLoadDirKeyPair, filepath.Join(missingKey, "a.crt"), filepath.Join(missingKey, "a.key")).Error(),
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := loadServingCertDir(tc.dir)
+			if err == nil || !strings.HasPrefix(err.Error(), tc.want) {
+				t.Errorf("\n%s\nloadServingCertDir(...): want error starting with %q, got %v", tc.reason, tc.want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const stateFile = "state.json"
+
+const (
+	errReadState       = "cannot read persisted state"
+	errDecodeState     = "cannot decode persisted state"
+	errWriteState      = "cannot write persisted state"
+	errStateMismatch   = "persisted state is for control plane %s at %s"
+	errStateWritable   = "persisted state file %s is writable by group or others"
+	errStateNoCertsYet = "persisted state has no gateway certs"
+)
+
+// State is the last known good configuration of the agent, which is persisted
+// in its state directory along with the gateway certs that were fetched with
+// it. It never holds secrets, like the control plane token or NATS JWTs.
+type State struct {
+	ControlPlaneID     string
+	UpboundAPIEndpoint string
+	SavedAt            time.Time
+}
+
+// WriteState persists the given state and gateway certs in the given
+// directory, so that the agent can start serving from them right away on
+// restart. The gateway certs are persisted as in the gateway certs cache.
+func WriteState(dir string, s State, c CachedCerts) error {
+	if err := writeJSONFile(dir, certCacheFile, c); err != nil {
+		return errors.Wrap(err, errWriteState)
+	}
+	return errors.Wrap(writeJSONFile(dir, stateFile, s), errWriteState)
+}
+
+// RestoreState returns the gateway certs persisted in the given directory if
+// the persisted state is for the given control plane and Upbound API endpoint.
+// Since tokens are validated with the persisted public keys, state files that
+// could have been tampered with by other users are refused.
+func RestoreState(dir, cpID, endpoint string) (CachedCerts, error) {
+	dir = filepath.Clean(dir)
+	for _, name := range []string{stateFile, certCacheFile} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			return CachedCerts{}, errors.Wrap(err, errReadState)
+		}
+		if fi.Mode().Perm()&0022 != 0 {
+			return CachedCerts{}, errors.Errorf(errStateWritable, name)
+		}
+	}
+	b, err := os.ReadFile(filepath.Join(dir, stateFile))
+	if err != nil {
+		return CachedCerts{}, errors.Wrap(err, errReadState)
+	}
+	s := State{}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return CachedCerts{}, errors.Wrap(err, errDecodeState)
+	}
+	if s.ControlPlaneID != cpID || s.UpboundAPIEndpoint != endpoint {
+		return CachedCerts{}, errors.Errorf(errStateMismatch, s.ControlPlaneID, s.UpboundAPIEndpoint)
+	}
+	c, err := ReadCertCache(dir)
+	if err != nil {
+		return CachedCerts{}, err
+	}
+	if c.JWTPublicKey == "" {
+		return CachedCerts{}, errors.New(errStateNoCertsYet)
+	}
+	return c, nil
+}
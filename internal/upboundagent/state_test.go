@@ -0,0 +1,130 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	"github.com/upbound/universal-crossplane/internal/clients/upbound"
+)
+
+func TestState(t *testing.T) {
+	cpID, endpoint := "c21561da-087b-4efc-af6b-718e99bfd85f", "https://api.upbound.io"
+	now := time.Unix(100, 0).UTC()
+	certs := CachedCerts{PublicCerts: upbound.PublicCerts{JWTPublicKey: "key", NATSCA: "ca"}, FetchedAt: now}
+
+	cases := map[string]struct {
+		reason   string
+		state    State
+		cpID     string
+		endpoint string
+		mode     os.FileMode
+		want     CachedCerts
+		wantErr  bool
+	}{
+		"Restored": {
+			reason:   "State persisted for the same control plane and endpoint should be restored.",
+			state:    State{ControlPlaneID: cpID, UpboundAPIEndpoint: endpoint, SavedAt: now},
+			cpID:     cpID,
+			endpoint: endpoint,
+			want:     certs,
+		},
+		"OtherControlPlane": {
+			reason:   "State persisted for another control plane should not be restored.",
+			state:    State{ControlPlaneID: "b0075060-a0d0-4948-80a3-ffdb0c28ef71", UpboundAPIEndpoint: endpoint, SavedAt: now},
+			cpID:     cpID,
+			endpoint: endpoint,
+			wantErr:  true,
+		},
+		"OtherEndpoint": {
+			reason:   "State persisted for another Upbound API endpoint should not be restored.",
+			state:    State{ControlPlaneID: cpID, UpboundAPIEndpoint: "https://api.upbound.dev", SavedAt: now},
+			cpID:     cpID,
+			endpoint: endpoint,
+			wantErr:  true,
+		},
+		"Tamperable": {
+			reason:   "State that other users could have tampered with should not be restored.",
+			state:    State{ControlPlaneID: cpID, UpboundAPIEndpoint: endpoint, SavedAt: now},
+			cpID:     cpID,
+			endpoint: endpoint,
+			mode:     0666,
+			wantErr:  true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if _, err := RestoreState(dir, tc.cpID, tc.endpoint); err == nil {
+				t.Errorf("\n%s\nRestoreState(...): want error if nothing was persisted", tc.reason)
+			}
+			if err := WriteState(dir, tc.state, certs); err != nil {
+				t.Fatalf("WriteState(...): %v", err)
+			}
+			if tc.mode != 0 {
+				if err := os.Chmod(filepath.Join(dir, certCacheFile), tc.mode); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := RestoreState(dir, tc.cpID, tc.endpoint)
+			if diff := cmp.Diff(tc.wantErr, err != nil); diff != "" {
+				t.Fatalf("\n%s\nRestoreState(...): -want error, +got error:\n%s\n%v", tc.reason, diff, err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("\n%s\nRestoreState(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestCertRefresher_runOnStart(t *testing.T) {
+	fetched := make(chan struct{}, 1)
+	r := &certRefresher{
+		log: logging.NewNopLogger(),
+		fetch: func() (upbound.PublicCerts, error) {
+			fetched <- struct{}{}
+			return upbound.PublicCerts{}, nil
+		},
+		apply:    func(upbound.PublicCerts) error { return nil },
+		failures: prometheus.NewGauge(prometheus.GaugeOpts{Name: "failures"}),
+		cached:   prometheus.NewGauge(prometheus.GaugeOpts{Name: "cached"}),
+		onStart:  true,
+	}
+
+	// Restored certs are re-validated right away, and only once without an
+	// interval.
+	done := make(chan struct{})
+	go func() {
+		r.run(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run(...): want return after a successful refresh without an interval")
+	}
+	if diff := cmp.Diff(1, len(fetched)); diff != "" {
+		t.Errorf("run(...): -want refreshes, +got refreshes:\n%s", diff)
+	}
+}
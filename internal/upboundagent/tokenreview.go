@@ -0,0 +1,91 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons that tokens of proxied requests are rejected for.
+const (
+	rejectReasonMissingToken      = "missing-token"
+	rejectReasonMalformed         = "malformed"
+	rejectReasonUnsigned          = "unsigned"
+	rejectReasonSigningMethod     = "signing-method"
+	rejectReasonSignatureInvalid  = "signature-invalid"
+	rejectReasonExpired           = "expired"
+	rejectReasonNotValidYet       = "not-valid-yet"
+	rejectReasonWrongControlPlane = "wrong-control-plane"
+	rejectReasonInvalidClaims     = "invalid-claims"
+	rejectReasonOther             = "other"
+)
+
+var (
+	tokenValidationsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "token_validations_total",
+		Help:      "Number of tokens of proxied requests that were validated.",
+	})
+	tokenRejectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "token_rejections_total",
+		Help:      "Number of tokens of proxied requests that were rejected, by reason.",
+	}, []string{"reason"})
+)
+
+// observeTokenValidation counts the validation of a token, and its rejection
+// if the given reason is not empty.
+func observeTokenValidation(reason string) {
+	tokenValidationsTotal.Inc()
+	if reason != "" {
+		tokenRejectionsTotal.WithLabelValues(reason).Inc()
+	}
+}
+
+// rejectionReason returns the reason that a token was rejected for with the
+// given error of reviewToken.
+func rejectionReason(err error) string {
+	switch errors.Cause(err).Error() {
+	case errMissingAuthHeader, errMissingBearer:
+		return rejectReasonMissingToken
+	}
+	var ve *jwt.ValidationError
+	if !errors.As(err, &ve) {
+		return rejectReasonOther
+	}
+	switch {
+	case ve.Errors&jwt.ValidationErrorMalformed != 0:
+		return rejectReasonMalformed
+	case ve.Errors&jwt.ValidationErrorUnverifiable != 0:
+		// The error of the key func, if any, tells why the token could
+		// not be verified.
+		switch {
+		case ve.Inner == nil, ve.Inner.Error() == errNoTokenPublicKey:
+			return rejectReasonOther
+		case ve.Inner.Error() == errUnsignedToken:
+			return rejectReasonUnsigned
+		}
+		return rejectReasonSigningMethod
+	case ve.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+		return rejectReasonSignatureInvalid
+	case ve.Errors&jwt.ValidationErrorExpired != 0:
+		return rejectReasonExpired
+	case ve.Errors&(jwt.ValidationErrorNotValidYet|jwt.ValidationErrorIssuedAt) != 0:
+		return rejectReasonNotValidYet
+	}
+	return rejectReasonOther
+}
@@ -0,0 +1,116 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/go-cmp/cmp"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_rejectionReason(t *testing.T) {
+	cases := map[string]struct {
+		err  error
+		want string
+	}{
+		"MissingHeader": {
+			err:  errors.New(errMissingAuthHeader),
+			want: rejectReasonMissingToken,
+		},
+		"Malformed": {
+			err:  errors.Wrap(jwt.NewValidationError("token contains an invalid number of segments", jwt.ValidationErrorMalformed), errInvalidToken),
+			want: rejectReasonMalformed,
+		},
+		"Unsigned": {
+			err:  errors.Wrap(&jwt.ValidationError{Inner: errors.New(errUnsignedToken), Errors: jwt.ValidationErrorUnverifiable}, errInvalidToken),
+			want: rejectReasonUnsigned,
+		},
+		"SigningMethod": {
+			err:  errors.Wrap(&jwt.ValidationError{Inner: errors.Errorf(errUnexpectedSigningMethod, "HS256"), Errors: jwt.ValidationErrorUnverifiable}, errInvalidToken),
+			want: rejectReasonSigningMethod,
+		},
+		"SignatureInvalid": {
+			err:  errors.Wrap(jwt.NewValidationError("crypto/rsa: verification error", jwt.ValidationErrorSignatureInvalid), errInvalidToken),
+			want: rejectReasonSignatureInvalid,
+		},
+		"Expired": {
+			err:  errors.Wrap(jwt.NewValidationError("token is expired", jwt.ValidationErrorExpired), errInvalidToken),
+			want: rejectReasonExpired,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, rejectionReason(tc.err)); diff != "" {
+				t.Errorf("rejectionReason(...): -want, +got:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProxy_getImpersonationConfigCountsValidations(t *testing.T) {
+	claims := strings.Split(validJWTToken, ".")[1]
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." + claims + "."
+	p := newTestProxy(t, "https://10.96.0.1")
+
+	total := testutil.ToFloat64(tokenValidationsTotal)
+	rejected := testutil.ToFloat64(tokenRejectionsTotal.WithLabelValues(rejectReasonUnsigned))
+	for _, tok := range []string{validJWTToken, unsigned} {
+		req := httptest.NewRequest(http.MethodGet, "/k8s/api", nil)
+		req.Header.Set(headerAuthorization, "Bearer "+tok)
+		_, _, _ = p.getImpersonationConfig(echo.New().NewContext(req, httptest.NewRecorder()))
+	}
+	if diff := cmp.Diff(total+2, testutil.ToFloat64(tokenValidationsTotal)); diff != "" {
+		t.Errorf("tokenValidationsTotal: -want, +got:\n%s", diff)
+	}
+	if diff := cmp.Diff(rejected+1, testutil.ToFloat64(tokenRejectionsTotal.WithLabelValues(rejectReasonUnsigned))); diff != "" {
+		t.Errorf("tokenRejectionsTotal: -want, +got:\n%s", diff)
+	}
+}
+
+func TestProxy_k8sReviewsTokenOnceWithClientRateLimit(t *testing.T) {
+	claims := strings.Split(validJWTToken, ".")[1]
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." + claims + "."
+	kube := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	defer kube.Close()
+
+	p := newTestProxy(t, kube.URL)
+	l := newClientRateLimiter(100, 100, p.clientIdentity, throttledRequestsTotal)
+	e := echo.New()
+	e.Any(k8sHandlerPath, p.k8s(), l.middleware())
+
+	total := testutil.ToFloat64(tokenValidationsTotal)
+	unsignedRejected := testutil.ToFloat64(unsignedTokensRejectedTotal)
+	for _, tok := range []string{validJWTToken, unsigned} {
+		req := httptest.NewRequest(http.MethodGet, "/k8s/api/v1/pods", nil)
+		req.Header.Set(headerAuthorization, "Bearer "+tok)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	// The client rate limiter identifies clients by their token, which the
+	// handler must not review again.
+	if diff := cmp.Diff(total+2, testutil.ToFloat64(tokenValidationsTotal)); diff != "" {
+		t.Errorf("tokenValidationsTotal: -want, +got:\n%s", diff)
+	}
+	if diff := cmp.Diff(unsignedRejected+1, testutil.ToFloat64(unsignedTokensRejectedTotal)); diff != "" {
+		t.Errorf("unsignedTokensRejectedTotal: -want, +got:\n%s", diff)
+	}
+}
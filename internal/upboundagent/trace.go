@@ -0,0 +1,155 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+)
+
+// Phases of downstream requests.
+const (
+	phaseDNS     = "dns"
+	phaseConnect = "connect"
+	phaseTLS     = "tls"
+	phaseTTFB    = "ttfb"
+)
+
+// Downstreams of proxied requests.
+const (
+	downstreamKube = "kube"
+	downstreamXGQL = "xgql"
+)
+
+var downstreamPhaseSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: metricsNamespace,
+	Name:      "downstream_phase_seconds",
+	Help:      "Time spent in each phase of proxied requests to the downstream, when tracing is enabled. Time to first byte is measured from the request being written.",
+	Buckets:   []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+}, []string{"downstream", "phase"})
+
+// tracingTransport measures the phases of requests, i.e. resolving the
+// downstream, connecting to it, the TLS handshake and the time to the first
+// byte of the response, so that network, TLS and server side latency can be
+// told apart. Phases of establishing a connection are only measured for
+// requests that do not reuse one.
+type tracingTransport struct {
+	next       http.RoundTripper
+	downstream string
+	phases     *prometheus.HistogramVec
+	log        logging.Logger
+}
+
+// RoundTrip traces the request and observes its phases once it is done.
+func (t *tracingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	pt := &phaseTrace{now: time.Now, starts: map[string]time.Time{}, durations: map[string]time.Duration{}}
+	res, err := t.next.RoundTrip(r.WithContext(httptrace.WithClientTrace(r.Context(), pt.clientTrace())))
+
+	d := pt.done()
+	kv := make([]interface{}, 0, 2*len(d)+2)
+	kv = append(kv, "downstream", t.downstream)
+	for _, p := range []string{phaseDNS, phaseConnect, phaseTLS, phaseTTFB} {
+		if v, ok := d[p]; ok {
+			t.phases.WithLabelValues(t.downstream, p).Observe(v.Seconds())
+			kv = append(kv, p, v.String())
+		}
+	}
+	t.log.Debug("traced downstream request", kv...)
+	return res, err
+}
+
+// traceRequests returns a middleware that records an OpenTelemetry span of
+// each request, whether it was received over NATS or directly, continuing the
+// trace of its caller. Requests to the API server and xgql are its children.
+func (p *Proxy) traceRequests() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			s, r := p.config.Tracer.StartServer(c.Request(), c.Request().Method+" "+c.Path())
+			defer s.End()
+			c.SetRequest(r)
+			err := next(c)
+			status := c.Response().Status
+			if err != nil {
+				status = http.StatusInternalServerError
+				if he, ok := err.(*echo.HTTPError); ok {
+					status = he.Code
+				}
+			}
+			s.SetStatusCode(status)
+			return err
+		}
+	}
+}
+
+// phaseTrace records the duration of request phases.
+type phaseTrace struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	starts    map[string]time.Time
+	durations map[string]time.Duration
+}
+
+func (p *phaseTrace) begin(phase string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Connecting may be attempted to multiple addresses at the same time.
+	if _, ok := p.starts[phase]; !ok {
+		p.starts[phase] = p.now()
+	}
+}
+
+func (p *phaseTrace) end(phase string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.starts[phase]
+	if _, done := p.durations[phase]; !ok || done {
+		return
+	}
+	p.durations[phase] = p.now().Sub(s)
+}
+
+// done returns the durations of the phases that completed. Hooks may still
+// fire afterwards, e.g. for connections established in the background.
+func (p *phaseTrace) done() map[string]time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	d := make(map[string]time.Duration, len(p.durations))
+	for k, v := range p.durations {
+		d[k] = v
+	}
+	return d
+}
+
+func (p *phaseTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { p.begin(phaseDNS) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { p.end(phaseDNS) },
+		ConnectStart:         func(_, _ string) { p.begin(phaseConnect) },
+		ConnectDone:          func(_, _ string, _ error) { p.end(phaseConnect) },
+		TLSHandshakeStart:    func() { p.begin(phaseTLS) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { p.end(phaseTLS) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { p.begin(phaseTTFB) },
+		GotFirstResponseByte: func() { p.end(phaseTTFB) },
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	"github.com/upbound/universal-crossplane/internal/tracing"
+)
+
+func TestTracingTransport_RoundTrip(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	// Use a host name rather than the IP address of the server so that it is
+	// resolved.
+	u, _ := url.Parse(srv.URL)
+	_, port, _ := net.SplitHostPort(u.Host)
+	u.Host = net.JoinHostPort("localhost", port)
+
+	phases := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "phases"}, []string{"downstream", "phase"})
+	rt := &tracingTransport{
+		next: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "example.com", MinVersion: tls.VersionTLS12},
+		},
+		downstream: downstreamKube,
+		phases:     phases,
+		log:        logging.NewNopLogger(),
+	}
+	c := &http.Client{Transport: rt}
+
+	samples := func() map[string]int {
+		got := map[string]int{}
+		for _, p := range []string{phaseDNS, phaseConnect, phaseTLS, phaseTTFB} {
+			if n := sampleCount(t, phases.WithLabelValues(downstreamKube, p).(prometheus.Histogram)); n > 0 {
+				got[p] = n
+			}
+		}
+		return got
+	}
+	get := func() {
+		res, err := c.Get(u.String())
+		if err != nil {
+			t.Fatalf("Get(...): %v", err)
+		}
+		_ = res.Body.Close()
+	}
+
+	get()
+	want := map[string]int{phaseDNS: 1, phaseConnect: 1, phaseTLS: 1, phaseTTFB: 1}
+	if diff := cmp.Diff(want, samples()); diff != "" {
+		t.Errorf("RoundTrip(...): -want observed phases, +got observed phases:\n%s", diff)
+	}
+
+	// A reused connection only has a time to first byte.
+	get()
+	want = map[string]int{phaseDNS: 1, phaseConnect: 1, phaseTLS: 1, phaseTTFB: 2}
+	if diff := cmp.Diff(want, samples()); diff != "" {
+		t.Errorf("RoundTrip(...) reusing connection: -want observed phases, +got observed phases:\n%s", diff)
+	}
+}
+
+func TestProxy_traceRequests(t *testing.T) {
+	var propagated string
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		propagated = r.Header.Get(tracing.HeaderTraceparent)
+	}))
+	defer downstream.Close()
+	tr, err := tracing.New("http://otel-collector:4318", "cp", logging.NewNopLogger())
+	if err != nil {
+		t.Fatalf("tracing.New(...): %v", err)
+	}
+	p := &Proxy{config: &Config{Tracer: tr}}
+	c := &http.Client{Transport: tr.Transport(nil)}
+
+	e := echo.New()
+	e.GET("/k8s/*", func(ec echo.Context) error {
+		req, _ := http.NewRequestWithContext(ec.Request().Context(), http.MethodGet, downstream.URL, nil)
+		res, err := c.Do(req)
+		if err != nil {
+			return err
+		}
+		_ = res.Body.Close()
+		return ec.NoContent(http.StatusOK)
+	}, p.traceRequests())
+	req := httptest.NewRequest(http.MethodGet, "/k8s/api", nil)
+	req.Header.Set(tracing.HeaderTraceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Requests made on behalf of the proxied request continue its trace.
+	if diff := cmp.Diff("00-4bf92f3577b34da6a3ce929d0e0e4736", strings.Join(strings.Split(propagated, "-")[:2], "-")); diff != "" {
+		t.Errorf("traceRequests(): -want propagated trace, +got:\n%s", diff)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	headerConnection = "Connection"
+	headerUpgrade    = "Upgrade"
+)
+
+// upgradeHeaders are the headers that protocol upgrades of the API server
+// depend on, i.e. SPDY for kubectl exec, attach and port-forward and WebSocket
+// for clients that use it instead. They are only forwarded with upgrades.
+var upgradeHeaders = []string{
+	headerConnection,
+	headerUpgrade,
+	"X-Stream-Protocol-Version",
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Protocol",
+	"Sec-Websocket-Extensions",
+}
+
+// isUpgradeRequest returns true if the given request asks to switch protocols,
+// i.e. lists upgrade in its Connection header and names the protocol in its
+// Upgrade header.
+func isUpgradeRequest(r *http.Request) bool {
+	if r.Header.Get(headerUpgrade) == "" {
+		return false
+	}
+	for _, v := range r.Header.Values(headerConnection) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isLongRunningRequest returns true if the given request may be served for an
+// unbounded time, i.e. it is a watch or an upgraded connection that streams
+// e.g. an exec session.
+func isLongRunningRequest(r *http.Request) bool {
+	return isWatchRequest(r) || isUpgradeRequest(r)
+}
+
+// copyUpgradeHeaders copies the headers of the given upgrade request that the
+// API server needs to switch protocols, with all of their values since e.g.
+// each supported SPDY stream protocol version is a value of its own.
+func copyUpgradeHeaders(out, in http.Header) {
+	for _, h := range upgradeHeaders {
+		for _, v := range in.Values(h) {
+			out.Add(h, v)
+		}
+	}
+}
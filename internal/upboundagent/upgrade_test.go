@@ -0,0 +1,151 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/labstack/echo/v4"
+)
+
+func TestIsUpgradeRequest(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		header http.Header
+		want   bool
+	}{
+		"SPDY": {
+			reason: "A request to upgrade to SPDY, as sent by kubectl exec, is an upgrade.",
+			header: http.Header{headerConnection: {"Upgrade"}, headerUpgrade: {"SPDY/3.1"}},
+			want:   true,
+		},
+		"ConnectionList": {
+			reason: "Upgrade may be one of several tokens of the Connection header.",
+			header: http.Header{headerConnection: {"keep-alive, upgrade"}, headerUpgrade: {"websocket"}},
+			want:   true,
+		},
+		"NoProtocol": {
+			reason: "A request that does not name a protocol to upgrade to is not an upgrade.",
+			header: http.Header{headerConnection: {"Upgrade"}},
+		},
+		"NoConnection": {
+			reason: "A request whose Connection header does not list upgrade is not an upgrade.",
+			header: http.Header{headerConnection: {"keep-alive"}, headerUpgrade: {"websocket"}},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := isUpgradeRequest(&http.Request{Header: tc.header})
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("\n%s\nisUpgradeRequest(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestProxy_k8sUpgrade(t *testing.T) {
+	cases := map[string]struct {
+		reason   string
+		protocol string
+		header   string
+	}{
+		"SPDY": {
+			reason:   "An exec session upgraded to SPDY should stream in both directions.",
+			protocol: "SPDY/3.1",
+			header:   "X-Stream-Protocol-Version: v4.channel.k8s.io\r\nX-Stream-Protocol-Version: channel.k8s.io\r\n",
+		},
+		"WebSocket": {
+			reason:   "An exec session upgraded to WebSocket should stream in both directions.",
+			protocol: "websocket",
+			header:   "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Protocol: v4.channel.k8s.io\r\n",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			// The downstream switches protocols, greets the client and then
+			// echoes what the client sends, like an exec session.
+			kube := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !isUpgradeRequest(r) || r.Header.Get(headerUpgrade) != tc.protocol {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				conn, brw, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					return
+				}
+				defer conn.Close() // nolint:errcheck
+				_, _ = fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\nX-Got: %s\r\n\r\nhello\n", tc.protocol, strings.Join(r.Header.Values("X-Stream-Protocol-Version"), ",")+r.Header.Get("Sec-Websocket-Key"))
+				_ = brw.Flush()
+				line, err := brw.ReadString('\n')
+				if err != nil {
+					return
+				}
+				_, _ = fmt.Fprintf(brw, "echo: %s", line)
+				_ = brw.Flush()
+			}))
+			defer kube.Close()
+
+			p := newTestProxy(t, kube.URL)
+			e := echo.New()
+			e.Use(compress(compressionSavedBytesTotal))
+			e.Any(k8sHandlerPath, p.k8s())
+			srv := httptest.NewServer(e)
+			defer srv.Close()
+
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatalf("cannot connect to proxy: %v", err)
+			}
+			defer conn.Close() // nolint:errcheck
+			_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+			_, _ = fmt.Fprintf(conn, "POST /k8s/api/v1/namespaces/default/pods/p/exec?command=sh HTTP/1.1\r\nHost: agent\r\nAuthorization: Bearer %s\r\nAccept-Encoding: gzip\r\nConnection: Upgrade\r\nUpgrade: %s\r\n%s\r\n", validJWTToken, tc.protocol, tc.header)
+
+			br := bufio.NewReader(conn)
+			res, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatalf("cannot read response: %v", err)
+			}
+			if diff := cmp.Diff(http.StatusSwitchingProtocols, res.StatusCode); diff != "" {
+				t.Fatalf("\n%s\nk8s(...): -want status code, +got status code:\n%s", tc.reason, diff)
+			}
+			if res.Header.Get("X-Got") == "" {
+				t.Errorf("\n%s\nk8s(...): upgrade headers were not forwarded to the downstream", tc.reason)
+			}
+			got, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatalf("cannot read from downstream: %v", err)
+			}
+			if diff := cmp.Diff("hello\n", got); diff != "" {
+				t.Errorf("\n%s\nk8s(...): -want from downstream, +got from downstream:\n%s", tc.reason, diff)
+			}
+			_, _ = fmt.Fprint(conn, "ping\n")
+			got, err = br.ReadString('\n')
+			if err != nil {
+				t.Fatalf("cannot read echo from downstream: %v", err)
+			}
+			if diff := cmp.Diff("echo: ping\n", got); diff != "" {
+				t.Errorf("\n%s\nk8s(...): -want echo from downstream, +got echo from downstream:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
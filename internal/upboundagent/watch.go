@@ -0,0 +1,112 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// isWatchRequest returns true if the given request is a Kubernetes watch,
+// either with the watch query parameter or with the legacy watch path.
+func isWatchRequest(r *http.Request) bool {
+	switch strings.ToLower(r.URL.Query().Get("watch")) {
+	case "true", "1":
+		return true
+	}
+	return strings.Contains(r.URL.Path, "/watch/")
+}
+
+// watchTracker keeps track of the response bodies of in-flight watches so
+// that they can be ended cleanly on shutdown. Its zero value is ready to use.
+type watchTracker struct {
+	mu      sync.Mutex
+	next    uint64
+	watches map[uint64]*watchBody
+}
+
+// track wraps the given response body of a watch so that it can be ended by
+// closeAll.
+func (w *watchTracker) track(body io.ReadCloser) io.ReadCloser {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.watches == nil {
+		w.watches = map[uint64]*watchBody{}
+	}
+	b := &watchBody{ReadCloser: body, tracker: w, id: w.next}
+	w.watches[w.next] = b
+	w.next++
+	return b
+}
+
+func (w *watchTracker) untrack(id uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.watches, id)
+}
+
+// count returns the number of in-flight watches.
+func (w *watchTracker) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.watches)
+}
+
+// closeAll ends all in-flight watches and returns how many were ended.
+func (w *watchTracker) closeAll() int {
+	w.mu.Lock()
+	bodies := make([]*watchBody, 0, len(w.watches))
+	for _, b := range w.watches {
+		bodies = append(bodies, b)
+	}
+	w.mu.Unlock()
+	for _, b := range bodies {
+		b.end()
+	}
+	return len(bodies)
+}
+
+// watchBody is the response body of a watch from the downstream. Once ended,
+// reads return io.EOF so that the proxy completes the response with a clean
+// end of stream, signaling the client to re-establish its watch, instead of
+// aborting the connection.
+type watchBody struct {
+	io.ReadCloser
+	tracker *watchTracker
+	id      uint64
+	ended   int32
+}
+
+func (b *watchBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && atomic.LoadInt32(&b.ended) == 1 {
+		return n, io.EOF
+	}
+	return n, err
+}
+
+func (b *watchBody) Close() error {
+	b.tracker.untrack(b.id)
+	return b.ReadCloser.Close()
+}
+
+func (b *watchBody) end() {
+	atomic.StoreInt32(&b.ended, 1)
+	// Closing the body unblocks any pending read.
+	_ = b.ReadCloser.Close()
+}
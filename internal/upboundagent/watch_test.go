@@ -0,0 +1,135 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upboundagent
+
+import (
+	"bufio"
+	"crypto"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/go-cmp/cmp"
+	"github.com/labstack/echo/v4"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+)
+
+func Test_isWatchRequest(t *testing.T) {
+	cases := map[string]struct {
+		url  string
+		want bool
+	}{
+		"WatchParam":      {url: "/api/v1/pods?watch=true", want: true},
+		"WatchParamOne":   {url: "/api/v1/pods?watch=1", want: true},
+		"WatchParamFalse": {url: "/api/v1/pods?watch=false", want: false},
+		"LegacyWatchPath": {url: "/api/v1/watch/pods", want: true},
+		"List":            {url: "/api/v1/pods", want: false},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			if diff := cmp.Diff(tc.want, isWatchRequest(r)); diff != "" {
+				t.Errorf("isWatchRequest(...): -want, +got: %s", diff)
+			}
+		})
+	}
+}
+
+// newTestProxy returns a Proxy that validates tokens with validPublicKey and
+// proxies Kubernetes requests to the given URL.
+func newTestProxy(t *testing.T, kube string) *Proxy {
+	t.Helper()
+	k, err := jwt.ParseRSAPublicKeyFromPEM([]byte(validPublicKey))
+	if err != nil {
+		t.Fatalf("invalid public key: %v", err)
+	}
+	u, err := url.Parse(kube)
+	if err != nil {
+		t.Fatalf("invalid kube url: %v", err)
+	}
+	return &Proxy{
+		log:           logging.NewNopLogger(),
+		config:        &Config{ControlPlaneID: "c21561da-087b-4efc-af6b-718e99bfd85f", TokenPublicKeys: []crypto.PublicKey{k}},
+		kubeHost:      u,
+		kubeTransport: http.DefaultTransport,
+	}
+}
+
+func TestProxy_closeWatchesOnShutdown(t *testing.T) {
+	// The downstream streams a single event and then keeps the watch open
+	// until the client goes away.
+	kube := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintln(w, `{"type":"ADDED"}`)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer kube.Close()
+
+	p := newTestProxy(t, kube.URL)
+	e := echo.New()
+	e.Any(k8sHandlerPath, p.k8s())
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/k8s/api/v1/pods?watch=true", nil)
+	req.Header.Set(headerAuthorization, "Bearer "+validJWTToken)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("watch request failed: %v", err)
+	}
+	defer res.Body.Close() // nolint:errcheck
+
+	r := bufio.NewReader(res.Body)
+	ev, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("cannot read watch event: %v", err)
+	}
+	if diff := cmp.Diff("{\"type\":\"ADDED\"}\n", ev); diff != "" {
+		t.Errorf("watch event: -want, +got: %s", diff)
+	}
+	if diff := cmp.Diff(1, p.watches.count()); diff != "" {
+		t.Errorf("watches.count(): -want, +got: %s", diff)
+	}
+
+	// Shutdown ends the in-flight watch.
+	if diff := cmp.Diff(1, p.watches.closeAll()); diff != "" {
+		t.Errorf("watches.closeAll(): -want, +got: %s", diff)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(r)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		// A clean end of stream rather than an aborted connection.
+		if err != nil {
+			t.Errorf("expected clean end of watch stream, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch was not ended")
+	}
+	if diff := cmp.Diff(0, p.watches.count()); diff != "" {
+		t.Errorf("watches.count() after shutdown: -want, +got: %s", diff)
+	}
+}
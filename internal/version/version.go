@@ -16,3 +16,10 @@ package version
 
 // Version will be overridden with the current version at build time using the -X linker flag
 var Version = "0.0.0"
+
+// GitCommit and BuildDate will be overridden with the commit the binary was
+// built from and the time it was built at build time using the -X linker flag
+var (
+	GitCommit = "unknown"
+	BuildDate = "unknown"
+)